@@ -0,0 +1,176 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// implements accountDeletionServiceItf and accountDeleterItf
+type accountDeletionService struct {
+	userService                    userServiceItf
+	sessionStore                   sessionStoreItf
+	databaseServiceAccountDeletion databaseServiceAccountDeletionItf
+	gracePeriod                    time.Duration
+
+	stopWorkerChan chan bool
+	pollTicker     *time.Ticker
+}
+
+func newAccountDeletionService(userService userServiceItf, sessionStore sessionStoreItf,
+	databaseServiceAccountDeletion databaseServiceAccountDeletionItf, gracePeriod time.Duration, pollPeriod time.Duration) (*accountDeletionService, error) {
+	if databaseServiceAccountDeletion == nil {
+		return nil, errors.New("account deletion service needs database")
+	}
+	if gracePeriod < 0 {
+		return nil, errors.New("bad gracePeriod value")
+	}
+	if pollPeriod < 1 {
+		return nil, errors.New("bad pollPeriod value")
+	}
+
+	service := &accountDeletionService{userService: userService, sessionStore: sessionStore,
+		databaseServiceAccountDeletion: databaseServiceAccountDeletion, gracePeriod: gracePeriod}
+	service.stopWorkerChan = make(chan bool)
+	service.pollTicker = time.NewTicker(pollPeriod)
+
+	go service.deletionLoopWorker()
+
+	return service, nil
+}
+
+func (service *accountDeletionService) deletionLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.pollTicker.C:
+			service.executeDueDeletions()
+		}
+	}
+}
+
+func (service *accountDeletionService) stop() {
+	service.pollTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop accountDeletionService instance")
+	}
+}
+
+func (service *accountDeletionService) executeDueDeletions() {
+	for {
+		job, err := service.databaseServiceAccountDeletion.executeDueAccountDeletion(time.Now())
+		if err != nil {
+			slog.Error("Executing account deletion:", slog.Any("error", err))
+			return
+		}
+		if job == nil {
+			return
+		}
+		slog.Info("Account deleted", slog.Int64("idUser", job.idUser), slog.String("mode", job.mode))
+		service.forgetSessions(job.idUser)
+	}
+}
+
+// sessions rows are already gone with the user, this clears caches on all instances
+func (service *accountDeletionService) forgetSessions(idUser int64) {
+	if service.sessionStore == nil {
+		return
+	}
+	err := service.sessionStore.forgetSessionsForUser(idUser)
+	if err != nil {
+		slog.Error("Forgetting sessions of deleted account", slog.Int64("idUser", idUser), slog.Any("error", err))
+	}
+}
+
+func accountDeletionJobToInfo(job *accountDeletionJob) *accountDeletionInfo {
+	return &accountDeletionInfo{Mode: job.mode, DtRequested: job.dtRequested, DtExecute: job.dtExecute,
+		RequestedByAdmin: job.idRequestedBy != nil}
+}
+
+func (service *accountDeletionService) requestAccountDeletion(sessionCookie *http.Cookie, mode string) (*accountDeletionInfo, error) {
+	err := validateAccountDeletionMode(mode)
+	if err != nil {
+		return nil, err
+	}
+	sessionToken, err := validateSessionCookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := service.scheduleAccountDeletion(user.Id, mode, nil, service.gracePeriod)
+	if err != nil || info == nil {
+		return info, err
+	}
+
+	if service.sessionStore != nil {
+		err = service.sessionStore.forgetSessionsForUserExcept(user.Id, sessionToken)
+		if err != nil {
+			slog.Error("Revoking sessions of account scheduled for deletion", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		}
+	}
+	return info, nil
+}
+
+func (service *accountDeletionService) cancelAccountDeletion(sessionCookie *http.Cookie) error {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+	return service.cancelAccountDeletionOfUser(user.Id)
+}
+
+func (service *accountDeletionService) getAccountDeletion(sessionCookie *http.Cookie) (*accountDeletionInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	job, err := service.databaseServiceAccountDeletion.getAccountDeletion(user.Id)
+	if err != nil || job == nil {
+		return nil, err
+	}
+	return accountDeletionJobToInfo(job), nil
+}
+
+func (service *accountDeletionService) scheduleAccountDeletion(idUser int64, mode string, idRequestedBy *int64, gracePeriod time.Duration) (*accountDeletionInfo, error) {
+	err := validateAccountDeletionMode(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	if gracePeriod <= 0 {
+		err = service.databaseServiceAccountDeletion.executeAccountDeletion(idUser, mode)
+		if err != nil {
+			return nil, err
+		}
+		service.forgetSessions(idUser)
+		return nil, nil
+	}
+
+	now := time.Now()
+	dtExecute := now.Add(gracePeriod)
+	err = service.databaseServiceAccountDeletion.scheduleAccountDeletion(idUser, mode, idRequestedBy, now, dtExecute)
+	if err != nil {
+		return nil, err
+	}
+	return &accountDeletionInfo{Mode: mode, DtRequested: now, DtExecute: dtExecute, RequestedByAdmin: idRequestedBy != nil}, nil
+}
+
+func (service *accountDeletionService) cancelAccountDeletionOfUser(idUser int64) error {
+	cancelled, err := service.databaseServiceAccountDeletion.cancelAccountDeletion(idUser)
+	if err != nil {
+		return err
+	}
+	if !cancelled {
+		return errAccountDeletionNotScheduled
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	accountDeletionModeAnonymize string        = "anonymize" // comments are kept and attributed to deletedUserUsername
+	accountDeletionModePurge     string        = "purge"     // comments are deleted together with the account
+	accountDeletionGracePeriod   time.Duration = 14 * 24 * time.Hour
+	accountDeletionPollPeriod    time.Duration = time.Minute
+	deletedUserUsername          string        = "deleted_user" // placeholder user created by sql/patch14.sql, found by users.deleted_placeholder
+)
+
+type accountDeletionInfo struct {
+	Mode             string    `json:"mode"`
+	DtRequested      time.Time `json:"dtRequested"`
+	DtExecute        time.Time `json:"dtExecute"`
+	RequestedByAdmin bool      `json:"requestedByAdmin"`
+}
+
+type accountDeletionServiceItf interface {
+	// account is deleted after accountDeletionGracePeriod, other sessions of the user are revoked immediately,
+	// current session stays valid so the deletion can still be cancelled
+	requestAccountDeletion(sessionCookie *http.Cookie, mode string) (*accountDeletionInfo, error)
+	cancelAccountDeletion(sessionCookie *http.Cookie) error
+	// returns nil if deletion is not scheduled
+	getAccountDeletion(sessionCookie *http.Cookie) (*accountDeletionInfo, error)
+}
+
+// used by adminUserService
+type accountDeleterItf interface {
+	// gracePeriod 0 deletes the account immediately and returns nil info
+	scheduleAccountDeletion(idUser int64, mode string, idRequestedBy *int64, gracePeriod time.Duration) (*accountDeletionInfo, error)
+	cancelAccountDeletionOfUser(idUser int64) error
+}
+
+func validateAccountDeletionMode(mode string) error {
+	if mode != accountDeletionModeAnonymize && mode != accountDeletionModePurge {
+		return errAccountDeletionModeNotValid
+	}
+	return nil
+}
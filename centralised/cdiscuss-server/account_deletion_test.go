@@ -0,0 +1,95 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type accountDeletionDbStub struct {
+	scheduled map[int64]accountDeletionJob
+	executed  map[int64]string
+}
+
+func (stub *accountDeletionDbStub) scheduleAccountDeletion(idUser int64, mode string, idRequestedBy *int64, now time.Time, dtExecute time.Time) error {
+	stub.scheduled[idUser] = accountDeletionJob{idUser: idUser, mode: mode, dtRequested: now, dtExecute: dtExecute, idRequestedBy: idRequestedBy}
+	return nil
+}
+
+func (stub *accountDeletionDbStub) cancelAccountDeletion(idUser int64) (bool, error) {
+	_, ok := stub.scheduled[idUser]
+	delete(stub.scheduled, idUser)
+	return ok, nil
+}
+
+func (stub *accountDeletionDbStub) getAccountDeletion(idUser int64) (*accountDeletionJob, error) {
+	job, ok := stub.scheduled[idUser]
+	if !ok {
+		return nil, nil
+	}
+	return &job, nil
+}
+
+func (stub *accountDeletionDbStub) executeDueAccountDeletion(now time.Time) (*accountDeletionJob, error) {
+	for idUser, job := range stub.scheduled {
+		if !job.dtExecute.After(now) {
+			delete(stub.scheduled, idUser)
+			stub.executed[idUser] = job.mode
+			return &job, nil
+		}
+	}
+	return nil, nil
+}
+
+func (stub *accountDeletionDbStub) executeAccountDeletion(idUser int64, mode string) error {
+	stub.executed[idUser] = mode
+	return nil
+}
+
+func TestAccountDeletionGracePeriod(t *testing.T) {
+	stub := &accountDeletionDbStub{scheduled: make(map[int64]accountDeletionJob), executed: make(map[int64]string)}
+	service, err := newAccountDeletionService(nil, nil, stub, time.Hour, time.Hour)
+	if err != nil {
+		t.Fatalf("Constructor error: %v", err)
+	}
+	defer service.stop()
+
+	_, err = service.scheduleAccountDeletion(1, "forget", nil, time.Hour)
+	if !errors.Is(err, errAccountDeletionModeNotValid) {
+		t.Errorf("Unknown mode should be rejected, got %v", err)
+	}
+
+	info, err := service.scheduleAccountDeletion(1, accountDeletionModeAnonymize, nil, time.Hour)
+	if err != nil || info == nil || info.RequestedByAdmin {
+		t.Fatalf("Scheduling failed: %v %v", info, err)
+	}
+	service.executeDueDeletions()
+	if len(stub.executed) != 0 {
+		t.Errorf("Account deleted before grace period")
+	}
+
+	err = service.cancelAccountDeletionOfUser(1)
+	if err != nil {
+		t.Errorf("Cancel failed: %v", err)
+	}
+	err = service.cancelAccountDeletionOfUser(1)
+	if !errors.Is(err, errAccountDeletionNotScheduled) {
+		t.Errorf("Second cancel should fail, got %v", err)
+	}
+
+	idAdmin := int64(9)
+	info, _ = service.scheduleAccountDeletion(2, accountDeletionModePurge, &idAdmin, time.Hour)
+	if !info.RequestedByAdmin {
+		t.Errorf("Admin request not recorded")
+	}
+	stub.scheduled[2] = accountDeletionJob{idUser: 2, mode: accountDeletionModePurge, dtExecute: time.Now().Add(-time.Second)}
+	service.executeDueDeletions()
+	if stub.executed[2] != accountDeletionModePurge {
+		t.Errorf("Due deletion not executed")
+	}
+
+	info, err = service.scheduleAccountDeletion(3, accountDeletionModeAnonymize, &idAdmin, 0)
+	if err != nil || info != nil || stub.executed[3] != accountDeletionModeAnonymize {
+		t.Errorf("Immediate deletion failed: %v %v", info, err)
+	}
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type apiTokenCacheContainer struct {
+	token       apiTokenRecord
+	cachedUntil time.Time
+}
+
+type apiTokenService struct {
+	tokensMap *sync.Map // tokenHash -> apiTokenCacheContainer
+
+	userService             userServiceItf
+	databaseServiceApiToken databaseServiceApiTokenItf
+	mqService               mqServiceItf
+}
+
+func newApiTokenService(userService userServiceItf, databaseServiceApiToken databaseServiceApiTokenItf, mqService mqServiceItf) (*apiTokenService, error) {
+	if databaseServiceApiToken == nil {
+		return nil, errors.New("API token service needs database")
+	}
+
+	service := &apiTokenService{tokensMap: &sync.Map{}, userService: userService, databaseServiceApiToken: databaseServiceApiToken,
+		mqService: mqService}
+
+	if service.mqService != nil {
+		service.mqService.registerMessageCB(mqApiTokenRevoked, service, false)
+		// also local, user could have been deleted or changed by other service on this instance
+		service.mqService.registerMessageCB(mqSessionsForUserEnd, service, true)
+		service.mqService.registerMessageCB(mqUserModified, service, true)
+	}
+
+	return service, nil
+}
+
+// implement MQ mqMessageCbItf
+func (service *apiTokenService) onMessage(msg mqMessage) {
+	switch msg.Operation {
+	case mqApiTokenRevoked:
+		service.tokensMap.Delete(msg.Argument)
+	case mqSessionsForUserEnd, mqUserModified:
+		idUser, err := strconv.ParseInt(msg.Argument, 10, 64)
+		if err != nil {
+			slog.Error("Forgetting cached API tokens for user idUser parsing error:", slog.String("idUserStr", msg.Argument), slog.Any("error", err))
+			return
+		}
+		service.forgetCachedTokensForUser(idUser)
+	}
+}
+
+func (service *apiTokenService) stop() {
+	service.tokensMap.Range(func(key, value any) bool {
+		service.tokensMap.Delete(key)
+		return true
+	})
+	if service.mqService != nil {
+		for _, operation := range []string{mqApiTokenRevoked, mqSessionsForUserEnd, mqUserModified} {
+			if err := service.mqService.unregisterMessageCB(operation, service); err != nil {
+				slog.Error("apiTokenService unregistering MQ CB error:", slog.String("operation", operation), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *apiTokenService) forgetCachedTokensForUser(idUser int64) {
+	service.tokensMap.Range(func(key, value any) bool {
+		cached, ok := value.(apiTokenCacheContainer)
+		if !ok || cached.token.user.Id == idUser {
+			service.tokensMap.Delete(key)
+		}
+		return true
+	})
+}
+
+func (service *apiTokenService) createApiToken(sessionCookie *http.Cookie, name string, scopes []string) (string, *apiTokenInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return "", nil, err
+	}
+	if name == "" || len(name) > apiTokenNameMaxLen {
+		return "", nil, errApiTokenNameLen
+	}
+	err = validateApiTokenScopes(scopes)
+	if err != nil {
+		return "", nil, err
+	}
+
+	tokens, err := service.databaseServiceApiToken.listApiTokensForUser(user.Id)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(tokens) >= apiTokenMaxPerUser {
+		return "", nil, errApiTokenLimit
+	}
+
+	token, err := generateApiToken()
+	if err != nil {
+		return "", nil, err
+	}
+	tokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return "", nil, err
+	}
+	record := apiTokenRecord{user: user, tokenHash: tokenHash, name: name, scopes: scopes, dtCreated: time.Now()}
+	id, err := service.databaseServiceApiToken.createApiToken(record)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return token, &apiTokenInfo{Id: id, Name: name, Scopes: scopes, DtCreated: record.dtCreated}, nil
+}
+
+func (service *apiTokenService) listApiTokens(sessionCookie *http.Cookie) ([]apiTokenInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	tokens, err := service.databaseServiceApiToken.listApiTokensForUser(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]apiTokenInfo, 0, len(tokens))
+	for _, token := range tokens {
+		infos = append(infos, apiTokenInfo{Id: token.id, Name: token.name, Scopes: token.scopes, DtCreated: token.dtCreated,
+			DtLastUsed: token.dtLastUsed})
+	}
+	return infos, nil
+}
+
+func (service *apiTokenService) revokeApiToken(sessionCookie *http.Cookie, id int64) error {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+
+	tokenHash, err := service.databaseServiceApiToken.deleteApiToken(id, user.Id)
+	if err != nil {
+		return err
+	}
+	// nothing deleted, nothing to broadcast
+	if tokenHash == "" {
+		return errApiTokenDoesntExist
+	}
+	service.tokensMap.Delete(tokenHash)
+
+	if service.mqService != nil {
+		err = service.mqService.sendMessage(mqApiTokenRevoked, tokenHash)
+		if err != nil {
+			slog.Error("API token service: informing token revocation to other instancs failed", slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+func (service *apiTokenService) getToken(tokenHash string) (*apiTokenRecord, error) {
+	now := time.Now()
+
+	value, ok := service.tokensMap.Load(tokenHash)
+	if ok {
+		cached, ok := value.(apiTokenCacheContainer)
+		if ok && !isExpired(now, cached.cachedUntil) {
+			return &cached.token, nil
+		}
+	}
+
+	token, err := service.databaseServiceApiToken.getApiToken(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+	if token == nil {
+		service.tokensMap.Delete(tokenHash)
+		return nil, errApiTokenNotValid
+	}
+
+	// last use is stored only when the token is (re)loaded, so it is precise to apiTokenCacheAge
+	err = service.databaseServiceApiToken.updateApiTokenLastUsed(tokenHash, now)
+	if err != nil {
+		slog.Error("Updating API token last use in DB:", slog.Any("error", err))
+	}
+	token.dtLastUsed = &now
+
+	service.tokensMap.Store(tokenHash, apiTokenCacheContainer{token: *token, cachedUntil: now.Add(apiTokenCacheAge)})
+	return token, nil
+}
+
+func (service *apiTokenService) authenticateApiToken(token string, anyOfScopes ...string) (*user, error) {
+	tokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return nil, errApiTokenNotValid
+	}
+	record, err := service.getToken(tokenHash)
+	if err != nil {
+		return nil, err
+	}
+
+	allowed := false
+	for _, scope := range anyOfScopes {
+		if hasApiTokenScope(record.scopes, scope) {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return nil, errApiTokenScopeMissing
+	}
+
+	// copy, cached user must not be modified
+	tokenUser := *record.user
+	tokenUser.apiTokenScopes = append([]string{}, record.scopes...) // never nil, so no scope means no permission
+	tokenUser.AdminRole = false
+	return &tokenUser, nil
+}
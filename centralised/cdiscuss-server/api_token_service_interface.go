@@ -0,0 +1,94 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	apiTokenPrefix            string        = "cdk_"
+	apiTokenRandomLen         int           = 32
+	apiTokenNameMaxLen        int           = 100
+	apiTokenMaxPerUser        int           = 20
+	apiTokenCacheAge          time.Duration = 10 * time.Minute
+	apiTokenCredentialName    string        = "CDAPITOKEN" // never set in browsers, HTTP layer wraps the bearer token in it
+	apiTokenScopeReadComments string        = "comments:read"
+	apiTokenScopePostComments string        = "comments:write"
+	apiTokenScopeModerate     string        = "moderate" // only comments:moderate permission
+	apiTokenScopeNone         string        = ""         // permissions that API tokens can't use
+	authorizationBearerPrefix string        = "Bearer "
+)
+
+var apiTokenScopes = []string{apiTokenScopeReadComments, apiTokenScopePostComments, apiTokenScopeModerate}
+
+type apiTokenInfo struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	DtCreated  time.Time  `json:"dtCreated"`
+	DtLastUsed *time.Time `json:"dtLastUsed"`
+}
+
+// API tokens are meant for bots and server-to-server integrations. They can't be used for account
+// management (password, sessions, 2FA, minting other tokens) nor for administration of users, roles,
+// sites and audit log, that needs a real session.
+type apiTokenServiceItf interface {
+	// token is returned only here, only its hash is stored
+	createApiToken(sessionCookie *http.Cookie, name string, scopes []string) (string, *apiTokenInfo, error)
+	listApiTokens(sessionCookie *http.Cookie) ([]apiTokenInfo, error)
+	revokeApiToken(sessionCookie *http.Cookie, id int64) error // revocation is broadcast to other instances
+}
+
+type apiTokenAuthenticatorItf interface {
+	// token must have at least one of the scopes. Returned user never has AdminRole.
+	authenticateApiToken(token string, anyOfScopes ...string) (*user, error)
+}
+
+func generateApiToken() (string, error) {
+	b := make([]byte, apiTokenRandomLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return apiTokenPrefix + base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// turns "Authorization: Bearer <token>" header value into credential accepted by the services
+func newApiTokenCredential(authorization string) (*http.Cookie, error) {
+	if len(authorization) <= len(authorizationBearerPrefix) || !strings.EqualFold(authorization[:len(authorizationBearerPrefix)], authorizationBearerPrefix) {
+		return nil, errApiTokenNotValid
+	}
+	token := strings.TrimSpace(authorization[len(authorizationBearerPrefix):])
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		return nil, errApiTokenNotValid
+	}
+	return &http.Cookie{Name: apiTokenCredentialName, Value: token}, nil
+}
+
+func isApiTokenCredential(credential *http.Cookie) bool {
+	return credential != nil && credential.Name == apiTokenCredentialName
+}
+
+func validateApiTokenScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return errApiTokenScopeNotValid
+	}
+	for _, scope := range scopes {
+		if !hasApiTokenScope(apiTokenScopes, scope) {
+			return errApiTokenScopeNotValid
+		}
+	}
+	return nil
+}
+
+func hasApiTokenScope(scopes []string, scope string) bool {
+	for _, s := range scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
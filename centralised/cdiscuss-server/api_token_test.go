@@ -0,0 +1,89 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNewApiTokenCredential(t *testing.T) {
+	token, err := generateApiToken()
+	if err != nil {
+		t.Fatalf("Token generation error: %v", err)
+	}
+	if !strings.HasPrefix(token, apiTokenPrefix) {
+		t.Fatalf("Token without prefix: %s", token)
+	}
+
+	credential, err := newApiTokenCredential("bearer " + token)
+	if err != nil {
+		t.Fatalf("Valid header rejected: %v", err)
+	}
+	if !isApiTokenCredential(credential) || credential.Value != token {
+		t.Errorf("Wrong credential: %v", credential)
+	}
+
+	for _, header := range []string{"", "Bearer ", "Basic " + token, "Bearer not-a-cdiscuss-token"} {
+		_, err = newApiTokenCredential(header)
+		if !errors.Is(err, errApiTokenNotValid) {
+			t.Errorf("Header '%s' should be rejected, got %v", header, err)
+		}
+	}
+}
+
+func TestValidateApiTokenScopes(t *testing.T) {
+	if err := validateApiTokenScopes([]string{apiTokenScopeReadComments, apiTokenScopeModerate}); err != nil {
+		t.Errorf("Valid scopes rejected: %v", err)
+	}
+	if err := validateApiTokenScopes(nil); !errors.Is(err, errApiTokenScopeNotValid) {
+		t.Errorf("Empty scopes should be rejected, got %v", err)
+	}
+	if err := validateApiTokenScopes([]string{"admin"}); !errors.Is(err, errApiTokenScopeNotValid) {
+		t.Errorf("Unknown scope should be rejected, got %v", err)
+	}
+}
+
+type apiTokenDbStub struct {
+	databaseServiceApiTokenItf // only methods below are used
+	deletedHash                string
+}
+
+func (stub *apiTokenDbStub) deleteApiToken(id int64, idUser int64) (string, error) {
+	return stub.deletedHash, nil
+}
+
+type apiTokenMqStub struct {
+	mqServiceItf // only methods below are used
+	sent         []string
+}
+
+func (stub *apiTokenMqStub) sendMessage(operation string, argument string) error {
+	stub.sent = append(stub.sent, operation)
+	return nil
+}
+
+func TestRevokeApiTokenNothingDeleted(t *testing.T) {
+	db := &apiTokenDbStub{}
+	mq := &apiTokenMqStub{}
+	service := &apiTokenService{tokensMap: &sync.Map{}, userService: &dataExportUserStub{}, databaseServiceApiToken: db, mqService: mq}
+	sessionCookie := &http.Cookie{Name: sessionCookieName, Value: "adam"}
+
+	err := service.revokeApiToken(sessionCookie, 1)
+	if !errors.Is(err, errApiTokenDoesntExist) {
+		t.Fatalf("Revoking missing token should fail, got %v", err)
+	}
+	if len(mq.sent) != 0 {
+		t.Errorf("Nothing was revoked, but broadcast was sent: %v", mq.sent)
+	}
+
+	db.deletedHash = "hash"
+	err = service.revokeApiToken(sessionCookie, 1)
+	if err != nil {
+		t.Fatalf("Revoking token failed: %v", err)
+	}
+	if len(mq.sent) != 1 || mq.sent[0] != mqApiTokenRevoked {
+		t.Errorf("Revocation should be broadcast once, got %v", mq.sent)
+	}
+}
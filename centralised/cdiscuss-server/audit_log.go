@@ -0,0 +1,168 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// implements auditLoggerItf and auditLogServiceItf
+type auditLogService struct {
+	userService             userServiceItf
+	authorizer              authorizerItf
+	databaseServiceAuditLog databaseServiceAuditLogItf
+	instanceID              string
+
+	// used only when there is no database
+	memoryEntriesMutex *sync.Mutex
+	memoryEntries      []auditLogEntry
+}
+
+func newAuditLogService(userService userServiceItf, authorizer authorizerItf, databaseServiceAuditLog databaseServiceAuditLogItf,
+	instanceID string) (*auditLogService, error) {
+	if instanceID == "" {
+		return nil, errors.New("bad instanceID value")
+	}
+	return &auditLogService{userService: userService, authorizer: authorizer, databaseServiceAuditLog: databaseServiceAuditLog,
+		instanceID: instanceID, memoryEntriesMutex: &sync.Mutex{}, memoryEntries: make([]auditLogEntry, 0)}, nil
+}
+
+func (service *auditLogService) logAction(actor *user, action string, targetType string, targetId string, before any, after any) {
+	entry := auditLogEntry{DtCreated: time.Now(), InstanceId: service.instanceID, Action: action, TargetType: targetType, TargetId: targetId,
+		Before: marshalAuditState(before), After: marshalAuditState(after)}
+	if actor != nil {
+		entry.IdActor = &actor.Id
+		entry.ActorUsername = actor.Username
+	}
+
+	if service.databaseServiceAuditLog == nil {
+		service.memoryEntriesMutex.Lock()
+		entry.Id = int64(len(service.memoryEntries)) + 1
+		service.memoryEntries = append(service.memoryEntries, entry)
+		service.memoryEntriesMutex.Unlock()
+		return
+	}
+
+	err := service.databaseServiceAuditLog.appendAuditLog(entry)
+	if err != nil {
+		slog.Error("Writing audit log failed", slog.String("action", action), slog.String("targetId", targetId), slog.Any("error", err))
+	}
+}
+
+func auditLogEntryMatches(entry auditLogEntry, filter auditLogFilter) bool {
+	if entry.Id <= filter.AfterId {
+		return false
+	}
+	if filter.IdActor != nil && (entry.IdActor == nil || *entry.IdActor != *filter.IdActor) {
+		return false
+	}
+	if filter.Action != "" && entry.Action != filter.Action {
+		return false
+	}
+	if filter.TargetType != "" && entry.TargetType != filter.TargetType {
+		return false
+	}
+	if filter.TargetId != "" && entry.TargetId != filter.TargetId {
+		return false
+	}
+	if filter.DtFrom != nil && entry.DtCreated.Before(*filter.DtFrom) {
+		return false
+	}
+	if filter.DtTo != nil && !entry.DtCreated.Before(*filter.DtTo) {
+		return false
+	}
+	return true
+}
+
+func (service *auditLogService) listEntries(filter auditLogFilter) ([]auditLogEntry, error) {
+	if service.databaseServiceAuditLog != nil {
+		return service.databaseServiceAuditLog.queryAuditLog(filter)
+	}
+
+	service.memoryEntriesMutex.Lock()
+	defer service.memoryEntriesMutex.Unlock()
+	entries := make([]auditLogEntry, 0)
+	for _, entry := range service.memoryEntries {
+		if uint64(len(entries)) >= filter.Count {
+			break
+		}
+		if auditLogEntryMatches(entry, filter) {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (service *auditLogService) getAuditor(sessionCookie *http.Cookie) error {
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return err
+	}
+	return service.authorizer.authorize(user, rbacPermAuditRead, rbacTarget{})
+}
+
+func validateAuditLogFilter(filter auditLogFilter) error {
+	if filter.DtFrom != nil && filter.DtTo != nil && filter.DtTo.Before(*filter.DtFrom) {
+		return errAuditLogFilterNotValid
+	}
+	if len(filter.Action) > 50 || len(filter.TargetType) > 20 || len(filter.TargetId) > 80 || strings.ContainsRune(filter.TargetId, 0) {
+		return errAuditLogFilterNotValid
+	}
+	return nil
+}
+
+func (service *auditLogService) queryAuditLog(sessionCookie *http.Cookie, filter auditLogFilter) ([]auditLogEntry, error) {
+	err := validateAuditLogFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	err = service.getAuditor(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	if filter.Count == 0 || filter.Count > auditLogQueryMaxCount {
+		filter.Count = auditLogQueryMaxCount
+	}
+	return service.listEntries(filter)
+}
+
+func (service *auditLogService) exportAuditLog(sessionCookie *http.Cookie, filter auditLogFilter, writer io.Writer) error {
+	err := validateAuditLogFilter(filter)
+	if err != nil {
+		return err
+	}
+	err = service.getAuditor(sessionCookie)
+	if err != nil {
+		return err
+	}
+	return service.writeAuditLogJsonLines(filter, writer)
+}
+
+// also used by admin CLI
+func (service *auditLogService) writeAuditLogJsonLines(filter auditLogFilter, writer io.Writer) error {
+	filter.AfterId = 0
+	filter.Count = auditLogExportPageCount
+	encoder := json.NewEncoder(writer) // Encode adds the new line
+	for {
+		entries, err := service.listEntries(filter)
+		if err != nil {
+			return err
+		}
+		for _, entry := range entries {
+			err = encoder.Encode(entry)
+			if err != nil {
+				return err
+			}
+		}
+		if uint64(len(entries)) < filter.Count {
+			return nil
+		}
+		filter.AfterId = entries[len(entries)-1].Id
+	}
+}
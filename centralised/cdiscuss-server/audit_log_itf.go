@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	auditTargetUser    string = "user"
+	auditTargetComment string = "comment"
+	auditTargetScope   string = "scope" // moderation policy, value is rbac scope
+	auditTargetSite    string = "site"
+	auditTargetPage    string = "page" // value is <idSite>:<urlHash>
+
+	auditActionUserCreate          string = "user.create"
+	auditActionUserDelete          string = "user.delete"
+	auditActionUserDeletionCancel  string = "user.deletion_cancel"
+	auditActionUserRoleAssign      string = "user.role_assign"
+	auditActionUserRoleRevoke      string = "user.role_revoke"
+	auditActionUserUnlock          string = "user.unlock"
+	auditActionUserPasswordReset   string = "user.password_reset_token"
+	auditActionUserBan             string = "user.ban"
+	auditActionUserUnban           string = "user.unban"
+	auditActionCommentModerate     string = "comment.moderate" // dismiss, hide, delete, ban, approve or reject, see after state
+	auditActionCommentDelete       string = "comment.delete"   // by moderator through deleteComment
+	auditActionModerationPolicySet string = "moderation_policy.set"
+	auditActionContentPolicySet    string = "content_policy.set"
+	auditActionSiteCreate          string = "site.create"
+	auditActionSiteUpdate          string = "site.update"
+	auditActionSiteDelete          string = "site.delete"
+	auditActionSiteOwnerAdd        string = "site.owner_add"
+	auditActionSiteOwnerRemove     string = "site.owner_remove"
+	auditActionPageStateSet        string = "page.discussion_state_set"
+
+	auditLogQueryMaxCount   uint64 = 1000
+	auditLogExportPageCount uint64 = 1000
+)
+
+type auditLogEntry struct {
+	Id            int64           `json:"id"`
+	DtCreated     time.Time       `json:"dtCreated"`
+	InstanceId    string          `json:"instanceId"`
+	IdActor       *int64          `json:"idActor"`
+	ActorUsername string          `json:"actorUsername"`
+	Action        string          `json:"action"`
+	TargetType    string          `json:"targetType"`
+	TargetId      string          `json:"targetId"`
+	Before        json.RawMessage `json:"before"`
+	After         json.RawMessage `json:"after"`
+}
+
+// empty fields don't filter, entries are returned by id ascending
+type auditLogFilter struct {
+	IdActor    *int64     `json:"idActor"`
+	Action     string     `json:"action"`
+	TargetType string     `json:"targetType"`
+	TargetId   string     `json:"targetId"`
+	DtFrom     *time.Time `json:"dtFrom"`
+	DtTo       *time.Time `json:"dtTo"`
+	AfterId    int64      `json:"afterId"` // for paging, id of the last entry of previous page
+	Count      uint64     `json:"count"`
+}
+
+// used by services that do privileged actions
+type auditLoggerItf interface {
+	// before and after are marshaled to JSON, nil is stored as null. Errors are only logged, the action already happened.
+	logAction(actor *user, action string, targetType string, targetId string, before any, after any)
+}
+
+type auditLogServiceItf interface {
+	queryAuditLog(sessionCookie *http.Cookie, filter auditLogFilter) ([]auditLogEntry, error)
+	// writes all entries matching the filter (Count and AfterId are ignored) as JSON lines
+	exportAuditLog(sessionCookie *http.Cookie, filter auditLogFilter, writer io.Writer) error
+}
+
+func marshalAuditState(state any) json.RawMessage {
+	if state == nil {
+		return nil
+	}
+	stateJson, err := json.Marshal(state)
+	if err != nil {
+		return nil
+	}
+	return stateJson
+}
+
+// services may run without audit logger (tests, admin CLI)
+func logAuditAction(auditLogger auditLoggerItf, actor *user, action string, targetType string, targetId string, before any, after any) {
+	if auditLogger == nil {
+		return
+	}
+	auditLogger.logAction(actor, action, targetType, targetId, before, after)
+}
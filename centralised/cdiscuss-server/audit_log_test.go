@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuditLogFilter(t *testing.T) {
+	service, err := newAuditLogService(nil, nil, nil, "instance1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = newAuditLogService(nil, nil, nil, ""); err == nil {
+		t.Errorf("Empty instance id accepted")
+	}
+
+	admin := &user{Id: 1, Username: "admin"}
+	moderator := &user{Id: 2, Username: "moderator"}
+	service.logAction(admin, auditActionUserRoleAssign, auditTargetUser, "2", nil, map[string]string{"role": rbacRoleModerator, "scope": ""})
+	service.logAction(moderator, auditActionUserBan, auditTargetUser, "3", nil, userBan{IdUser: 3, Kind: userBanKindBan})
+	service.logAction(moderator, auditActionCommentModerate, auditTargetComment, "7", map[string]string{"status": commentStatusVisible}, nil)
+
+	entries, err := service.listEntries(auditLogFilter{IdActor: &moderator.Id, Count: 10})
+	if err != nil || len(entries) != 2 {
+		t.Fatalf("Expected 2 entries of moderator, got %d %v", len(entries), err)
+	}
+	if entries[0].InstanceId != "instance1" || entries[0].ActorUsername != "moderator" || entries[0].Before != nil {
+		t.Errorf("Wrong entry %+v", entries[0])
+	}
+
+	entries, _ = service.listEntries(auditLogFilter{TargetType: auditTargetUser, TargetId: "3", Count: 10})
+	if len(entries) != 1 || entries[0].Action != auditActionUserBan {
+		t.Errorf("Target filter doesn't work: %+v", entries)
+	}
+	entries, _ = service.listEntries(auditLogFilter{AfterId: 2, Count: 10})
+	if len(entries) != 1 || entries[0].Id != 3 {
+		t.Errorf("Paging doesn't work: %+v", entries)
+	}
+	future := time.Now().Add(time.Hour)
+	entries, _ = service.listEntries(auditLogFilter{DtFrom: &future, Count: 10})
+	if len(entries) != 0 {
+		t.Errorf("Date filter doesn't work: %+v", entries)
+	}
+
+	past := time.Now().Add(-time.Hour)
+	if err = validateAuditLogFilter(auditLogFilter{DtFrom: &future, DtTo: &past}); !errors.Is(err, errAuditLogFilterNotValid) {
+		t.Errorf("Reversed date range accepted")
+	}
+}
+
+func TestAuditLogJsonLinesExport(t *testing.T) {
+	service, _ := newAuditLogService(nil, nil, nil, "instance1")
+	const count = int(auditLogExportPageCount) + 5 // more than one page
+	for i := 0; i < count; i++ {
+		service.logAction(nil, auditActionUserUnlock, auditTargetUser, "5", nil, nil)
+	}
+
+	var buffer bytes.Buffer
+	err := service.writeAuditLogJsonLines(auditLogFilter{Count: 1}, &buffer)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scanner := bufio.NewScanner(&buffer)
+	lines := 0
+	var lastId int64
+	for scanner.Scan() {
+		var entry auditLogEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatalf("Line %d is not JSON: %v", lines, err)
+		}
+		if entry.Id <= lastId || entry.IdActor != nil {
+			t.Errorf("Wrong entry %+v", entry)
+		}
+		lastId = entry.Id
+		lines++
+	}
+	if lines != count {
+		t.Errorf("Expected %d lines, got %d", count, lines)
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// Minimal CBOR (RFC 8949) decoder, just enough for WebAuthn attestation objects and COSE keys.
+// Unsigned and negative integers are decoded as int64, byte strings as []byte, text as string,
+// arrays as []any and maps as map[any]any. Tags are skipped and their content is returned.
+
+const cborMaxNesting int = 16
+
+var errCborTruncated = errors.New("CBOR data is truncated")
+
+func decodeCbor(data []byte) (any, []byte, error) {
+	return decodeCborItem(data, 0)
+}
+
+func decodeCborArgument(data []byte) (byte, uint64, []byte, error) {
+	if len(data) < 1 {
+		return 0, 0, nil, errCborTruncated
+	}
+	majorType := data[0] >> 5
+	info := data[0] & 0x1f
+	data = data[1:]
+
+	switch {
+	case info < 24:
+		return majorType, uint64(info), data, nil
+	case info == 24:
+		if len(data) < 1 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return majorType, uint64(data[0]), data[1:], nil
+	case info == 25:
+		if len(data) < 2 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return majorType, uint64(binary.BigEndian.Uint16(data)), data[2:], nil
+	case info == 26:
+		if len(data) < 4 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return majorType, uint64(binary.BigEndian.Uint32(data)), data[4:], nil
+	case info == 27:
+		if len(data) < 8 {
+			return 0, 0, nil, errCborTruncated
+		}
+		return majorType, binary.BigEndian.Uint64(data), data[8:], nil
+	}
+	return 0, 0, nil, fmt.Errorf("CBOR indefinite length or reserved additional info %d is not supported", info)
+}
+
+func decodeCborItem(data []byte, nesting int) (any, []byte, error) {
+	if nesting > cborMaxNesting {
+		return nil, nil, errors.New("CBOR data is nested too deep")
+	}
+
+	majorType, argument, rest, err := decodeCborArgument(data)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch majorType {
+	case 0: // unsigned integer
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return int64(argument), rest, nil
+	case 1: // negative integer
+		if argument > math.MaxInt64 {
+			return nil, nil, errors.New("CBOR integer overflow")
+		}
+		return -1 - int64(argument), rest, nil
+	case 2, 3: // byte string, text string
+		if argument > uint64(len(rest)) {
+			return nil, nil, errCborTruncated
+		}
+		value := rest[:argument]
+		if majorType == 3 {
+			return string(value), rest[argument:], nil
+		}
+		return value, rest[argument:], nil
+	case 4: // array
+		if argument > uint64(len(rest)) {
+			return nil, nil, errCborTruncated
+		}
+		array := make([]any, 0, argument)
+		for i := uint64(0); i < argument; i++ {
+			var item any
+			item, rest, err = decodeCborItem(rest, nesting+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			array = append(array, item)
+		}
+		return array, rest, nil
+	case 5: // map
+		if argument > uint64(len(rest)) {
+			return nil, nil, errCborTruncated
+		}
+		cborMap := make(map[any]any, argument)
+		for i := uint64(0); i < argument; i++ {
+			var key, value any
+			key, rest, err = decodeCborItem(rest, nesting+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch key.(type) {
+			case int64, string:
+			default:
+				return nil, nil, errors.New("CBOR map key must be integer or text")
+			}
+			value, rest, err = decodeCborItem(rest, nesting+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			cborMap[key] = value
+		}
+		return cborMap, rest, nil
+	case 6: // tag
+		return decodeCborItem(rest, nesting+1)
+	case 7: // simple values
+		switch argument {
+		case 20:
+			return false, rest, nil
+		case 21:
+			return true, rest, nil
+		case 22, 23:
+			return nil, rest, nil
+		}
+		return nil, nil, fmt.Errorf("CBOR simple value %d is not supported", argument)
+	}
+	return nil, nil, fmt.Errorf("CBOR major type %d is not supported", majorType)
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"net"
+	"net/http"
+)
+
+// data about the client that made the request, filled by the HTTP layer
+type clientInfo struct {
+	ip        string
+	userAgent string
+}
+
+const clientUserAgentMaxLen int = 500
+
+func newClientInfoFromRequest(r *http.Request) clientInfo {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+	userAgent := r.UserAgent()
+	if len(userAgent) > clientUserAgentMaxLen {
+		userAgent = userAgent[:clientUserAgentMaxLen]
+	}
+	return clientInfo{ip: ip, userAgent: userAgent}
+}
+
+// returns network part of client IP, /24 for IPv4 and /64 for IPv6
+func (client clientInfo) subnet() string {
+	ip := net.ParseIP(client.ip)
+	if ip == nil {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4.Mask(net.CIDRMask(rateLimitIPv4SubnetBits, 32)).String()
+	}
+	return ip.Mask(net.CIDRMask(rateLimitIPv6SubnetBits, 128)).String()
+}
@@ -1 +1,252 @@
 package main
+
+import (
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+type commentService struct {
+	userService            userServiceItf
+	databaseServiceComment databaseServiceCommentItf
+	rateLimiter            rateLimiterItf
+	authorizer             authorizerItf
+	banChecker             banCheckerItf
+	preModerator           preModeratorItf
+	auditLogger            auditLoggerItf
+	spamClassifier         spamClassifierItf
+	contentFilter          contentFilterItf
+	duplicateDetector      duplicateDetectorItf
+	siteRegistry           siteRegistryItf
+	proofOfWork            proofOfWorkConformationItf
+	pageStateChecker       pageStateCheckerItf
+}
+
+func newCommentService(userService userServiceItf, databaseServiceComment databaseServiceCommentItf, rateLimiter rateLimiterItf,
+	authorizer authorizerItf, banChecker banCheckerItf, preModerator preModeratorItf, auditLogger auditLoggerItf,
+	spamClassifier spamClassifierItf, contentFilter contentFilterItf, duplicateDetector duplicateDetectorItf, siteRegistry siteRegistryItf,
+	proofOfWork proofOfWorkConformationItf, pageStateChecker pageStateCheckerItf) *commentService {
+	return &commentService{userService: userService, databaseServiceComment: databaseServiceComment, rateLimiter: rateLimiter,
+		authorizer: authorizer, banChecker: banChecker, preModerator: preModerator, auditLogger: auditLogger,
+		spamClassifier: spamClassifier, contentFilter: contentFilter, duplicateDetector: duplicateDetector,
+		siteRegistry: siteRegistry, proofOfWork: proofOfWork, pageStateChecker: pageStateChecker}
+}
+
+func (commentService *commentService) getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error) {
+	if commentService.pageStateChecker == nil {
+		return &pageDiscussionState{State: pageStateOpen}, nil
+	}
+	return commentService.pageStateChecker.getPageDiscussionState(idSite, urlHash)
+}
+
+func (commentService *commentService) getSite(idSite int64) (*site, error) {
+	if commentService.siteRegistry == nil {
+		return &site{Id: idSite}, nil
+	}
+	return commentService.siteRegistry.getSite(idSite)
+}
+
+func (commentService *commentService) listPageComments(sessionCookie *http.Cookie, idSite int64, urlHash string, offset uint64, count uint64) (*pageComments, error) {
+	if len(urlHash) != urlHashLen {
+		return nil, errUrlHashLen
+	}
+	_, err := commentService.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+
+	// guests see only approved comments, authors also their pending ones and moderators all pending ones
+	var idViewer int64
+	showAllPending := false
+	if sessionCookie != nil {
+		user, err := commentService.userService.getRequestUser(sessionCookie, apiTokenScopeReadComments)
+		if err != nil && !isCredentialNotValidError(err) {
+			return nil, err
+		}
+		// expired or invalid credential reads the page as guest
+		if err == nil {
+			idViewer = user.Id
+			showAllPending = commentService.authorizer.authorize(user, rbacPermCommentsModerate, rbacSiteTarget(idSite, urlHash)) == nil
+		}
+	}
+	discussion, err := commentService.getPageDiscussionState(idSite, urlHash)
+	if err != nil {
+		return nil, err
+	}
+	pageComments, err := commentService.databaseServiceComment.listPageComments(idSite, urlHash, offset, count, idViewer, showAllPending)
+	if err != nil {
+		return nil, err
+	}
+	pageComments.Discussion = *discussion
+	return pageComments, nil
+}
+
+func (commentService *commentService) createComment(sessionCookie *http.Cookie, client clientInfo, idSite int64, idParent *int64, urlHash string,
+	commentBody string, powString string) (int64, error) {
+	if len(urlHash) != urlHashLen {
+		return -1, errUrlHashLen
+	}
+	if commentBody == "" {
+		return -1, errCommentBodyEmpty
+	}
+
+	user, err := commentService.userService.getRequestUser(sessionCookie, apiTokenScopePostComments)
+	if err != nil {
+		return -1, err
+	}
+	site, err := commentService.getSite(idSite)
+	if err != nil {
+		return -1, err
+	}
+	target := rbacSiteTarget(idSite, urlHash)
+	err = commentService.authorizer.authorize(user, rbacPermCommentsWrite, target)
+	if err != nil {
+		return -1, err
+	}
+	// moderators are trusted, held comments go to the moderation queue as pending
+	trusted := commentService.authorizer.authorize(user, rbacPermCommentsModerate, target) == nil
+	discussion, err := commentService.getPageDiscussionState(idSite, urlHash)
+	if err != nil {
+		return -1, err
+	}
+	err = pageDiscussionStateError(discussion.State, idParent != nil, trusted)
+	if err != nil {
+		return -1, err
+	}
+
+	var ban *userBan
+	if commentService.banChecker != nil {
+		ban, err = commentService.banChecker.getUserBan(user.Id)
+		if err != nil {
+			return -1, err
+		}
+		err = userBanError(ban)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	holdByPolicy := false
+	if commentService.contentFilter != nil {
+		commentBody, holdByPolicy, err = commentService.contentFilter.filterComment(target, commentBody)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	if commentService.rateLimiter != nil {
+		err = commentService.rateLimiter.allow(rateLimitOpCreateComment, rateLimitKeys{idUser: &user.Id, client: client, urlHash: urlHash})
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	if site.PowRequired && !trusted && commentService.proofOfWork != nil {
+		err = commentService.proofOfWork.isTokenAceptableStore(powString, site.PowHardnes, user.Username)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	var duplicate *duplicateCheck
+	if commentService.duplicateDetector != nil {
+		duplicate, err = commentService.duplicateDetector.checkDuplicate(user.Id, commentBody)
+		if err != nil {
+			return -1, err
+		}
+		if !trusted && duplicate.verdict == spamVerdictReject {
+			slog.Info("Comment rejected as duplicate", slog.Int64("idUser", user.Id), slog.Int("userRepeats", duplicate.userRepeats),
+				slog.Int("globalRepeats", duplicate.globalRepeats))
+			return -1, errCommentDuplicate
+		}
+	}
+
+	status := commentStatusVisible
+	if commentService.preModerator != nil {
+		status, err = commentService.preModerator.newCommentStatus(user, target)
+		if err != nil {
+			return -1, err
+		}
+	}
+	if holdByPolicy || (!trusted && duplicate != nil && duplicate.verdict == spamVerdictHold) {
+		status = commentStatusPending
+	} else if status == commentStatusVisible && !trusted && commentService.spamClassifier != nil {
+		status, err = commentService.checkSpam(user, client, idParent, urlHash, commentBody)
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	// comment of shadow-banned user goes through the same checks, so unban doesn't publish what would have been held
+	shadow := ban != nil && ban.Kind == userBanKindShadow
+	id, err := commentService.databaseServiceComment.createComment(idSite, idParent, urlHash, user.Id, time.Now(), commentBody, status, shadow)
+	if err != nil {
+		return -1, err
+	}
+	if duplicate != nil {
+		err = commentService.duplicateDetector.recordComment(id, duplicate)
+		if err != nil {
+			slog.Error("Saving comment fingerprint failed", slog.Int64("idComment", id), slog.Any("error", err))
+		}
+	}
+	return id, nil
+}
+
+func (commentService *commentService) checkSpam(user *user, client clientInfo, idParent *int64, urlHash string, commentBody string) (string, error) {
+	verdict, err := commentService.spamClassifier.classifyComment(spamCheckRequest{IdUser: user.Id, Username: user.Username, UrlHash: urlHash,
+		IdParent: idParent, CommentBody: commentBody, Ip: client.ip, UserAgent: client.userAgent})
+	if err != nil {
+		return "", err
+	}
+	switch verdict.Verdict {
+	case spamVerdictReject:
+		slog.Info("Comment rejected as spam", slog.Int64("idUser", user.Id), slog.Float64("score", verdict.Score), slog.Any("reasons", verdict.Reasons))
+		return "", errCommentRejectedAsSpam
+	case spamVerdictHold:
+		slog.Info("Comment held as spam", slog.Int64("idUser", user.Id), slog.Float64("score", verdict.Score), slog.Any("reasons", verdict.Reasons))
+		return commentStatusPending, nil
+	}
+	return commentStatusVisible, nil
+}
+
+func (commentService *commentService) deleteComment(sessionCookie *http.Cookie, id int64) error {
+	user, err := commentService.userService.getRequestUser(sessionCookie, apiTokenScopePostComments, apiTokenScopeModerate)
+	if err != nil {
+		return err
+	}
+	comment, err := commentService.databaseServiceComment.getComment(id)
+	if err != nil {
+		return err
+	}
+
+	permission := rbacPermCommentsModerate
+	if comment.IdUser == user.Id {
+		permission = rbacPermCommentsDeleteOwn
+	}
+	err = commentService.authorizer.authorize(user, permission, rbacSiteTarget(comment.IdSite, comment.UrlHash))
+	if err != nil {
+		return err
+	}
+	// moderators still remove comments from archived pages
+	if permission == rbacPermCommentsDeleteOwn {
+		discussion, err := commentService.getPageDiscussionState(comment.IdSite, comment.UrlHash)
+		if err != nil {
+			return err
+		}
+		if discussion.State == pageStateArchived {
+			return errPageArchived
+		}
+	}
+	err = commentService.databaseServiceComment.deleteComment(id, user.Id, permission == rbacPermCommentsModerate)
+	if err != nil {
+		return err
+	}
+
+	// deleting own comment is not a privileged action
+	if permission == rbacPermCommentsModerate {
+		logAuditAction(commentService.auditLogger, user, auditActionCommentDelete, auditTargetComment, strconv.FormatInt(id, 10),
+			map[string]any{"idUser": comment.IdUser, "urlHash": comment.UrlHash, "status": comment.Status}, nil)
+	}
+	return nil
+}
@@ -9,7 +9,12 @@ const (
 )
 
 type commentiServiceItf interface {
-	listPageComments(urlHash string, offset uint64, count uint64) (*pageComments, error)
-	createComment(sessionCookie *http.Cookie, idParent *int64, urlHash string, commentBody string) (int64, error)
+	// sessionCookie is optional, with it the author also sees own pending comments and moderators all pending comments
+	listPageComments(sessionCookie *http.Cookie, idSite int64, urlHash string, offset uint64, count uint64) (*pageComments, error)
+	// comment can be pending, depending on moderation policy of the page. Proof of work is needed if the site requires it.
+	// Discussion state of the page can refuse the comment.
+	createComment(sessionCookie *http.Cookie, client clientInfo, idSite int64, idParent *int64, urlHash string, commentBody string,
+		powString string) (int64, error)
+	// authors can't delete own comments on archived pages
 	deleteComment(sessionCookie *http.Cookie, id int64) error
 }
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+type requestUserStub struct {
+	userServiceItf // only methods below are used
+	err            error
+}
+
+func (stub *requestUserStub) getRequestUser(credential *http.Cookie, anyOfScopes ...string) (*user, error) {
+	if stub.err != nil {
+		return nil, stub.err
+	}
+	return &user{Id: 1}, nil
+}
+
+type pageCommentsDbStub struct {
+	databaseServiceCommentItf // only methods below are used
+	idViewer                  int64
+}
+
+func (stub *pageCommentsDbStub) listPageComments(idSite int64, urlHash string, offset uint64, count uint64, idViewer int64,
+	showAllPending bool) (*pageComments, error) {
+	stub.idViewer = idViewer
+	return &pageComments{}, nil
+}
+
+func TestListPageCommentsCredential(t *testing.T) {
+	urlHash := strings.Repeat("a", urlHashLen)
+	userStub := &requestUserStub{}
+	db := &pageCommentsDbStub{}
+	service := newCommentService(userStub, db, nil, newAuthorizer(nil, nil), nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+
+	if _, err := service.listPageComments(cookie, defaultSiteId, urlHash, 0, 10); err != nil || db.idViewer != 1 {
+		t.Errorf("Valid session not used: viewer %d, %v", db.idViewer, err)
+	}
+	for _, credentialErr := range []error{errUserSessionIsNotValid, errApiTokenNotValid, errApiTokenScopeMissing} {
+		userStub.err = credentialErr
+		if _, err := service.listPageComments(cookie, defaultSiteId, urlHash, 0, 10); err != nil || db.idViewer != 0 {
+			t.Errorf("%v: should read as guest, viewer %d, %v", credentialErr, db.idViewer, err)
+		}
+	}
+	userStub.err = errors.New("database down")
+	if _, err := service.listPageComments(cookie, defaultSiteId, urlHash, 0, 10); err == nil {
+		t.Errorf("Other errors should not be hidden")
+	}
+}
+
+type createCommentDbStub struct {
+	databaseServiceCommentItf // only methods below are used
+	status                    string
+	shadow                    bool
+}
+
+func (stub *createCommentDbStub) createComment(idSite int64, idParent *int64, urlHash string, idUser int64, dtCreated time.Time,
+	commentBody string, status string, shadow bool) (int64, error) {
+	stub.status = status
+	stub.shadow = shadow
+	return 1, nil
+}
+
+type shadowBanStub struct{}
+
+func (stub *shadowBanStub) getUserBan(idUser int64) (*userBan, error) {
+	return &userBan{IdUser: idUser, Kind: userBanKindShadow}, nil
+}
+
+type preModeratorStub struct {
+	status string
+}
+
+func (stub *preModeratorStub) newCommentStatus(user *user, target rbacTarget) (string, error) {
+	return stub.status, nil
+}
+
+// unban restores the status the comment would have had, so it must be decided also for shadow-banned users
+func TestCreateCommentShadowBanKeepsStatus(t *testing.T) {
+	urlHash := strings.Repeat("a", urlHashLen)
+	db := &createCommentDbStub{}
+	preModerator := &preModeratorStub{status: commentStatusPending}
+	service := newCommentService(&requestUserStub{}, db, nil, newAuthorizer(nil, nil), &shadowBanStub{}, preModerator, nil, nil, nil, nil,
+		nil, nil, nil)
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+
+	if _, err := service.createComment(cookie, clientInfo{}, defaultSiteId, nil, urlHash, "Hello", ""); err != nil {
+		t.Fatalf("Creating comment failed: %v", err)
+	}
+	if db.status != commentStatusPending || !db.shadow {
+		t.Errorf("Pre-moderated comment of shadow-banned user should be pending and shadow, got %s %v", db.status, db.shadow)
+	}
+
+	preModerator.status = commentStatusVisible
+	if _, err := service.createComment(cookie, clientInfo{}, defaultSiteId, nil, urlHash, "Hello again", ""); err != nil {
+		t.Fatalf("Creating comment failed: %v", err)
+	}
+	if db.status != commentStatusVisible || !db.shadow {
+		t.Errorf("Comment of shadow-banned user should be visible and shadow, got %s %v", db.status, db.shadow)
+	}
+}
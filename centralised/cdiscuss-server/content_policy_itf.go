@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	contentActionMask   string = "mask"   // matched text is replaced with contentMaskRune
+	contentActionHold   string = "hold"   // comment waits in moderation queue
+	contentActionReject string = "reject" // comment is not saved
+
+	contentPolicyTermsMax   int           = 500
+	contentPolicyTermMaxLen int           = 200
+	contentPolicyCacheAge   time.Duration = 10 * time.Minute
+	contentMaskRune         rune          = '*'
+)
+
+// pattern is case insensitive and matches whole words, * matches any part of a word. Regex patterns are used as they are.
+type contentPolicyTerm struct {
+	Pattern string `json:"pattern"`
+	Regex   bool   `json:"regex"`
+	Action  string `json:"action"`
+}
+
+type contentPolicy struct {
+	Terms     []contentPolicyTerm `json:"terms"`
+	MaxLinks  *int                `json:"maxLinks"`  // nil is not limited, 0 allows no links
+	MaxLength int                 `json:"maxLength"` // in characters, 0 is not limited
+}
+
+type compiledContentTerm struct {
+	regex      *regexp.Regexp
+	wholeWords bool
+	action     string
+}
+
+type compiledContentPolicy struct {
+	terms     []compiledContentTerm
+	maxLinks  *int
+	maxLength int
+}
+
+type usernameFilterItf interface {
+	checkUsername(username string) error
+}
+
+// used in comment creation and username validation
+type contentFilterItf interface {
+	usernameFilterItf
+	// returns the body with masked terms and true if the comment has to be held for moderation
+	filterComment(target rbacTarget, commentBody string) (string, bool, error)
+}
+
+type contentPolicyServiceItf interface {
+	// returns nil if the scope has no policy
+	getContentPolicy(sessionCookie *http.Cookie, scope string) (*contentPolicy, error)
+	// nil policy removes it, scope is rbacScopeGlobal or site:<id>
+	setContentPolicy(sessionCookie *http.Cookie, scope string, policy *contentPolicy) error
+}
+
+func contentTermRegex(term contentPolicyTerm) (*regexp.Regexp, error) {
+	if term.Regex {
+		return regexp.Compile("(?i)" + term.Pattern)
+	}
+	parts := strings.Split(term.Pattern, "*")
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.Compile("(?i)" + strings.Join(parts, `[\p{L}\p{N}]*`))
+}
+
+func compileContentPolicy(policy contentPolicy) (*compiledContentPolicy, error) {
+	if len(policy.Terms) > contentPolicyTermsMax || policy.MaxLength < 0 || (policy.MaxLinks != nil && *policy.MaxLinks < 0) {
+		return nil, errContentPolicyNotValid
+	}
+
+	compiled := &compiledContentPolicy{terms: make([]compiledContentTerm, 0, len(policy.Terms)), maxLinks: policy.MaxLinks,
+		maxLength: policy.MaxLength}
+	for _, term := range policy.Terms {
+		if strings.Trim(term.Pattern, "*") == "" || len(term.Pattern) > contentPolicyTermMaxLen {
+			return nil, errContentPolicyNotValid
+		}
+		if term.Action != contentActionMask && term.Action != contentActionHold && term.Action != contentActionReject {
+			return nil, errContentPolicyNotValid
+		}
+		regex, err := contentTermRegex(term)
+		if err != nil {
+			return nil, errContentPolicyNotValid
+		}
+		compiled.terms = append(compiled.terms, compiledContentTerm{regex: regex, wholeWords: !term.Regex, action: term.Action})
+	}
+	return compiled, nil
+}
+
+func isContentWordRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsNumber(r)
+}
+
+// so that "ass" doesn't match in "class", regexp \b knows only ASCII
+func isWholeWordMatch(text string, start int, end int) bool {
+	if start > 0 {
+		r, _ := utf8.DecodeLastRuneInString(text[:start])
+		if isContentWordRune(r) {
+			return false
+		}
+	}
+	if end < len(text) {
+		r, _ := utf8.DecodeRuneInString(text[end:])
+		if isContentWordRune(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (term compiledContentTerm) findMatches(text string) [][]int {
+	matches := make([][]int, 0)
+	for _, match := range term.regex.FindAllStringIndex(text, -1) {
+		if match[0] == match[1] {
+			continue
+		}
+		if term.wholeWords && !isWholeWordMatch(text, match[0], match[1]) {
+			continue
+		}
+		matches = append(matches, match)
+	}
+	return matches
+}
+
+func maskContent(text string, matches [][]int) string {
+	var sb strings.Builder
+	last := 0
+	for _, match := range matches {
+		if match[0] < last {
+			continue // overlaps already masked text
+		}
+		sb.WriteString(text[last:match[0]])
+		sb.WriteString(strings.Repeat(string(contentMaskRune), utf8.RuneCountInString(text[match[0]:match[1]])))
+		last = match[1]
+	}
+	sb.WriteString(text[last:])
+	return sb.String()
+}
+
+// returns the (masked) body and true if it has to be held
+func (policy *compiledContentPolicy) checkComment(commentBody string) (string, bool, error) {
+	if policy.maxLength > 0 && utf8.RuneCountInString(commentBody) > policy.maxLength {
+		return "", false, errCommentTooLong
+	}
+	if policy.maxLinks != nil && countSpamLinks(commentBody) > *policy.maxLinks {
+		return "", false, errCommentTooManyLinks
+	}
+
+	hold := false
+	for _, term := range policy.terms {
+		matches := term.findMatches(commentBody)
+		if len(matches) == 0 {
+			continue
+		}
+		switch term.action {
+		case contentActionReject:
+			return "", false, errCommentBlockedByPolicy
+		case contentActionHold:
+			hold = true
+		case contentActionMask:
+			commentBody = maskContent(commentBody, matches)
+		}
+	}
+	return commentBody, hold, nil
+}
+
+// usernames can't be masked, so every matching term rejects it. Underscores separate words.
+func (policy *compiledContentPolicy) checkUsername(username string) error {
+	words := strings.ReplaceAll(username, "_", " ")
+	for _, term := range policy.terms {
+		if len(term.findMatches(words)) > 0 {
+			return errUsernameBlockedByPolicy
+		}
+	}
+	return nil
+}
+
+func validateContentPolicyScope(scope string) error {
+	if strings.HasPrefix(scope, rbacScopePagePrefix) {
+		return errContentPolicyScopeNotValid
+	}
+	// any role is fine for validating the scope
+	err := validateRbacRoleAndScope(rbacRoleModerator, scope)
+	if err != nil {
+		return errContentPolicyScopeNotValid
+	}
+	return nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+type contentPolicyCacheContainer struct {
+	policy      *compiledContentPolicy // nil if the scope has no policy
+	cachedUntil time.Time
+}
+
+// implements contentPolicyServiceItf and contentFilterItf
+type contentPolicyService struct {
+	userService                  userServiceItf
+	authorizer                   authorizerItf
+	databaseServiceContentPolicy databaseServiceContentPolicyItf
+	auditLogger                  auditLoggerItf
+	mqService                    mqServiceItf
+
+	policiesMap *sync.Map // scope -> contentPolicyCacheContainer
+}
+
+func newContentPolicyService(userService userServiceItf, authorizer authorizerItf, databaseServiceContentPolicy databaseServiceContentPolicyItf,
+	auditLogger auditLoggerItf, mqService mqServiceItf) (*contentPolicyService, error) {
+	if databaseServiceContentPolicy == nil {
+		return nil, errors.New("content policy service needs database")
+	}
+
+	service := &contentPolicyService{userService: userService, authorizer: authorizer, databaseServiceContentPolicy: databaseServiceContentPolicy,
+		auditLogger: auditLogger, mqService: mqService, policiesMap: &sync.Map{}}
+	if service.mqService != nil {
+		service.mqService.registerMessageCB(mqContentPolicy, service, false)
+	}
+	return service, nil
+}
+
+// implement MQ mqMessageCbItf, the policy is reloaded from DB on next use
+func (service *contentPolicyService) onMessage(msg mqMessage) {
+	service.policiesMap.Delete(msg.Argument)
+}
+
+func (service *contentPolicyService) stop() {
+	if service.mqService != nil {
+		if err := service.mqService.unregisterMessageCB(mqContentPolicy, service); err != nil {
+			slog.Error("contentPolicyService unregistering MQ CB error:", slog.Any("error", err))
+		}
+	}
+}
+
+func (service *contentPolicyService) getCompiledPolicy(scope string) (*compiledContentPolicy, error) {
+	now := time.Now()
+	value, ok := service.policiesMap.Load(scope)
+	if ok {
+		cached, ok := value.(contentPolicyCacheContainer)
+		if ok && now.Before(cached.cachedUntil) {
+			return cached.policy, nil
+		}
+	}
+
+	policy, err := service.databaseServiceContentPolicy.getContentPolicy(scope)
+	if err != nil {
+		return nil, err
+	}
+	var compiled *compiledContentPolicy
+	if policy != nil {
+		compiled, err = compileContentPolicy(*policy)
+		if err != nil {
+			// policies are validated before they are stored
+			slog.Error("Stored content policy is not valid", slog.String("scope", scope), slog.Any("error", err))
+			return nil, errInternalServer
+		}
+	}
+	service.policiesMap.Store(scope, contentPolicyCacheContainer{policy: compiled, cachedUntil: now.Add(contentPolicyCacheAge)})
+	return compiled, nil
+}
+
+// global policy applies everywhere, site policy adds to it
+func (service *contentPolicyService) filterComment(target rbacTarget, commentBody string) (string, bool, error) {
+	scopes := []string{rbacScopeGlobal}
+	if target.site != "" {
+		scopes = append(scopes, rbacScopeSitePrefix+target.site)
+	}
+
+	hold := false
+	for _, scope := range scopes {
+		policy, err := service.getCompiledPolicy(scope)
+		if err != nil {
+			return "", false, err
+		}
+		if policy == nil {
+			continue
+		}
+		var holdScope bool
+		commentBody, holdScope, err = policy.checkComment(commentBody)
+		if err != nil {
+			return "", false, err
+		}
+		hold = hold || holdScope
+	}
+	return commentBody, hold, nil
+}
+
+// usernames are not bound to a site
+func (service *contentPolicyService) checkUsername(username string) error {
+	policy, err := service.getCompiledPolicy(rbacScopeGlobal)
+	if err != nil || policy == nil {
+		return err
+	}
+	return policy.checkUsername(username)
+}
+
+func (service *contentPolicyService) getSiteConfigurator(sessionCookie *http.Cookie, scope string) (*user, error) {
+	err := validateContentPolicyScope(scope)
+	if err != nil {
+		return nil, err
+	}
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+	err = service.authorizer.authorize(user, rbacPermSiteConfigure, rbacScopeToTarget(scope))
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (service *contentPolicyService) getContentPolicy(sessionCookie *http.Cookie, scope string) (*contentPolicy, error) {
+	_, err := service.getSiteConfigurator(sessionCookie, scope)
+	if err != nil {
+		return nil, err
+	}
+	return service.databaseServiceContentPolicy.getContentPolicy(scope)
+}
+
+func (service *contentPolicyService) setContentPolicy(sessionCookie *http.Cookie, scope string, policy *contentPolicy) error {
+	user, err := service.getSiteConfigurator(sessionCookie, scope)
+	if err != nil {
+		return err
+	}
+	if policy != nil {
+		_, err = compileContentPolicy(*policy)
+		if err != nil {
+			return err
+		}
+	}
+
+	previousPolicy, err := service.databaseServiceContentPolicy.getContentPolicy(scope)
+	if err != nil {
+		return err
+	}
+	err = service.databaseServiceContentPolicy.setContentPolicy(scope, policy, user.Id, time.Now())
+	if err != nil {
+		return err
+	}
+	logAuditAction(service.auditLogger, user, auditActionContentPolicySet, auditTargetScope, scope, previousPolicy, policy)
+
+	service.policiesMap.Delete(scope)
+	if service.mqService != nil {
+		err = service.mqService.sendMessage(mqContentPolicy, scope)
+		if err != nil {
+			slog.Error("content policy: informing policy change to other instances failed", slog.Any("error", err), slog.String("scope", scope))
+		}
+	}
+	return nil
+}
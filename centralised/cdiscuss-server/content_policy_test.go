@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestContentPolicyTerms(t *testing.T) {
+	maxLinks := 1
+	policy, err := compileContentPolicy(contentPolicy{Terms: []contentPolicyTerm{
+		{Pattern: "darn", Action: contentActionMask},
+		{Pattern: "scam*", Action: contentActionHold},
+		{Pattern: `fr[e3]{2}\s+money`, Regex: true, Action: contentActionReject},
+	}, MaxLinks: &maxLinks, MaxLength: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		body string
+		want string
+		hold bool
+		err  error
+	}{
+		{"Darn it, darning socks is fine", "**** it, darning socks is fine", false, nil},
+		{"Žabe darn čez", "Žabe **** čez", false, nil},
+		{"a scammer here", "a scammer here", true, nil},
+		{"get FR33 money", "", false, errCommentBlockedByPolicy},
+		{"http://a.example http://b.example", "", false, errCommentTooManyLinks},
+		{string(make([]byte, 101)), "", false, errCommentTooLong},
+	}
+	for _, test := range tests {
+		got, hold, err := policy.checkComment(test.body)
+		if !errors.Is(err, test.err) || got != test.want || hold != test.hold {
+			t.Errorf("%q: got %q %v %v want %q %v %v", test.body, got, hold, err, test.want, test.hold, test.err)
+		}
+	}
+
+	if err = policy.checkUsername("big_darn_fan"); !errors.Is(err, errUsernameBlockedByPolicy) {
+		t.Errorf("Blocked term in username accepted")
+	}
+	if err = policy.checkUsername("darning"); err != nil {
+		t.Errorf("Username should be allowed: %v", err)
+	}
+	if err = validateUsername("big_darn_fan", nil, policy); !errors.Is(err, errUsernameBlockedByPolicy) {
+		t.Errorf("validateUsername should use username filter")
+	}
+	if err = validateProfile("Big Darn Fan", "", "", nil, policy); !errors.Is(err, errDisplayNameBlockedByPolicy) {
+		t.Errorf("validateProfile should use username filter for display name: %v", err)
+	}
+
+	for _, bad := range []contentPolicy{
+		{Terms: []contentPolicyTerm{{Pattern: "*", Action: contentActionMask}}},
+		{Terms: []contentPolicyTerm{{Pattern: "x", Action: "delete"}}},
+		{Terms: []contentPolicyTerm{{Pattern: "(", Regex: true, Action: contentActionMask}}},
+		{MaxLength: -1},
+	} {
+		if _, err = compileContentPolicy(bad); !errors.Is(err, errContentPolicyNotValid) {
+			t.Errorf("Bad policy accepted: %+v", bad)
+		}
+	}
+	if validateContentPolicyScope("page:abc") == nil || validateContentPolicyScope(rbacSiteScope(1)) != nil {
+		t.Errorf("Wrong content policy scope validation")
+	}
+}
+
+type contentPolicyDbStub struct {
+	policies map[string]*contentPolicy
+	queries  int
+}
+
+func (stub *contentPolicyDbStub) getContentPolicy(scope string) (*contentPolicy, error) {
+	stub.queries++
+	return stub.policies[scope], nil
+}
+
+func (stub *contentPolicyDbStub) setContentPolicy(scope string, policy *contentPolicy, idModifiedBy int64, now time.Time) error {
+	stub.policies[scope] = policy
+	return nil
+}
+
+func TestContentPolicyServiceReload(t *testing.T) {
+	stub := &contentPolicyDbStub{policies: map[string]*contentPolicy{
+		rbacScopeGlobal:  {Terms: []contentPolicyTerm{{Pattern: "darn", Action: contentActionMask}}},
+		rbacSiteScope(7): {Terms: []contentPolicyTerm{{Pattern: "heck", Action: contentActionHold}}},
+	}}
+	service, err := newContentPolicyService(nil, nil, stub, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, hold, err := service.filterComment(rbacTarget{site: "7"}, "darn heck")
+	if err != nil || body != "**** heck" || !hold {
+		t.Errorf("Global and site policy expected: %q %v %v", body, hold, err)
+	}
+	body, hold, _ = service.filterComment(rbacTarget{}, "darn heck")
+	if body != "**** heck" || hold {
+		t.Errorf("Only global policy expected: %q %v", body, hold)
+	}
+	if stub.queries != 2 {
+		t.Errorf("Policies should be cached, %d queries", stub.queries)
+	}
+
+	// other instance changed the global policy
+	stub.policies[rbacScopeGlobal] = nil
+	service.onMessage(mqMessage{Operation: mqContentPolicy, Argument: rbacScopeGlobal})
+	body, _, _ = service.filterComment(rbacTarget{}, "darn")
+	if body != "darn" {
+		t.Errorf("Policy should be reloaded, got %q", body)
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+)
+
+// Attributes that every cookie set by the server gets. cDiscuss is embedded on third-party pages,
+// so by default cookies have to be sent in cross-site requests, which browsers allow only for
+// SameSite=None cookies that are also Secure.
+type cookiePolicy struct {
+	path     string
+	domain   string
+	secure   bool
+	sameSite http.SameSite
+}
+
+var defaultCookiePolicy = cookiePolicy{path: "/", secure: true, sameSite: http.SameSiteNoneMode}
+
+func newCookiePolicy(path string, domain string, secure bool, sameSite http.SameSite) (cookiePolicy, error) {
+	if path == "" {
+		return cookiePolicy{}, errors.New("bad path value")
+	}
+	if sameSite == http.SameSiteNoneMode && !secure {
+		return cookiePolicy{}, errors.New("bad sameSite value, SameSite=None cookies must be secure")
+	}
+	return cookiePolicy{path: path, domain: domain, secure: secure, sameSite: sameSite}, nil
+}
+
+// cookies carrying credentials are not readable from JS, see newReadableCookie for the rest
+func (policy cookiePolicy) newCookie(name string, value string, expires time.Time) *http.Cookie {
+	return &http.Cookie{Name: name, Value: value, Expires: expires, Path: policy.path, Domain: policy.domain,
+		Secure: policy.secure, HttpOnly: true, SameSite: policy.sameSite}
+}
+
+// for values the embed has to read, e.g. double-submit CSRF token
+func (policy cookiePolicy) newReadableCookie(name string, value string, expires time.Time) *http.Cookie {
+	cookie := policy.newCookie(name, value, expires)
+	cookie.HttpOnly = false
+	return cookie
+}
+
+func (policy cookiePolicy) newExpiredCookie(name string) *http.Cookie {
+	cookie := policy.newCookie(name, "", time.Unix(0, 0))
+	cookie.MaxAge = -1
+	return cookie
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// Requests that carry an Origin header are checked against the configured allow-list and, for requests
+// scoped to a site, the origins of that site. Requests without it (older browsers, privacy extensions)
+// need the double-submit token.
+type csrfGuard struct {
+	allowedOrigins map[string]bool
+	siteRegistry   siteRegistryItf // optional, origins of the site for protectSite
+	cookiePolicy   cookiePolicy
+}
+
+func newCsrfGuard(allowedOrigins []string, siteRegistry siteRegistryItf, cookiePolicy cookiePolicy) (*csrfGuard, error) {
+	guard := csrfGuard{allowedOrigins: make(map[string]bool), siteRegistry: siteRegistry, cookiePolicy: cookiePolicy}
+	for _, origin := range allowedOrigins {
+		normalized := normalizeOrigin(origin)
+		if normalized == "" {
+			return nil, errors.New("bad allowedOrigins value")
+		}
+		guard.allowedOrigins[normalized] = true
+	}
+	return &guard, nil
+}
+
+// idSite 0 accepts only configured origins, one site can't forge requests to other sites or global endpoints
+func (guard *csrfGuard) isOriginAllowed(origin string, idSite int64) bool {
+	normalized := normalizeOrigin(origin)
+	if normalized == "" {
+		return false
+	}
+	if guard.allowedOrigins[normalized] {
+		return true
+	}
+	if idSite <= 0 || guard.siteRegistry == nil {
+		return false
+	}
+	allowed, err := guard.siteRegistry.isOriginAllowedForSite(idSite, normalized)
+	if err != nil {
+		slog.Error("Checking origin of site failed", slog.Int64("idSite", idSite), slog.String("origin", normalized), slog.Any("error", err))
+		return false
+	}
+	return allowed
+}
+
+func (guard *csrfGuard) checkRequest(r *http.Request) error {
+	return guard.checkRequestOfSite(r, 0)
+}
+
+func (guard *csrfGuard) checkRequestOfSite(r *http.Request, idSite int64) error {
+	if isSafeHttpMethod(r.Method) {
+		return nil
+	}
+	// bearer tokens are not sent by the browser on its own, so they can't be forged cross-site
+	if _, err := newApiTokenCredential(r.Header.Get("Authorization")); err == nil {
+		return nil
+	}
+
+	origin := r.Header.Get("Origin")
+	if origin != "" && origin != "null" {
+		if !guard.isOriginAllowed(origin, idSite) {
+			return errCsrfOriginNotAllowed
+		}
+		return nil
+	}
+
+	cookie, err := r.Cookie(csrfCookieName)
+	if err != nil {
+		return errCsrfTokenNotValid
+	}
+	if !isCsrfTokenMatching(cookie.Value, r.Header.Get(csrfHeaderName)) {
+		return errCsrfTokenNotValid
+	}
+	return nil
+}
+
+func (guard *csrfGuard) newTokenCookie() (*http.Cookie, string, error) {
+	token, err := generateCsrfToken()
+	if err != nil {
+		return nil, "", err
+	}
+	return guard.cookiePolicy.newReadableCookie(csrfCookieName, token, time.Now().Add(seassionExpiresAge)), token, nil
+}
+
+func (guard *csrfGuard) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := guard.checkRequest(r)
+		if err != nil {
+			writeGuardError(w, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (guard *csrfGuard) protectSite(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		idSite, found, err := parseRequestSiteId(r)
+		if err == nil {
+			// without the site only configured origins are trusted, like siteCorsGuard
+			err = guard.checkRequestOfSite(r, idSite)
+		}
+		if err != nil {
+			writeGuardError(w, err)
+			return
+		}
+		if !found {
+			idSite = defaultSiteId
+		}
+		next.ServeHTTP(w, withRequestSiteId(r, idSite))
+	})
+}
+
+// guard errors are always validation errors
+func writeGuardError(w http.ResponseWriter, err error) {
+	var errHttp errWithHttpStatus
+	if !errors.As(err, &errHttp) {
+		errHttp = errInternalServer
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(errHttp.getHttpStatus())
+	err = json.NewEncoder(w).Encode(newErrorDTO(errHttp))
+	if err != nil {
+		slog.Error("Failed to write guard error response", slog.Any("error", err))
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	csrfCookieName     string = "CDCSRF"
+	csrfHeaderName     string = "X-CSRF-Token"
+	csrfTokenRandomLen int    = 32
+)
+
+// Must guard every session-authenticated write: createComment, deleteComment, modifyPassword and
+// all admin calls. This module has no HTTP handlers yet, so nothing applies it: the HTTP layer has to
+// wrap global and account handlers with protect and the embed handlers with protectSite (after
+// siteCorsGuard.protect). Embed handlers must take the site from requestSiteId.
+type csrfGuardItf interface {
+	// only configured origins are accepted
+	checkRequest(r *http.Request) error
+	// cookie is readable by the embed, which repeats it in csrfHeaderName. Token is also returned so it
+	// can be passed to embeds that can't read the cookie (third-party cookies blocked).
+	newTokenCookie() (*http.Cookie, string, error)
+	protect(next http.Handler) http.Handler
+	// also accepts origins of the site the request is scoped to
+	protectSite(next http.Handler) http.Handler
+}
+
+func generateCsrfToken() (string, error) {
+	b := make([]byte, csrfTokenRandomLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func isSafeHttpMethod(method string) bool {
+	return method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions
+}
+
+// returns scheme://host[:port] in lower case, or "" when it's not a valid origin
+func normalizeOrigin(origin string) string {
+	parsed, err := url.Parse(strings.TrimSpace(origin))
+	if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+		return ""
+	}
+	if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		return ""
+	}
+	return strings.ToLower(parsed.Scheme + "://" + parsed.Host)
+}
+
+// double-submit check, the header must repeat the value of the CSRF cookie
+func isCsrfTokenMatching(cookieToken string, headerToken string) bool {
+	if cookieToken == "" || headerToken == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) == 1
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+func TestCsrfGuardCheckRequest(t *testing.T) {
+	guard, err := newCsrfGuard([]string{"https://Blog.Example.com/"}, nil, defaultCookiePolicy)
+	if err != nil {
+		t.Fatalf("CSRF guard creation error: %v", err)
+	}
+	cookie, token, err := guard.newTokenCookie()
+	if err != nil {
+		t.Fatalf("CSRF token creation error: %v", err)
+	}
+	if cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteNoneMode {
+		t.Errorf("Wrong CSRF cookie attributes: %v", cookie)
+	}
+
+	tests := []struct {
+		name        string
+		method      string
+		origin      string
+		withCookie  bool
+		headerToken string
+		expectedErr error
+	}{
+		{"safe method", http.MethodGet, "https://evil.example.org", false, "", nil},
+		{"allowed origin", http.MethodPost, "https://blog.example.com", false, "", nil},
+		{"foreign origin", http.MethodPost, "https://evil.example.org", true, token, errCsrfOriginNotAllowed},
+		{"no origin, matching token", http.MethodPost, "", true, token, nil},
+		{"no origin, wrong token", http.MethodDelete, "", true, "wrong", errCsrfTokenNotValid},
+		{"null origin, no cookie", http.MethodPost, "null", false, token, errCsrfTokenNotValid},
+	}
+	for _, test := range tests {
+		r := httptest.NewRequest(test.method, "/comments", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.withCookie {
+			r.AddCookie(cookie)
+		}
+		if test.headerToken != "" {
+			r.Header.Set(csrfHeaderName, test.headerToken)
+		}
+		err = guard.checkRequest(r)
+		if !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expectedErr, err)
+		}
+	}
+}
+
+func TestCsrfGuardProtect(t *testing.T) {
+	guard, err := newCsrfGuard([]string{"https://blog.example.com"}, nil, defaultCookiePolicy)
+	if err != nil {
+		t.Fatalf("CSRF guard creation error: %v", err)
+	}
+	handler := guard.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	r := httptest.NewRequest(http.MethodPost, "/comments", nil)
+	r.Header.Set("Origin", "https://evil.example.org")
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Foreign origin not rejected, status %d", w.Code)
+	}
+}
+
+func TestCsrfGuardSiteOrigins(t *testing.T) {
+	registry := &stubSiteRegistry{origins: map[int64][]string{1: {"https://a.example.com"}, 2: {"https://b.example.com"}}}
+	guard, err := newCsrfGuard([]string{"https://cdiscuss.example.com"}, registry, defaultCookiePolicy)
+	if err != nil {
+		t.Fatalf("CSRF guard creation error: %v", err)
+	}
+	var handledSite int64
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handledSite, _ = requestSiteId(r)
+		w.WriteHeader(http.StatusNoContent)
+	})
+
+	tests := []struct {
+		name           string
+		siteScoped     bool
+		origin         string
+		site           string
+		expectedStatus int
+	}{
+		{"configured origin on global endpoint", false, "https://cdiscuss.example.com", "", http.StatusNoContent},
+		{"site origin on global endpoint", false, "https://a.example.com", "1", http.StatusForbidden},
+		{"site origin on its site", true, "https://a.example.com", "1", http.StatusNoContent},
+		{"site origin on other site", true, "https://b.example.com", "1", http.StatusForbidden},
+		{"site origin without site", true, "https://a.example.com", "", http.StatusForbidden},
+	}
+	for _, test := range tests {
+		handler := guard.protect(next)
+		if test.siteScoped {
+			handler = guard.protectSite(next)
+		}
+		r := httptest.NewRequest(http.MethodPost, "/comments", nil)
+		r.Header.Set("Origin", test.origin)
+		if test.site != "" {
+			r.Header.Set(siteIdHeaderName, test.site)
+		}
+		handledSite = 0
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatus {
+			t.Errorf("%s: got status %d want %d", test.name, w.Code, test.expectedStatus)
+		}
+		if test.siteScoped && w.Code == http.StatusNoContent && strconv.FormatInt(handledSite, 10) != test.site {
+			t.Errorf("%s: handler got site %d", test.name, handledSite)
+		}
+	}
+}
+
+func TestNewCookiePolicy(t *testing.T) {
+	_, err := newCookiePolicy("/", "", false, http.SameSiteNoneMode)
+	if err == nil {
+		t.Errorf("SameSite=None without Secure should be rejected")
+	}
+}
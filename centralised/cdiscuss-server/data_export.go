@@ -0,0 +1,109 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"time"
+)
+
+const (
+	dataExportJsonFileName string = "cdiscuss-data.json"
+	dataExportHtmlFileName string = "cdiscuss-data.html"
+)
+
+type personalDataComment struct {
+	Id          int64     `json:"id"`
+	IdParent    *int64    `json:"idParent"`
+	UrlHash     string    `json:"urlHash"`
+	DtCreated   time.Time `json:"dtCreated"`
+	CommentBody string    `json:"commentBody"`
+}
+
+type personalDataExternalIdentity struct {
+	Issuer    string    `json:"issuer"`
+	Subject   string    `json:"subject"`
+	DtCreated time.Time `json:"dtCreated"`
+}
+
+// everything that is stored about the user, secrets (password hash, token hashes, TOTP secret) are left out
+type personalData struct {
+	DtExported         time.Time                      `json:"dtExported"`
+	Profile            userProfile                    `json:"profile"`
+	Email              string                         `json:"email"`
+	AdminRole          bool                           `json:"adminRole"`
+	TwoFactorEnabled   bool                           `json:"twoFactorEnabled"`
+	UsernameHistory    []usernameHistoryEntry         `json:"usernameHistory"`
+	Comments           []personalDataComment          `json:"comments"`
+	Sessions           []sessionInfo                  `json:"sessions"`
+	Passkeys           []passkeyInfo                  `json:"passkeys"`
+	ApiTokens          []apiTokenInfo                 `json:"apiTokens"`
+	ExternalIdentities []personalDataExternalIdentity `json:"externalIdentities"`
+}
+
+var personalDataHtmlTemplate = template.Must(template.New("export").Parse(`<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>cDiscuss data of {{.Profile.Username}}</title></head>
+<body>
+<h1>cDiscuss data of {{.Profile.Username}}</h1>
+<p>Exported {{.DtExported.Format "2006-01-02 15:04:05 MST"}}</p>
+<h2>Profile</h2>
+<ul>
+<li>Username: {{.Profile.Username}}</li>
+<li>Display name: {{.Profile.DisplayName}}</li>
+<li>Bio: {{.Profile.Bio}}</li>
+<li>Website: {{.Profile.Website}}</li>
+<li>Email: {{.Email}}</li>
+<li>Admin: {{.AdminRole}}</li>
+<li>Two-factor authentication: {{.TwoFactorEnabled}}</li>
+</ul>
+<h2>Previous usernames</h2>
+<ul>{{range .UsernameHistory}}<li>{{.Username}} (until {{.DtChanged.Format "2006-01-02"}})</li>{{end}}</ul>
+<h2>Comments ({{len .Comments}})</h2>
+{{range .Comments}}<article><p><small>{{.DtCreated.Format "2006-01-02 15:04"}}, page {{.UrlHash}}</small></p><p>{{.CommentBody}}</p></article>
+{{end}}
+<h2>Sessions</h2>
+<ul>{{range .Sessions}}<li>{{.DtCreated.Format "2006-01-02 15:04"}}, last seen {{.DtLastSeen.Format "2006-01-02 15:04"}}, {{.IP}}, {{.UserAgent}}</li>{{end}}</ul>
+<h2>Passkeys</h2>
+<ul>{{range .Passkeys}}<li>{{.Name}}, created {{.DtCreated.Format "2006-01-02"}}</li>{{end}}</ul>
+<h2>API tokens</h2>
+<ul>{{range .ApiTokens}}<li>{{.Name}} {{.Scopes}}, created {{.DtCreated.Format "2006-01-02"}}</li>{{end}}</ul>
+<h2>Linked external accounts</h2>
+<ul>{{range .ExternalIdentities}}<li>{{.Issuer}} {{.Subject}}</li>{{end}}</ul>
+</body></html>
+`))
+
+// zip with JSON and optionally human readable HTML
+func buildPersonalDataArchive(data *personalData, includeHtml bool) ([]byte, error) {
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+
+	jsonFile, err := archive.Create(dataExportJsonFileName)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create export archive: %w", err)
+	}
+	encoder := json.NewEncoder(jsonFile)
+	encoder.SetIndent("", "  ")
+	err = encoder.Encode(data)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to write export JSON: %w", err)
+	}
+
+	if includeHtml {
+		htmlFile, err := archive.Create(dataExportHtmlFileName)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to create export archive: %w", err)
+		}
+		err = personalDataHtmlTemplate.Execute(htmlFile, data)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to write export HTML: %w", err)
+		}
+	}
+
+	err = archive.Close()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to close export archive: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type dataExportService struct {
+	userService     userServiceItf
+	databaseService databaseServiceItf // export reads from all parts of the database
+	rateLimiter     rateLimiterItf
+
+	stopWorkerChan              chan bool
+	wakeWorkerChan              chan bool
+	pollTicker                  *time.Ticker
+	deleteOutdatedExportsTicker *time.Ticker
+}
+
+func newDataExportService(userService userServiceItf, databaseService databaseServiceItf, rateLimiter rateLimiterItf,
+	pollPeriod time.Duration, deleteOutdatedExportsPeriod time.Duration) (*dataExportService, error) {
+	if databaseService == nil {
+		return nil, errors.New("data export service needs database")
+	}
+	if pollPeriod < 1 {
+		return nil, errors.New("bad pollPeriod value")
+	}
+	if deleteOutdatedExportsPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedExportsPeriod value")
+	}
+
+	service := &dataExportService{userService: userService, databaseService: databaseService, rateLimiter: rateLimiter}
+	service.stopWorkerChan = make(chan bool)
+	service.wakeWorkerChan = make(chan bool, 1)
+	service.pollTicker = time.NewTicker(pollPeriod)
+	service.deleteOutdatedExportsTicker = time.NewTicker(deleteOutdatedExportsPeriod)
+
+	go service.exportLoopWorker()
+
+	return service, nil
+}
+
+// polling picks up jobs requested on other instances and jobs left behind by crashed instances
+func (service *dataExportService) exportLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.wakeWorkerChan:
+			service.processPendingExports()
+		case <-service.pollTicker.C:
+			service.processPendingExports()
+		case <-service.deleteOutdatedExportsTicker.C:
+			err := service.databaseService.deleteDataExportsThatExpired(time.Now())
+			if err != nil {
+				slog.Error("Deleting outdated data exports from DB:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *dataExportService) stop() {
+	service.pollTicker.Stop()
+	service.deleteOutdatedExportsTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop dataExportService instance")
+	}
+}
+
+func (service *dataExportService) processPendingExports() {
+	for {
+		now := time.Now()
+		job, err := service.databaseService.claimDataExport(now, now.Add(-dataExportRunningMaxAge))
+		if err != nil {
+			slog.Error("Claiming data export:", slog.Any("error", err))
+			return
+		}
+		if job == nil {
+			return
+		}
+
+		archive, err := service.exportPersonalData(job.idUser, job.includeHtml)
+		now = time.Now()
+		if err != nil {
+			slog.Error("Data export failed", slog.Int64("id", job.id), slog.Int64("idUser", job.idUser), slog.Any("error", err))
+			err = service.databaseService.failDataExport(job.id, now, now.Add(dataExportAge))
+		} else {
+			err = service.databaseService.finishDataExport(job.id, archive, now, now.Add(dataExportAge))
+		}
+		if err != nil {
+			slog.Error("Storing data export result:", slog.Int64("id", job.id), slog.Any("error", err))
+		}
+	}
+}
+
+func (service *dataExportService) collectPersonalData(idUser int64) (*personalData, error) {
+	db := service.databaseService
+
+	user, err := db.getUser(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data := &personalData{DtExported: time.Now(), AdminRole: user.AdminRole, TwoFactorEnabled: user.TwoFactorEnabled}
+
+	profile, err := db.getUserProfile(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.Profile = *profile
+	data.Email, err = db.getUserEmail(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.UsernameHistory, err = db.listUsernameHistory(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.Comments, err = db.listUserComments(idUser)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions, err := db.listSessionsForUser(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.Sessions = make([]sessionInfo, 0, len(sessions))
+	for _, session := range sessions {
+		data.Sessions = append(data.Sessions, newSessionDataContainer(&session).toSessionInfo(false))
+	}
+
+	passkeys, err := db.listPasskeyCredentials(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.Passkeys = make([]passkeyInfo, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		data.Passkeys = append(data.Passkeys, passkeyInfo{Id: passkey.id, Name: passkey.name, DtCreated: passkey.dtCreated, DtLastUsed: passkey.dtLastUsed})
+	}
+
+	apiTokens, err := db.listApiTokensForUser(idUser)
+	if err != nil {
+		return nil, err
+	}
+	data.ApiTokens = make([]apiTokenInfo, 0, len(apiTokens))
+	for _, token := range apiTokens {
+		data.ApiTokens = append(data.ApiTokens, apiTokenInfo{Id: token.id, Name: token.name, Scopes: token.scopes, DtCreated: token.dtCreated,
+			DtLastUsed: token.dtLastUsed})
+	}
+
+	data.ExternalIdentities, err = db.listExternalIdentities(idUser)
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+func (service *dataExportService) exportPersonalData(idUser int64, includeHtml bool) ([]byte, error) {
+	data, err := service.collectPersonalData(idUser)
+	if err != nil {
+		return nil, err
+	}
+	return buildPersonalDataArchive(data, includeHtml)
+}
+
+func newDataExportInfo(job dataExportJob) dataExportInfo {
+	return dataExportInfo{Id: job.id, Status: job.status, IncludeHtml: job.includeHtml, DtRequested: job.dtRequested,
+		DtFinished: job.dtFinished, DtExpires: job.dtExpires}
+}
+
+func (service *dataExportService) requestDataExport(sessionCookie *http.Cookie, includeHtml bool) (*dataExportInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	// unfinished export is refused before the allowance is used, unique index in database covers concurrent requests
+	jobs, err := service.databaseService.listDataExports(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	for _, job := range jobs {
+		if job.status == dataExportStatusPending || job.status == dataExportStatusRunning {
+			return nil, errDataExportPending
+		}
+	}
+
+	if service.rateLimiter != nil {
+		err = service.rateLimiter.allow(rateLimitOpDataExport, rateLimitKeys{idUser: &user.Id})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	job, err := service.databaseService.createDataExport(user.Id, includeHtml, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case service.wakeWorkerChan <- true:
+	default: // worker is already woken up
+	}
+
+	info := newDataExportInfo(*job)
+	return &info, nil
+}
+
+func (service *dataExportService) listDataExports(sessionCookie *http.Cookie) ([]dataExportInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	jobs, err := service.databaseService.listDataExports(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]dataExportInfo, 0, len(jobs))
+	for _, job := range jobs {
+		infos = append(infos, newDataExportInfo(job))
+	}
+	return infos, nil
+}
+
+func (service *dataExportService) downloadDataExport(sessionCookie *http.Cookie, id int64) ([]byte, string, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, "", err
+	}
+
+	job, err := service.databaseService.getDataExportArchive(id, user.Id)
+	if err != nil {
+		return nil, "", err
+	}
+	if job == nil || (job.dtExpires != nil && isExpired(time.Now(), *job.dtExpires)) {
+		return nil, "", errDataExportDoesntExist
+	}
+
+	fileName := fmt.Sprintf("cdiscuss-%s-%s.zip", user.Username, job.dtRequested.Format("20060102"))
+	return job.archive, fileName, nil
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	dataExportStatusPending string        = "pending"
+	dataExportStatusRunning string        = "running"
+	dataExportStatusReady   string        = "ready"
+	dataExportStatusFailed  string        = "failed"
+	dataExportAge           time.Duration = 7 * 24 * time.Hour // ready archive can be downloaded this long
+	dataExportRunningMaxAge time.Duration = time.Hour          // stuck job (crashed instance) is retried after
+	dataExportPollPeriod    time.Duration = 10 * time.Second
+)
+
+type dataExportInfo struct {
+	Id          int64      `json:"id"`
+	Status      string     `json:"status"`
+	IncludeHtml bool       `json:"includeHtml"`
+	DtRequested time.Time  `json:"dtRequested"`
+	DtFinished  *time.Time `json:"dtFinished"`
+	DtExpires   *time.Time `json:"dtExpires"`
+}
+
+type dataExportServiceItf interface {
+	// archive is built in background, status can be polled with listDataExports
+	requestDataExport(sessionCookie *http.Cookie, includeHtml bool) (*dataExportInfo, error)
+	listDataExports(sessionCookie *http.Cookie) ([]dataExportInfo, error)
+	// returns zip archive and file name
+	downloadDataExport(sessionCookie *http.Cookie, id int64) ([]byte, string, error)
+	// synchronous, for admin CLI
+	exportPersonalData(idUser int64, includeHtml bool) ([]byte, error)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildPersonalDataArchive(t *testing.T) {
+	data := &personalData{DtExported: time.Now(), Profile: userProfile{IdUser: 7, Username: "adam"},
+		Comments: []personalDataComment{{Id: 1, UrlHash: "abc", CommentBody: "<script>alert(1)</script>"}}}
+
+	archive, err := buildPersonalDataArchive(data, true)
+	if err != nil {
+		t.Fatalf("Archive error: %v", err)
+	}
+	reader, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		t.Fatalf("Archive is not zip: %v", err)
+	}
+
+	files := make(map[string]string)
+	for _, file := range reader.File {
+		rc, err := file.Open()
+		if err != nil {
+			t.Fatalf("Archive file error: %v", err)
+		}
+		content, _ := io.ReadAll(rc)
+		rc.Close()
+		files[file.Name] = string(content)
+	}
+
+	var decoded personalData
+	if err = json.Unmarshal([]byte(files[dataExportJsonFileName]), &decoded); err != nil || decoded.Profile.Username != "adam" {
+		t.Errorf("Wrong JSON in archive: %v", err)
+	}
+	html := files[dataExportHtmlFileName]
+	if !strings.Contains(html, "adam") || strings.Contains(html, "<script>") {
+		t.Errorf("HTML missing or not escaped: %s", html)
+	}
+
+	archive, _ = buildPersonalDataArchive(data, false)
+	reader, _ = zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if len(reader.File) != 1 {
+		t.Errorf("HTML should be optional")
+	}
+}
+
+type dataExportDbStub struct {
+	databaseServiceItf // only methods below are used
+	jobs               []dataExportJob
+}
+
+func (stub *dataExportDbStub) listDataExports(idUser int64) ([]dataExportJob, error) {
+	return stub.jobs, nil
+}
+
+func (stub *dataExportDbStub) createDataExport(idUser int64, includeHtml bool, now time.Time) (*dataExportJob, error) {
+	job := dataExportJob{id: int64(len(stub.jobs) + 1), idUser: idUser, status: dataExportStatusPending, includeHtml: includeHtml, dtRequested: now}
+	stub.jobs = append(stub.jobs, job)
+	return &job, nil
+}
+
+type dataExportUserStub struct {
+	userServiceItf // only methods below are used
+}
+
+func (stub *dataExportUserStub) getSessionUser(sessionCookie *http.Cookie) (*user, error) {
+	return &user{Id: 7, Username: "adam"}, nil
+}
+
+func TestRequestDataExport(t *testing.T) {
+	rateLimiter, err := newRateLimiter(nil, defaultRateLimitPolicies, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rateLimiter.stop()
+	db := &dataExportDbStub{}
+	service := &dataExportService{userService: &dataExportUserStub{}, databaseService: db, rateLimiter: rateLimiter,
+		wakeWorkerChan: make(chan bool, 1)}
+	sessionCookie := &http.Cookie{Name: sessionCookieName, Value: "adam"}
+
+	if _, err := service.requestDataExport(sessionCookie, false); err != nil {
+		t.Fatalf("Request failed: %v", err)
+	}
+	for _, status := range []string{dataExportStatusPending, dataExportStatusRunning} {
+		db.jobs[0].status = status
+		if _, err := service.requestDataExport(sessionCookie, false); !errors.Is(err, errDataExportPending) {
+			t.Errorf("%s export should block new requests: %v", status, err)
+		}
+	}
+
+	// refused requests don't use the allowance, finished exports do
+	db.jobs[0].status = dataExportStatusReady
+	if _, err := service.requestDataExport(sessionCookie, true); err != nil {
+		t.Fatalf("Second request failed: %v", err)
+	}
+	db.jobs[1].status = dataExportStatusFailed
+	var rateLimitErr rateLimitError
+	if _, err := service.requestDataExport(sessionCookie, false); !errors.As(err, &rateLimitErr) {
+		t.Errorf("Third export in a day should be rate limited: %v", err)
+	}
+	if len(db.jobs) != 2 {
+		t.Errorf("Refused requests created exports: %d", len(db.jobs))
+	}
+}
@@ -9,12 +9,14 @@ import (
 
 type comment struct {
 	Id          int64     `json: id`
+	IdSite      int64     `json:"idSite"`
 	IdRoot      *int64    `json: idRoot`
 	IdParent    *int64    `json: idParent`
 	UrlHash     string    `json: urlHash`
 	IdUser      int64     `json: idUser`
 	DtCreated   time.Time `json: dtCreated`
 	CommentBody string    `json: commentBody`
+	Status      string    `json:"status"` // commentStatus* constants
 }
 
 type pageComments struct {
@@ -23,6 +25,7 @@ type pageComments struct {
 	Count          uint64                  `json: count`
 	Total          uint64                  `json: total`
 	Comments       []commentJoinedWithUser `json: comments`
+	Discussion     pageDiscussionState     `json:"discussion"`
 }
 
 type commentJoinedWithUser struct {
@@ -32,21 +35,33 @@ type commentJoinedWithUser struct {
 	ParentComment *commentJoinedWithUser `json: parentComment`
 	IdUser        int64                  `json: idUser`
 	Username      string                 `json: username`
+	DisplayName   string                 `json:"displayName"`
+	AvatarUrl     string                 `json:"avatarUrl"`
 	DtCreated     time.Time              `json: dtCreated`
 	CommentBody   string                 `json: commentBody`
+	Status        string                 `json:"status"`
 }
 
 type databaseServiceCommentItf interface {
-	listPageComments(urlHash string, offset uint64, count uint64) (*pageComments, error)
+	// pending and shadow comments are listed only for their author (idViewer) and with showAllPending for moderators,
+	// the author sees own shadow comments as visible
+	listPageComments(idSite int64, urlHash string, offset uint64, count uint64, idViewer int64, showAllPending bool) (*pageComments, error)
 	getComment(id int64) (*comment, error)
-	createComment(idParent *int64, urlHash string, idUser int64, dtCreated time.Time, commentBody string) (int64, error)
-	deleteComment(id, idUser int64, adminRole bool) error
+	// status is commentStatusVisible or commentStatusPending. Parent must be visible or own pending or shadow comment.
+	// Comment of shadow-banned author is stored as commentStatusShadow, status is restored when the shadow-ban ends.
+	createComment(idSite int64, idParent *int64, urlHash string, idUser int64, dtCreated time.Time, commentBody string, status string,
+		shadow bool) (int64, error)
+	// without moderate only own comment is deleted
+	deleteComment(id, idUser int64, moderate bool) error
 }
 
 type user struct {
-	Id        int64  `json: id`
-	Username  string `json: username`
-	AdminRole bool   `json: adminRole`
+	Id               int64  `json: id`
+	Username         string `json: username`
+	AdminRole        bool   `json: adminRole`
+	TwoFactorEnabled bool   `json:"twoFactorEnabled"`
+
+	apiTokenScopes []string // nil for sessions, set when the request is authenticated with API token
 }
 
 type databaseServiceUserItf interface {
@@ -57,6 +72,25 @@ type databaseServiceUserItf interface {
 	getUser(id int64) (*user, error)
 	getUserByUsername(username string) (*user, error)
 	deleteUser(id int64) error
+	// sets password without knowing the old one, used by password reset
+	setUserPassword(id int64, newPassword string) error
+	// empty email removes it
+	setUserEmail(id int64, email string) error
+	// returns empty string if user has no email
+	getUserEmail(id int64) (string, error)
+	// errUserAlreadyExists, errUsernameReserved or errUsernameUnchanged if the user can't take the username now
+	checkUsernameAvailable(id int64, username string, now time.Time) error
+	// old username goes to history and can't be taken by others before dtReclaimable
+	changeUsername(id int64, newUsername string, now time.Time, dtReclaimable time.Time) error
+	listUsernameHistory(id int64) ([]usernameHistoryEntry, error)
+	// returns nil if the username was never used
+	getUserByPreviousUsername(username string) (*user, error)
+}
+
+type usernameHistoryEntry struct {
+	Username      string    `json:"username"`
+	DtChanged     time.Time `json:"dtChanged"`
+	DtReclaimable time.Time `json:"dtReclaimable"`
 }
 
 func generateSalt() string {
@@ -82,12 +116,312 @@ type databaseServiceProofOfWorkItf interface {
 	deletePowTokensThatExpired(now time.Time) error
 }
 
+type sessionRecord struct {
+	id         int64
+	tokenHash  string
+	user       *user
+	dtCreated  time.Time // login time, kept when token is rotated
+	dtIssued   time.Time // token creation time
+	dtLastSeen time.Time
+	dtExpires  time.Time
+	userAgent  string
+	ip         string
+	rotated    bool
+}
+
+type sessionRenewal struct {
+	tokenHash  string
+	dtExpires  time.Time
+	dtLastSeen time.Time
+}
+
 type databaseServiceSessionItf interface {
-	getSession(tokenHash string) (*time.Time, *user, error)
-	createSession(tokenHash string, idUser int64, dtExpires time.Time) error
+	getSession(tokenHash string) (*sessionRecord, error)
+	// returns id of the new session
+	createSession(session sessionRecord) (int64, error)
+	listSessionsForUser(idUser int64) ([]sessionRecord, error)
+	// expiry times only move forward and rotated sessions are not renewed
+	renewSessions(renewals []sessionRenewal) error
+	markSessionRotated(tokenHash string, dtExpires time.Time) error
 	deleteSession(tokenHash string) error
+	// returns token hash of deleted session or empty string if it didn't exist
+	deleteSessionById(id int64, idUser int64) (string, error)
 	deleteSessionsThatExpired(now time.Time) error
 	deleteSessionsForUser(idUser int64) error
+	deleteSessionsForUserExcept(idUser int64, keepTokenHash string) error
+}
+
+type databaseServiceRateLimitItf interface {
+	takeRateLimitToken(bucketKey string, policy rateLimitPolicy, now time.Time) (bool, time.Duration, error)
+	deleteRateLimitBucketsUpdatedBefore(before time.Time) error
+}
+
+type databaseServiceLoginGuardItf interface {
+	getLoginFailures(failureKey string) (*loginFailures, error)
+	// failures last registered before forgetBefore are reset before counting the new one
+	registerLoginFailure(failureKey string, now time.Time, forgetBefore time.Time) (*loginFailures, error)
+	deleteLoginFailures(failureKey string) error
+	deleteLoginFailuresBefore(before time.Time) error
+}
+
+type userTotp struct {
+	secret      string
+	enabled     bool
+	lastCounter int64
+}
+
+type databaseServiceTwoFactorItf interface {
+	setUserTotpSecret(idUser int64, secret string) error
+	getUserTotp(idUser int64) (*userTotp, error)
+	enableUserTotp(idUser int64, lastCounter int64, recoveryCodeHashes []string) error
+	disableUserTotp(idUser int64) error
+	// returns false if counter is not greater than the stored one (code was already used)
+	updateUserTotpLastCounter(idUser int64, counter int64) (bool, error)
+	replaceRecoveryCodes(idUser int64, recoveryCodeHashes []string) error
+	// deletes the code and returns true if it existed
+	useRecoveryCode(idUser int64, codeHash string) (bool, error)
+	createTwoFactorTicket(ticketHash string, idUser int64, dtExpires time.Time) error
+	getTwoFactorTicket(ticketHash string) (*time.Time, *user, error)
+	deleteTwoFactorTicket(ticketHash string) error
+	deleteTwoFactorTicketsThatExpired(now time.Time) error
+}
+
+type passkeyCredential struct {
+	id           int64
+	idUser       int64
+	credentialId []byte
+	publicKey    []byte // COSE key
+	signCount    uint32
+	name         string
+	dtCreated    time.Time
+	dtLastUsed   *time.Time
+}
+
+type databaseServicePasskeyItf interface {
+	createWebauthnChallenge(challengeHash string, kind string, idUser *int64, dtExpires time.Time) error
+	// deletes the challenge and returns if it was found
+	takeWebauthnChallenge(challengeHash string, kind string) (bool, *int64, time.Time, error)
+	deleteWebauthnChallengesThatExpired(now time.Time) error
+	createPasskeyCredential(credential passkeyCredential) (int64, error)
+	// returns nil if credential doesn't exist
+	getPasskeyCredential(credentialId []byte) (*passkeyCredential, error)
+	listPasskeyCredentials(idUser int64) ([]passkeyCredential, error)
+	updatePasskeyCredentialUse(id int64, signCount uint32, dtLastUsed time.Time) error
+	deletePasskeyCredential(id int64, idUser int64) error
+}
+
+type apiTokenRecord struct {
+	id         int64
+	user       *user
+	tokenHash  string
+	name       string
+	scopes     []string
+	dtCreated  time.Time
+	dtLastUsed *time.Time
+}
+
+type databaseServiceApiTokenItf interface {
+	createApiToken(token apiTokenRecord) (int64, error)
+	// returns nil if token doesn't exist
+	getApiToken(tokenHash string) (*apiTokenRecord, error)
+	listApiTokensForUser(idUser int64) ([]apiTokenRecord, error)
+	// returns hash of the deleted token, errApiTokenDoesntExist if the user has no such token
+	deleteApiToken(id int64, idUser int64) (string, error)
+	updateApiTokenLastUsed(tokenHash string, dtLastUsed time.Time) error
+}
+
+type oidcAuthRequest struct {
+	stateHash    string
+	nonce        string
+	codeVerifier string
+	idUser       *int64 // set when linking to logged in user
+	dtExpires    time.Time
+}
+
+type databaseServiceOidcItf interface {
+	createOidcAuthRequest(request oidcAuthRequest) error
+	// deletes the request and returns it, nil if it doesn't exist
+	takeOidcAuthRequest(stateHash string) (*oidcAuthRequest, error)
+	deleteOidcAuthRequestsThatExpired(now time.Time) error
+	// returns nil if the subject is not linked
+	getUserByExternalIdentity(issuer string, subject string) (*user, error)
+	// errOidcIdentityTaken if the subject is already linked
+	linkExternalIdentity(idUser int64, issuer string, subject string) error
+	// creates user and links the subject in one transaction
+	createUserWithExternalIdentity(username string, password string, issuer string, subject string) (*user, error)
+}
+
+type passwordResetToken struct {
+	tokenHash string
+	idUser    int64
+	dtExpires time.Time
+}
+
+type databaseServicePasswordResetItf interface {
+	createPasswordResetToken(token passwordResetToken) error
+	// deletes the token and returns it, nil if it doesn't exist
+	takePasswordResetToken(tokenHash string) (*passwordResetToken, error)
+	deletePasswordResetTokensForUser(idUser int64) error
+	deletePasswordResetTokensThatExpired(now time.Time) error
+}
+
+type userProfile struct {
+	IdUser      int64  `json:"idUser"`
+	Username    string `json:"username"`
+	DisplayName string `json:"displayName"`
+	Bio         string `json:"bio"`
+	Website     string `json:"website"`
+	AvatarUrl   string `json:"avatarUrl"`
+}
+
+type userRecentComment struct {
+	Id          int64     `json:"id"`
+	UrlHash     string    `json:"urlHash"`
+	DtCreated   time.Time `json:"dtCreated"`
+	CommentBody string    `json:"commentBody"`
+}
+
+type databaseServiceProfileItf interface {
+	getUserProfile(idUser int64) (*userProfile, error)
+	updateUserProfile(idUser int64, displayName string, bio string, website string) error
+	// stores PNG and bumps avatar version
+	setUserAvatar(idUser int64, image []byte) error
+	deleteUserAvatar(idUser int64) error
+	// returns nil if user has no uploaded avatar
+	getUserAvatar(idUser int64) ([]byte, error)
+	// only visible comments, the user viewing own profile (idViewer) also sees own shadow comments
+	listUserRecentComments(idUser int64, idViewer int64, count uint64) ([]userRecentComment, error)
+}
+
+type dataExportJob struct {
+	id          int64
+	idUser      int64
+	status      string
+	includeHtml bool
+	dtRequested time.Time
+	dtFinished  *time.Time
+	dtExpires   *time.Time
+	archive     []byte // only filled by getDataExportArchive
+}
+
+type databaseServiceDataExportItf interface {
+	// errDataExportPending if the user already has unfinished export
+	createDataExport(idUser int64, includeHtml bool, now time.Time) (*dataExportJob, error)
+	// marks oldest pending job (or job stuck in running since before runningBefore) as running, nil if there is none.
+	// Safe to call from more instances.
+	claimDataExport(now time.Time, runningBefore time.Time) (*dataExportJob, error)
+	finishDataExport(id int64, archive []byte, now time.Time, dtExpires time.Time) error
+	failDataExport(id int64, now time.Time, dtExpires time.Time) error
+	listDataExports(idUser int64) ([]dataExportJob, error)
+	// returns nil if ready export doesn't exist
+	getDataExportArchive(id int64, idUser int64) (*dataExportJob, error)
+	deleteDataExportsThatExpired(now time.Time) error
+	listUserComments(idUser int64) ([]personalDataComment, error)
+	listExternalIdentities(idUser int64) ([]personalDataExternalIdentity, error)
+}
+
+type accountDeletionJob struct {
+	idUser        int64
+	mode          string
+	dtRequested   time.Time
+	dtExecute     time.Time
+	idRequestedBy *int64
+}
+
+type databaseServiceAccountDeletionItf interface {
+	// replaces already scheduled deletion, errUserDoesntExist for unknown user or deletedUserUsername placeholder
+	scheduleAccountDeletion(idUser int64, mode string, idRequestedBy *int64, now time.Time, dtExecute time.Time) error
+	// returns false if deletion wasn't scheduled
+	cancelAccountDeletion(idUser int64) (bool, error)
+	// returns nil if deletion is not scheduled
+	getAccountDeletion(idUser int64) (*accountDeletionJob, error)
+	// executes one deletion that is due, returns nil if there is none. Safe to call from more instances.
+	executeDueAccountDeletion(now time.Time) (*accountDeletionJob, error)
+	// anonymize moves comments to deletedUserUsername placeholder, purge deletes them, both delete the user
+	executeAccountDeletion(idUser int64, mode string) error
+}
+
+type databaseServiceRbacItf interface {
+	listUserRoles(idUser int64) ([]roleAssignment, error)
+	// no error if the user already has the role, users.admin_role stays true while user has global admin or superadmin role
+	assignUserRole(assignment roleAssignment) error
+	revokeUserRole(idUser int64, role string, scope string) (bool, error)
+}
+
+type databaseServiceModerationItf interface {
+	// errCommentAlreadyReported if the reporter has open report of the comment
+	createCommentReport(report commentReport) error
+	// comments with open reports, only Comment and ReportsCount are filled
+	listReportedComments(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error)
+	listOpenCommentReports(idComment int64) ([]commentReport, error)
+	getAuthorModerationHistory(idUser int64, recentCount uint64) (*authorModerationHistory, error)
+	// records the action, applies it to the comment (and author for ban) and resolves open reports in one transaction.
+	// Returns errCommentNotPending if approved or rejected comment is not pending anymore.
+	applyModerationAction(record moderationActionRecord, now time.Time) error
+	// returns nil if the user is not banned or the suspension has expired
+	getUserBan(idUser int64, now time.Time) (*userBan, error)
+	// replaces existing ban and records the action, visible and pending comments of shadow-banned user get
+	// commentStatusShadow and keep their status for unban
+	setUserBan(ban userBan, record moderationActionRecord) error
+	// returns false if the user was not banned, shadow comments get back their status from before the shadow-ban
+	deleteUserBan(idUser int64, record moderationActionRecord) (bool, error)
+	// pending comments, oldest first, only Comment is filled
+	listPendingComments(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error)
+	// true if the user has at least one approved comment
+	hasApprovedComment(idUser int64) (bool, error)
+	// returns empty string if the scope has no policy
+	getModerationPolicy(scope string) (string, error)
+	// empty policy removes the policy of the scope
+	setModerationPolicy(scope string, policy string, idModifiedBy int64, now time.Time) error
+	// returns nil if the page has no state
+	getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error)
+	// pageStateOpen removes the state of the page
+	setPageDiscussionState(idSite int64, urlHash string, state string, reason string, idModifiedBy int64, now time.Time) error
+}
+
+type databaseServiceAuditLogItf interface {
+	appendAuditLog(entry auditLogEntry) error
+	// at most filter.Count entries with id greater than filter.AfterId, by id ascending
+	queryAuditLog(filter auditLogFilter) ([]auditLogEntry, error)
+}
+
+type databaseServiceSpamItf interface {
+	getSpamAuthorStats(idUser int64, commentBody string, since time.Time) (*spamAuthorStats, error)
+	// tokens never seen in training are missing from the map
+	getSpamTokenCounts(tokens []string) (map[string]spamTokenCounts, spamTrainingTotals, error)
+	trainSpamTokens(tokens []string, spam bool) error
+}
+
+type databaseServiceContentPolicyItf interface {
+	// returns nil if the scope has no policy
+	getContentPolicy(scope string) (*contentPolicy, error)
+	// nil policy deletes it
+	setContentPolicy(scope string, policy *contentPolicy, idModifiedBy int64, now time.Time) error
+}
+
+type databaseServiceDuplicateItf interface {
+	// nil idUser lists comments of all users, newest first
+	listRecentCommentFingerprints(idUser *int64, since time.Time, count int) ([]commentFingerprint, error)
+	saveCommentFingerprint(fingerprint commentFingerprint, idDuplicateOf *int64, similarity float64) error
+}
+
+type databaseServiceSiteItf interface {
+	createSite(settings siteSettings, now time.Time) (*site, error)
+	// errSiteDoesntExist if there is no such site
+	getSite(idSite int64) (*site, error)
+	// nil idSites lists all sites
+	listSites(idSites []int64) ([]site, error)
+	updateSite(idSite int64, settings siteSettings) (*site, error)
+	// also removes comments, roles and policies of the site, returns users whose roles were removed
+	deleteSite(idSite int64) ([]int64, error)
+	listSiteOwners(idSite int64) ([]siteOwner, error)
+}
+
+type databaseServicePageItf interface {
+	// errPageDoesntExist if the page wasn't registered
+	getPage(idSite int64, urlHash string) (*page, error)
+	// creates the page or sets its title if it has none
+	savePage(idSite int64, urlHash string, canonicalUrl string, title string, now time.Time) (*page, error)
 }
 
 type databaseServiceItf interface {
@@ -95,4 +429,22 @@ type databaseServiceItf interface {
 	databaseServiceUserItf
 	databaseServiceProofOfWorkItf
 	databaseServiceSessionItf
+	databaseServiceRateLimitItf
+	databaseServiceLoginGuardItf
+	databaseServiceTwoFactorItf
+	databaseServicePasskeyItf
+	databaseServiceApiTokenItf
+	databaseServiceOidcItf
+	databaseServicePasswordResetItf
+	databaseServiceProfileItf
+	databaseServiceDataExportItf
+	databaseServiceAccountDeletionItf
+	databaseServiceRbacItf
+	databaseServiceModerationItf
+	databaseServiceAuditLogItf
+	databaseServiceSpamItf
+	databaseServiceContentPolicyItf
+	databaseServiceDuplicateItf
+	databaseServiceSiteItf
+	databaseServicePageItf
 }
@@ -3,16 +3,21 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // implements interfaces: databaseServiceCommentItf, databaseServiceUserItf,
-// databaseServiceProofOfWorkItf, databaseServiceSessionItf and finaly databaseServiceItf
+// databaseServiceProofOfWorkItf, databaseServiceSessionItf, databaseServiceRateLimitItf,
+// databaseServiceLoginGuardItf, databaseServiceTwoFactorItf, databaseServicePasskeyItf,
+// databaseServiceApiTokenItf, databaseServiceOidcItf, databaseServicePasswordResetItf,
+// databaseServiceProfileItf, databaseServiceDataExportItf, databaseServiceAccountDeletionItf,
+// databaseServiceRbacItf, databaseServiceModerationItf, databaseServiceAuditLogItf, databaseServiceSpamItf, databaseServiceContentPolicyItf, databaseServiceDuplicateItf, databaseServiceSiteItf, databaseServicePageItf and finaly databaseServiceItf
 type postgresAdapter struct {
 	connString string
 	db         *sql.DB
@@ -40,7 +45,7 @@ func (postgresAdapter postgresAdapter) closeDb() error {
 	return nil
 }
 
-func (postgresAdapter postgresAdapter) listPageComments(urlHash string, offset uint64, count uint64) (*pageComments, error) {
+func (postgresAdapter postgresAdapter) listPageComments(idSite int64, urlHash string, offset uint64, count uint64, idViewer int64, showAllPending bool) (*pageComments, error) {
 	if len(urlHash) != urlHashLen {
 		return nil, errUrlHashLen
 	}
@@ -50,7 +55,7 @@ func (postgresAdapter postgresAdapter) listPageComments(urlHash string, offset u
 		return nil, fmt.Errorf("Failed to read comments (create transaction): %w", err)
 	}
 
-	totalCount, err := getCommentsTotalCount(tx, urlHash)
+	totalCount, err := getCommentsTotalCount(tx, idSite, urlHash, idViewer, showAllPending)
 	if err != nil {
 		err2 := tx.Rollback()
 		if err2 != nil {
@@ -59,7 +64,7 @@ func (postgresAdapter postgresAdapter) listPageComments(urlHash string, offset u
 		return nil, fmt.Errorf("Failed to read comments (total comments count): %w", err)
 	}
 
-	commentsSlice, err := getComments(tx, urlHash, offset, count)
+	commentsSlice, err := getComments(tx, idSite, urlHash, offset, count, idViewer, showAllPending)
 	if err != nil {
 		err2 := tx.Rollback()
 		if err2 != nil {
@@ -73,17 +78,20 @@ func (postgresAdapter postgresAdapter) listPageComments(urlHash string, offset u
 	}
 
 	actualCount := len(commentsSlice)
-	pageComments := &pageComments{Offset: offset, RequestedCount: count, Count: uint64(actualCount), Total: totalCount, Comments: commentsSlice}
+	pageComments := &pageComments{Offset: offset, RequestedCount: count, Count: uint64(actualCount), Total: totalCount, Comments: commentsSlice,
+		Discussion: pageDiscussionState{State: pageStateOpen}}
 	return pageComments, nil
 }
 
-func getCommentsTotalCount(tx *sql.Tx, urlHash string) (uint64, error) {
+// pending and shadow comments are counted only for their author and moderators
+func getCommentsTotalCount(tx *sql.Tx, idSite int64, urlHash string, idViewer int64, showAllPending bool) (uint64, error) {
 	if len(urlHash) != urlHashLen {
 		return 0, errUrlHashLen
 	}
 
-	const query = "SELECT COUNT(*) FROM comments WHERE url_hash=$1"
-	var row *sql.Row = tx.QueryRow(query, urlHash)
+	const query = `SELECT COUNT(*) FROM comments
+	WHERE url_hash=$1 AND id_site=$4 AND (status='visible' OR (status IN ('pending', 'shadow') AND ($2 OR id_user=$3)))`
+	var row *sql.Row = tx.QueryRow(query, urlHash, showAllPending, idViewer, idSite)
 
 	var totalCount uint64
 	err := row.Scan(&totalCount)
@@ -93,21 +101,24 @@ func getCommentsTotalCount(tx *sql.Tx, urlHash string) (uint64, error) {
 	return totalCount, err
 }
 
-func getComments(tx *sql.Tx, urlHash string, offset uint64, count uint64) ([]commentJoinedWithUser, error) {
+// shadow-banned author must not find out, own shadow comments are reported as visible, moderators see the real status
+func getComments(tx *sql.Tx, idSite int64, urlHash string, offset uint64, count uint64, idViewer int64, showAllPending bool) ([]commentJoinedWithUser, error) {
 	if len(urlHash) != urlHashLen {
 		return nil, errUrlHashLen
 	}
 
-	const query = `SELECT cm.id, cm.id_root, cm.id_parent, cm.id_user, us.username, cm.dt_created, cm.comment_body,
-	parent_cm.id, parent_cm.id_root, parent_cm.id_parent, parent_cm.id_user, parent_us.username, parent_cm.dt_created, parent_cm.comment_body
+	const query = `SELECT cm.id, cm.id_root, cm.id_parent, cm.id_user, us.username, us.display_name, us.avatar_version, cm.dt_created, cm.comment_body,
+	CASE WHEN cm.status='shadow' AND NOT $4 THEN 'visible' ELSE cm.status END,
+	parent_cm.id, parent_cm.id_root, parent_cm.id_parent, parent_cm.id_user, parent_us.username, parent_us.display_name, parent_us.avatar_version,
+	parent_cm.dt_created, parent_cm.comment_body
 	FROM comments cm
 	INNER JOIN users us ON cm.id_user = us.id
-	LEFT JOIN comments parent_cm ON parent_cm.url_hash = cm.url_hash AND parent_cm.id = cm.id_parent
+	LEFT JOIN comments parent_cm ON parent_cm.url_hash = cm.url_hash AND parent_cm.id = cm.id_parent AND parent_cm.status = 'visible'
 	LEFT JOIN users parent_us ON parent_cm.id_user = parent_us.id
-	WHERE cm.url_hash=$1 
+	WHERE cm.url_hash=$1 AND cm.id_site=$6 AND (cm.status='visible' OR (cm.status IN ('pending', 'shadow') AND ($4 OR cm.id_user=$5)))
 	ORDER BY cm.id ASC OFFSET $2 LIMIT $3`
 
-	rows, err := tx.Query(query, urlHash, offset, count)
+	rows, err := tx.Query(query, urlHash, offset, count, showAllPending, idViewer, idSite)
 	if err != nil {
 		return nil, err
 	}
@@ -127,16 +138,22 @@ func getComments(tx *sql.Tx, urlHash string, offset uint64, count uint64) ([]com
 			parCmtIdParent    sql.NullInt64
 			parCmtIdUser      sql.NullInt64
 			parCmtUsername    sql.NullString
+			parCmtDisplayName sql.NullString
+			parCmtAvatarVer   sql.NullInt64
 			parCmtDtCreated   sql.NullTime
 			parCmtCommentBody sql.NullString
+			cmtAvatarVersion  int64
 		)
 
 		comment := commentJoinedWithUser{}
-		err = rows.Scan(&comment.Id, &cmtIdRoot, &cmtIdParent, &comment.IdUser, &comment.Username, &comment.DtCreated, &comment.CommentBody,
-			&parCmtId, &parCmtIdRoot, &parCmtIdParent, &parCmtIdUser, &parCmtUsername, &parCmtDtCreated, &parCmtCommentBody)
+		err = rows.Scan(&comment.Id, &cmtIdRoot, &cmtIdParent, &comment.IdUser, &comment.Username, &comment.DisplayName, &cmtAvatarVersion,
+			&comment.DtCreated, &comment.CommentBody, &comment.Status,
+			&parCmtId, &parCmtIdRoot, &parCmtIdParent, &parCmtIdUser, &parCmtUsername, &parCmtDisplayName, &parCmtAvatarVer,
+			&parCmtDtCreated, &parCmtCommentBody)
 		if err != nil {
 			return nil, err
 		}
+		comment.AvatarUrl = avatarUrl(comment.IdUser, cmtAvatarVersion)
 		if cmtIdRoot.Valid {
 			comment.IdRoot = &cmtIdRoot.Int64
 		}
@@ -146,6 +163,7 @@ func getComments(tx *sql.Tx, urlHash string, offset uint64, count uint64) ([]com
 
 		if parCmtId.Valid && parCmtCommentBody.Valid {
 			parentComment := commentJoinedWithUser{Id: parCmtId.Int64, IdUser: parCmtIdUser.Int64, Username: parCmtUsername.String,
+				DisplayName: parCmtDisplayName.String, AvatarUrl: avatarUrl(parCmtIdUser.Int64, parCmtAvatarVer.Int64),
 				DtCreated: parCmtDtCreated.Time, CommentBody: parCmtCommentBody.String}
 
 			if parCmtIdRoot.Valid {
@@ -173,11 +191,12 @@ func (postgresAdapter postgresAdapter) getComment(id int64) (*comment, error) {
 		cmtIdParent sql.NullInt64
 	)
 
-	const query = "SELECT id, id_root, id_parent, url_hash, id_user, dt_created, comment_body FROM comments WHERE id=$1 LIMIT 1"
+	const query = "SELECT id, id_site, id_root, id_parent, url_hash, id_user, dt_created, comment_body, status FROM comments WHERE id=$1 LIMIT 1"
 	var row *sql.Row = postgresAdapter.db.QueryRow(query, id)
 
 	comment := &comment{}
-	err := row.Scan(&comment.Id, &cmtIdRoot, &cmtIdParent, &comment.UrlHash, &comment.DtCreated, &comment.CommentBody)
+	err := row.Scan(&comment.Id, &comment.IdSite, &cmtIdRoot, &cmtIdParent, &comment.UrlHash, &comment.IdUser, &comment.DtCreated, &comment.CommentBody,
+		&comment.Status)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return comment, errCommentDoesntExist
@@ -193,7 +212,8 @@ func (postgresAdapter postgresAdapter) getComment(id int64) (*comment, error) {
 	return comment, nil
 }
 
-func (postgresAdapter postgresAdapter) createComment(idParent *int64, urlHash string, idUser int64, dtCreated time.Time, commentBody string) (int64, error) {
+func (postgresAdapter postgresAdapter) createComment(idSite int64, idParent *int64, urlHash string, idUser int64, dtCreated time.Time, commentBody string, status string,
+	shadow bool) (int64, error) {
 	var (
 		idRoot     *int64 = nil
 		readIdRoot sql.NullInt64
@@ -213,8 +233,10 @@ func (postgresAdapter postgresAdapter) createComment(idParent *int64, urlHash st
 	}
 
 	if idParent != nil {
-		const queryIdRoot = "SELECT id_root FROM comments WHERE url_hash = $1 AND id = $2"
-		row := tx.QueryRow(queryIdRoot, urlHash, idParent)
+		// hidden, rejected and other users' unapproved comments can't be replied to, the author can reply to own
+		const queryIdRoot = `SELECT id_root FROM comments WHERE url_hash = $1 AND id = $2 AND id_site = $3
+		AND (status = 'visible' OR (status IN ('pending', 'shadow') AND id_user = $4))`
+		row := tx.QueryRow(queryIdRoot, urlHash, idParent, idSite, idUser)
 		err := row.Scan(&readIdRoot)
 		if err != nil {
 			err2 := tx.Rollback()
@@ -231,9 +253,16 @@ func (postgresAdapter postgresAdapter) createComment(idParent *int64, urlHash st
 		}
 	}
 
+	var statusBeforeShadow *string = nil
+	if shadow {
+		statusBeforeShadow = &status
+		status = commentStatusShadow
+	}
+
 	var commentId int64
-	const query = "INSERT INTO comments (id_root, id_parent, url_hash, id_user, dt_created, comment_body) VALUES($1, $2, $3, $4, $5, $6) RETURNING id"
-	row := tx.QueryRow(query, idRoot, idParent, urlHash, idUser, dtCreated, commentBody)
+	const query = `INSERT INTO comments (id_site, id_root, id_parent, url_hash, id_user, dt_created, comment_body, status, status_before_shadow)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9) RETURNING id`
+	row := tx.QueryRow(query, idSite, idRoot, idParent, urlHash, idUser, dtCreated, commentBody, status, statusBeforeShadow)
 	err = row.Scan(&commentId)
 	if err != nil {
 		err2 := tx.Rollback()
@@ -262,9 +291,9 @@ func (postgresAdapter postgresAdapter) createComment(idParent *int64, urlHash st
 	return commentId, nil
 }
 
-func (postgresAdapter postgresAdapter) deleteComment(id, idUser int64, adminRole bool) error {
+func (postgresAdapter postgresAdapter) deleteComment(id, idUser int64, moderate bool) error {
 	const query = "DELETE FROM comments WHERE id=$1 AND (id_user=$2 OR $3)"
-	_, err := postgresAdapter.db.Exec(query, id, idUser, adminRole)
+	_, err := postgresAdapter.db.Exec(query, id, idUser, moderate)
 	if err != nil {
 		return fmt.Errorf("Failed to delete a comment id=%d: %w", id, err)
 	}
@@ -299,6 +328,18 @@ func (postgresAdapter postgresAdapter) createUser(username string, password stri
 		return nil, errUserAlreadyExists
 	}
 
+	reserved, err := isUsernameReserved(tx, username, -1, time.Now())
+	if err != nil || reserved {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback user creation!", slog.Any("error", err2))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Error creating user (checking username history): %w", err)
+		}
+		return nil, errUsernameReserved
+	}
+
 	var salt string = generateSalt()
 	pwHash, err := getPasswordAndSaltSHA256Hash(salt, password)
 	if err != nil {
@@ -342,6 +383,17 @@ func getUserId(tx *sql.Tx, username string) (int64, error) {
 	return userId, nil
 }
 
+// username is reserved while it is in cooldown after other user changed it
+func isUsernameReserved(tx *sql.Tx, username string, idUser int64, now time.Time) (bool, error) {
+	const query = "SELECT EXISTS(SELECT 1 FROM username_history WHERE username=$1 AND id_user<>$2 AND dt_reclaimable > $3)"
+	var reserved bool
+	err := tx.QueryRow(query, username, idUser, now).Scan(&reserved)
+	if err != nil {
+		return false, err
+	}
+	return reserved, nil
+}
+
 func (postgresAdapter postgresAdapter) modifyUserPassword(id int64, oldPassword string, newPassword string) error {
 	if oldPassword == "" {
 		return fmt.Errorf("Error modifing user password: empty old password")
@@ -428,13 +480,13 @@ func (postgresAdapter postgresAdapter) authenticateUser(username string, passwor
 		return nil, errUsernameTooLong
 	}
 
-	const query = "SELECT id, username, salt, pw_hash, admin_role FROM users WHERE username=$1 LIMIT 1"
+	const query = "SELECT id, username, salt, pw_hash, admin_role, totp_enabled FROM users WHERE username=$1 LIMIT 1"
 	var row *sql.Row = postgresAdapter.db.QueryRow(query, username)
 
 	user := &user{}
 	var salt string
 	var pwHash string
-	err := row.Scan(&user.Id, &user.Username, &salt, &pwHash, &user.AdminRole)
+	err := row.Scan(&user.Id, &user.Username, &salt, &pwHash, &user.AdminRole, &user.TwoFactorEnabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errUserDoesntExist
@@ -454,11 +506,11 @@ func (postgresAdapter postgresAdapter) authenticateUser(username string, passwor
 }
 
 func (postgresAdapter postgresAdapter) getUser(id int64) (*user, error) {
-	const query = "SELECT id, username, admin_role FROM users WHERE id=$1 LIMIT 1"
+	const query = "SELECT id, username, admin_role, totp_enabled FROM users WHERE id=$1 LIMIT 1"
 	var row *sql.Row = postgresAdapter.db.QueryRow(query, id)
 
 	user := &user{}
-	err := row.Scan(&user.Id, &user.Username, &user.AdminRole)
+	err := row.Scan(&user.Id, &user.Username, &user.AdminRole, &user.TwoFactorEnabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errUserDoesntExist
@@ -474,11 +526,11 @@ func (postgresAdapter postgresAdapter) getUserByUsername(username string) (*user
 		return nil, errUsernameTooLong
 	}
 
-	const query = "SELECT id, username, admin_role FROM users WHERE username=$1 LIMIT 1"
+	const query = "SELECT id, username, admin_role, totp_enabled FROM users WHERE username=$1 LIMIT 1"
 	var row *sql.Row = postgresAdapter.db.QueryRow(query, username)
 
 	user := &user{}
-	err := row.Scan(&user.Id, &user.Username, &user.AdminRole)
+	err := row.Scan(&user.Id, &user.Username, &user.AdminRole, &user.TwoFactorEnabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, errUserDoesntExist
@@ -488,6 +540,205 @@ func (postgresAdapter postgresAdapter) getUserByUsername(username string) (*user
 	return user, nil
 }
 
+func (postgresAdapter postgresAdapter) setUserPassword(id int64, newPassword string) error {
+	if newPassword == "" {
+		return fmt.Errorf("Error setting user password: empty new password")
+	}
+
+	var salt string = generateSalt()
+	pwHash, err := getPasswordAndSaltSHA256Hash(salt, newPassword)
+	if err != nil {
+		return fmt.Errorf("Error setting user password (password and salt hash): %w", err)
+	}
+
+	const query = "UPDATE users SET salt=$1, pw_hash=$2 WHERE id=$3"
+	result, err := postgresAdapter.db.Exec(query, salt, pwHash, id)
+	if err != nil {
+		return fmt.Errorf("Failed to set password for user id=%d: %w", id, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to set password for user id=%d: %w", id, err)
+	}
+	if count == 0 {
+		return errUserDoesntExist
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) setUserEmail(id int64, email string) error {
+	const query = "UPDATE users SET email=NULLIF($1, '') WHERE id=$2"
+	result, err := postgresAdapter.db.Exec(query, email, id)
+	if err != nil {
+		return fmt.Errorf("Failed to set email for user id=%d: %w", id, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to set email for user id=%d: %w", id, err)
+	}
+	if count == 0 {
+		return errUserDoesntExist
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserEmail(id int64) (string, error) {
+	const query = "SELECT COALESCE(email, '') FROM users WHERE id=$1 LIMIT 1"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, id)
+
+	var email string
+	err := row.Scan(&email)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errUserDoesntExist
+		}
+		return "", fmt.Errorf("Failed to query email of user id=%d: %w", id, err)
+	}
+	return email, nil
+}
+
+func (postgresAdapter postgresAdapter) checkUsernameAvailable(id int64, username string, now time.Time) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: true})
+	if err != nil {
+		return fmt.Errorf("Error checking username (create transaction): %w", err)
+	}
+	defer func() {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback username check!", slog.Any("error", err2))
+		}
+	}()
+
+	userId, err := getUserId(tx, username)
+	if !errors.Is(err, sql.ErrNoRows) {
+		if err != nil {
+			return fmt.Errorf("Error checking username (checking if username is taken): %w", err)
+		}
+		if userId == id {
+			return errUsernameUnchanged
+		}
+		return errUserAlreadyExists
+	}
+	reserved, err := isUsernameReserved(tx, username, id, now)
+	if err != nil {
+		return fmt.Errorf("Error checking username (checking username history): %w", err)
+	}
+	if reserved {
+		return errUsernameReserved
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) changeUsername(id int64, newUsername string, now time.Time, dtReclaimable time.Time) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error changing username (create transaction): %w", err)
+	}
+	rollback := func() {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback username change!", slog.Any("error", err2))
+		}
+	}
+
+	const lockQuery = "SELECT username FROM users WHERE id=$1 FOR UPDATE"
+	var oldUsername string
+	err = tx.QueryRow(lockQuery, id).Scan(&oldUsername)
+	if err != nil {
+		rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return errUserDoesntExist
+		}
+		return fmt.Errorf("Error changing username (get user): %w", err)
+	}
+	if oldUsername == newUsername {
+		rollback()
+		return errUsernameUnchanged
+	}
+
+	_, err = getUserId(tx, newUsername)
+	if !errors.Is(err, sql.ErrNoRows) {
+		rollback()
+		if err != nil {
+			return fmt.Errorf("Error changing username (checking if username is taken): %w", err)
+		}
+		return errUserAlreadyExists
+	}
+	reserved, err := isUsernameReserved(tx, newUsername, id, now)
+	if err != nil || reserved {
+		rollback()
+		if err != nil {
+			return fmt.Errorf("Error changing username (checking username history): %w", err)
+		}
+		return errUsernameReserved
+	}
+
+	const queryHistory = "INSERT INTO username_history (id_user, username, dt_changed, dt_reclaimable) VALUES($1, $2, $3, $4)"
+	_, err = tx.Exec(queryHistory, id, oldUsername, now, dtReclaimable)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Error changing username (insert history): %w", err)
+	}
+
+	const queryUpdate = "UPDATE users SET username=$1 WHERE id=$2"
+	_, err = tx.Exec(queryUpdate, newUsername, id)
+	if err != nil {
+		rollback()
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation, concurrent change or sign-up
+			return errUserAlreadyExists
+		}
+		return fmt.Errorf("Error changing username (update): %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit username change: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listUsernameHistory(id int64) ([]usernameHistoryEntry, error) {
+	const query = "SELECT username, dt_changed, dt_reclaimable FROM username_history WHERE id_user=$1 ORDER BY dt_changed DESC"
+	rows, err := postgresAdapter.db.Query(query, id)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query username history for user id=%d: %w", id, err)
+	}
+	defer rows.Close()
+
+	history := make([]usernameHistoryEntry, 0)
+	for rows.Next() {
+		var entry usernameHistoryEntry
+		err = rows.Scan(&entry.Username, &entry.DtChanged, &entry.DtReclaimable)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read username history for user id=%d: %w", id, err)
+		}
+		history = append(history, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read username history for user id=%d: %w", id, err)
+	}
+	return history, nil
+}
+
+func (postgresAdapter postgresAdapter) getUserByPreviousUsername(username string) (*user, error) {
+	const query = `SELECT usr.id, usr.username, usr.admin_role, usr.totp_enabled FROM username_history h
+	INNER JOIN users usr ON usr.id = h.id_user
+	WHERE h.username=$1 ORDER BY h.dt_changed DESC LIMIT 1`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, username)
+
+	user := &user{}
+	err := row.Scan(&user.Id, &user.Username, &user.AdminRole, &user.TwoFactorEnabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query a user by previous username='%s': %w", username, err)
+	}
+	return user, nil
+}
+
 func (postgresAdapter postgresAdapter) deleteUser(id int64) error {
 	const query = "DELETE FROM users WHERE id=$1"
 	_, err := postgresAdapter.db.Exec(query, id)
@@ -539,36 +790,103 @@ func (postgresAdapter postgresAdapter) deletePowTokensThatExpired(now time.Time)
 	return nil
 }
 
-func (postgresAdapter postgresAdapter) getSession(tokenHash string) (*time.Time, *user, error) {
-	const query = `SELECT s.date_expires, usr.id, usr.username, usr.admin_role FROM user_sessions s 
+func (postgresAdapter postgresAdapter) getSession(tokenHash string) (*sessionRecord, error) {
+	const query = `SELECT s.id, s.dt_created, s.dt_issued, s.dt_last_seen, s.dt_expires, s.user_agent, s.ip, s.rotated,
+	usr.id, usr.username, usr.admin_role, usr.totp_enabled FROM user_seassions s
 	INNER JOIN users usr ON usr.id = s.id_user
-	WHERE session_token_hash=$1`
+	WHERE s.seassion_token_hash=$1`
 	var row *sql.Row = postgresAdapter.db.QueryRow(query, tokenHash)
 
-	var dtExpires time.Time
-	var user user
-
-	err := row.Scan(&dtExpires, user.Id, &user.Username, &user.AdminRole)
+	session := sessionRecord{tokenHash: tokenHash, user: &user{}}
+	err := row.Scan(&session.id, &session.dtCreated, &session.dtIssued, &session.dtLastSeen, &session.dtExpires, &session.userAgent, &session.ip,
+		&session.rotated, &session.user.Id, &session.user.Username, &session.user.AdminRole, &session.user.TwoFactorEnabled)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return nil, nil, nil
+			return nil, nil
 		}
-		return nil, nil, fmt.Errorf("Failed to query a seassion tokenHash='%s': %w", tokenHash, err)
+		return nil, fmt.Errorf("Failed to query a seassion tokenHash='%s': %w", tokenHash, err)
 	}
-	return &dtExpires, &user, nil
+	return &session, nil
+}
+
+func (postgresAdapter postgresAdapter) createSession(session sessionRecord) (int64, error) {
+	const queryInsert = `INSERT INTO user_seassions (seassion_token_hash, id_user, dt_created, dt_issued, dt_last_seen, dt_expires, user_agent, ip)
+	VALUES($1, $2, $3, $4, $5, $6, $7, $8) RETURNING id`
+	var row *sql.Row = postgresAdapter.db.QueryRow(queryInsert, session.tokenHash, session.user.Id, session.dtCreated, session.dtIssued,
+		session.dtLastSeen, session.dtExpires, session.userAgent, session.ip)
+
+	var id int64
+	err := row.Scan(&id)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to insert seassion tokenHash='%s': %w", session.tokenHash, err)
+	}
+	return id, nil
+}
+
+func (postgresAdapter postgresAdapter) listSessionsForUser(idUser int64) ([]sessionRecord, error) {
+	const query = `SELECT id, seassion_token_hash, dt_created, dt_issued, dt_last_seen, dt_expires, user_agent, ip, rotated FROM user_seassions
+	WHERE id_user=$1 ORDER BY dt_last_seen DESC`
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query seassions for user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	sessions := make([]sessionRecord, 0)
+	for rows.Next() {
+		var session sessionRecord
+		err = rows.Scan(&session.id, &session.tokenHash, &session.dtCreated, &session.dtIssued, &session.dtLastSeen, &session.dtExpires,
+			&session.userAgent, &session.ip, &session.rotated)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read seassions for user id=%d: %w", idUser, err)
+		}
+		sessions = append(sessions, session)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read seassions for user id=%d: %w", idUser, err)
+	}
+	return sessions, nil
+}
+
+func (postgresAdapter postgresAdapter) renewSessions(renewals []sessionRenewal) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error renewing seassions (create transaction): %w", err)
+	}
+
+	// expiry can only move forward, so renewals from different instances can't shorten a session
+	const query = `UPDATE user_seassions SET dt_expires=GREATEST(dt_expires, $1), dt_last_seen=GREATEST(dt_last_seen, $2)
+	WHERE seassion_token_hash=$3 AND NOT rotated`
+	for _, renewal := range renewals {
+		_, err = tx.Exec(query, renewal.dtExpires, renewal.dtLastSeen, renewal.tokenHash)
+		if err != nil {
+			err2 := tx.Rollback()
+			if err2 != nil {
+				slog.Error("Failed to rollback seassions renewal!", slog.Any("error", err2))
+			}
+			return fmt.Errorf("Error renewing seassion tokenHash='%s': %w", renewal.tokenHash, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit seassions renewal: %w", err)
+	}
+	return nil
 }
 
-func (postgresAdapter postgresAdapter) createSession(tokenHash string, idUser int64, dtExpires time.Time) error {
-	const queryInsert = "INSERT INTO user_sessions (seassion_token_hash, id_user, dt_expires) VALUES($1, $2, $3)"
-	_, err := postgresAdapter.db.Exec(queryInsert, idUser, tokenHash, dtExpires)
+func (postgresAdapter postgresAdapter) markSessionRotated(tokenHash string, dtExpires time.Time) error {
+	const query = "UPDATE user_seassions SET rotated=TRUE, dt_expires=LEAST(dt_expires, $1) WHERE seassion_token_hash=$2"
+	_, err := postgresAdapter.db.Exec(query, dtExpires, tokenHash)
 	if err != nil {
-		return fmt.Errorf("Failed to insert seassion tokenHash='%s': %w", tokenHash, err)
+		return fmt.Errorf("Failed to mark seassion rotated tokenHash='%s': %w", tokenHash, err)
 	}
 	return nil
 }
 
 func (postgresAdapter postgresAdapter) deleteSession(tokenHash string) error {
-	const query = "DELETE FROM user_sessions WHERE seassion_token_hash=$1"
+	const query = "DELETE FROM user_seassions WHERE seassion_token_hash=$1"
 	_, err := postgresAdapter.db.Exec(query, tokenHash)
 	if err != nil {
 		return fmt.Errorf("Failed to delete seassion tokenHash='%s': %w", tokenHash, err)
@@ -576,8 +894,23 @@ func (postgresAdapter postgresAdapter) deleteSession(tokenHash string) error {
 	return nil
 }
 
+func (postgresAdapter postgresAdapter) deleteSessionById(id int64, idUser int64) (string, error) {
+	const query = "DELETE FROM user_seassions WHERE id=$1 AND id_user=$2 RETURNING seassion_token_hash"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, id, idUser)
+
+	var tokenHash string
+	err := row.Scan(&tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed to delete seassion id=%d: %w", id, err)
+	}
+	return tokenHash, nil
+}
+
 func (postgresAdapter postgresAdapter) deleteSessionsThatExpired(now time.Time) error {
-	const query = "DELETE FROM user_sessions WHERE dt_expires <= $1"
+	const query = "DELETE FROM user_seassions WHERE dt_expires <= $1"
 	_, err := postgresAdapter.db.Exec(query, now)
 	if err != nil {
 		return fmt.Errorf("Failed to delete seassions <='%v': %w", now, err)
@@ -586,10 +919,2182 @@ func (postgresAdapter postgresAdapter) deleteSessionsThatExpired(now time.Time)
 }
 
 func (postgresAdapter postgresAdapter) deleteSessionsForUser(idUser int64) error {
-	const query = "DELETE FROM user_sessions WHERE id_user <= $1"
+	const query = "DELETE FROM user_seassions WHERE id_user=$1"
 	_, err := postgresAdapter.db.Exec(query, idUser)
 	if err != nil {
-		return fmt.Errorf("Failed to delete seassions for user <='%d': %w", idUser, err)
+		return fmt.Errorf("Failed to delete seassions for user='%d': %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) takeRateLimitToken(bucketKey string, policy rateLimitPolicy, now time.Time) (bool, time.Duration, error) {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return false, 0, fmt.Errorf("Error taking rate limit token (create transaction): %w", err)
+	}
+
+	bucket := newFullTokenBucket(policy, now)
+
+	const query = "SELECT tokens, dt_updated FROM rate_limit_buckets WHERE bucket_key=$1 FOR UPDATE"
+	var row *sql.Row = tx.QueryRow(query, bucketKey)
+	err = row.Scan(&bucket.tokens, &bucket.dtUpdated)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback taking rate limit token!", slog.Any("error", err2))
+		}
+		return false, 0, fmt.Errorf("Error taking rate limit token (get bucket) key='%s': %w", bucketKey, err)
+	}
+
+	bucket, allowed, retryAfter := takeToken(bucket, policy, now)
+
+	const queryUpsert = `INSERT INTO rate_limit_buckets (bucket_key, tokens, dt_updated) VALUES($1, $2, $3)
+	ON CONFLICT (bucket_key) DO UPDATE SET tokens=EXCLUDED.tokens, dt_updated=EXCLUDED.dt_updated`
+	_, err = tx.Exec(queryUpsert, bucketKey, bucket.tokens, bucket.dtUpdated)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback taking rate limit token!", slog.Any("error", err2))
+		}
+		return false, 0, fmt.Errorf("Error taking rate limit token (store bucket) key='%s': %w", bucketKey, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, 0, fmt.Errorf("Failed to commit taking rate limit token: %w", err)
+	}
+	return allowed, retryAfter, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteRateLimitBucketsUpdatedBefore(before time.Time) error {
+	const query = "DELETE FROM rate_limit_buckets WHERE dt_updated < $1"
+	_, err := postgresAdapter.db.Exec(query, before)
+	if err != nil {
+		return fmt.Errorf("Failed to delete rate limit buckets <'%v': %w", before, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getLoginFailures(failureKey string) (*loginFailures, error) {
+	const query = "SELECT failed_count, dt_last_failure FROM login_failures WHERE failure_key=$1"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, failureKey)
+
+	var failures loginFailures
+	err := row.Scan(&failures.failedCount, &failures.dtLastFailure)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query login failures key='%s': %w", failureKey, err)
+	}
+	return &failures, nil
+}
+
+func (postgresAdapter postgresAdapter) registerLoginFailure(failureKey string, now time.Time, forgetBefore time.Time) (*loginFailures, error) {
+	const query = `INSERT INTO login_failures (failure_key, failed_count, dt_last_failure) VALUES($1, 1, $2)
+	ON CONFLICT (failure_key) DO UPDATE SET
+	failed_count=CASE WHEN login_failures.dt_last_failure < $3 THEN 1 ELSE login_failures.failed_count + 1 END,
+	dt_last_failure=EXCLUDED.dt_last_failure
+	RETURNING failed_count, dt_last_failure`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, failureKey, now, forgetBefore)
+
+	var failures loginFailures
+	err := row.Scan(&failures.failedCount, &failures.dtLastFailure)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to register login failure key='%s': %w", failureKey, err)
+	}
+	return &failures, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteLoginFailures(failureKey string) error {
+	const query = "DELETE FROM login_failures WHERE failure_key=$1"
+	_, err := postgresAdapter.db.Exec(query, failureKey)
+	if err != nil {
+		return fmt.Errorf("Failed to delete login failures key='%s': %w", failureKey, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deleteLoginFailuresBefore(before time.Time) error {
+	const query = "DELETE FROM login_failures WHERE dt_last_failure < $1"
+	_, err := postgresAdapter.db.Exec(query, before)
+	if err != nil {
+		return fmt.Errorf("Failed to delete login failures <'%v': %w", before, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deleteSessionsForUserExcept(idUser int64, keepTokenHash string) error {
+	const query = "DELETE FROM user_seassions WHERE id_user=$1 AND seassion_token_hash<>$2"
+	_, err := postgresAdapter.db.Exec(query, idUser, keepTokenHash)
+	if err != nil {
+		return fmt.Errorf("Failed to delete other seassions for user='%d': %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) setUserTotpSecret(idUser int64, secret string) error {
+	const query = "UPDATE users SET totp_secret=$1, totp_enabled=FALSE, totp_last_counter=0 WHERE id=$2 AND NOT totp_enabled"
+	_, err := postgresAdapter.db.Exec(query, secret, idUser)
+	if err != nil {
+		return fmt.Errorf("Failed to set TOTP secret for user id=%d: %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserTotp(idUser int64) (*userTotp, error) {
+	const query = "SELECT totp_secret, totp_enabled, totp_last_counter FROM users WHERE id=$1 LIMIT 1"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, idUser)
+
+	var (
+		secret sql.NullString
+		totp   userTotp
+	)
+	err := row.Scan(&secret, &totp.enabled, &totp.lastCounter)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUserDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to query TOTP for user id=%d: %w", idUser, err)
+	}
+	totp.secret = secret.String
+	return &totp, nil
+}
+
+func insertRecoveryCodes(tx *sql.Tx, idUser int64, recoveryCodeHashes []string) error {
+	const queryDelete = "DELETE FROM user_recovery_codes WHERE id_user=$1"
+	_, err := tx.Exec(queryDelete, idUser)
+	if err != nil {
+		return err
+	}
+
+	const queryInsert = "INSERT INTO user_recovery_codes (id_user, code_hash) VALUES($1, $2)"
+	for _, codeHash := range recoveryCodeHashes {
+		_, err = tx.Exec(queryInsert, idUser, codeHash)
+		if err != nil {
+			return err
+		}
 	}
 	return nil
 }
+
+func (postgresAdapter postgresAdapter) enableUserTotp(idUser int64, lastCounter int64, recoveryCodeHashes []string) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error enabling TOTP (create transaction): %w", err)
+	}
+
+	const query = "UPDATE users SET totp_enabled=TRUE, totp_last_counter=$1 WHERE id=$2 AND totp_secret IS NOT NULL"
+	_, err = tx.Exec(query, lastCounter, idUser)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback enabling TOTP!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error enabling TOTP for user id=%d: %w", idUser, err)
+	}
+
+	err = insertRecoveryCodes(tx, idUser, recoveryCodeHashes)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback enabling TOTP!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error enabling TOTP (recovery codes) for user id=%d: %w", idUser, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit enabling TOTP: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) disableUserTotp(idUser int64) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error disabling TOTP (create transaction): %w", err)
+	}
+
+	const query = "UPDATE users SET totp_secret=NULL, totp_enabled=FALSE, totp_last_counter=0 WHERE id=$1"
+	_, err = tx.Exec(query, idUser)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback disabling TOTP!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error disabling TOTP for user id=%d: %w", idUser, err)
+	}
+
+	err = insertRecoveryCodes(tx, idUser, nil)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback disabling TOTP!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error disabling TOTP (recovery codes) for user id=%d: %w", idUser, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit disabling TOTP: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) updateUserTotpLastCounter(idUser int64, counter int64) (bool, error) {
+	const query = "UPDATE users SET totp_last_counter=$1 WHERE id=$2 AND totp_last_counter < $1"
+	result, err := postgresAdapter.db.Exec(query, counter, idUser)
+	if err != nil {
+		return false, fmt.Errorf("Failed to update TOTP counter for user id=%d: %w", idUser, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to update TOTP counter for user id=%d (rows affected): %w", idUser, err)
+	}
+	return rowsAffected == 1, nil
+}
+
+func (postgresAdapter postgresAdapter) replaceRecoveryCodes(idUser int64, recoveryCodeHashes []string) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error replacing recovery codes (create transaction): %w", err)
+	}
+
+	err = insertRecoveryCodes(tx, idUser, recoveryCodeHashes)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback replacing recovery codes!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error replacing recovery codes for user id=%d: %w", idUser, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit replacing recovery codes: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) useRecoveryCode(idUser int64, codeHash string) (bool, error) {
+	const query = "DELETE FROM user_recovery_codes WHERE id_user=$1 AND code_hash=$2"
+	result, err := postgresAdapter.db.Exec(query, idUser, codeHash)
+	if err != nil {
+		return false, fmt.Errorf("Failed to use recovery code for user id=%d: %w", idUser, err)
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to use recovery code for user id=%d (rows affected): %w", idUser, err)
+	}
+	return rowsAffected == 1, nil
+}
+
+func (postgresAdapter postgresAdapter) createTwoFactorTicket(ticketHash string, idUser int64, dtExpires time.Time) error {
+	const queryInsert = "INSERT INTO two_factor_tickets (ticket_hash, id_user, dt_expires) VALUES($1, $2, $3)"
+	_, err := postgresAdapter.db.Exec(queryInsert, ticketHash, idUser, dtExpires)
+	if err != nil {
+		return fmt.Errorf("Failed to insert 2FA ticket ticketHash='%s': %w", ticketHash, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getTwoFactorTicket(ticketHash string) (*time.Time, *user, error) {
+	const query = `SELECT t.dt_expires, usr.id, usr.username, usr.admin_role, usr.totp_enabled FROM two_factor_tickets t
+	INNER JOIN users usr ON usr.id = t.id_user
+	WHERE t.ticket_hash=$1`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, ticketHash)
+
+	var dtExpires time.Time
+	var user user
+
+	err := row.Scan(&dtExpires, &user.Id, &user.Username, &user.AdminRole, &user.TwoFactorEnabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil, nil
+		}
+		return nil, nil, fmt.Errorf("Failed to query a 2FA ticket ticketHash='%s': %w", ticketHash, err)
+	}
+	return &dtExpires, &user, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteTwoFactorTicket(ticketHash string) error {
+	const query = "DELETE FROM two_factor_tickets WHERE ticket_hash=$1"
+	_, err := postgresAdapter.db.Exec(query, ticketHash)
+	if err != nil {
+		return fmt.Errorf("Failed to delete 2FA ticket ticketHash='%s': %w", ticketHash, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deleteTwoFactorTicketsThatExpired(now time.Time) error {
+	const query = "DELETE FROM two_factor_tickets WHERE dt_expires <= $1"
+	_, err := postgresAdapter.db.Exec(query, now)
+	if err != nil {
+		return fmt.Errorf("Failed to delete 2FA tickets <='%v': %w", now, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) createWebauthnChallenge(challengeHash string, kind string, idUser *int64, dtExpires time.Time) error {
+	const queryInsert = "INSERT INTO webauthn_challenges (challenge_hash, kind, id_user, dt_expires) VALUES($1, $2, $3, $4)"
+	_, err := postgresAdapter.db.Exec(queryInsert, challengeHash, kind, idUser, dtExpires)
+	if err != nil {
+		return fmt.Errorf("Failed to insert WebAuthn challenge: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) takeWebauthnChallenge(challengeHash string, kind string) (bool, *int64, time.Time, error) {
+	const query = "DELETE FROM webauthn_challenges WHERE challenge_hash=$1 AND kind=$2 RETURNING id_user, dt_expires"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, challengeHash, kind)
+
+	var (
+		idUser    sql.NullInt64
+		dtExpires time.Time
+	)
+	err := row.Scan(&idUser, &dtExpires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil, time.Time{}, nil
+		}
+		return false, nil, time.Time{}, fmt.Errorf("Failed to take WebAuthn challenge: %w", err)
+	}
+	if idUser.Valid {
+		return true, &idUser.Int64, dtExpires, nil
+	}
+	return true, nil, dtExpires, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteWebauthnChallengesThatExpired(now time.Time) error {
+	const query = "DELETE FROM webauthn_challenges WHERE dt_expires <= $1"
+	_, err := postgresAdapter.db.Exec(query, now)
+	if err != nil {
+		return fmt.Errorf("Failed to delete WebAuthn challenges <='%v': %w", now, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) createPasskeyCredential(credential passkeyCredential) (int64, error) {
+	const queryInsert = `INSERT INTO webauthn_credentials (id_user, credential_id, public_key, sign_count, name, dt_created)
+	VALUES($1, $2, $3, $4, $5, $6) RETURNING id`
+	var row *sql.Row = postgresAdapter.db.QueryRow(queryInsert, credential.idUser, credential.credentialId, credential.publicKey,
+		int64(credential.signCount), credential.name, credential.dtCreated)
+
+	var id int64
+	err := row.Scan(&id)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return -1, errPasskeyAlreadyExists
+		}
+		return -1, fmt.Errorf("Failed to insert passkey for user id=%d: %w", credential.idUser, err)
+	}
+	return id, nil
+}
+
+func scanPasskeyCredential(scanner interface{ Scan(dest ...any) error }) (*passkeyCredential, error) {
+	var (
+		credential passkeyCredential
+		signCount  int64
+		dtLastUsed sql.NullTime
+	)
+	err := scanner.Scan(&credential.id, &credential.idUser, &credential.credentialId, &credential.publicKey, &signCount,
+		&credential.name, &credential.dtCreated, &dtLastUsed)
+	if err != nil {
+		return nil, err
+	}
+	credential.signCount = uint32(signCount)
+	if dtLastUsed.Valid {
+		credential.dtLastUsed = &dtLastUsed.Time
+	}
+	return &credential, nil
+}
+
+func (postgresAdapter postgresAdapter) getPasskeyCredential(credentialId []byte) (*passkeyCredential, error) {
+	const query = `SELECT id, id_user, credential_id, public_key, sign_count, name, dt_created, dt_last_used
+	FROM webauthn_credentials WHERE credential_id=$1`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, credentialId)
+
+	credential, err := scanPasskeyCredential(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query a passkey: %w", err)
+	}
+	return credential, nil
+}
+
+func (postgresAdapter postgresAdapter) listPasskeyCredentials(idUser int64) ([]passkeyCredential, error) {
+	const query = `SELECT id, id_user, credential_id, public_key, sign_count, name, dt_created, dt_last_used
+	FROM webauthn_credentials WHERE id_user=$1 ORDER BY id ASC`
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query passkeys for user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	credentials := make([]passkeyCredential, 0)
+	for rows.Next() {
+		credential, err := scanPasskeyCredential(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read passkeys for user id=%d: %w", idUser, err)
+		}
+		credentials = append(credentials, *credential)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read passkeys for user id=%d: %w", idUser, err)
+	}
+	return credentials, nil
+}
+
+func (postgresAdapter postgresAdapter) updatePasskeyCredentialUse(id int64, signCount uint32, dtLastUsed time.Time) error {
+	const query = "UPDATE webauthn_credentials SET sign_count=$1, dt_last_used=$2 WHERE id=$3"
+	_, err := postgresAdapter.db.Exec(query, int64(signCount), dtLastUsed, id)
+	if err != nil {
+		return fmt.Errorf("Failed to update passkey id=%d: %w", id, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deletePasskeyCredential(id int64, idUser int64) error {
+	const query = "DELETE FROM webauthn_credentials WHERE id=$1 AND id_user=$2"
+	_, err := postgresAdapter.db.Exec(query, id, idUser)
+	if err != nil {
+		return fmt.Errorf("Failed to delete passkey id=%d: %w", id, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) createApiToken(token apiTokenRecord) (int64, error) {
+	const queryInsert = `INSERT INTO api_tokens (id_user, token_hash, name, scopes, dt_created)
+	VALUES($1, $2, $3, $4, $5) RETURNING id`
+	var row *sql.Row = postgresAdapter.db.QueryRow(queryInsert, token.user.Id, token.tokenHash, token.name, pq.Array(token.scopes), token.dtCreated)
+
+	var id int64
+	err := row.Scan(&id)
+	if err != nil {
+		return -1, fmt.Errorf("Failed to insert API token for user id=%d: %w", token.user.Id, err)
+	}
+	return id, nil
+}
+
+func (postgresAdapter postgresAdapter) getApiToken(tokenHash string) (*apiTokenRecord, error) {
+	const query = `SELECT t.id, t.name, t.scopes, t.dt_created, t.dt_last_used,
+	usr.id, usr.username, usr.admin_role, usr.totp_enabled FROM api_tokens t
+	INNER JOIN users usr ON usr.id = t.id_user
+	WHERE t.token_hash=$1`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, tokenHash)
+
+	var dtLastUsed sql.NullTime
+	token := apiTokenRecord{tokenHash: tokenHash, user: &user{}}
+	err := row.Scan(&token.id, &token.name, pq.Array(&token.scopes), &token.dtCreated, &dtLastUsed,
+		&token.user.Id, &token.user.Username, &token.user.AdminRole, &token.user.TwoFactorEnabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query an API token: %w", err)
+	}
+	if dtLastUsed.Valid {
+		token.dtLastUsed = &dtLastUsed.Time
+	}
+	return &token, nil
+}
+
+func (postgresAdapter postgresAdapter) listApiTokensForUser(idUser int64) ([]apiTokenRecord, error) {
+	const query = `SELECT id, token_hash, name, scopes, dt_created, dt_last_used FROM api_tokens
+	WHERE id_user=$1 ORDER BY id ASC`
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query API tokens for user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	tokens := make([]apiTokenRecord, 0)
+	for rows.Next() {
+		var dtLastUsed sql.NullTime
+		token := apiTokenRecord{user: &user{Id: idUser}}
+		err = rows.Scan(&token.id, &token.tokenHash, &token.name, pq.Array(&token.scopes), &token.dtCreated, &dtLastUsed)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read API tokens for user id=%d: %w", idUser, err)
+		}
+		if dtLastUsed.Valid {
+			token.dtLastUsed = &dtLastUsed.Time
+		}
+		tokens = append(tokens, token)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read API tokens for user id=%d: %w", idUser, err)
+	}
+	return tokens, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteApiToken(id int64, idUser int64) (string, error) {
+	const query = "DELETE FROM api_tokens WHERE id=$1 AND id_user=$2 RETURNING token_hash"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, id, idUser)
+
+	var tokenHash string
+	err := row.Scan(&tokenHash)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", errApiTokenDoesntExist
+		}
+		return "", fmt.Errorf("Failed to delete API token id=%d: %w", id, err)
+	}
+	return tokenHash, nil
+}
+
+func (postgresAdapter postgresAdapter) updateApiTokenLastUsed(tokenHash string, dtLastUsed time.Time) error {
+	const query = "UPDATE api_tokens SET dt_last_used=$1 WHERE token_hash=$2"
+	_, err := postgresAdapter.db.Exec(query, dtLastUsed, tokenHash)
+	if err != nil {
+		return fmt.Errorf("Failed to update API token last use: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) createOidcAuthRequest(request oidcAuthRequest) error {
+	const queryInsert = `INSERT INTO oidc_auth_requests (state_hash, nonce, code_verifier, id_user, dt_expires)
+	VALUES($1, $2, $3, $4, $5)`
+	_, err := postgresAdapter.db.Exec(queryInsert, request.stateHash, request.nonce, request.codeVerifier, request.idUser, request.dtExpires)
+	if err != nil {
+		return fmt.Errorf("Failed to insert OIDC auth request: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) takeOidcAuthRequest(stateHash string) (*oidcAuthRequest, error) {
+	const query = "DELETE FROM oidc_auth_requests WHERE state_hash=$1 RETURNING nonce, code_verifier, id_user, dt_expires"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, stateHash)
+
+	var idUser sql.NullInt64
+	request := oidcAuthRequest{stateHash: stateHash}
+	err := row.Scan(&request.nonce, &request.codeVerifier, &idUser, &request.dtExpires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to take OIDC auth request: %w", err)
+	}
+	if idUser.Valid {
+		request.idUser = &idUser.Int64
+	}
+	return &request, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteOidcAuthRequestsThatExpired(now time.Time) error {
+	const query = "DELETE FROM oidc_auth_requests WHERE dt_expires <= $1"
+	_, err := postgresAdapter.db.Exec(query, now)
+	if err != nil {
+		return fmt.Errorf("Failed to delete OIDC auth requests <='%v': %w", now, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserByExternalIdentity(issuer string, subject string) (*user, error) {
+	const query = `SELECT usr.id, usr.username, usr.admin_role, usr.totp_enabled FROM user_external_identities ext
+	INNER JOIN users usr ON usr.id = ext.id_user
+	WHERE ext.issuer=$1 AND ext.subject=$2`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, issuer, subject)
+
+	var user user
+	err := row.Scan(&user.Id, &user.Username, &user.AdminRole, &user.TwoFactorEnabled)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query user by external identity issuer='%s': %w", issuer, err)
+	}
+	return &user, nil
+}
+
+func (postgresAdapter postgresAdapter) linkExternalIdentity(idUser int64, issuer string, subject string) error {
+	const queryInsert = "INSERT INTO user_external_identities (id_user, issuer, subject, dt_created) VALUES($1, $2, $3, $4)"
+	_, err := postgresAdapter.db.Exec(queryInsert, idUser, issuer, subject, time.Now())
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return errOidcIdentityTaken
+		}
+		return fmt.Errorf("Failed to link external identity to user id=%d: %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) createUserWithExternalIdentity(username string, password string, issuer string, subject string) (*user, error) {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return nil, fmt.Errorf("Error creating external user (create transaction): %w", err)
+	}
+	rollback := func() {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback external user creation!", slog.Any("error", err2))
+		}
+	}
+
+	userId, err := getUserId(tx, username)
+	if !errors.Is(err, sql.ErrNoRows) {
+		rollback()
+		if err != nil {
+			return nil, fmt.Errorf("Error creating external user (checking if user already exists): %w", err)
+		}
+		return nil, errUserAlreadyExists
+	}
+
+	reserved, err := isUsernameReserved(tx, username, -1, time.Now())
+	if err != nil || reserved {
+		rollback()
+		if err != nil {
+			return nil, fmt.Errorf("Error creating external user (checking username history): %w", err)
+		}
+		return nil, errUserAlreadyExists // reserved name is handled as taken, a suffixed one is tried
+	}
+
+	var salt string = generateSalt()
+	pwHash, err := getPasswordAndSaltSHA256Hash(salt, password)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("Error creating external user (password and salt hash): %w", err)
+	}
+
+	const queryInsertUser = "INSERT INTO users (username, salt, pw_hash, admin_role) VALUES($1, $2, $3, FALSE) RETURNING id"
+	err = tx.QueryRow(queryInsertUser, username, salt, pwHash).Scan(&userId)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("Error creating external user (insert): %w", err)
+	}
+
+	const queryInsertIdentity = "INSERT INTO user_external_identities (id_user, issuer, subject, dt_created) VALUES($1, $2, $3, $4)"
+	_, err = tx.Exec(queryInsertIdentity, userId, issuer, subject, time.Now())
+	if err != nil {
+		rollback()
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return nil, errOidcIdentityTaken
+		}
+		return nil, fmt.Errorf("Error creating external user (link identity): %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit external user creation: %w", err)
+	}
+	return &user{Id: userId, Username: username}, nil
+}
+
+func (postgresAdapter postgresAdapter) createPasswordResetToken(token passwordResetToken) error {
+	const queryInsert = "INSERT INTO password_reset_tokens (token_hash, id_user, dt_expires) VALUES($1, $2, $3)"
+	_, err := postgresAdapter.db.Exec(queryInsert, token.tokenHash, token.idUser, token.dtExpires)
+	if err != nil {
+		return fmt.Errorf("Failed to insert password reset token for user id=%d: %w", token.idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) takePasswordResetToken(tokenHash string) (*passwordResetToken, error) {
+	const query = "DELETE FROM password_reset_tokens WHERE token_hash=$1 RETURNING id_user, dt_expires"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, tokenHash)
+
+	token := passwordResetToken{tokenHash: tokenHash}
+	err := row.Scan(&token.idUser, &token.dtExpires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to take password reset token: %w", err)
+	}
+	return &token, nil
+}
+
+func (postgresAdapter postgresAdapter) deletePasswordResetTokensForUser(idUser int64) error {
+	const query = "DELETE FROM password_reset_tokens WHERE id_user=$1"
+	_, err := postgresAdapter.db.Exec(query, idUser)
+	if err != nil {
+		return fmt.Errorf("Failed to delete password reset tokens for user id=%d: %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deletePasswordResetTokensThatExpired(now time.Time) error {
+	const query = "DELETE FROM password_reset_tokens WHERE dt_expires <= $1"
+	_, err := postgresAdapter.db.Exec(query, now)
+	if err != nil {
+		return fmt.Errorf("Failed to delete password reset tokens <='%v': %w", now, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserProfile(idUser int64) (*userProfile, error) {
+	const query = "SELECT id, username, display_name, bio, website, avatar_version FROM users WHERE id=$1 LIMIT 1"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, idUser)
+
+	var avatarVersion int64
+	profile := &userProfile{}
+	err := row.Scan(&profile.IdUser, &profile.Username, &profile.DisplayName, &profile.Bio, &profile.Website, &avatarVersion)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUserDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to query profile of user id=%d: %w", idUser, err)
+	}
+	profile.AvatarUrl = avatarUrl(profile.IdUser, avatarVersion)
+	return profile, nil
+}
+
+func (postgresAdapter postgresAdapter) updateUserProfile(idUser int64, displayName string, bio string, website string) error {
+	const query = "UPDATE users SET display_name=$1, bio=$2, website=$3 WHERE id=$4"
+	result, err := postgresAdapter.db.Exec(query, displayName, bio, website, idUser)
+	if err != nil {
+		return fmt.Errorf("Failed to update profile of user id=%d: %w", idUser, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to update profile of user id=%d: %w", idUser, err)
+	}
+	if count == 0 {
+		return errUserDoesntExist
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) setUserAvatar(idUser int64, image []byte) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error setting avatar (create transaction): %w", err)
+	}
+
+	const queryAvatar = `INSERT INTO user_avatars (id_user, image, dt_updated) VALUES($1, $2, $3)
+	ON CONFLICT (id_user) DO UPDATE SET image=EXCLUDED.image, dt_updated=EXCLUDED.dt_updated`
+	_, err = tx.Exec(queryAvatar, idUser, image, time.Now())
+	if err == nil {
+		const queryVersion = "UPDATE users SET avatar_version=avatar_version+1 WHERE id=$1"
+		_, err = tx.Exec(queryVersion, idUser)
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback setting avatar!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error setting avatar of user id=%d: %w", idUser, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit setting avatar: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) deleteUserAvatar(idUser int64) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted, ReadOnly: false})
+	if err != nil {
+		return fmt.Errorf("Error deleting avatar (create transaction): %w", err)
+	}
+
+	_, err = tx.Exec("DELETE FROM user_avatars WHERE id_user=$1", idUser)
+	if err == nil {
+		_, err = tx.Exec("UPDATE users SET avatar_version=0 WHERE id=$1", idUser)
+	}
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback deleting avatar!", slog.Any("error", err2))
+		}
+		return fmt.Errorf("Error deleting avatar of user id=%d: %w", idUser, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit deleting avatar: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserAvatar(idUser int64) ([]byte, error) {
+	const query = "SELECT image FROM user_avatars WHERE id_user=$1"
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, idUser)
+
+	var image []byte
+	err := row.Scan(&image)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query avatar of user id=%d: %w", idUser, err)
+	}
+	return image, nil
+}
+
+// shadow-banned author must not find out, own shadow comments are listed as if visible
+func (postgresAdapter postgresAdapter) listUserRecentComments(idUser int64, idViewer int64, count uint64) ([]userRecentComment, error) {
+	const query = `SELECT id, url_hash, dt_created, comment_body FROM comments
+	WHERE id_user=$1 AND (status='visible' OR (status='shadow' AND id_user=$2)) ORDER BY dt_created DESC LIMIT $3`
+	rows, err := postgresAdapter.db.Query(query, idUser, idViewer, count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query recent comments of user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	comments := make([]userRecentComment, 0)
+	for rows.Next() {
+		var comment userRecentComment
+		err = rows.Scan(&comment.Id, &comment.UrlHash, &comment.DtCreated, &comment.CommentBody)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read recent comments of user id=%d: %w", idUser, err)
+		}
+		comments = append(comments, comment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recent comments of user id=%d: %w", idUser, err)
+	}
+	return comments, nil
+}
+
+func scanDataExportJob(scanner interface{ Scan(dest ...any) error }) (*dataExportJob, error) {
+	var (
+		job        dataExportJob
+		dtFinished sql.NullTime
+		dtExpires  sql.NullTime
+	)
+	err := scanner.Scan(&job.id, &job.idUser, &job.status, &job.includeHtml, &job.dtRequested, &dtFinished, &dtExpires)
+	if err != nil {
+		return nil, err
+	}
+	if dtFinished.Valid {
+		job.dtFinished = &dtFinished.Time
+	}
+	if dtExpires.Valid {
+		job.dtExpires = &dtExpires.Time
+	}
+	return &job, nil
+}
+
+func (postgresAdapter postgresAdapter) createDataExport(idUser int64, includeHtml bool, now time.Time) (*dataExportJob, error) {
+	const queryInsert = `INSERT INTO data_exports (id_user, status, include_html, dt_requested) VALUES($1, $2, $3, $4)
+	RETURNING id, id_user, status, include_html, dt_requested, dt_finished, dt_expires`
+	var row *sql.Row = postgresAdapter.db.QueryRow(queryInsert, idUser, dataExportStatusPending, includeHtml, now)
+
+	job, err := scanDataExportJob(row)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation, only one unfinished export per user
+			return nil, errDataExportPending
+		}
+		return nil, fmt.Errorf("Failed to insert data export for user id=%d: %w", idUser, err)
+	}
+	return job, nil
+}
+
+func (postgresAdapter postgresAdapter) claimDataExport(now time.Time, runningBefore time.Time) (*dataExportJob, error) {
+	const query = `UPDATE data_exports SET status=$1, dt_started=$2
+	WHERE id = (SELECT id FROM data_exports WHERE status=$3 OR (status=$1 AND dt_started < $4) ORDER BY id ASC LIMIT 1 FOR UPDATE SKIP LOCKED)
+	RETURNING id, id_user, status, include_html, dt_requested, dt_finished, dt_expires`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, dataExportStatusRunning, now, dataExportStatusPending, runningBefore)
+
+	job, err := scanDataExportJob(row)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to claim data export: %w", err)
+	}
+	return job, nil
+}
+
+func (postgresAdapter postgresAdapter) finishDataExport(id int64, archive []byte, now time.Time, dtExpires time.Time) error {
+	const query = "UPDATE data_exports SET status=$1, archive=$2, dt_finished=$3, dt_expires=$4 WHERE id=$5"
+	_, err := postgresAdapter.db.Exec(query, dataExportStatusReady, archive, now, dtExpires, id)
+	if err != nil {
+		return fmt.Errorf("Failed to finish data export id=%d: %w", id, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) failDataExport(id int64, now time.Time, dtExpires time.Time) error {
+	const query = "UPDATE data_exports SET status=$1, dt_finished=$2, dt_expires=$3 WHERE id=$4"
+	_, err := postgresAdapter.db.Exec(query, dataExportStatusFailed, now, dtExpires, id)
+	if err != nil {
+		return fmt.Errorf("Failed to mark data export id=%d as failed: %w", id, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listDataExports(idUser int64) ([]dataExportJob, error) {
+	const query = `SELECT id, id_user, status, include_html, dt_requested, dt_finished, dt_expires FROM data_exports
+	WHERE id_user=$1 ORDER BY id DESC`
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query data exports for user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	jobs := make([]dataExportJob, 0)
+	for rows.Next() {
+		job, err := scanDataExportJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read data exports for user id=%d: %w", idUser, err)
+		}
+		jobs = append(jobs, *job)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read data exports for user id=%d: %w", idUser, err)
+	}
+	return jobs, nil
+}
+
+func (postgresAdapter postgresAdapter) getDataExportArchive(id int64, idUser int64) (*dataExportJob, error) {
+	const query = `SELECT id, id_user, status, include_html, dt_requested, dt_finished, dt_expires, archive FROM data_exports
+	WHERE id=$1 AND id_user=$2 AND status=$3`
+	var row *sql.Row = postgresAdapter.db.QueryRow(query, id, idUser, dataExportStatusReady)
+
+	var (
+		job        dataExportJob
+		dtFinished sql.NullTime
+		dtExpires  sql.NullTime
+	)
+	err := row.Scan(&job.id, &job.idUser, &job.status, &job.includeHtml, &job.dtRequested, &dtFinished, &dtExpires, &job.archive)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query data export id=%d: %w", id, err)
+	}
+	if dtFinished.Valid {
+		job.dtFinished = &dtFinished.Time
+	}
+	if dtExpires.Valid {
+		job.dtExpires = &dtExpires.Time
+	}
+	return &job, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteDataExportsThatExpired(now time.Time) error {
+	const query = "DELETE FROM data_exports WHERE dt_expires <= $1"
+	_, err := postgresAdapter.db.Exec(query, now)
+	if err != nil {
+		return fmt.Errorf("Failed to delete data exports <='%v': %w", now, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listUserComments(idUser int64) ([]personalDataComment, error) {
+	const query = "SELECT id, id_parent, url_hash, dt_created, comment_body FROM comments WHERE id_user=$1 ORDER BY id ASC"
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query comments of user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	comments := make([]personalDataComment, 0)
+	for rows.Next() {
+		var (
+			comment  personalDataComment
+			idParent sql.NullInt64
+		)
+		err = rows.Scan(&comment.Id, &idParent, &comment.UrlHash, &comment.DtCreated, &comment.CommentBody)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read comments of user id=%d: %w", idUser, err)
+		}
+		if idParent.Valid {
+			comment.IdParent = &idParent.Int64
+		}
+		comments = append(comments, comment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read comments of user id=%d: %w", idUser, err)
+	}
+	return comments, nil
+}
+
+func (postgresAdapter postgresAdapter) listExternalIdentities(idUser int64) ([]personalDataExternalIdentity, error) {
+	const query = "SELECT issuer, subject, dt_created FROM user_external_identities WHERE id_user=$1 ORDER BY id ASC"
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query external identities of user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	identities := make([]personalDataExternalIdentity, 0)
+	for rows.Next() {
+		var identity personalDataExternalIdentity
+		err = rows.Scan(&identity.Issuer, &identity.Subject, &identity.DtCreated)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read external identities of user id=%d: %w", idUser, err)
+		}
+		identities = append(identities, identity)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read external identities of user id=%d: %w", idUser, err)
+	}
+	return identities, nil
+}
+
+func (postgresAdapter postgresAdapter) scheduleAccountDeletion(idUser int64, mode string, idRequestedBy *int64, now time.Time, dtExecute time.Time) error {
+	const query = `INSERT INTO account_deletions (id_user, mode, dt_requested, dt_execute, id_requested_by)
+	SELECT id, $2, $3, $4, $5 FROM users WHERE id=$1 AND NOT deleted_placeholder
+	ON CONFLICT (id_user) DO UPDATE SET mode=EXCLUDED.mode, dt_requested=EXCLUDED.dt_requested,
+	dt_execute=EXCLUDED.dt_execute, id_requested_by=EXCLUDED.id_requested_by`
+	result, err := postgresAdapter.db.Exec(query, idUser, mode, now, dtExecute, idRequestedBy)
+	if err != nil {
+		return fmt.Errorf("Failed to schedule account deletion for user id=%d: %w", idUser, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to schedule account deletion for user id=%d: %w", idUser, err)
+	}
+	if count == 0 {
+		return errUserDoesntExist
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) cancelAccountDeletion(idUser int64) (bool, error) {
+	const query = "DELETE FROM account_deletions WHERE id_user=$1"
+	result, err := postgresAdapter.db.Exec(query, idUser)
+	if err != nil {
+		return false, fmt.Errorf("Failed to cancel account deletion for user id=%d: %w", idUser, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return false, fmt.Errorf("Failed to cancel account deletion for user id=%d: %w", idUser, err)
+	}
+	return count > 0, nil
+}
+
+func scanAccountDeletionJob(row interface{ Scan(dest ...any) error }) (*accountDeletionJob, error) {
+	job := &accountDeletionJob{}
+	var idRequestedBy sql.NullInt64
+	err := row.Scan(&job.idUser, &job.mode, &job.dtRequested, &job.dtExecute, &idRequestedBy)
+	if err != nil {
+		return nil, err
+	}
+	if idRequestedBy.Valid {
+		job.idRequestedBy = &idRequestedBy.Int64
+	}
+	return job, nil
+}
+
+func (postgresAdapter postgresAdapter) getAccountDeletion(idUser int64) (*accountDeletionJob, error) {
+	const query = "SELECT id_user, mode, dt_requested, dt_execute, id_requested_by FROM account_deletions WHERE id_user=$1"
+	job, err := scanAccountDeletionJob(postgresAdapter.db.QueryRow(query, idUser))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query account deletion for user id=%d: %w", idUser, err)
+	}
+	return job, nil
+}
+
+func (postgresAdapter postgresAdapter) executeDueAccountDeletion(now time.Time) (*accountDeletionJob, error) {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to begin account deletion transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback account deletion!", slog.Any("error", err))
+		}
+	}
+
+	const query = `SELECT id_user, mode, dt_requested, dt_execute, id_requested_by FROM account_deletions
+	WHERE dt_execute <= $1 ORDER BY dt_execute ASC LIMIT 1 FOR UPDATE SKIP LOCKED`
+	job, err := scanAccountDeletionJob(tx.QueryRow(query, now))
+	if err != nil {
+		rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to claim account deletion: %w", err)
+	}
+
+	err = deleteAccountInTx(tx, job.idUser, job.mode)
+	if err != nil {
+		rollback()
+		return nil, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit account deletion for user id=%d: %w", job.idUser, err)
+	}
+	return job, nil
+}
+
+func (postgresAdapter postgresAdapter) executeAccountDeletion(idUser int64, mode string) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("Failed to begin account deletion transaction: %w", err)
+	}
+
+	err = deleteAccountInTx(tx, idUser, mode)
+	if err != nil {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback account deletion!", slog.Any("error", err2))
+		}
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit account deletion for user id=%d: %w", idUser, err)
+	}
+	return nil
+}
+
+// account_deletions row and everything else owned by the user goes away with ON DELETE CASCADE
+func deleteAccountInTx(tx *sql.Tx, idUser int64, mode string) error {
+	var idPlaceholder int64
+	err := tx.QueryRow("SELECT id FROM users WHERE deleted_placeholder").Scan(&idPlaceholder)
+	if err != nil {
+		return fmt.Errorf("Failed to query deleted user placeholder: %w", err)
+	}
+	if idPlaceholder == idUser {
+		return errUserDoesntExist
+	}
+
+	if mode == accountDeletionModeAnonymize {
+		_, err = tx.Exec("UPDATE comments SET id_user=$1 WHERE id_user=$2", idPlaceholder, idUser)
+		if err != nil {
+			return fmt.Errorf("Failed to anonymize comments of user id=%d: %w", idUser, err)
+		}
+	}
+
+	result, err := tx.Exec("DELETE FROM users WHERE id=$1", idUser)
+	if err != nil {
+		return fmt.Errorf("Failed to delete a user id=%d: %w", idUser, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("Failed to delete a user id=%d: %w", idUser, err)
+	}
+	if count == 0 {
+		return errUserDoesntExist
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listUserRoles(idUser int64) ([]roleAssignment, error) {
+	const query = "SELECT id_user, role, scope, dt_created, id_granted_by FROM user_roles WHERE id_user=$1 ORDER BY dt_created ASC"
+	rows, err := postgresAdapter.db.Query(query, idUser)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query roles for user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	roles := make([]roleAssignment, 0)
+	for rows.Next() {
+		var (
+			assignment  roleAssignment
+			idGrantedBy sql.NullInt64
+		)
+		err = rows.Scan(&assignment.IdUser, &assignment.Role, &assignment.Scope, &assignment.DtCreated, &idGrantedBy)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read roles for user id=%d: %w", idUser, err)
+		}
+		if idGrantedBy.Valid {
+			assignment.IdGrantedBy = &idGrantedBy.Int64
+		}
+		roles = append(roles, assignment)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read roles for user id=%d: %w", idUser, err)
+	}
+	return roles, nil
+}
+
+// users.admin_role is kept for code that only needs to know if the user is a global admin
+func syncUserAdminRole(tx *sql.Tx, idUser int64) error {
+	const query = `UPDATE users SET admin_role=EXISTS(SELECT 1 FROM user_roles
+	WHERE id_user=$1 AND scope='' AND role IN ($2, $3)) WHERE id=$1`
+	_, err := tx.Exec(query, idUser, rbacRoleAdmin, rbacRoleSuperadmin)
+	if err != nil {
+		return fmt.Errorf("Failed to update admin role of user id=%d: %w", idUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) assignUserRole(assignment roleAssignment) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("Failed to begin role assignment transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback role assignment!", slog.Any("error", err))
+		}
+	}
+
+	const query = `INSERT INTO user_roles (id_user, role, scope, dt_created, id_granted_by) VALUES ($1, $2, $3, $4, $5)
+	ON CONFLICT (id_user, role, scope) DO NOTHING`
+	_, err = tx.Exec(query, assignment.IdUser, assignment.Role, assignment.Scope, assignment.DtCreated, assignment.IdGrantedBy)
+	if err != nil {
+		rollback()
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return errUserDoesntExist
+		}
+		return fmt.Errorf("Failed to assign role to user id=%d: %w", assignment.IdUser, err)
+	}
+	err = syncUserAdminRole(tx, assignment.IdUser)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit role assignment for user id=%d: %w", assignment.IdUser, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) revokeUserRole(idUser int64, role string, scope string) (bool, error) {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return false, fmt.Errorf("Failed to begin role revoke transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback role revoke!", slog.Any("error", err))
+		}
+	}
+
+	const query = "DELETE FROM user_roles WHERE id_user=$1 AND role=$2 AND scope=$3"
+	result, err := tx.Exec(query, idUser, role, scope)
+	if err != nil {
+		rollback()
+		return false, fmt.Errorf("Failed to revoke role of user id=%d: %w", idUser, err)
+	}
+	count, err := result.RowsAffected()
+	if err != nil {
+		rollback()
+		return false, fmt.Errorf("Failed to revoke role of user id=%d: %w", idUser, err)
+	}
+	err = syncUserAdminRole(tx, idUser)
+	if err != nil {
+		rollback()
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("Failed to commit role revoke for user id=%d: %w", idUser, err)
+	}
+	return count > 0, nil
+}
+
+func (postgresAdapter postgresAdapter) createCommentReport(report commentReport) error {
+	const query = `INSERT INTO comment_reports (id_comment, id_reporter, reason, details, dt_created) VALUES ($1, $2, $3, $4, $5)`
+	_, err := postgresAdapter.db.Exec(query, report.IdComment, report.IdReporter, report.Reason, report.Details, report.DtCreated)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23505" { // unique_violation
+			return errCommentAlreadyReported
+		}
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return errCommentDoesntExist
+		}
+		return fmt.Errorf("Failed to report a comment id=%d: %w", report.IdComment, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listReportedComments(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error) {
+	const query = `SELECT cm.id, cm.id_site, cm.id_root, cm.id_parent, cm.url_hash, cm.id_user, cm.dt_created, cm.comment_body, cm.status, r.reports_count,
+	f.id_duplicate_of, f.similarity
+	FROM (SELECT id_comment, COUNT(*) AS reports_count, MIN(dt_created) AS dt_first FROM comment_reports
+		WHERE dt_resolved IS NULL GROUP BY id_comment) r
+	INNER JOIN comments cm ON cm.id = r.id_comment
+	LEFT JOIN comment_fingerprints f ON f.id_comment = cm.id
+	WHERE $1 OR cm.id_site = ANY($2) OR cm.url_hash = ANY($3)
+	ORDER BY r.reports_count DESC, r.dt_first ASC OFFSET $4 LIMIT $5`
+	rows, err := postgresAdapter.db.Query(query, scope.all, pq.Array(scope.idSites), pq.Array(scope.urlHashes), offset, count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query moderation queue: %w", err)
+	}
+	return scanModerationQueueItems(rows)
+}
+
+func (postgresAdapter postgresAdapter) listPendingComments(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error) {
+	const query = `SELECT cm.id, cm.id_site, cm.id_root, cm.id_parent, cm.url_hash, cm.id_user, cm.dt_created, cm.comment_body, cm.status, 0,
+	f.id_duplicate_of, f.similarity
+	FROM comments cm LEFT JOIN comment_fingerprints f ON f.id_comment = cm.id
+	WHERE cm.status=$1 AND ($2 OR cm.id_site = ANY($3) OR cm.url_hash = ANY($4))
+	ORDER BY cm.id ASC OFFSET $5 LIMIT $6`
+	rows, err := postgresAdapter.db.Query(query, commentStatusPending, scope.all, pq.Array(scope.idSites), pq.Array(scope.urlHashes), offset, count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query pending comments: %w", err)
+	}
+	return scanModerationQueueItems(rows)
+}
+
+func scanModerationQueueItems(rows *sql.Rows) ([]moderationQueueItem, error) {
+	defer rows.Close()
+
+	items := make([]moderationQueueItem, 0)
+	for rows.Next() {
+		var (
+			item          moderationQueueItem
+			cmtIdRoot     sql.NullInt64
+			cmtIdParent   sql.NullInt64
+			idDuplicateOf sql.NullInt64
+			similarity    sql.NullFloat64
+		)
+		err := rows.Scan(&item.Comment.Id, &item.Comment.IdSite, &cmtIdRoot, &cmtIdParent, &item.Comment.UrlHash, &item.Comment.IdUser, &item.Comment.DtCreated,
+			&item.Comment.CommentBody, &item.Comment.Status, &item.ReportsCount, &idDuplicateOf, &similarity)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read moderation queue: %w", err)
+		}
+		if idDuplicateOf.Valid {
+			item.DuplicateOf = &idDuplicateOf.Int64
+			item.DuplicateSimilarity = similarity.Float64
+		}
+		if cmtIdRoot.Valid {
+			item.Comment.IdRoot = &cmtIdRoot.Int64
+		}
+		if cmtIdParent.Valid {
+			item.Comment.IdParent = &cmtIdParent.Int64
+		}
+		items = append(items, item)
+	}
+	err := rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read moderation queue: %w", err)
+	}
+	return items, nil
+}
+
+func (postgresAdapter postgresAdapter) listOpenCommentReports(idComment int64) ([]commentReport, error) {
+	const query = `SELECT id, id_comment, id_reporter, reason, details, dt_created FROM comment_reports
+	WHERE id_comment=$1 AND dt_resolved IS NULL ORDER BY id ASC`
+	rows, err := postgresAdapter.db.Query(query, idComment)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query reports of comment id=%d: %w", idComment, err)
+	}
+	defer rows.Close()
+
+	reports := make([]commentReport, 0)
+	for rows.Next() {
+		var report commentReport
+		err = rows.Scan(&report.Id, &report.IdComment, &report.IdReporter, &report.Reason, &report.Details, &report.DtCreated)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read reports of comment id=%d: %w", idComment, err)
+		}
+		reports = append(reports, report)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read reports of comment id=%d: %w", idComment, err)
+	}
+	return reports, nil
+}
+
+func (postgresAdapter postgresAdapter) getAuthorModerationHistory(idUser int64, recentCount uint64) (*authorModerationHistory, error) {
+	const query = `SELECT usr.id, usr.username,
+	(SELECT COUNT(*) FROM comments WHERE id_user=usr.id),
+	(SELECT COUNT(*) FROM comments WHERE id_user=usr.id AND status=$2),
+	(SELECT COUNT(*) FROM moderation_actions WHERE id_author=usr.id AND action<>$3),
+	EXISTS(SELECT 1 FROM user_bans WHERE id_user=usr.id AND (dt_expires IS NULL OR dt_expires > $4))
+	FROM users usr WHERE usr.id=$1`
+	history := &authorModerationHistory{}
+	err := postgresAdapter.db.QueryRow(query, idUser, commentStatusHidden, moderationActionDismiss, time.Now()).Scan(&history.IdUser, &history.Username,
+		&history.CommentsCount, &history.HiddenCount, &history.ActionsCount, &history.Banned)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errUserDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to query moderation history of user id=%d: %w", idUser, err)
+	}
+
+	// moderators also see hidden comments of the author
+	const queryRecent = `SELECT id, url_hash, dt_created, comment_body FROM comments
+	WHERE id_user=$1 ORDER BY dt_created DESC LIMIT $2`
+	rows, err := postgresAdapter.db.Query(queryRecent, idUser, recentCount)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query recent comments of user id=%d: %w", idUser, err)
+	}
+	defer rows.Close()
+
+	history.RecentComments = make([]userRecentComment, 0, recentCount)
+	for rows.Next() {
+		var recent userRecentComment
+		err = rows.Scan(&recent.Id, &recent.UrlHash, &recent.DtCreated, &recent.CommentBody)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read recent comments of user id=%d: %w", idUser, err)
+		}
+		history.RecentComments = append(history.RecentComments, recent)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read recent comments of user id=%d: %w", idUser, err)
+	}
+	return history, nil
+}
+
+func (postgresAdapter postgresAdapter) applyModerationAction(record moderationActionRecord, now time.Time) error {
+	if record.IdComment == nil {
+		return errCommentDoesntExist
+	}
+	idComment := *record.IdComment
+
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("Failed to begin moderation transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback moderation action!", slog.Any("error", err))
+		}
+	}
+
+	// action is recorded first, deleting the comment sets id_comment to NULL
+	err = insertModerationActionRecord(tx, record, now)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	_, err = tx.Exec("UPDATE comment_reports SET dt_resolved=$1 WHERE id_comment=$2 AND dt_resolved IS NULL", now, idComment)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Failed to resolve reports of comment id=%d: %w", idComment, err)
+	}
+
+	var result sql.Result
+	switch record.Action {
+	case moderationActionHide, moderationActionBan:
+		result, err = tx.Exec("UPDATE comments SET status=$1 WHERE id=$2", commentStatusHidden, idComment)
+	case moderationActionApprove:
+		// concurrent moderator could have decided already
+		result, err = tx.Exec("UPDATE comments SET status=$1 WHERE id=$2 AND status=$3", commentStatusVisible, idComment, commentStatusPending)
+	case moderationActionReject:
+		result, err = tx.Exec("UPDATE comments SET status=$1 WHERE id=$2 AND status=$3", commentStatusRejected, idComment, commentStatusPending)
+	case moderationActionDelete:
+		result, err = tx.Exec("DELETE FROM comments WHERE id=$1", idComment)
+	}
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Failed to %s comment id=%d: %w", record.Action, idComment, err)
+	}
+	if record.Action == moderationActionApprove || record.Action == moderationActionReject {
+		affected, err := result.RowsAffected()
+		if err != nil {
+			rollback()
+			return fmt.Errorf("Failed to %s comment id=%d: %w", record.Action, idComment, err)
+		}
+		if affected == 0 {
+			rollback()
+			return errCommentNotPending
+		}
+	}
+
+	if record.Action == moderationActionBan && record.IdAuthor != nil {
+		ban := userBan{IdUser: *record.IdAuthor, Kind: userBanKindBan, Reason: record.Note, IdBannedBy: record.IdModerator, DtCreated: now}
+		err = upsertUserBan(tx, ban)
+		if err != nil {
+			rollback()
+			return err
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit moderation action on comment id=%d: %w", idComment, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getUserBan(idUser int64, now time.Time) (*userBan, error) {
+	const query = `SELECT id_user, kind, reason, id_banned_by, dt_created, dt_expires FROM user_bans
+	WHERE id_user=$1 AND (dt_expires IS NULL OR dt_expires > $2)`
+	var (
+		ban        userBan
+		idBannedBy sql.NullInt64
+		dtExpires  sql.NullTime
+	)
+	err := postgresAdapter.db.QueryRow(query, idUser, now).Scan(&ban.IdUser, &ban.Kind, &ban.Reason, &idBannedBy, &ban.DtCreated, &dtExpires)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query ban of user id=%d: %w", idUser, err)
+	}
+	if idBannedBy.Valid {
+		ban.IdBannedBy = &idBannedBy.Int64
+	}
+	if dtExpires.Valid {
+		ban.DtExpires = &dtExpires.Time
+	}
+	return &ban, nil
+}
+
+func upsertUserBan(tx *sql.Tx, ban userBan) error {
+	const query = `INSERT INTO user_bans (id_user, kind, reason, id_banned_by, dt_created, dt_expires) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (id_user) DO UPDATE SET kind=EXCLUDED.kind, reason=EXCLUDED.reason, id_banned_by=EXCLUDED.id_banned_by,
+	dt_created=EXCLUDED.dt_created, dt_expires=EXCLUDED.dt_expires`
+	_, err := tx.Exec(query, ban.IdUser, ban.Kind, ban.Reason, ban.IdBannedBy, ban.DtCreated, ban.DtExpires)
+	if err != nil {
+		var pqErr *pq.Error
+		if errors.As(err, &pqErr) && pqErr.Code == "23503" { // foreign_key_violation
+			return errUserDoesntExist
+		}
+		return fmt.Errorf("Failed to ban user id=%d: %w", ban.IdUser, err)
+	}
+	return nil
+}
+
+func insertModerationActionRecord(tx *sql.Tx, record moderationActionRecord, now time.Time) error {
+	const query = `INSERT INTO moderation_actions (action, id_comment, url_hash, id_author, id_moderator, note, dt_created)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	var urlHash *string
+	if record.UrlHash != "" {
+		urlHash = &record.UrlHash
+	}
+	_, err := tx.Exec(query, record.Action, record.IdComment, urlHash, record.IdAuthor, record.IdModerator, record.Note, now)
+	if err != nil {
+		return fmt.Errorf("Failed to record moderation action %s: %w", record.Action, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) setUserBan(ban userBan, record moderationActionRecord) error {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("Failed to begin ban transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback user ban!", slog.Any("error", err))
+		}
+	}
+
+	var previousKind sql.NullString
+	err = tx.QueryRow("SELECT kind FROM user_bans WHERE id_user=$1 FOR UPDATE", ban.IdUser).Scan(&previousKind)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		rollback()
+		return fmt.Errorf("Failed to query ban of user id=%d: %w", ban.IdUser, err)
+	}
+
+	err = upsertUserBan(tx, ban)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	// shadow comments of former shadow-ban are hidden by the new ban anyway, so only the other direction is needed
+	if ban.Kind == userBanKindShadow {
+		_, err = tx.Exec("UPDATE comments SET status_before_shadow=status, status=$1 WHERE id_user=$2 AND status IN ($3, $4)",
+			commentStatusShadow, ban.IdUser, commentStatusVisible, commentStatusPending)
+	} else if previousKind.String == userBanKindShadow && ban.Kind == userBanKindSuspension {
+		err = restoreShadowComments(tx, ban.IdUser)
+	}
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Failed to update comments of banned user id=%d: %w", ban.IdUser, err)
+	}
+
+	err = insertModerationActionRecord(tx, record, ban.DtCreated)
+	if err != nil {
+		rollback()
+		return err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit ban of user id=%d: %w", ban.IdUser, err)
+	}
+	return nil
+}
+
+// pending comments go back to the moderation queue, the rest become visible
+func restoreShadowComments(tx *sql.Tx, idUser int64) error {
+	_, err := tx.Exec(`UPDATE comments SET status=COALESCE(status_before_shadow, $1), status_before_shadow=NULL
+	WHERE id_user=$2 AND status=$3`, commentStatusVisible, idUser, commentStatusShadow)
+	return err
+}
+
+func (postgresAdapter postgresAdapter) deleteUserBan(idUser int64, record moderationActionRecord) (bool, error) {
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return false, fmt.Errorf("Failed to begin unban transaction: %w", err)
+	}
+	rollback := func() {
+		err := tx.Rollback()
+		if err != nil {
+			slog.Error("Failed to rollback user unban!", slog.Any("error", err))
+		}
+	}
+
+	var kind string
+	err = tx.QueryRow("DELETE FROM user_bans WHERE id_user=$1 RETURNING kind", idUser).Scan(&kind)
+	if err != nil {
+		rollback()
+		if errors.Is(err, sql.ErrNoRows) {
+			return false, nil
+		}
+		return false, fmt.Errorf("Failed to unban user id=%d: %w", idUser, err)
+	}
+
+	err = restoreShadowComments(tx, idUser)
+	if err != nil {
+		rollback()
+		return false, fmt.Errorf("Failed to restore comments of user id=%d: %w", idUser, err)
+	}
+
+	err = insertModerationActionRecord(tx, record, time.Now())
+	if err != nil {
+		rollback()
+		return false, err
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return false, fmt.Errorf("Failed to commit unban of user id=%d: %w", idUser, err)
+	}
+	return true, nil
+}
+
+func (postgresAdapter postgresAdapter) hasApprovedComment(idUser int64) (bool, error) {
+	var approved bool
+	err := postgresAdapter.db.QueryRow("SELECT EXISTS(SELECT 1 FROM comments WHERE id_user=$1 AND status=$2)", idUser, commentStatusVisible).Scan(&approved)
+	if err != nil {
+		return false, fmt.Errorf("Failed to query approved comments of user id=%d: %w", idUser, err)
+	}
+	return approved, nil
+}
+
+func (postgresAdapter postgresAdapter) getModerationPolicy(scope string) (string, error) {
+	var policy string
+	err := postgresAdapter.db.QueryRow("SELECT policy FROM moderation_policies WHERE scope=$1", scope).Scan(&policy)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", fmt.Errorf("Failed to query moderation policy scope='%s': %w", scope, err)
+	}
+	return policy, nil
+}
+
+func (postgresAdapter postgresAdapter) setModerationPolicy(scope string, policy string, idModifiedBy int64, now time.Time) error {
+	if policy == "" {
+		_, err := postgresAdapter.db.Exec("DELETE FROM moderation_policies WHERE scope=$1", scope)
+		if err != nil {
+			return fmt.Errorf("Failed to delete moderation policy scope='%s': %w", scope, err)
+		}
+		return nil
+	}
+
+	const query = `INSERT INTO moderation_policies (scope, policy, dt_modified, id_modified_by) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (scope) DO UPDATE SET policy=EXCLUDED.policy, dt_modified=EXCLUDED.dt_modified, id_modified_by=EXCLUDED.id_modified_by`
+	_, err := postgresAdapter.db.Exec(query, scope, policy, now, idModifiedBy)
+	if err != nil {
+		return fmt.Errorf("Failed to set moderation policy scope='%s': %w", scope, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error) {
+	var state pageDiscussionState
+	err := postgresAdapter.db.QueryRow("SELECT state, reason, dt_modified FROM page_discussion_states WHERE id_site=$1 AND url_hash=$2",
+		idSite, urlHash).Scan(&state.State, &state.Reason, &state.DtModified)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query discussion state id_site=%d url_hash='%s': %w", idSite, urlHash, err)
+	}
+	return &state, nil
+}
+
+func (postgresAdapter postgresAdapter) setPageDiscussionState(idSite int64, urlHash string, state string, reason string, idModifiedBy int64,
+	now time.Time) error {
+	if state == pageStateOpen {
+		_, err := postgresAdapter.db.Exec("DELETE FROM page_discussion_states WHERE id_site=$1 AND url_hash=$2", idSite, urlHash)
+		if err != nil {
+			return fmt.Errorf("Failed to delete discussion state id_site=%d url_hash='%s': %w", idSite, urlHash, err)
+		}
+		return nil
+	}
+
+	const query = `INSERT INTO page_discussion_states (id_site, url_hash, state, reason, dt_modified, id_modified_by) VALUES ($1, $2, $3, $4, $5, $6)
+	ON CONFLICT (id_site, url_hash) DO UPDATE SET state=EXCLUDED.state, reason=EXCLUDED.reason, dt_modified=EXCLUDED.dt_modified,
+	id_modified_by=EXCLUDED.id_modified_by`
+	_, err := postgresAdapter.db.Exec(query, idSite, urlHash, state, reason, now, idModifiedBy)
+	if err != nil {
+		return fmt.Errorf("Failed to set discussion state id_site=%d url_hash='%s': %w", idSite, urlHash, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) appendAuditLog(entry auditLogEntry) error {
+	const query = `INSERT INTO audit_log (dt_created, instance_id, id_actor, actor_username, action, target_type, target_id, before_state, after_state)
+	VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)`
+	var before, after *string
+	if entry.Before != nil {
+		beforeStr := string(entry.Before)
+		before = &beforeStr
+	}
+	if entry.After != nil {
+		afterStr := string(entry.After)
+		after = &afterStr
+	}
+	_, err := postgresAdapter.db.Exec(query, entry.DtCreated, entry.InstanceId, entry.IdActor, entry.ActorUsername, entry.Action,
+		entry.TargetType, entry.TargetId, before, after)
+	if err != nil {
+		return fmt.Errorf("Failed to append audit log action=%s: %w", entry.Action, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) queryAuditLog(filter auditLogFilter) ([]auditLogEntry, error) {
+	const query = `SELECT id, dt_created, instance_id, id_actor, actor_username, action, target_type, target_id, before_state, after_state
+	FROM audit_log
+	WHERE id > $1 AND ($2::BIGINT IS NULL OR id_actor = $2) AND ($3 = '' OR action = $3) AND ($4 = '' OR target_type = $4)
+	AND ($5 = '' OR target_id = $5) AND ($6::TIMESTAMP IS NULL OR dt_created >= $6) AND ($7::TIMESTAMP IS NULL OR dt_created < $7)
+	ORDER BY id ASC LIMIT $8`
+	rows, err := postgresAdapter.db.Query(query, filter.AfterId, filter.IdActor, filter.Action, filter.TargetType, filter.TargetId,
+		filter.DtFrom, filter.DtTo, filter.Count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query audit log: %w", err)
+	}
+	defer rows.Close()
+
+	entries := make([]auditLogEntry, 0)
+	for rows.Next() {
+		var (
+			entry   auditLogEntry
+			idActor sql.NullInt64
+			before  sql.NullString
+			after   sql.NullString
+		)
+		err = rows.Scan(&entry.Id, &entry.DtCreated, &entry.InstanceId, &idActor, &entry.ActorUsername, &entry.Action, &entry.TargetType,
+			&entry.TargetId, &before, &after)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read audit log: %w", err)
+		}
+		if idActor.Valid {
+			entry.IdActor = &idActor.Int64
+		}
+		if before.Valid {
+			entry.Before = json.RawMessage(before.String)
+		}
+		if after.Valid {
+			entry.After = json.RawMessage(after.String)
+		}
+		entries = append(entries, entry)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read audit log: %w", err)
+	}
+	return entries, nil
+}
+
+func (postgresAdapter postgresAdapter) getSpamAuthorStats(idUser int64, commentBody string, since time.Time) (*spamAuthorStats, error) {
+	const query = `SELECT COUNT(*) FILTER (WHERE status = $2), MIN(dt_created), COUNT(*) FILTER (WHERE dt_created >= $3 AND comment_body = $4)
+	FROM comments WHERE id_user = $1`
+	var (
+		stats          spamAuthorStats
+		dtFirstComment sql.NullTime
+	)
+	err := postgresAdapter.db.QueryRow(query, idUser, commentStatusVisible, since, commentBody).Scan(&stats.approvedComments, &dtFirstComment,
+		&stats.sameBodyComments)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query spam stats of user id=%d: %w", idUser, err)
+	}
+	if dtFirstComment.Valid {
+		stats.dtFirstComment = &dtFirstComment.Time
+	}
+	return &stats, nil
+}
+
+func (postgresAdapter postgresAdapter) getSpamTokenCounts(tokens []string) (map[string]spamTokenCounts, spamTrainingTotals, error) {
+	var totals spamTrainingTotals
+	err := postgresAdapter.db.QueryRow("SELECT spam_docs, ham_docs FROM spam_training_totals WHERE id = 1").Scan(&totals.spamDocs, &totals.hamDocs)
+	if err != nil {
+		return nil, totals, fmt.Errorf("Failed to query spam training totals: %w", err)
+	}
+
+	rows, err := postgresAdapter.db.Query("SELECT token, spam_count, ham_count FROM spam_tokens WHERE token = ANY($1)", pq.Array(tokens))
+	if err != nil {
+		return nil, totals, fmt.Errorf("Failed to query spam tokens: %w", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]spamTokenCounts)
+	for rows.Next() {
+		var (
+			token string
+			count spamTokenCounts
+		)
+		err = rows.Scan(&token, &count.spam, &count.ham)
+		if err != nil {
+			return nil, totals, fmt.Errorf("Failed to read spam tokens: %w", err)
+		}
+		counts[token] = count
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, totals, fmt.Errorf("Failed to read spam tokens: %w", err)
+	}
+	return counts, totals, nil
+}
+
+func (postgresAdapter postgresAdapter) trainSpamTokens(tokens []string, spam bool) error {
+	spamInc, hamInc := 0, 1
+	if spam {
+		spamInc, hamInc = 1, 0
+	}
+
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return fmt.Errorf("Failed to begin spam training transaction: %w", err)
+	}
+	rollback := func() {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback spam training!", slog.Any("error", err2))
+		}
+	}
+
+	const queryTokens = `INSERT INTO spam_tokens (token, spam_count, ham_count) SELECT token, $2, $3 FROM UNNEST($1::VARCHAR[]) AS token
+	ON CONFLICT (token) DO UPDATE SET spam_count = spam_tokens.spam_count + $2, ham_count = spam_tokens.ham_count + $3`
+	_, err = tx.Exec(queryTokens, pq.Array(tokens), spamInc, hamInc)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Failed to train spam tokens: %w", err)
+	}
+	_, err = tx.Exec("UPDATE spam_training_totals SET spam_docs = spam_docs + $1, ham_docs = ham_docs + $2 WHERE id = 1", spamInc, hamInc)
+	if err != nil {
+		rollback()
+		return fmt.Errorf("Failed to update spam training totals: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("Failed to commit spam training: %w", err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) getContentPolicy(scope string) (*contentPolicy, error) {
+	var policyJson []byte
+	err := postgresAdapter.db.QueryRow("SELECT policy FROM content_policies WHERE scope=$1", scope).Scan(&policyJson)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("Failed to query content policy scope='%s': %w", scope, err)
+	}
+
+	var policy contentPolicy
+	err = json.Unmarshal(policyJson, &policy)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse content policy scope='%s': %w", scope, err)
+	}
+	return &policy, nil
+}
+
+func (postgresAdapter postgresAdapter) setContentPolicy(scope string, policy *contentPolicy, idModifiedBy int64, now time.Time) error {
+	if policy == nil {
+		_, err := postgresAdapter.db.Exec("DELETE FROM content_policies WHERE scope=$1", scope)
+		if err != nil {
+			return fmt.Errorf("Failed to delete content policy scope='%s': %w", scope, err)
+		}
+		return nil
+	}
+
+	policyJson, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	const query = `INSERT INTO content_policies (scope, policy, dt_modified, id_modified_by) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (scope) DO UPDATE SET policy=EXCLUDED.policy, dt_modified=EXCLUDED.dt_modified, id_modified_by=EXCLUDED.id_modified_by`
+	_, err = postgresAdapter.db.Exec(query, scope, string(policyJson), now, idModifiedBy)
+	if err != nil {
+		return fmt.Errorf("Failed to set content policy scope='%s': %w", scope, err)
+	}
+	return nil
+}
+
+func (postgresAdapter postgresAdapter) listRecentCommentFingerprints(idUser *int64, since time.Time, count int) ([]commentFingerprint, error) {
+	const query = `SELECT id_comment, id_user, dt_created, body_hash, signature FROM comment_fingerprints
+	WHERE dt_created >= $1 AND ($2::BIGINT IS NULL OR id_user = $2) ORDER BY dt_created DESC LIMIT $3`
+	rows, err := postgresAdapter.db.Query(query, since, idUser, count)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query comment fingerprints: %w", err)
+	}
+	defer rows.Close()
+
+	fingerprints := make([]commentFingerprint, 0)
+	for rows.Next() {
+		var fingerprint commentFingerprint
+		err = rows.Scan(&fingerprint.idComment, &fingerprint.idUser, &fingerprint.dtCreated, &fingerprint.bodyHash, pq.Array(&fingerprint.signature))
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read comment fingerprints: %w", err)
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read comment fingerprints: %w", err)
+	}
+	return fingerprints, nil
+}
+
+func (postgresAdapter postgresAdapter) saveCommentFingerprint(fingerprint commentFingerprint, idDuplicateOf *int64, similarity float64) error {
+	const query = `INSERT INTO comment_fingerprints (id_comment, id_user, dt_created, body_hash, signature, id_duplicate_of, similarity)
+	VALUES ($1, $2, $3, $4, $5, $6, $7)`
+	_, err := postgresAdapter.db.Exec(query, fingerprint.idComment, fingerprint.idUser, fingerprint.dtCreated, fingerprint.bodyHash,
+		pq.Array(fingerprint.signature), idDuplicateOf, similarity)
+	if err != nil {
+		return fmt.Errorf("Failed to save fingerprint of comment id=%d: %w", fingerprint.idComment, err)
+	}
+	return nil
+}
+
+const siteColumns = "id, dt_created, name, allowed_origins, pow_required, pow_hardnes, styling, url_rules"
+
+func scanSite(row interface{ Scan(dest ...any) error }) (*site, error) {
+	var (
+		site         site
+		stylingJson  []byte
+		urlRulesJson []byte
+	)
+	err := row.Scan(&site.Id, &site.DtCreated, &site.Name, pq.Array(&site.AllowedOrigins), &site.PowRequired, &site.PowHardnes, &stylingJson,
+		&urlRulesJson)
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(stylingJson, &site.Styling)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse styling of site id=%d: %w", site.Id, err)
+	}
+	err = json.Unmarshal(urlRulesJson, &site.UrlRules)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to parse URL rules of site id=%d: %w", site.Id, err)
+	}
+	if site.AllowedOrigins == nil {
+		site.AllowedOrigins = make([]string, 0)
+	}
+	return &site, nil
+}
+
+func (postgresAdapter postgresAdapter) createSite(settings siteSettings, now time.Time) (*site, error) {
+	stylingJson, err := json.Marshal(settings.Styling)
+	if err != nil {
+		return nil, err
+	}
+	urlRulesJson, err := json.Marshal(settings.UrlRules)
+	if err != nil {
+		return nil, err
+	}
+	query := `INSERT INTO sites (name, allowed_origins, pow_required, pow_hardnes, styling, url_rules, dt_created)
+	VALUES ($1, $2, $3, $4, $5, $6, $7) RETURNING ` + siteColumns
+	site, err := scanSite(postgresAdapter.db.QueryRow(query, settings.Name, pq.Array(settings.AllowedOrigins), settings.PowRequired,
+		settings.PowHardnes, string(stylingJson), string(urlRulesJson), now))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to create site name='%s': %w", settings.Name, err)
+	}
+	return site, nil
+}
+
+func (postgresAdapter postgresAdapter) getSite(idSite int64) (*site, error) {
+	site, err := scanSite(postgresAdapter.db.QueryRow("SELECT "+siteColumns+" FROM sites WHERE id=$1", idSite))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errSiteDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to query site id=%d: %w", idSite, err)
+	}
+	return site, nil
+}
+
+func (postgresAdapter postgresAdapter) listSites(idSites []int64) ([]site, error) {
+	query := "SELECT " + siteColumns + " FROM sites WHERE $1::BIGINT[] IS NULL OR id = ANY($1) ORDER BY id ASC"
+	var idSitesArg any = pq.Array(idSites)
+	if idSites == nil {
+		idSitesArg = nil
+	}
+	rows, err := postgresAdapter.db.Query(query, idSitesArg)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query sites: %w", err)
+	}
+	defer rows.Close()
+
+	sites := make([]site, 0)
+	for rows.Next() {
+		site, err := scanSite(rows)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read sites: %w", err)
+		}
+		sites = append(sites, *site)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read sites: %w", err)
+	}
+	return sites, nil
+}
+
+func (postgresAdapter postgresAdapter) updateSite(idSite int64, settings siteSettings) (*site, error) {
+	stylingJson, err := json.Marshal(settings.Styling)
+	if err != nil {
+		return nil, err
+	}
+	urlRulesJson, err := json.Marshal(settings.UrlRules)
+	if err != nil {
+		return nil, err
+	}
+	query := `UPDATE sites SET name=$2, allowed_origins=$3, pow_required=$4, pow_hardnes=$5, styling=$6, url_rules=$7 WHERE id=$1
+	RETURNING ` + siteColumns
+	site, err := scanSite(postgresAdapter.db.QueryRow(query, idSite, settings.Name, pq.Array(settings.AllowedOrigins), settings.PowRequired,
+		settings.PowHardnes, string(stylingJson), string(urlRulesJson)))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errSiteDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to update site id=%d: %w", idSite, err)
+	}
+	return site, nil
+}
+
+func (postgresAdapter postgresAdapter) deleteSite(idSite int64) ([]int64, error) {
+	scope := rbacSiteScope(idSite)
+	tx, err := postgresAdapter.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelReadCommitted})
+	if err != nil {
+		return nil, fmt.Errorf("Failed to begin site deletion transaction: %w", err)
+	}
+	rollback := func() {
+		err2 := tx.Rollback()
+		if err2 != nil {
+			slog.Error("Failed to rollback site deletion!", slog.Any("error", err2))
+		}
+	}
+
+	rows, err := tx.Query("DELETE FROM user_roles WHERE scope=$1 RETURNING id_user", scope)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("Failed to delete roles of site id=%d: %w", idSite, err)
+	}
+	idUsers := make([]int64, 0)
+	for rows.Next() {
+		var idUser int64
+		err = rows.Scan(&idUser)
+		if err != nil {
+			rows.Close()
+			rollback()
+			return nil, fmt.Errorf("Failed to read roles of site id=%d: %w", idSite, err)
+		}
+		idUsers = append(idUsers, idUser)
+	}
+	rows.Close()
+
+	for _, query := range []string{"DELETE FROM moderation_policies WHERE scope=$1", "DELETE FROM content_policies WHERE scope=$1"} {
+		_, err = tx.Exec(query, scope)
+		if err != nil {
+			rollback()
+			return nil, fmt.Errorf("Failed to delete policies of site id=%d: %w", idSite, err)
+		}
+	}
+
+	// comments are deleted by foreign key cascade
+	result, err := tx.Exec("DELETE FROM sites WHERE id=$1", idSite)
+	if err != nil {
+		rollback()
+		return nil, fmt.Errorf("Failed to delete site id=%d: %w", idSite, err)
+	}
+	affected, err := result.RowsAffected()
+	if err != nil || affected == 0 {
+		rollback()
+		if err != nil {
+			return nil, fmt.Errorf("Failed to delete site id=%d: %w", idSite, err)
+		}
+		return nil, errSiteDoesntExist
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to commit site deletion: %w", err)
+	}
+	return idUsers, nil
+}
+
+func (postgresAdapter postgresAdapter) listSiteOwners(idSite int64) ([]siteOwner, error) {
+	const query = `SELECT us.id, us.username FROM user_roles ur INNER JOIN users us ON us.id = ur.id_user
+	WHERE ur.role=$1 AND ur.scope=$2 ORDER BY us.id ASC`
+	rows, err := postgresAdapter.db.Query(query, siteOwnerRole, rbacSiteScope(idSite))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to query owners of site id=%d: %w", idSite, err)
+	}
+	defer rows.Close()
+
+	owners := make([]siteOwner, 0)
+	for rows.Next() {
+		var owner siteOwner
+		err = rows.Scan(&owner.IdUser, &owner.Username)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read owners of site id=%d: %w", idSite, err)
+		}
+		owners = append(owners, owner)
+	}
+	err = rows.Err()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read owners of site id=%d: %w", idSite, err)
+	}
+	return owners, nil
+}
+
+const pageColumns = "id_site, url_hash, canonical_url, title, dt_created, dt_modified"
+
+func scanPage(row interface{ Scan(dest ...any) error }) (*page, error) {
+	var page page
+	err := row.Scan(&page.IdSite, &page.UrlHash, &page.CanonicalUrl, &page.Title, &page.DtCreated, &page.DtModified)
+	if err != nil {
+		return nil, err
+	}
+	return &page, nil
+}
+
+func (postgresAdapter postgresAdapter) getPage(idSite int64, urlHash string) (*page, error) {
+	page, err := scanPage(postgresAdapter.db.QueryRow("SELECT "+pageColumns+" FROM pages WHERE id_site=$1 AND url_hash=$2", idSite, urlHash))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errPageDoesntExist
+		}
+		return nil, fmt.Errorf("Failed to query page id_site=%d url_hash='%s': %w", idSite, urlHash, err)
+	}
+	return page, nil
+}
+
+func (postgresAdapter postgresAdapter) savePage(idSite int64, urlHash string, canonicalUrl string, title string, now time.Time) (*page, error) {
+	if len(urlHash) != urlHashLen {
+		return nil, errUrlHashLen
+	}
+	// known title is never overwritten, pages are registered by anybody
+	query := `INSERT INTO pages (id_site, url_hash, canonical_url, title, dt_created, dt_modified) VALUES ($1, $2, $3, $4, $5, $5)
+	ON CONFLICT (id_site, url_hash) DO UPDATE SET title=CASE WHEN pages.title = '' THEN $4 ELSE pages.title END, dt_modified=$5
+	RETURNING ` + pageColumns
+	page, err := scanPage(postgresAdapter.db.QueryRow(query, idSite, urlHash, canonicalUrl, title, now))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to save page id_site=%d url_hash='%s': %w", idSite, urlHash, err)
+	}
+	return page, nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+// implements duplicateDetectorItf
+type duplicateDetector struct {
+	config                   duplicateDetectorConfig
+	databaseServiceDuplicate databaseServiceDuplicateItf
+}
+
+func newDuplicateDetector(config duplicateDetectorConfig, databaseServiceDuplicate databaseServiceDuplicateItf) (*duplicateDetector, error) {
+	if databaseServiceDuplicate == nil {
+		return nil, errors.New("duplicate detector needs database")
+	}
+	err := validateDuplicateDetectorConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	return &duplicateDetector{config: config, databaseServiceDuplicate: databaseServiceDuplicate}, nil
+}
+
+func reachedRepeats(repeats int, threshold int) bool {
+	return threshold > 0 && repeats >= threshold
+}
+
+func (detector *duplicateDetector) checkDuplicate(idUser int64, commentBody string) (*duplicateCheck, error) {
+	now := time.Now()
+	check := &duplicateCheck{verdict: spamVerdictAllow, fingerprint: newCommentFingerprint(idUser, commentBody, now)}
+	since := now.Add(-detector.config.window)
+
+	// own comments are looked up separately, so that busy site doesn't push them out of global candidates
+	userCandidates, err := detector.databaseServiceDuplicate.listRecentCommentFingerprints(&idUser, since, detector.config.candidatesMax)
+	if err != nil {
+		return nil, err
+	}
+	countGlobal := len(commentShingles(normalizeCommentWords(commentBody))) >= detector.config.globalMinShingles
+	globalCandidates := make([]commentFingerprint, 0)
+	if countGlobal {
+		globalCandidates, err = detector.databaseServiceDuplicate.listRecentCommentFingerprints(nil, since, detector.config.candidatesMax)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	counted := make(map[int64]bool)
+	for _, candidates := range [][]commentFingerprint{userCandidates, globalCandidates} {
+		for _, candidate := range candidates {
+			if counted[candidate.idComment] {
+				continue
+			}
+			counted[candidate.idComment] = true
+
+			similarity := commentFingerprintSimilarity(check.fingerprint, candidate)
+			if similarity < detector.config.similarityThreshold {
+				continue
+			}
+			if countGlobal {
+				check.globalRepeats++
+			}
+			if candidate.idUser == idUser {
+				check.userRepeats++
+			}
+			if similarity > check.similarity {
+				check.similarity = similarity
+				check.idDuplicateOf = &candidate.idComment
+			}
+		}
+	}
+
+	config := detector.config
+	switch {
+	case reachedRepeats(check.userRepeats, config.userRejectRepeats) || reachedRepeats(check.globalRepeats, config.globalRejectRepeats):
+		check.verdict = spamVerdictReject
+	case reachedRepeats(check.userRepeats, config.userHoldRepeats) || reachedRepeats(check.globalRepeats, config.globalHoldRepeats):
+		check.verdict = spamVerdictHold
+	}
+	return check, nil
+}
+
+func (detector *duplicateDetector) recordComment(idComment int64, check *duplicateCheck) error {
+	fingerprint := check.fingerprint
+	fingerprint.idComment = idComment
+	return detector.databaseServiceDuplicate.saveCommentFingerprint(fingerprint, check.idDuplicateOf, check.similarity)
+}
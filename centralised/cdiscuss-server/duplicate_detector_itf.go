@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+const (
+	duplicateSignatureLen int = 64 // MinHash functions, similarity is precise to about 1/8
+	duplicateShingleWords int = 3
+)
+
+// repeats are earlier comments in the window at least similarityThreshold similar, 0 disables the action
+type duplicateDetectorConfig struct {
+	window              time.Duration
+	similarityThreshold float64
+	userHoldRepeats     int // repeats of own comments
+	userRejectRepeats   int
+	globalHoldRepeats   int // repeats of comments of anybody
+	globalRejectRepeats int
+	globalMinShingles   int // shorter comments ("thanks", "+1") are common, only own repeats of them count
+	candidatesMax       int // at most this many recent comments are compared, for user and global each
+}
+
+var defaultDuplicateDetectorConfig = duplicateDetectorConfig{window: 6 * time.Hour, similarityThreshold: 0.8, userHoldRepeats: 1,
+	userRejectRepeats: 3, globalHoldRepeats: 3, globalRejectRepeats: 10, globalMinShingles: 3, candidatesMax: 1000}
+
+type commentFingerprint struct {
+	idComment int64
+	idUser    int64
+	dtCreated time.Time
+	bodyHash  string
+	signature []int64
+}
+
+type duplicateCheck struct {
+	verdict       string // spamVerdict* constants
+	fingerprint   commentFingerprint
+	idDuplicateOf *int64 // most similar earlier comment
+	similarity    float64
+	userRepeats   int
+	globalRepeats int
+}
+
+type duplicateDetectorItf interface {
+	checkDuplicate(idUser int64, commentBody string) (*duplicateCheck, error)
+	// stores the fingerprint, so later comments are compared with this one
+	recordComment(idComment int64, check *duplicateCheck) error
+}
+
+func validateDuplicateDetectorConfig(config duplicateDetectorConfig) error {
+	if config.window <= 0 || config.similarityThreshold <= 0 || config.similarityThreshold > 1 || config.candidatesMax <= 0 {
+		return errors.New("bad duplicate detector config value")
+	}
+	if config.userHoldRepeats < 0 || config.userRejectRepeats < 0 || config.globalHoldRepeats < 0 || config.globalRejectRepeats < 0 ||
+		config.globalMinShingles < 0 {
+		return errors.New("bad duplicate detector config value")
+	}
+	return nil
+}
+
+// lowercase words without punctuation, so small edits don't change the hash
+func normalizeCommentWords(commentBody string) []string {
+	return strings.FieldsFunc(strings.ToLower(commentBody), func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsNumber(r)
+	})
+}
+
+func commentBodyHash(words []string) string {
+	hash := sha256.Sum256([]byte(strings.Join(words, " ")))
+	return hex.EncodeToString(hash[:])
+}
+
+// word shingles, short comments are a single shingle
+func commentShingles(words []string) []string {
+	if len(words) <= duplicateShingleWords {
+		return []string{strings.Join(words, " ")}
+	}
+	shingles := make([]string, 0, len(words)-duplicateShingleWords+1)
+	for i := 0; i+duplicateShingleWords <= len(words); i++ {
+		shingles = append(shingles, strings.Join(words[i:i+duplicateShingleWords], " "))
+	}
+	return shingles
+}
+
+// mixes shingle hash with function index, so one hash gives duplicateSignatureLen independent ones
+func minHashMix(hash uint64, seed uint64) uint64 {
+	hash ^= seed * 0x9e3779b97f4a7c15
+	hash ^= hash >> 33
+	hash *= 0xff51afd7ed558ccd
+	hash ^= hash >> 33
+	hash *= 0xc4ceb9fe1a85ec53
+	hash ^= hash >> 33
+	return hash
+}
+
+func commentMinHashSignature(shingles []string) []int64 {
+	mins := make([]uint64, duplicateSignatureLen)
+	for i := range mins {
+		mins[i] = ^uint64(0)
+	}
+	for _, shingle := range shingles {
+		hasher := fnv.New64a()
+		hasher.Write([]byte(shingle))
+		hash := hasher.Sum64()
+		for i := range mins {
+			if mixed := minHashMix(hash, uint64(i+1)); mixed < mins[i] {
+				mins[i] = mixed
+			}
+		}
+	}
+
+	signature := make([]int64, duplicateSignatureLen)
+	for i, min := range mins {
+		signature[i] = int64(min) // stored as BIGINT
+	}
+	return signature
+}
+
+func newCommentFingerprint(idUser int64, commentBody string, now time.Time) commentFingerprint {
+	words := normalizeCommentWords(commentBody)
+	return commentFingerprint{idUser: idUser, dtCreated: now, bodyHash: commentBodyHash(words),
+		signature: commentMinHashSignature(commentShingles(words))}
+}
+
+// estimated Jaccard similarity of shingle sets
+func commentFingerprintSimilarity(a commentFingerprint, b commentFingerprint) float64 {
+	if a.bodyHash == b.bodyHash {
+		return 1
+	}
+	if len(a.signature) != len(b.signature) || len(a.signature) == 0 {
+		return 0
+	}
+	same := 0
+	for i := range a.signature {
+		if a.signature[i] == b.signature[i] {
+			same++
+		}
+	}
+	return float64(same) / float64(len(a.signature))
+}
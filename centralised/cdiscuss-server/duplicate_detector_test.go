@@ -0,0 +1,104 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+type duplicateDbStub struct {
+	fingerprints []commentFingerprint
+}
+
+func (stub *duplicateDbStub) listRecentCommentFingerprints(idUser *int64, since time.Time, count int) ([]commentFingerprint, error) {
+	fingerprints := make([]commentFingerprint, 0)
+	for i := len(stub.fingerprints) - 1; i >= 0 && len(fingerprints) < count; i-- {
+		fingerprint := stub.fingerprints[i]
+		if fingerprint.dtCreated.Before(since) || (idUser != nil && fingerprint.idUser != *idUser) {
+			continue
+		}
+		fingerprints = append(fingerprints, fingerprint)
+	}
+	return fingerprints, nil
+}
+
+func (stub *duplicateDbStub) saveCommentFingerprint(fingerprint commentFingerprint, idDuplicateOf *int64, similarity float64) error {
+	stub.fingerprints = append(stub.fingerprints, fingerprint)
+	return nil
+}
+
+func TestCommentFingerprintSimilarity(t *testing.T) {
+	now := time.Now()
+	base := "Great article! Visit my site for the best cheap watches and bags, limited offer today only."
+	same := newCommentFingerprint(1, "great article, visit my site for the BEST cheap watches and bags; limited offer today only", now)
+	similar := newCommentFingerprint(1, base+" Hurry", now)
+	other := newCommentFingerprint(1, "I think the author misunderstood how the tax reform affects small businesses.", now)
+	fingerprint := newCommentFingerprint(1, base, now)
+
+	if got := commentFingerprintSimilarity(fingerprint, same); got != 1 {
+		t.Errorf("Normalized bodies should be equal, got %v", got)
+	}
+	if got := commentFingerprintSimilarity(fingerprint, similar); got < 0.7 {
+		t.Errorf("Near-duplicate should be similar, got %v", got)
+	}
+	if got := commentFingerprintSimilarity(fingerprint, other); got > 0.2 {
+		t.Errorf("Different comments should not be similar, got %v", got)
+	}
+}
+
+func TestDuplicateDetector(t *testing.T) {
+	if _, err := newDuplicateDetector(duplicateDetectorConfig{}, &duplicateDbStub{}); err == nil {
+		t.Errorf("Bad config accepted")
+	}
+	config := duplicateDetectorConfig{window: time.Hour, similarityThreshold: 0.8, userHoldRepeats: 1, userRejectRepeats: 2,
+		globalHoldRepeats: 2, globalRejectRepeats: 0, globalMinShingles: 3, candidatesMax: 100}
+	stub := &duplicateDbStub{}
+	detector, err := newDuplicateDetector(config, stub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	spam := "Buy followers now, the cheapest followers on the whole internet"
+
+	post := func(idComment int64, idUser int64, body string) *duplicateCheck {
+		check, err := detector.checkDuplicate(idUser, body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		detector.recordComment(idComment, check)
+		return check
+	}
+
+	if check := post(1, 10, spam); check.verdict != spamVerdictAllow {
+		t.Errorf("First comment should be allowed: %+v", check)
+	}
+	check := post(2, 10, spam+"!")
+	if check.verdict != spamVerdictHold || check.idDuplicateOf == nil || *check.idDuplicateOf != 1 {
+		t.Errorf("Own repeat should be held as duplicate of 1: %+v", check)
+	}
+	if check = post(3, 10, spam); check.verdict != spamVerdictReject {
+		t.Errorf("Second own repeat should be rejected: %+v", check)
+	}
+	if check = post(4, 20, spam); check.verdict != spamVerdictHold || check.userRepeats != 0 || check.globalRepeats != 3 {
+		t.Errorf("Repeat of other users should be held: %+v", check)
+	}
+	if check = post(5, 20, "Thanks, this explained the issue I had with my bike."); check.verdict != spamVerdictAllow {
+		t.Errorf("Different comment should be allowed: %+v", check)
+	}
+
+	// short comments repeat naturally, only own repeats of them count
+	for idUser := int64(30); idUser < 35; idUser++ {
+		if check = post(idUser, idUser, "Thanks!"); check.verdict != spamVerdictAllow || check.globalRepeats != 0 {
+			t.Errorf("Common short comment of user %d should be allowed: %+v", idUser, check)
+		}
+	}
+	if check = post(35, 30, "thanks"); check.verdict != spamVerdictHold || check.userRepeats != 1 {
+		t.Errorf("Own repeat of short comment should be held: %+v", check)
+	}
+
+	// outside of the window
+	for i := range stub.fingerprints {
+		stub.fingerprints[i].dtCreated = stub.fingerprints[i].dtCreated.Add(-2 * time.Hour)
+	}
+	if check = post(6, 10, spam); check.verdict != spamVerdictAllow {
+		t.Errorf("Old comments should not count: %+v", check)
+	}
+}
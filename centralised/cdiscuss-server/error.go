@@ -2,6 +2,7 @@ package main
 
 import (
 	"net/http"
+	"time"
 )
 
 type errWithHttpStatus interface {
@@ -9,12 +10,18 @@ type errWithHttpStatus interface {
 	getHttpStatus() int
 }
 
+type errWithRetryAfter interface {
+	errWithHttpStatus
+	getRetryAfter() time.Duration
+}
+
 var (
 	errInternalServer = newInternalServerError("Internal server error!", http.StatusInternalServerError)
 
 	errUserAlreadyExists      = newValidationError("User already exists.", http.StatusConflict)
 	errUserDoesntExist        = newValidationError("User doesn't exist.", http.StatusUnauthorized)
 	errCommentDoesntExist     = newValidationError("Comment doesn't exist.", http.StatusNotFound)
+	errCommentBodyEmpty       = newValidationError("Comment is empty.", http.StatusBadRequest)
 	errUserWrongPassword      = newValidationError("Wrong user password.", http.StatusUnauthorized)
 	errUserNotAdmin           = newValidationError("You need to be an admin to do that.", http.StatusUnauthorized)
 	errUrlHashLen             = newValidationError("Wrong URL hash length.", http.StatusBadRequest)
@@ -28,6 +35,101 @@ var (
 	errUsedPowToken    = newValidationError("Already used POW token.", http.StatusUnauthorized)
 
 	errUserSessionIsNotValid = newValidationError("User session is not valid or doesn't exist", http.StatusUnauthorized)
+	errSessionDoesntExist    = newValidationError("Session doesn't exist.", http.StatusNotFound)
+
+	errTwoFactorRequired       = newValidationError("Two-factor authentication code is required.", http.StatusUnauthorized)
+	errTwoFactorWrongCode      = newValidationError("Wrong two-factor authentication code.", http.StatusUnauthorized)
+	errTwoFactorTicketNotValid = newValidationError("Two-factor login is not valid or has expired.", http.StatusUnauthorized)
+	errTwoFactorNotEnrolled    = newValidationError("Two-factor authentication enrolment was not started.", http.StatusBadRequest)
+	errTwoFactorAlreadyEnabled = newValidationError("Two-factor authentication is already enabled.", http.StatusConflict)
+	errTwoFactorNotEnabled     = newValidationError("Two-factor authentication is not enabled.", http.StatusBadRequest)
+	errAdminTwoFactorRequired  = newValidationError("Admins need to enable two-factor authentication to do that.", http.StatusForbidden)
+
+	errPasskeyNotValid          = newValidationError("Passkey is not valid.", http.StatusUnauthorized)
+	errPasskeyChallengeNotValid = newValidationError("Passkey challenge is not valid or has expired.", http.StatusUnauthorized)
+	errPasskeyNameLen           = newValidationError("Passkey name is empty or too long.", http.StatusBadRequest)
+	errPasskeyAlreadyExists     = newValidationError("Passkey is already registered.", http.StatusConflict)
+
+	errCsrfOriginNotAllowed = newValidationError("Request origin is not allowed.", http.StatusForbidden)
+	errCsrfTokenNotValid    = newValidationError("CSRF token is missing or not valid.", http.StatusForbidden)
+
+	errApiTokenNotValid      = newValidationError("API token is not valid or was revoked.", http.StatusUnauthorized)
+	errApiTokenScopeMissing  = newValidationError("API token doesn't have the scope to do that.", http.StatusForbidden)
+	errApiTokenScopeNotValid = newValidationError("API token scopes are not valid.", http.StatusBadRequest)
+	errApiTokenNameLen       = newValidationError("API token name is empty or too long.", http.StatusBadRequest)
+	errApiTokenLimit         = newValidationError("Too many API tokens, revoke some first.", http.StatusConflict)
+	errApiTokenDoesntExist   = newValidationError("API token doesn't exist.", http.StatusNotFound)
+
+	errOidcNotValid            = newValidationError("External login is not valid or has expired.", http.StatusUnauthorized)
+	errOidcIdentityTaken       = newValidationError("External account is already linked to other user.", http.StatusConflict)
+	errOidcProviderUnavailable = newValidationError("External login provider is not available.", http.StatusBadGateway)
+
+	errPasswordResetTokenNotValid = newValidationError("Password reset link is not valid or has expired.", http.StatusUnauthorized)
+	errEmailNotValid              = newValidationError("Email address is not valid.", http.StatusBadRequest)
+
+	errUsernameReserved  = newValidationError("Username was recently used by other user, try again later.", http.StatusConflict)
+	errUsernameUnchanged = newValidationError("New username is the same as the old one.", http.StatusBadRequest)
+
+	errDisplayNameNotValid   = newValidationError("Display name is too long or contains unallowed chars.", http.StatusBadRequest)
+	errBioNotValid           = newValidationError("Bio is too long or contains unallowed chars.", http.StatusBadRequest)
+	errWebsiteNotValid       = newValidationError("Website must be a http or https URL.", http.StatusBadRequest)
+	errDataExportPending     = newValidationError("Data export is already being prepared.", http.StatusConflict)
+	errDataExportDoesntExist = newValidationError("Data export doesn't exist or has expired.", http.StatusNotFound)
+	errAvatarNotValid        = newValidationError("Avatar must be a PNG, JPEG or GIF image up to 2 MB and 4096x4096 pixels.", http.StatusBadRequest)
+
+	errAccountDeletionModeNotValid = newValidationError("Account deletion mode must be anonymize or purge.", http.StatusBadRequest)
+	errAccountDeletionNotScheduled = newValidationError("Account deletion is not scheduled.", http.StatusNotFound)
+
+	errPermissionDenied        = newValidationError("You don't have the permission to do that.", http.StatusForbidden)
+	errRoleNotValid            = newValidationError("Role must be moderator, admin or superadmin.", http.StatusBadRequest)
+	errRoleScopeNotValid       = newValidationError("Role scope must be empty (global), site:<id> or page:<urlHash>.", http.StatusBadRequest)
+	errRoleNotAssigned         = newValidationError("User doesn't have this role.", http.StatusNotFound)
+	errCantRevokeOwnSuperadmin = newValidationError("You can't revoke your own global superadmin role.", http.StatusConflict)
+
+	errReportReasonNotValid     = newValidationError("Report reason must be spam, harassment, hate, offtopic or other.", http.StatusBadRequest)
+	errReportDetailsNotValid    = newValidationError("Report details are too long.", http.StatusBadRequest)
+	errCommentAlreadyReported   = newValidationError("You have already reported this comment.", http.StatusConflict)
+	errModerationActionNotValid = newValidationError("Moderation action must be dismiss, hide, delete, ban, approve or reject.", http.StatusBadRequest)
+	errModerationNoteNotValid   = newValidationError("Moderation note is too long.", http.StatusBadRequest)
+	errUserBanned               = newValidationError("Your account is banned.", http.StatusForbidden)
+	errModerationPolicyNotValid = newValidationError("Moderation policy must be open, first-post or all.", http.StatusBadRequest)
+	errCommentNotPending        = newValidationError("Comment is not waiting for approval.", http.StatusConflict)
+	errUserBanKindNotValid      = newValidationError("Ban kind must be ban, suspension or shadow.", http.StatusBadRequest)
+	errUserBanDurationNotValid  = newValidationError("Suspension needs positive duration.", http.StatusBadRequest)
+	errUserNotBanned            = newValidationError("User is not banned.", http.StatusNotFound)
+
+	errAuditLogFilterNotValid = newValidationError("Audit log filter is not valid.", http.StatusBadRequest)
+
+	errCommentRejectedAsSpam = newValidationError("Comment looks like spam and was rejected.", http.StatusForbidden)
+	errCommentDuplicate      = newValidationError("Comment repeats recent comments and was rejected.", http.StatusForbidden)
+
+	errContentPolicyNotValid      = newValidationError("Content policy is not valid.", http.StatusBadRequest)
+	errContentPolicyScopeNotValid = newValidationError("Content policy scope must be empty (global) or site:<id>.", http.StatusBadRequest)
+	errCommentTooLong             = newValidationError("Comment is too long.", http.StatusBadRequest)
+	errCommentTooManyLinks        = newValidationError("Comment contains too many links.", http.StatusBadRequest)
+	errCommentBlockedByPolicy     = newValidationError("Comment contains words that are not allowed.", http.StatusBadRequest)
+	errUsernameBlockedByPolicy    = newValidationError("Username contains words that are not allowed.", http.StatusBadRequest)
+	errDisplayNameBlockedByPolicy = newValidationError("Display name contains words that are not allowed.", http.StatusBadRequest)
+
+	errSiteDoesntExist        = newValidationError("Site doesn't exist.", http.StatusNotFound)
+	errSiteNameNotValid       = newValidationError("Site name is empty or too long.", http.StatusBadRequest)
+	errSiteOriginNotValid     = newValidationError("Site origins must be up to 20 http or https origins.", http.StatusBadRequest)
+	errSitePowHardnesNotValid = newValidationError("Site proof of work hardnes is too high.", http.StatusBadRequest)
+	errSiteStylingNotValid    = newValidationError("Site styling is not valid.", http.StatusBadRequest)
+	errSiteOriginNotAllowed   = newValidationError("Request origin is not allowed for this site.", http.StatusForbidden)
+	errSiteNeedsOwner         = newValidationError("Site needs at least one owner.", http.StatusConflict)
+	errSiteUrlRulesNotValid   = newValidationError("Site URL rules are not valid.", http.StatusBadRequest)
+	errSiteDefaultDelete      = newValidationError("Default site can't be deleted.", http.StatusConflict)
+
+	errPageUrlNotValid   = newValidationError("Page URL must be an http or https URL.", http.StatusBadRequest)
+	errPageUrlNotAllowed = newValidationError("Page URL is not on this site.", http.StatusForbidden)
+	errPageTitleNotValid = newValidationError("Page title is not valid.", http.StatusBadRequest)
+	errPageDoesntExist   = newValidationError("Page doesn't exist.", http.StatusNotFound)
+
+	errPageDiscussionStateNotValid = newValidationError("Discussion state must be open, roots-locked, locked or archived.", http.StatusBadRequest)
+	errPageRootsLocked             = newValidationError("Discussion on this page accepts only replies.", http.StatusForbidden)
+	errPageLocked                  = newValidationError("Discussion on this page is locked.", http.StatusForbidden)
+	errPageArchived                = newValidationError("Discussion on this page is archived and read-only.", http.StatusForbidden)
 )
 
 type validationError struct {
@@ -70,6 +172,46 @@ func (err internalServerError) getHttpStatus() int {
 	return err.httpStatus
 }
 
+type rateLimitError struct {
+	errStr     string
+	httpStatus int
+	retryAfter time.Duration
+}
+
+func newRateLimitError(retryAfter time.Duration) rateLimitError {
+	var err rateLimitError
+	err.errStr = "Too many requests, try again later."
+	err.httpStatus = http.StatusTooManyRequests
+	err.retryAfter = retryAfter
+	return err
+}
+
+func newLoginBlockedError(retryAfter time.Duration) rateLimitError {
+	err := newRateLimitError(retryAfter)
+	err.errStr = "Too many failed logins, try again later."
+	return err
+}
+
+// Retry-After tells when the suspension ends
+func newUserSuspendedError(dtExpires time.Time) rateLimitError {
+	err := newRateLimitError(time.Until(dtExpires))
+	err.errStr = "Your account is suspended until " + dtExpires.UTC().Format(time.RFC3339) + "."
+	err.httpStatus = http.StatusForbidden
+	return err
+}
+
+func (err rateLimitError) Error() string {
+	return err.errStr
+}
+
+func (err rateLimitError) getHttpStatus() int {
+	return err.httpStatus
+}
+
+func (err rateLimitError) getRetryAfter() time.Duration {
+	return err.retryAfter
+}
+
 type errorDTO struct {
 	ErrStr     string `json: err`
 	HttpStatus int    `json: status`
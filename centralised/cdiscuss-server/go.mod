@@ -2,4 +2,4 @@ module cdiscuss-server
 
 go 1.21.4
 
-require github.com/lib/pq v1.10.9 // indirect
+require github.com/lib/pq v1.10.9
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type loginGuard struct {
+	policies  []loginGuardPolicy
+	forgetAge time.Duration
+
+	// used only when there is no database, otherwise failures are shared between instances through it
+	failuresMapMutex *sync.Mutex
+	failuresMap      map[string]loginFailures
+
+	stopWorkerChan               chan bool
+	deleteOutdatedFailuresTicker *time.Ticker
+
+	databaseServiceLoginGuard databaseServiceLoginGuardItf
+}
+
+func newLoginGuard(databaseServiceLoginGuard databaseServiceLoginGuardItf, policies []loginGuardPolicy, deleteOutdatedFailuresPeriod time.Duration) (*loginGuard, error) {
+	var guard loginGuard
+
+	if deleteOutdatedFailuresPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedFailuresPeriod value")
+	}
+	for _, policy := range policies {
+		if policy.scope != loginGuardScopeUsername && policy.scope != loginGuardScopeIP {
+			return nil, errors.New("bad login guard policy scope")
+		}
+		if policy.baseBackoff < 1 || policy.maxBackoff < policy.baseBackoff || policy.lockoutDuration < 1 || policy.forgetAge < 1 {
+			return nil, errors.New("bad login guard policy")
+		}
+		if policy.forgetAge > guard.forgetAge {
+			guard.forgetAge = policy.forgetAge
+		}
+	}
+
+	guard.policies = policies
+	guard.failuresMapMutex = &sync.Mutex{}
+	guard.failuresMap = make(map[string]loginFailures)
+	guard.databaseServiceLoginGuard = databaseServiceLoginGuard
+
+	guard.stopWorkerChan = make(chan bool)
+	guard.deleteOutdatedFailuresTicker = time.NewTicker(deleteOutdatedFailuresPeriod)
+
+	go guard.deleteOutdatedFailuresLoopWorker()
+
+	return &guard, nil
+}
+
+func (guard *loginGuard) deleteOutdatedFailuresLoopWorker() {
+	for {
+		select {
+		case <-guard.stopWorkerChan:
+			return
+		case <-guard.deleteOutdatedFailuresTicker.C:
+			guard.deleteOutdatedFailures()
+		}
+	}
+}
+
+func (guard *loginGuard) deleteOutdatedFailures() {
+	before := time.Now().Add(-guard.forgetAge)
+
+	if guard.databaseServiceLoginGuard != nil {
+		err := guard.databaseServiceLoginGuard.deleteLoginFailuresBefore(before)
+		if err != nil {
+			slog.Error("Deleting outdated login failures from DB:", slog.Any("error", err))
+		}
+	}
+
+	guard.failuresMapMutex.Lock()
+	for key, failures := range guard.failuresMap {
+		if failures.dtLastFailure.Before(before) {
+			delete(guard.failuresMap, key)
+		}
+	}
+	guard.failuresMapMutex.Unlock()
+}
+
+func (guard *loginGuard) stop() {
+	guard.deleteOutdatedFailuresTicker.Stop()
+
+	select {
+	case guard.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop loginGuard instance")
+	}
+
+	guard.failuresMapMutex.Lock()
+	guard.failuresMap = make(map[string]loginFailures)
+	guard.failuresMapMutex.Unlock()
+}
+
+func (guard *loginGuard) policyKey(policy loginGuardPolicy, username string, client clientInfo) string {
+	switch policy.scope {
+	case loginGuardScopeUsername:
+		if username == "" {
+			return ""
+		}
+		return loginGuardKey(policy.scope, username)
+	case loginGuardScopeIP:
+		if client.ip == "" {
+			return ""
+		}
+		return loginGuardKey(policy.scope, client.ip)
+	}
+	return ""
+}
+
+func (guard *loginGuard) getFailures(failureKey string) (loginFailures, error) {
+	if guard.databaseServiceLoginGuard != nil {
+		failures, err := guard.databaseServiceLoginGuard.getLoginFailures(failureKey)
+		if err != nil || failures == nil {
+			return loginFailures{}, err
+		}
+		return *failures, nil
+	}
+
+	guard.failuresMapMutex.Lock()
+	defer guard.failuresMapMutex.Unlock()
+	return guard.failuresMap[failureKey], nil
+}
+
+func (guard *loginGuard) checkLoginAllowed(username string, client clientInfo) error {
+	var (
+		now          time.Time = time.Now()
+		blockedUntil time.Time
+	)
+
+	for _, policy := range guard.policies {
+		failureKey := guard.policyKey(policy, username, client)
+		if failureKey == "" {
+			continue
+		}
+		failures, err := guard.getFailures(failureKey)
+		if err != nil {
+			slog.Error("Login guard failed to read login failures", slog.Any("error", err))
+			return errInternalServer
+		}
+		policyBlockedUntil := loginBlockedUntil(failures, policy, now)
+		if policyBlockedUntil.After(blockedUntil) {
+			blockedUntil = policyBlockedUntil
+		}
+	}
+
+	if blockedUntil.After(now) {
+		return newLoginBlockedError(blockedUntil.Sub(now))
+	}
+	return nil
+}
+
+func (guard *loginGuard) loginFailed(username string, client clientInfo) error {
+	now := time.Now()
+
+	for _, policy := range guard.policies {
+		failureKey := guard.policyKey(policy, username, client)
+		if failureKey == "" {
+			continue
+		}
+
+		var failures loginFailures
+		if guard.databaseServiceLoginGuard != nil {
+			failuresPtr, err := guard.databaseServiceLoginGuard.registerLoginFailure(failureKey, now, now.Add(-policy.forgetAge))
+			if err != nil {
+				return err
+			}
+			failures = *failuresPtr
+		} else {
+			guard.failuresMapMutex.Lock()
+			failures = guard.failuresMap[failureKey]
+			if isExpired(now, failures.dtLastFailure.Add(policy.forgetAge)) {
+				failures.failedCount = 0
+			}
+			failures.failedCount++
+			failures.dtLastFailure = now
+			guard.failuresMap[failureKey] = failures
+			guard.failuresMapMutex.Unlock()
+		}
+
+		if failures.failedCount == policy.lockoutFailures {
+			slog.Warn("Login locked out because of too many failures", slog.String("key", failureKey), slog.Any("failedCount", failures.failedCount))
+		}
+	}
+	return nil
+}
+
+func (guard *loginGuard) forgetFailures(failureKey string) error {
+	if guard.databaseServiceLoginGuard != nil {
+		err := guard.databaseServiceLoginGuard.deleteLoginFailures(failureKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	guard.failuresMapMutex.Lock()
+	delete(guard.failuresMap, failureKey)
+	guard.failuresMapMutex.Unlock()
+	return nil
+}
+
+func (guard *loginGuard) loginSucceeded(username string) error {
+	return guard.forgetFailures(loginGuardKey(loginGuardScopeUsername, username))
+}
+
+func (guard *loginGuard) unlockUser(username string) error {
+	return guard.forgetFailures(loginGuardKey(loginGuardScopeUsername, username))
+}
+
+func (guard *loginGuard) getPowHardnesIncrease(username string) uint {
+	var increase uint = 0
+
+	for _, policy := range guard.policies {
+		if policy.scope != loginGuardScopeUsername {
+			continue
+		}
+		failures, err := guard.getFailures(loginGuardKey(policy.scope, username))
+		if err != nil {
+			slog.Error("Login guard failed to read login failures", slog.Any("error", err))
+			continue
+		}
+		policyIncrease := loginPowHardnesIncrease(failures, policy, time.Now())
+		if policyIncrease > increase {
+			increase = policyIncrease
+		}
+	}
+	return increase
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"time"
+)
+
+const (
+	loginGuardScopeUsername string = "user"
+	loginGuardScopeIP       string = "ip"
+
+	loginGuardMaxPowHardnesIncrease uint          = 6
+	loginGuardCleanUpPeriod         time.Duration = time.Hour
+)
+
+// Failures below freeFailures are not punished, after that every failure doubles the waiting time
+// starting with baseBackoff up to maxBackoff. Reaching lockoutFailures locks the key for lockoutDuration.
+// Failures are forgotten after forgetAge without new failures.
+type loginGuardPolicy struct {
+	scope           string
+	freeFailures    uint
+	baseBackoff     time.Duration
+	maxBackoff      time.Duration
+	lockoutFailures uint
+	lockoutDuration time.Duration
+	forgetAge       time.Duration
+}
+
+var defaultLoginGuardPolicies = []loginGuardPolicy{
+	{scope: loginGuardScopeUsername, freeFailures: 3, baseBackoff: time.Second, maxBackoff: 5 * time.Minute,
+		lockoutFailures: 20, lockoutDuration: time.Hour, forgetAge: 24 * time.Hour},
+	{scope: loginGuardScopeIP, freeFailures: 10, baseBackoff: time.Second, maxBackoff: 15 * time.Minute,
+		lockoutFailures: 100, lockoutDuration: 6 * time.Hour, forgetAge: 24 * time.Hour},
+}
+
+type loginFailures struct {
+	failedCount   uint
+	dtLastFailure time.Time
+}
+
+type loginGuardItf interface {
+	// returns error with Retry-After if login for username or from the client is currently blocked
+	checkLoginAllowed(username string, client clientInfo) error
+	loginFailed(username string, client clientInfo) error
+	// forgets username failures, source failures are kept so guessing other usernames is still slowed down
+	loginSucceeded(username string) error
+	unlockUser(username string) error
+	// every failed login above free failures doubles the POW work required to login as username
+	getPowHardnesIncrease(username string) uint
+}
+
+func loginGuardKey(scope string, value string) string {
+	return scope + ":" + value
+}
+
+// returns the time until which login is blocked, zero time if it isn't
+func loginBlockedUntil(failures loginFailures, policy loginGuardPolicy, now time.Time) time.Time {
+	if isExpired(now, failures.dtLastFailure.Add(policy.forgetAge)) {
+		return time.Time{}
+	}
+	if failures.failedCount >= policy.lockoutFailures {
+		return failures.dtLastFailure.Add(policy.lockoutDuration)
+	}
+	if failures.failedCount < policy.freeFailures {
+		return time.Time{}
+	}
+
+	backoff := policy.baseBackoff
+	for i := policy.freeFailures; i < failures.failedCount && backoff < policy.maxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > policy.maxBackoff {
+		backoff = policy.maxBackoff
+	}
+	return failures.dtLastFailure.Add(backoff)
+}
+
+func loginPowHardnesIncrease(failures loginFailures, policy loginGuardPolicy, now time.Time) uint {
+	if isExpired(now, failures.dtLastFailure.Add(policy.forgetAge)) || failures.failedCount <= policy.freeFailures {
+		return 0
+	}
+	increase := failures.failedCount - policy.freeFailures
+	if increase > loginGuardMaxPowHardnesIncrease {
+		increase = loginGuardMaxPowHardnesIncrease
+	}
+	return increase
+}
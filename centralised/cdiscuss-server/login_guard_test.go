@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginBlockedUntil(t *testing.T) {
+	policy := loginGuardPolicy{scope: loginGuardScopeUsername, freeFailures: 3, baseBackoff: time.Second, maxBackoff: 8 * time.Second,
+		lockoutFailures: 10, lockoutDuration: time.Hour, forgetAge: 24 * time.Hour}
+	lastFailure := time.UnixMilli(1717855224906)
+	now := lastFailure.Add(time.Millisecond)
+
+	expectedBackoffs := map[uint]time.Duration{0: 0, 2: 0, 3: time.Second, 4: 2 * time.Second, 5: 4 * time.Second, 6: 8 * time.Second, 9: 8 * time.Second, 10: time.Hour}
+	for failedCount, expectedBackoff := range expectedBackoffs {
+		blockedUntil := loginBlockedUntil(loginFailures{failedCount: failedCount, dtLastFailure: lastFailure}, policy, now)
+		if expectedBackoff == 0 {
+			if !blockedUntil.IsZero() {
+				t.Errorf("Failures %d should not block: %v", failedCount, blockedUntil)
+			}
+			continue
+		}
+		if blockedUntil.Sub(lastFailure) != expectedBackoff {
+			t.Errorf("Wrong backoff for %d failures: %v", failedCount, blockedUntil.Sub(lastFailure))
+		}
+	}
+
+	blockedUntil := loginBlockedUntil(loginFailures{failedCount: 10, dtLastFailure: lastFailure}, policy, lastFailure.Add(25*time.Hour))
+	if !blockedUntil.IsZero() {
+		t.Errorf("Forgotten failures should not block: %v", blockedUntil)
+	}
+}
+
+func TestLoginPowHardnesIncrease(t *testing.T) {
+	policy := defaultLoginGuardPolicies[0]
+	now := time.UnixMilli(1717855224906)
+
+	if increase := loginPowHardnesIncrease(loginFailures{failedCount: policy.freeFailures, dtLastFailure: now}, policy, now); increase != 0 {
+		t.Errorf("Free failures should not increase hardnes: %d", increase)
+	}
+	if increase := loginPowHardnesIncrease(loginFailures{failedCount: policy.freeFailures + 2, dtLastFailure: now}, policy, now); increase != 2 {
+		t.Errorf("Wrong hardnes increase: %d", increase)
+	}
+	if increase := loginPowHardnesIncrease(loginFailures{failedCount: 1000, dtLastFailure: now}, policy, now); increase != loginGuardMaxPowHardnesIncrease {
+		t.Errorf("Hardnes increase should be capped: %d", increase)
+	}
+}
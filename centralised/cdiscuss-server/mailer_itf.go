@@ -0,0 +1,5 @@
+package main
+
+type mailerItf interface {
+	sendMail(to string, subject string, body string) error
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"strings"
+	"time"
+)
+
+// sends plain text mails through SMTP relay, STARTTLS is used when the server offers it
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func newSmtpMailer(addr string, from string, username string, password string) (*smtpMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errors.New("bad addr value")
+	}
+	if _, err = mail.ParseAddress(from); err != nil {
+		return nil, errors.New("bad from value")
+	}
+
+	mailer := &smtpMailer{addr: addr, from: from}
+	if username != "" {
+		mailer.auth = smtp.PlainAuth("", username, password, host)
+	}
+	return mailer, nil
+}
+
+func (mailer *smtpMailer) sendMail(to string, subject string, body string) error {
+	// header injection
+	if strings.ContainsAny(to, "\r\n") || strings.ContainsAny(subject, "\r\n") {
+		return errors.New("mail header contains new line")
+	}
+
+	var msg strings.Builder
+	msg.WriteString("From: " + mailer.from + "\r\n")
+	msg.WriteString("To: " + to + "\r\n")
+	msg.WriteString("Subject: " + subject + "\r\n")
+	msg.WriteString("Date: " + time.Now().Format(time.RFC1123Z) + "\r\n")
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	msg.WriteString("\r\n")
+	msg.WriteString(strings.ReplaceAll(body, "\n", "\r\n"))
+
+	err := smtp.SendMail(mailer.addr, mailer.auth, mailer.from, []string{to}, []byte(msg.String()))
+	if err != nil {
+		return fmt.Errorf("Failed to send mail: %w", err)
+	}
+	return nil
+}
@@ -1,10 +1,10 @@
 package main
 
 import (
-	"crypto/sha256"
 	"flag"
 	"fmt"
 	"log/slog"
+	"os"
 	"strconv"
 	"time"
 )
@@ -16,6 +16,10 @@ var db databaseServiceItf
 var mq mqServiceItf
 
 var doRequireProofOfWorkInRequests *bool = flag.Bool("pow", true, "Enable Proof Of Work for some of requsts (create user, login, create comment)")
+var exportUserDataId *int64 = flag.Int64("export-user-data", 0, "Admin: write personal data archive of the user with this id and exit")
+var exportUserDataOut *string = flag.String("export-out", "", "Admin: file the personal data archive is written to (default cdiscuss-<id>.zip)")
+var exportUserDataHtml *bool = flag.Bool("export-html", true, "Admin: include HTML version in the personal data archive")
+var exportAuditLogOut *string = flag.String("export-audit-log", "", "Admin: write the whole audit log as JSON lines to this file and exit")
 
 type cbObj struct { // TODO remove
 }
@@ -34,9 +38,39 @@ func generateNewInstanceID() string {
 	return randomPart + nowMicroHexStr
 }
 
+// admin CLI equivalent of dataExportServiceItf, runs synchronously
+func exportUserDataToFile(db databaseServiceItf, idUser int64, includeHtml bool, fileName string) error {
+	if fileName == "" {
+		fileName = fmt.Sprintf("cdiscuss-%d.zip", idUser)
+	}
+	exporter := &dataExportService{databaseService: db}
+	archive, err := exporter.exportPersonalData(idUser, includeHtml)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, archive, 0600)
+}
+
+// admin CLI equivalent of auditLogServiceItf.exportAuditLog
+func exportAuditLogToFile(db databaseServiceItf, fileName string) error {
+	file, err := os.OpenFile(fileName, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	exporter := &auditLogService{databaseServiceAuditLog: db}
+	err = exporter.writeAuditLogJsonLines(auditLogFilter{}, file)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
 func main() {
 	var err error
 
+	flag.Parse()
+
 	instanceID = generateNewInstanceID()
 	slog.Info("New cDiscuss instance", slog.String("instanceID", instanceID))
 
@@ -46,6 +80,21 @@ func main() {
 		slog.Error("connect", slog.Any("error", err))
 		return
 	}
+	if *exportUserDataId > 0 {
+		err = exportUserDataToFile(db, *exportUserDataId, *exportUserDataHtml, *exportUserDataOut)
+		if err != nil {
+			slog.Error("export user data", slog.Any("error", err))
+		}
+		return
+	}
+	if *exportAuditLogOut != "" {
+		err = exportAuditLogToFile(db, *exportAuditLogOut)
+		if err != nil {
+			slog.Error("export audit log", slog.Any("error", err))
+		}
+		return
+	}
+
 	mq, err = newMqPostgres(dbConnString, instanceID)
 	if err != nil {
 		slog.Error("create", slog.Any("error", err))
@@ -75,9 +124,14 @@ func main() {
 		return
 	}
 
-	urlHash := fmt.Sprintf("%x", sha256.Sum256([]byte("https://www.example.com")))
+	canonicalUrl, err := canonicalizeUrl("https://www.example.com", siteUrlRules{})
+	if err != nil {
+		slog.Error("canonicalize url", slog.Any("error", err))
+		return
+	}
+	urlHash := hashCanonicalUrl(canonicalUrl)
 
-	commentId, err := db.createComment(nil, urlHash, user.Id, time.Now(), "besedilo")
+	commentId, err := db.createComment(defaultSiteId, nil, urlHash, user.Id, time.Now(), "besedilo", commentStatusVisible, false)
 	if err != nil {
 		slog.Error("create comment", slog.Any("error", err))
 		return
@@ -90,7 +144,7 @@ func main() {
 			return
 		}
 	*/
-	pageComments, err := db.listPageComments(urlHash, 0, 100)
+	pageComments, err := db.listPageComments(defaultSiteId, urlHash, 0, 100, 0, false)
 	if err != nil {
 		slog.Error("list comments", slog.Any("error", err))
 		return
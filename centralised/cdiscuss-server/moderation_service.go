@@ -0,0 +1,669 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+type userBanCacheContainer struct {
+	ban         *userBan // nil if the user is not banned
+	cachedUntil time.Time
+}
+
+type moderationPolicyCacheContainer struct {
+	policy      string
+	cachedUntil time.Time
+}
+
+type pageStateCacheContainer struct {
+	state       *pageDiscussionState
+	cachedUntil time.Time
+}
+
+// implements moderationServiceItf, banCheckerItf, preModeratorItf and pageStateCheckerItf
+type moderationService struct {
+	userService               userServiceItf
+	sessionStore              sessionStoreItf
+	authorizer                authorizerItf
+	databaseServiceComment    databaseServiceCommentItf
+	databaseServiceModeration databaseServiceModerationItf
+	rateLimiter               rateLimiterItf
+	auditLogger               auditLoggerItf
+	spamTrainer               spamTrainerItf
+	mqService                 mqServiceItf
+
+	subscribersMutex *sync.RWMutex
+	subscribers      map[int64]func(event moderationEvent)
+	lastSubscriberId int64
+
+	policiesMap   *sync.Map // scope -> moderationPolicyCacheContainer
+	bansMap       *sync.Map // idUser -> userBanCacheContainer
+	pageStatesMap *sync.Map // pageKey -> pageStateCacheContainer
+}
+
+func newModerationService(userService userServiceItf, sessionStore sessionStoreItf, authorizer authorizerItf, databaseServiceComment databaseServiceCommentItf,
+	databaseServiceModeration databaseServiceModerationItf, rateLimiter rateLimiterItf, auditLogger auditLoggerItf, spamTrainer spamTrainerItf, mqService mqServiceItf) (*moderationService, error) {
+	if databaseServiceComment == nil || databaseServiceModeration == nil {
+		return nil, errors.New("moderation service needs database")
+	}
+	if authorizer == nil {
+		return nil, errors.New("moderation service needs authorizer")
+	}
+
+	service := &moderationService{userService: userService, sessionStore: sessionStore, authorizer: authorizer,
+		databaseServiceComment: databaseServiceComment, databaseServiceModeration: databaseServiceModeration, rateLimiter: rateLimiter,
+		auditLogger: auditLogger, spamTrainer: spamTrainer, mqService: mqService, subscribersMutex: &sync.RWMutex{}, subscribers: make(map[int64]func(event moderationEvent)),
+		policiesMap: &sync.Map{}, bansMap: &sync.Map{}, pageStatesMap: &sync.Map{}}
+
+	if service.mqService != nil {
+		// also local, subscribers on this instance are informed the same way
+		service.mqService.registerMessageCB(mqModerationAction, service, true)
+		service.mqService.registerMessageCB(mqModerationPolicy, service, false)
+		service.mqService.registerMessageCB(mqPageState, service, false)
+		// bans are changed together with the user object in session store
+		service.mqService.registerMessageCB(mqUserModified, service, false)
+		service.mqService.registerMessageCB(mqSessionsForUserEnd, service, false)
+	}
+	return service, nil
+}
+
+// implement MQ mqMessageCbItf
+func (service *moderationService) onMessage(msg mqMessage) {
+	switch msg.Operation {
+	case mqModerationPolicy:
+		service.policiesMap.Delete(msg.Argument)
+		return
+	case mqPageState:
+		service.pageStatesMap.Delete(msg.Argument)
+		return
+	case mqUserModified, mqSessionsForUserEnd:
+		idUser, err := strconv.ParseInt(msg.Argument, 10, 64)
+		if err != nil {
+			slog.Error("Forgetting cached ban idUser parsing error:", slog.String("idUserStr", msg.Argument), slog.Any("error", err))
+			return
+		}
+		service.bansMap.Delete(idUser)
+		return
+	}
+
+	var event moderationEvent
+	err := json.Unmarshal([]byte(msg.Argument), &event)
+	if err != nil {
+		slog.Error("Moderation event JSON unmarshal problem", slog.Any("error", err))
+		return
+	}
+	service.notifySubscribers(event)
+}
+
+func (service *moderationService) stop() {
+	if service.mqService != nil {
+		for _, operation := range []string{mqModerationAction, mqModerationPolicy, mqPageState, mqUserModified, mqSessionsForUserEnd} {
+			if err := service.mqService.unregisterMessageCB(operation, service); err != nil {
+				slog.Error("moderationService unregistering MQ CB error:", slog.String("operation", operation), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *moderationService) notifySubscribers(event moderationEvent) {
+	service.subscribersMutex.RLock()
+	defer service.subscribersMutex.RUnlock()
+	for _, callback := range service.subscribers {
+		callback(event)
+	}
+}
+
+func (service *moderationService) subscribeModerationEvents(callback func(event moderationEvent)) func() {
+	service.subscribersMutex.Lock()
+	service.lastSubscriberId++
+	id := service.lastSubscriberId
+	service.subscribers[id] = callback
+	service.subscribersMutex.Unlock()
+
+	return func() {
+		service.subscribersMutex.Lock()
+		delete(service.subscribers, id)
+		service.subscribersMutex.Unlock()
+	}
+}
+
+func (service *moderationService) publishModerationEvent(event moderationEvent) {
+	if service.mqService == nil {
+		service.notifySubscribers(event)
+		return
+	}
+	eventJson, err := json.Marshal(event)
+	if err != nil {
+		slog.Error("Moderation event JSON marshal problem", slog.Any("error", err))
+		return
+	}
+	err = service.mqService.sendMessage(mqModerationAction, string(eventJson))
+	if err != nil {
+		slog.Error("moderation: informing other instances failed", slog.Any("error", err), slog.Int64("idComment", event.IdComment))
+	}
+}
+
+func (service *moderationService) reportComment(sessionCookie *http.Cookie, client clientInfo, idComment int64, reason string, details string) error {
+	err := validateCommentReport(reason, details)
+	if err != nil {
+		return err
+	}
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopePostComments)
+	if err != nil {
+		return err
+	}
+
+	if service.rateLimiter != nil {
+		err = service.rateLimiter.allow(rateLimitOpReportComment, rateLimitKeys{idUser: &user.Id, client: client})
+		if err != nil {
+			return err
+		}
+	}
+
+	comment, err := service.databaseServiceComment.getComment(idComment)
+	if err != nil {
+		return err
+	}
+	if comment.Status != commentStatusVisible {
+		return errCommentDoesntExist
+	}
+
+	report := commentReport{IdComment: idComment, IdReporter: user.Id, Reason: reason, Details: details, DtCreated: time.Now()}
+	return service.databaseServiceModeration.createCommentReport(report)
+}
+
+func (service *moderationService) listModerationQueue(sessionCookie *http.Cookie, offset uint64, count uint64) ([]moderationQueueItem, error) {
+	return service.listQueue(sessionCookie, offset, count, service.databaseServiceModeration.listReportedComments)
+}
+
+func (service *moderationService) listPendingComments(sessionCookie *http.Cookie, offset uint64, count uint64) ([]moderationQueueItem, error) {
+	return service.listQueue(sessionCookie, offset, count, service.databaseServiceModeration.listPendingComments)
+}
+
+// moderators with site or page scoped role see only their part of the queue, it's filtered before paging
+func (service *moderationService) getModerationQueueScope(moderator *user) (moderationQueueScope, error) {
+	err := service.authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{})
+	if err == nil {
+		return moderationQueueScope{all: true}, nil
+	}
+	if !errors.Is(err, errPermissionDenied) {
+		return moderationQueueScope{}, err
+	}
+
+	roles, err := service.authorizer.listUserRoles(moderator.Id)
+	if err != nil {
+		return moderationQueueScope{}, err
+	}
+	scope := moderationQueueScope{idSites: make([]int64, 0), urlHashes: make([]string, 0)}
+	for _, role := range roles {
+		if !rbacRoleHasPermission(role.Role, rbacPermCommentsModerate) {
+			continue
+		}
+		if site, found := strings.CutPrefix(role.Scope, rbacScopeSitePrefix); found {
+			idSite, err := strconv.ParseInt(site, 10, 64)
+			if err == nil {
+				scope.idSites = append(scope.idSites, idSite)
+			}
+		} else if urlHash, found := strings.CutPrefix(role.Scope, rbacScopePagePrefix); found {
+			scope.urlHashes = append(scope.urlHashes, urlHash)
+		}
+	}
+	if len(scope.idSites) == 0 && len(scope.urlHashes) == 0 {
+		return moderationQueueScope{}, errPermissionDenied
+	}
+	return scope, nil
+}
+
+// fills context of the queue items
+func (service *moderationService) listQueue(sessionCookie *http.Cookie, offset uint64, count uint64,
+	listItems func(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error)) ([]moderationQueueItem, error) {
+	if count > moderationQueueMaxCount {
+		count = moderationQueueMaxCount
+	}
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+	scope, err := service.getModerationQueueScope(user)
+	if err != nil {
+		return nil, err
+	}
+
+	items, err := listItems(scope, offset, count)
+	if err != nil {
+		return nil, err
+	}
+
+	// the same author is often queued many times
+	authors := make(map[int64]*authorModerationHistory)
+	for i := range items {
+		item := &items[i]
+		if item.Comment.IdParent != nil {
+			parent, err := service.databaseServiceComment.getComment(*item.Comment.IdParent)
+			if err == nil {
+				item.ParentComment = parent
+			} else if !errors.Is(err, errCommentDoesntExist) {
+				return nil, err
+			}
+		}
+		item.Reports, err = service.databaseServiceModeration.listOpenCommentReports(item.Comment.Id)
+		if err != nil {
+			return nil, err
+		}
+		author, ok := authors[item.Comment.IdUser]
+		if !ok {
+			author, err = service.databaseServiceModeration.getAuthorModerationHistory(item.Comment.IdUser, moderationAuthorComments)
+			if err != nil {
+				return nil, err
+			}
+			authors[item.Comment.IdUser] = author
+		}
+		item.Author = author
+	}
+	return items, nil
+}
+
+func (service *moderationService) moderateComment(sessionCookie *http.Cookie, idComment int64, action string, note string) error {
+	err := validateModerationAction(action, note)
+	if err != nil {
+		return err
+	}
+	moderator, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return err
+	}
+
+	comment, err := service.databaseServiceComment.getComment(idComment)
+	if err != nil {
+		return err
+	}
+	err = service.authorizer.authorize(moderator, rbacPermCommentsModerate, rbacSiteTarget(comment.IdSite, comment.UrlHash))
+	if err != nil {
+		return err
+	}
+	if action == moderationActionBan {
+		// ban is global and permanent, site or page moderators can't issue it
+		err = service.authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{})
+		if err != nil {
+			return err
+		}
+		err = service.authorizeBanOf(moderator, comment.IdUser)
+		if err != nil {
+			return err
+		}
+	}
+	if (action == moderationActionApprove || action == moderationActionReject) && comment.Status != commentStatusPending {
+		return errCommentNotPending
+	}
+
+	record := moderationActionRecord{Action: action, IdComment: &comment.Id, UrlHash: comment.UrlHash, IdAuthor: &comment.IdUser,
+		IdModerator: &moderator.Id, Note: note}
+	err = service.databaseServiceModeration.applyModerationAction(record, time.Now())
+	if err != nil {
+		return err
+	}
+
+	if action == moderationActionBan {
+		service.forgetCachedBan(comment.IdUser, true)
+	}
+	service.trainSpam(comment, action)
+	logAuditAction(service.auditLogger, moderator, auditActionCommentModerate, auditTargetComment, strconv.FormatInt(comment.Id, 10),
+		map[string]any{"idUser": comment.IdUser, "urlHash": comment.UrlHash, "status": comment.Status},
+		map[string]any{"action": action, "note": note})
+
+	service.publishModerationEvent(moderationEvent{Action: action, IdComment: comment.Id, UrlHash: comment.UrlHash, IdAuthor: comment.IdUser})
+	return nil
+}
+
+// only decisions that clearly tell spam from ham are learned, hide and delete are used for other reasons too
+func (service *moderationService) trainSpam(comment *comment, action string) {
+	if service.spamTrainer == nil {
+		return
+	}
+	var spam bool
+	switch action {
+	case moderationActionReject, moderationActionBan:
+		spam = true
+	case moderationActionApprove, moderationActionDismiss:
+		spam = false
+	default:
+		return
+	}
+	err := service.spamTrainer.trainSpam(comment.CommentBody, spam)
+	if err != nil {
+		slog.Error("Training spam classifier failed", slog.Int64("idComment", comment.Id), slog.Any("error", err))
+	}
+}
+
+func (service *moderationService) approveComment(sessionCookie *http.Cookie, idComment int64) error {
+	return service.moderateComment(sessionCookie, idComment, moderationActionApprove, "")
+}
+
+func (service *moderationService) rejectComment(sessionCookie *http.Cookie, idComment int64, note string) error {
+	return service.moderateComment(sessionCookie, idComment, moderationActionReject, note)
+}
+
+func (service *moderationService) setModerationPolicy(sessionCookie *http.Cookie, scope string, policy string) error {
+	err := validateModerationPolicy(policy)
+	if err != nil {
+		return err
+	}
+	// any role is fine for validating the scope
+	err = validateRbacRoleAndScope(rbacRoleModerator, scope)
+	if err != nil {
+		return err
+	}
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return err
+	}
+	err = service.authorizer.authorize(user, rbacPermSiteConfigure, rbacScopeToTarget(scope))
+	if err != nil {
+		return err
+	}
+
+	previousPolicy, err := service.databaseServiceModeration.getModerationPolicy(scope)
+	if err != nil {
+		return err
+	}
+	err = service.databaseServiceModeration.setModerationPolicy(scope, policy, user.Id, time.Now())
+	if err != nil {
+		return err
+	}
+	logAuditAction(service.auditLogger, user, auditActionModerationPolicySet, auditTargetScope, scope,
+		map[string]string{"policy": previousPolicy}, map[string]string{"policy": policy})
+
+	service.policiesMap.Delete(scope)
+	if service.mqService != nil {
+		err = service.mqService.sendMessage(mqModerationPolicy, scope)
+		if err != nil {
+			slog.Error("moderation: informing policy change to other instances failed", slog.Any("error", err), slog.String("scope", scope))
+		}
+	}
+	return nil
+}
+
+func (service *moderationService) getScopeModerationPolicy(scope string) (string, error) {
+	value, ok := service.policiesMap.Load(scope)
+	if ok {
+		cached, ok := value.(moderationPolicyCacheContainer)
+		if ok && time.Now().Before(cached.cachedUntil) {
+			return cached.policy, nil
+		}
+	}
+
+	policy, err := service.databaseServiceModeration.getModerationPolicy(scope)
+	if err != nil {
+		return "", err
+	}
+	service.policiesMap.Store(scope, moderationPolicyCacheContainer{policy: policy, cachedUntil: time.Now().Add(moderationPolicyCacheAge)})
+	return policy, nil
+}
+
+func (service *moderationService) getModerationPolicy(target rbacTarget) (string, error) {
+	scopes := make([]string, 0, 3)
+	if target.urlHash != "" {
+		scopes = append(scopes, rbacPageScope(target.urlHash))
+	}
+	if target.site != "" {
+		scopes = append(scopes, rbacScopeSitePrefix+target.site)
+	}
+	scopes = append(scopes, rbacScopeGlobal)
+
+	for _, scope := range scopes {
+		policy, err := service.getScopeModerationPolicy(scope)
+		if err != nil {
+			return "", err
+		}
+		if policy != "" {
+			return policy, nil
+		}
+	}
+	return moderationPolicyOpen, nil
+}
+
+func (service *moderationService) setPageDiscussionState(sessionCookie *http.Cookie, idSite int64, urlHash string, state string, reason string) error {
+	if len(urlHash) != urlHashLen {
+		return errUrlHashLen
+	}
+	err := validatePageDiscussionState(state, reason)
+	if err != nil {
+		return err
+	}
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return err
+	}
+	err = service.authorizer.authorize(user, rbacPermCommentsModerate, rbacSiteTarget(idSite, urlHash))
+	if err != nil {
+		return err
+	}
+
+	previousState, err := service.databaseServiceModeration.getPageDiscussionState(idSite, urlHash)
+	if err != nil {
+		return err
+	}
+	err = service.databaseServiceModeration.setPageDiscussionState(idSite, urlHash, state, reason, user.Id, time.Now())
+	if err != nil {
+		return err
+	}
+	key := pageKey(idSite, urlHash)
+	logAuditAction(service.auditLogger, user, auditActionPageStateSet, auditTargetPage, key, previousState,
+		map[string]string{"state": state, "reason": reason})
+
+	service.pageStatesMap.Delete(key)
+	if service.mqService != nil {
+		err = service.mqService.sendMessage(mqPageState, key)
+		if err != nil {
+			slog.Error("moderation: informing discussion state change to other instances failed", slog.Any("error", err), slog.String("page", key))
+		}
+	}
+	return nil
+}
+
+func (service *moderationService) getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error) {
+	key := pageKey(idSite, urlHash)
+	value, ok := service.pageStatesMap.Load(key)
+	if ok {
+		cached, ok := value.(pageStateCacheContainer)
+		if ok && time.Now().Before(cached.cachedUntil) {
+			return cached.state, nil
+		}
+	}
+
+	state, err := service.databaseServiceModeration.getPageDiscussionState(idSite, urlHash)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &pageDiscussionState{State: pageStateOpen}
+	}
+	service.pageStatesMap.Store(key, pageStateCacheContainer{state: state, cachedUntil: time.Now().Add(pageStateCacheAge)})
+	return state, nil
+}
+
+func (service *moderationService) newCommentStatus(user *user, target rbacTarget) (string, error) {
+	policy, err := service.getModerationPolicy(target)
+	if err != nil {
+		return "", err
+	}
+	if policy == moderationPolicyOpen {
+		return commentStatusVisible, nil
+	}
+
+	err = service.authorizer.authorize(user, rbacPermCommentsModerate, target)
+	if err == nil {
+		return commentStatusVisible, nil
+	}
+	if !errors.Is(err, errPermissionDenied) && !errors.Is(err, errApiTokenScopeMissing) {
+		return "", err
+	}
+
+	if policy == moderationPolicyFirstPost {
+		approved, err := service.databaseServiceModeration.hasApprovedComment(user.Id)
+		if err != nil {
+			return "", err
+		}
+		if approved {
+			return commentStatusVisible, nil
+		}
+	}
+	return commentStatusPending, nil
+}
+
+func (service *moderationService) getUserBan(idUser int64) (*userBan, error) {
+	now := time.Now()
+	value, ok := service.bansMap.Load(idUser)
+	if ok {
+		cached, ok := value.(userBanCacheContainer)
+		if ok && now.Before(cached.cachedUntil) {
+			return cached.ban, nil
+		}
+	}
+
+	ban, err := service.databaseServiceModeration.getUserBan(idUser, now)
+	if err != nil {
+		return nil, err
+	}
+	cachedUntil := now.Add(userBanCacheAge)
+	if ban != nil && ban.DtExpires != nil && ban.DtExpires.Before(cachedUntil) {
+		cachedUntil = *ban.DtExpires
+	}
+	service.bansMap.Store(idUser, userBanCacheContainer{ban: ban, cachedUntil: cachedUntil})
+	return ban, nil
+}
+
+func (service *moderationService) getGlobalModerator(sessionCookie *http.Cookie) (*user, error) {
+	moderator, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+	// bans are not limited to a site or page
+	err = service.authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
+	return moderator, nil
+}
+
+// like in administration of users, moderator must be able to assign every role of the banned user, so that
+// global moderator can't ban an admin
+func (service *moderationService) authorizeBanOf(moderator *user, idUser int64) error {
+	if moderator.Id == idUser {
+		return errPermissionDenied
+	}
+	roles, err := service.authorizer.listUserRoles(idUser)
+	if err != nil {
+		return err
+	}
+	for _, role := range roles {
+		err = service.authorizer.authorize(moderator, rbacPermRolesAssign, rbacScopeToTarget(role.Scope))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ban is cached in this service and user object in session store, both are dropped on all instances
+func (service *moderationService) forgetCachedBan(idUser int64, revokeSessions bool) {
+	service.bansMap.Delete(idUser)
+	if service.sessionStore == nil {
+		return
+	}
+
+	var err error
+	if revokeSessions {
+		err = service.sessionStore.forgetSessionsForUser(idUser)
+	} else {
+		err = service.sessionStore.forgetCachedUser(idUser)
+	}
+	if err != nil {
+		slog.Error("Forgetting cached user after ban change", slog.Int64("idUser", idUser), slog.Any("error", err))
+	}
+}
+
+func (service *moderationService) banUser(sessionCookie *http.Cookie, idUser int64, kind string, duration time.Duration, reason string) (*userBan, error) {
+	err := validateUserBan(kind, duration, reason)
+	if err != nil {
+		return nil, err
+	}
+	moderator, err := service.getGlobalModerator(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	err = service.authorizeBanOf(moderator, idUser)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	previousBan, err := service.databaseServiceModeration.getUserBan(idUser, now)
+	if err != nil {
+		return nil, err
+	}
+	ban := userBan{IdUser: idUser, Kind: kind, Reason: reason, IdBannedBy: &moderator.Id, DtCreated: now}
+	action := moderationActionBan
+	switch kind {
+	case userBanKindSuspension:
+		dtExpires := now.Add(duration)
+		ban.DtExpires = &dtExpires
+		action = moderationActionSuspend
+	case userBanKindShadow:
+		action = moderationActionShadowban
+	}
+
+	record := moderationActionRecord{Action: action, IdAuthor: &idUser, IdModerator: &moderator.Id, Note: reason}
+	err = service.databaseServiceModeration.setUserBan(ban, record)
+	if err != nil {
+		return nil, err
+	}
+
+	// shadow-banned user stays logged in, so that nothing gives the ban away
+	service.forgetCachedBan(idUser, kind != userBanKindShadow)
+	logAuditAction(service.auditLogger, moderator, auditActionUserBan, auditTargetUser, strconv.FormatInt(idUser, 10), previousBan, ban)
+	return &ban, nil
+}
+
+func (service *moderationService) unbanUser(sessionCookie *http.Cookie, idUser int64, reason string) error {
+	if !utf8.ValidString(reason) || utf8.RuneCountInString(reason) > userBanReasonMaxLen {
+		return errModerationNoteNotValid
+	}
+	moderator, err := service.getGlobalModerator(sessionCookie)
+	if err != nil {
+		return err
+	}
+
+	previousBan, err := service.databaseServiceModeration.getUserBan(idUser, time.Now())
+	if err != nil {
+		return err
+	}
+	record := moderationActionRecord{Action: moderationActionUnban, IdAuthor: &idUser, IdModerator: &moderator.Id, Note: reason}
+	unbanned, err := service.databaseServiceModeration.deleteUserBan(idUser, record)
+	if err != nil {
+		return err
+	}
+	if !unbanned {
+		return errUserNotBanned
+	}
+
+	service.forgetCachedBan(idUser, false)
+	logAuditAction(service.auditLogger, moderator, auditActionUserUnban, auditTargetUser, strconv.FormatInt(idUser, 10), previousBan,
+		map[string]string{"reason": reason})
+	return nil
+}
+
+func (service *moderationService) getUserBanAsModerator(sessionCookie *http.Cookie, idUser int64) (*userBan, error) {
+	_, err := service.getGlobalModerator(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	return service.databaseServiceModeration.getUserBan(idUser, time.Now())
+}
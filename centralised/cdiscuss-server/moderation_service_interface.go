@@ -0,0 +1,269 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	commentStatusVisible  string = "visible"
+	commentStatusHidden   string = "hidden"  // kept for moderators, not listed on the page
+	commentStatusPending  string = "pending" // waiting for approval, listed only for the author and moderators
+	commentStatusRejected string = "rejected"
+	commentStatusShadow   string = "shadow" // author is shadow-banned, listed only for the author and moderators
+
+	userBanKindBan        string        = "ban"
+	userBanKindSuspension string        = "suspension" // ban that expires
+	userBanKindShadow     string        = "shadow"     // user doesn't know, comments are visible only to the user
+	userBanCacheAge       time.Duration = time.Minute
+	userBanReasonMaxLen   int           = 1000
+
+	moderationPolicyOpen      string        = "open"
+	moderationPolicyFirstPost string        = "first-post" // until the user has an approved comment
+	moderationPolicyAll       string        = "all"
+	moderationPolicyCacheAge  time.Duration = time.Minute
+
+	pageStateOpen         string        = "open"
+	pageStateRootsLocked  string        = "roots-locked" // only replies to existing comments
+	pageStateLocked       string        = "locked"       // only moderators can comment
+	pageStateArchived     string        = "archived"     // read-only for everybody, authors can't delete own comments
+	pageStateCacheAge     time.Duration = time.Minute
+	pageStateReasonMaxLen int           = 1000
+
+	reportReasonSpam       string = "spam"
+	reportReasonHarassment string = "harassment"
+	reportReasonHate       string = "hate"
+	reportReasonOfftopic   string = "offtopic"
+	reportReasonOther      string = "other"
+
+	moderationActionDismiss string = "dismiss" // reports were wrong, comment stays
+	moderationActionHide    string = "hide"
+	moderationActionDelete  string = "delete"
+	moderationActionBan     string = "ban"     // hides the comment and bans its author
+	moderationActionApprove string = "approve" // pending comment becomes visible
+	moderationActionReject  string = "reject"
+
+	// user actions, recorded without comment
+	moderationActionSuspend   string = "suspend"
+	moderationActionShadowban string = "shadowban"
+	moderationActionUnban     string = "unban"
+
+	reportDetailsMaxLen      int    = 1000
+	moderationNoteMaxLen     int    = 1000
+	moderationQueueMaxCount  uint64 = 100
+	moderationAuthorComments uint64 = 5 // recent comments of the author shown in the queue
+)
+
+var reportReasons = []string{reportReasonSpam, reportReasonHarassment, reportReasonHate, reportReasonOfftopic, reportReasonOther}
+
+type commentReport struct {
+	Id         int64      `json:"id"`
+	IdComment  int64      `json:"idComment"`
+	IdReporter int64      `json:"idReporter"`
+	Reason     string     `json:"reason"`
+	Details    string     `json:"details"`
+	DtCreated  time.Time  `json:"dtCreated"`
+	DtResolved *time.Time `json:"dtResolved"`
+}
+
+type authorModerationHistory struct {
+	IdUser         int64               `json:"idUser"`
+	Username       string              `json:"username"`
+	CommentsCount  uint64              `json:"commentsCount"`
+	HiddenCount    uint64              `json:"hiddenCount"`
+	ActionsCount   uint64              `json:"actionsCount"` // moderation actions other than dismiss on author's comments
+	Banned         bool                `json:"banned"`
+	RecentComments []userRecentComment `json:"recentComments"`
+}
+
+type userBan struct {
+	IdUser     int64      `json:"idUser"`
+	Kind       string     `json:"kind"`
+	Reason     string     `json:"reason"`
+	IdBannedBy *int64     `json:"idBannedBy"`
+	DtCreated  time.Time  `json:"dtCreated"`
+	DtExpires  *time.Time `json:"dtExpires"` // only for suspension
+}
+
+// part of the queue a moderator sees, global moderators see all of it
+type moderationQueueScope struct {
+	all       bool
+	idSites   []int64
+	urlHashes []string
+}
+
+type moderationQueueItem struct {
+	Comment       comment                  `json:"comment"`
+	ParentComment *comment                 `json:"parentComment"`
+	Author        *authorModerationHistory `json:"author"`
+	ReportsCount  uint64                   `json:"reportsCount"`
+	Reports       []commentReport          `json:"reports"`
+	// most similar earlier comment found by duplicate detection
+	DuplicateOf         *int64  `json:"duplicateOf"`
+	DuplicateSimilarity float64 `json:"duplicateSimilarity"`
+}
+
+type moderationActionRecord struct {
+	Id          int64     `json:"id"`
+	Action      string    `json:"action"`
+	IdComment   *int64    `json:"idComment"`
+	UrlHash     string    `json:"urlHash"`
+	IdAuthor    *int64    `json:"idAuthor"`
+	IdModerator *int64    `json:"idModerator"`
+	Note        string    `json:"note"`
+	DtCreated   time.Time `json:"dtCreated"`
+}
+
+// included in pageComments, so that clients can render closed discussion
+type pageDiscussionState struct {
+	State      string     `json:"state"`
+	Reason     string     `json:"reason"` // shown to readers
+	DtModified *time.Time `json:"dtModified"`
+}
+
+// sent over MQ, so that pages on all instances can update without reload
+type moderationEvent struct {
+	Action    string `json:"action"`
+	IdComment int64  `json:"idComment"`
+	UrlHash   string `json:"urlHash"`
+	IdAuthor  int64  `json:"idAuthor"`
+}
+
+type moderationServiceItf interface {
+	reportComment(sessionCookie *http.Cookie, client clientInfo, idComment int64, reason string, details string) error
+	// comments with open reports, most reported first, only items the moderator can moderate are returned
+	listModerationQueue(sessionCookie *http.Cookie, offset uint64, count uint64) ([]moderationQueueItem, error)
+	// action is recorded and open reports of the comment are resolved
+	moderateComment(sessionCookie *http.Cookie, idComment int64, action string, note string) error
+	// callback is called for moderation actions on all instances, returned function unsubscribes
+	subscribeModerationEvents(callback func(event moderationEvent)) func()
+
+	// comments waiting for approval, oldest first, only items the moderator can moderate are returned
+	listPendingComments(sessionCookie *http.Cookie, offset uint64, count uint64) ([]moderationQueueItem, error)
+	approveComment(sessionCookie *http.Cookie, idComment int64) error
+	rejectComment(sessionCookie *http.Cookie, idComment int64, note string) error
+	// scope is rbacScopeGlobal, site:<id> or page:<urlHash>, empty policy removes the policy of the scope
+	setModerationPolicy(sessionCookie *http.Cookie, scope string, policy string) error
+	// policy of the page with fallback to site and global policy
+	getModerationPolicy(target rbacTarget) (string, error)
+	// needs moderator of the page, pageStateOpen removes the state
+	setPageDiscussionState(sessionCookie *http.Cookie, idSite int64, urlHash string, state string, reason string) error
+
+	// needs global moderator, duration is used only for userBanKindSuspension. Replaces existing ban of the user.
+	banUser(sessionCookie *http.Cookie, idUser int64, kind string, duration time.Duration, reason string) (*userBan, error)
+	unbanUser(sessionCookie *http.Cookie, idUser int64, reason string) error
+	// returns nil if the user is not banned
+	getUserBanAsModerator(sessionCookie *http.Cookie, idUser int64) (*userBan, error)
+}
+
+// used by commentService
+type preModeratorItf interface {
+	// commentStatusVisible or commentStatusPending, moderators are never pre-moderated
+	newCommentStatus(user *user, target rbacTarget) (string, error)
+}
+
+// used by commentService
+type pageStateCheckerItf interface {
+	// pageStateOpen if the page has no state
+	getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error)
+}
+
+// used by commentService and userService
+type banCheckerItf interface {
+	// returns nil if the user is not banned or the suspension has expired
+	getUserBan(idUser int64) (*userBan, error)
+}
+
+// errUserBanned or errUserSuspended, nil for shadow-ban, user must not find out about it
+func userBanError(ban *userBan) error {
+	if ban == nil || ban.Kind == userBanKindShadow {
+		return nil
+	}
+	if ban.Kind == userBanKindSuspension && ban.DtExpires != nil {
+		return newUserSuspendedError(*ban.DtExpires)
+	}
+	return errUserBanned
+}
+
+// moderators (trusted) can comment on locked pages, but nobody on archived ones
+func pageDiscussionStateError(state string, isReply bool, trusted bool) error {
+	switch state {
+	case pageStateArchived:
+		return errPageArchived
+	case pageStateLocked:
+		if !trusted {
+			return errPageLocked
+		}
+	case pageStateRootsLocked:
+		if !trusted && !isReply {
+			return errPageRootsLocked
+		}
+	}
+	return nil
+}
+
+// key of the page in caches, MQ messages and audit log
+func pageKey(idSite int64, urlHash string) string {
+	return strconv.FormatInt(idSite, 10) + ":" + urlHash
+}
+
+func validatePageDiscussionState(state string, reason string) error {
+	if state != pageStateOpen && state != pageStateRootsLocked && state != pageStateLocked && state != pageStateArchived {
+		return errPageDiscussionStateNotValid
+	}
+	if !utf8.ValidString(reason) || utf8.RuneCountInString(reason) > pageStateReasonMaxLen {
+		return errModerationNoteNotValid
+	}
+	return nil
+}
+
+func validateCommentReport(reason string, details string) error {
+	validReason := false
+	for _, allowed := range reportReasons {
+		if reason == allowed {
+			validReason = true
+			break
+		}
+	}
+	if !validReason {
+		return errReportReasonNotValid
+	}
+	if !utf8.ValidString(details) || utf8.RuneCountInString(details) > reportDetailsMaxLen {
+		return errReportDetailsNotValid
+	}
+	return nil
+}
+
+func validateModerationAction(action string, note string) error {
+	switch action {
+	case moderationActionDismiss, moderationActionHide, moderationActionDelete, moderationActionBan, moderationActionApprove, moderationActionReject:
+	default:
+		return errModerationActionNotValid
+	}
+	if !utf8.ValidString(note) || utf8.RuneCountInString(note) > moderationNoteMaxLen {
+		return errModerationNoteNotValid
+	}
+	return nil
+}
+
+func validateModerationPolicy(policy string) error {
+	if policy != "" && policy != moderationPolicyOpen && policy != moderationPolicyFirstPost && policy != moderationPolicyAll {
+		return errModerationPolicyNotValid
+	}
+	return nil
+}
+
+func validateUserBan(kind string, duration time.Duration, reason string) error {
+	if kind != userBanKindBan && kind != userBanKindSuspension && kind != userBanKindShadow {
+		return errUserBanKindNotValid
+	}
+	if kind == userBanKindSuspension && duration <= 0 {
+		return errUserBanDurationNotValid
+	}
+	if !utf8.ValidString(reason) || utf8.RuneCountInString(reason) > userBanReasonMaxLen {
+		return errModerationNoteNotValid
+	}
+	return nil
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestValidateCommentReport(t *testing.T) {
+	if err := validateCommentReport(reportReasonSpam, ""); err != nil {
+		t.Errorf("Valid report rejected: %v", err)
+	}
+	if err := validateCommentReport("boring", ""); !errors.Is(err, errReportReasonNotValid) {
+		t.Errorf("Unknown reason accepted")
+	}
+	if err := validateCommentReport(reportReasonOther, strings.Repeat("č", reportDetailsMaxLen+1)); !errors.Is(err, errReportDetailsNotValid) {
+		t.Errorf("Too long details accepted")
+	}
+	if err := validateModerationAction("shadow", ""); !errors.Is(err, errModerationActionNotValid) {
+		t.Errorf("Unknown action accepted")
+	}
+}
+
+func TestModerationEventSubscribers(t *testing.T) {
+	service := &moderationService{subscribersMutex: &sync.RWMutex{}, subscribers: make(map[int64]func(event moderationEvent))}
+
+	received := make([]moderationEvent, 0)
+	unsubscribe := service.subscribeModerationEvents(func(event moderationEvent) {
+		received = append(received, event)
+	})
+
+	service.publishModerationEvent(moderationEvent{Action: moderationActionHide, IdComment: 7})
+	unsubscribe()
+	service.publishModerationEvent(moderationEvent{Action: moderationActionDelete, IdComment: 8})
+
+	if len(received) != 1 || received[0].IdComment != 7 {
+		t.Errorf("Wrong events received: %v", received)
+	}
+}
+
+type moderationDbStub struct {
+	databaseServiceModerationItf // only methods below are used
+	policies                     map[string]string
+	approved                     bool
+}
+
+func (stub *moderationDbStub) getModerationPolicy(scope string) (string, error) {
+	return stub.policies[scope], nil
+}
+
+func (stub *moderationDbStub) hasApprovedComment(idUser int64) (bool, error) {
+	return stub.approved, nil
+}
+
+func TestNewCommentStatus(t *testing.T) {
+	urlHash := strings.Repeat("a", urlHashLen)
+	stub := &moderationDbStub{policies: map[string]string{}}
+	authorizer := newAuthorizer(nil, nil)
+	service := &moderationService{authorizer: authorizer, databaseServiceModeration: stub, policiesMap: &sync.Map{}}
+	author := &user{Id: 1}
+	moderator := &user{Id: 2}
+	authorizer.assignUserRole(moderator.Id, rbacRoleModerator, rbacScopeGlobal, nil)
+
+	status := func(user *user) string {
+		service.policiesMap = &sync.Map{} // policies changed in the test
+		status, err := service.newCommentStatus(user, rbacTarget{urlHash: urlHash})
+		if err != nil {
+			t.Fatalf("Status error: %v", err)
+		}
+		return status
+	}
+
+	if status(author) != commentStatusVisible {
+		t.Errorf("Default policy should be open")
+	}
+
+	stub.policies[rbacScopeGlobal] = moderationPolicyFirstPost
+	if status(author) != commentStatusPending {
+		t.Errorf("First post should be pending")
+	}
+	stub.approved = true
+	if status(author) != commentStatusVisible {
+		t.Errorf("Approved author should not be pre-moderated")
+	}
+
+	stub.policies[rbacPageScope(urlHash)] = moderationPolicyAll
+	if status(author) != commentStatusPending {
+		t.Errorf("Page policy should override global policy")
+	}
+	if status(moderator) != commentStatusVisible {
+		t.Errorf("Moderator should not be pre-moderated")
+	}
+}
+
+type banDbStub struct {
+	databaseServiceModerationItf // only methods below are used
+	ban                          *userBan
+	queries                      int
+}
+
+func (stub *banDbStub) getUserBan(idUser int64, now time.Time) (*userBan, error) {
+	stub.queries++
+	if stub.ban != nil && stub.ban.DtExpires != nil && !stub.ban.DtExpires.After(now) {
+		return nil, nil
+	}
+	return stub.ban, nil
+}
+
+func TestUserBanError(t *testing.T) {
+	if userBanError(nil) != nil || userBanError(&userBan{Kind: userBanKindShadow}) != nil {
+		t.Errorf("Shadow-ban must not be visible to the user")
+	}
+	if !errors.Is(userBanError(&userBan{Kind: userBanKindBan}), errUserBanned) {
+		t.Errorf("Ban should return errUserBanned")
+	}
+
+	dtExpires := time.Now().Add(time.Hour)
+	var errRetry errWithRetryAfter
+	err := userBanError(&userBan{Kind: userBanKindSuspension, DtExpires: &dtExpires})
+	if !errors.As(err, &errRetry) || errRetry.getRetryAfter() <= 0 || errRetry.getHttpStatus() != http.StatusForbidden {
+		t.Errorf("Suspension should tell when it ends: %v", err)
+	}
+
+	if err := validateUserBan(userBanKindSuspension, 0, ""); !errors.Is(err, errUserBanDurationNotValid) {
+		t.Errorf("Suspension without duration accepted")
+	}
+}
+
+func TestUserBanCache(t *testing.T) {
+	dtExpires := time.Now().Add(50 * time.Millisecond)
+	stub := &banDbStub{ban: &userBan{IdUser: 1, Kind: userBanKindSuspension, DtExpires: &dtExpires}}
+	service := &moderationService{databaseServiceModeration: stub, bansMap: &sync.Map{}}
+
+	for i := 0; i < 3; i++ {
+		ban, _ := service.getUserBan(1)
+		if ban == nil {
+			t.Fatalf("Suspension not found")
+		}
+	}
+	if stub.queries != 1 {
+		t.Errorf("Ban should be cached, %d queries", stub.queries)
+	}
+
+	time.Sleep(60 * time.Millisecond)
+	ban, _ := service.getUserBan(1)
+	if ban != nil {
+		t.Errorf("Cached suspension should expire with the suspension")
+	}
+
+	service.onMessage(mqMessage{Operation: mqUserModified, Argument: "1"})
+	if _, ok := service.bansMap.Load(int64(1)); ok {
+		t.Errorf("MQ message should drop cached ban")
+	}
+}
+
+type pageStateDbStub struct {
+	databaseServiceModerationItf // only methods below are used
+	states                       map[string]pageDiscussionState
+	queries                      int
+}
+
+func (stub *pageStateDbStub) getPageDiscussionState(idSite int64, urlHash string) (*pageDiscussionState, error) {
+	stub.queries++
+	state, ok := stub.states[pageKey(idSite, urlHash)]
+	if !ok {
+		return nil, nil
+	}
+	return &state, nil
+}
+
+func TestPageDiscussionState(t *testing.T) {
+	tests := []struct {
+		state    string
+		isReply  bool
+		trusted  bool
+		expected error
+	}{
+		{pageStateOpen, false, false, nil},
+		{pageStateRootsLocked, false, false, errPageRootsLocked},
+		{pageStateRootsLocked, true, false, nil},
+		{pageStateRootsLocked, false, true, nil},
+		{pageStateLocked, true, false, errPageLocked},
+		{pageStateLocked, false, true, nil},
+		{pageStateArchived, true, true, errPageArchived},
+	}
+	for _, test := range tests {
+		if err := pageDiscussionStateError(test.state, test.isReply, test.trusted); !errors.Is(err, test.expected) {
+			t.Errorf("%s reply=%v trusted=%v: got %v want %v", test.state, test.isReply, test.trusted, err, test.expected)
+		}
+	}
+	if err := validatePageDiscussionState("closed", ""); !errors.Is(err, errPageDiscussionStateNotValid) {
+		t.Errorf("Unknown state accepted")
+	}
+
+	urlHash := strings.Repeat("a", urlHashLen)
+	stub := &pageStateDbStub{states: map[string]pageDiscussionState{pageKey(2, urlHash): {State: pageStateLocked, Reason: "event ended"}}}
+	service := &moderationService{databaseServiceModeration: stub, pageStatesMap: &sync.Map{}}
+	for i := 0; i < 2; i++ {
+		state, err := service.getPageDiscussionState(2, urlHash)
+		if err != nil || state.State != pageStateLocked || state.Reason != "event ended" {
+			t.Errorf("Wrong state of locked page: %+v, %v", state, err)
+		}
+	}
+	if stub.queries != 1 {
+		t.Errorf("State should be cached, queries %d", stub.queries)
+	}
+	if state, err := service.getPageDiscussionState(1, urlHash); err != nil || state.State != pageStateOpen {
+		t.Errorf("Page of other site should be open: %+v, %v", state, err)
+	}
+}
+
+type queueDbStub struct {
+	databaseServiceModerationItf // only methods below are used
+	scope                        moderationQueueScope
+	authorQueries                int
+}
+
+func (stub *queueDbStub) listPendingComments(scope moderationQueueScope, offset uint64, count uint64) ([]moderationQueueItem, error) {
+	stub.scope = scope
+	return []moderationQueueItem{{Comment: comment{Id: 1, IdUser: 5}}, {Comment: comment{Id: 2, IdUser: 5}}}, nil
+}
+
+func (stub *queueDbStub) listOpenCommentReports(idComment int64) ([]commentReport, error) {
+	return nil, nil
+}
+
+func (stub *queueDbStub) getAuthorModerationHistory(idUser int64, recentCount uint64) (*authorModerationHistory, error) {
+	stub.authorQueries++
+	return &authorModerationHistory{}, nil
+}
+
+type queueCommentDbStub struct {
+	databaseServiceCommentItf // only methods below are used
+}
+
+func (stub *queueCommentDbStub) getComment(idComment int64) (*comment, error) {
+	return &comment{Id: idComment, IdSite: 3, UrlHash: strings.Repeat("a", urlHashLen), IdUser: 5, Status: commentStatusVisible}, nil
+}
+
+func TestModerationQueueScope(t *testing.T) {
+	urlHash := strings.Repeat("a", urlHashLen)
+	authorizer := newAuthorizer(nil, nil)
+	db := &queueDbStub{}
+	service := &moderationService{userService: &requestUserStub{}, authorizer: authorizer, databaseServiceModeration: db,
+		databaseServiceComment: &queueCommentDbStub{}}
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+
+	if _, err := service.listPendingComments(cookie, 0, 10); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("User without role lists the queue: %v", err)
+	}
+
+	authorizer.assignUserRole(1, rbacRoleModerator, rbacSiteScope(3), nil)
+	authorizer.assignUserRole(1, rbacRoleModerator, rbacPageScope(urlHash), nil)
+	items, err := service.listPendingComments(cookie, 0, 10)
+	if err != nil || len(items) != 2 {
+		t.Fatalf("Scoped moderator can't list the queue: %v", err)
+	}
+	if db.scope.all || len(db.scope.idSites) != 1 || db.scope.idSites[0] != 3 || len(db.scope.urlHashes) != 1 || db.scope.urlHashes[0] != urlHash {
+		t.Errorf("Wrong queue scope: %+v", db.scope)
+	}
+	if db.authorQueries != 1 || items[1].Author == nil {
+		t.Errorf("Author history should be loaded once per author: %d", db.authorQueries)
+	}
+	if err := service.moderateComment(cookie, 7, moderationActionBan, ""); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("Site moderator bans globally: %v", err)
+	}
+
+	authorizer.assignUserRole(1, rbacRoleModerator, rbacScopeGlobal, nil)
+	if _, err := service.listPendingComments(cookie, 0, 10); err != nil || !db.scope.all {
+		t.Errorf("Global moderator should see the whole queue: %+v %v", db.scope, err)
+	}
+	authorizer.assignUserRole(5, rbacRoleAdmin, rbacScopeGlobal, nil)
+	if err := service.moderateComment(cookie, 7, moderationActionBan, ""); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("Global moderator bans an admin: %v", err)
+	}
+}
+
+type newSessionStub struct {
+	sessionStoreItf // only methods below are used
+	sessions        int
+}
+
+func (stub *newSessionStub) newSession(user *user, client clientInfo) (string, time.Time, error) {
+	stub.sessions++
+	return "token", time.Now().Add(time.Hour), nil
+}
+
+type loginSucceededStub struct {
+	loginGuardItf // only methods below are used
+	succeeded     []string
+}
+
+func (stub *loginSucceededStub) loginSucceeded(username string) error {
+	stub.succeeded = append(stub.succeeded, username)
+	return nil
+}
+
+func TestStartSessionChecksBan(t *testing.T) {
+	db := &banDbStub{ban: &userBan{IdUser: 1, Kind: userBanKindBan}}
+	banChecker := &moderationService{databaseServiceModeration: db, bansMap: &sync.Map{}}
+	sessionStore := &newSessionStub{}
+	loginGuard := &loginSucceededStub{}
+	var starter sessionStarterItf = newUserService(sessionStore, nil, nil, false, nil, loginGuard, nil, nil, banChecker, nil, cookiePolicy{})
+
+	// passkey and OIDC logins start the session the same way
+	if _, _, err := starter.startSession(&user{Id: 1, Username: "jane"}, clientInfo{}); !errors.Is(err, errUserBanned) {
+		t.Errorf("Banned user got a session: %v", err)
+	}
+	if sessionStore.sessions != 0 || len(loginGuard.succeeded) != 0 {
+		t.Errorf("Banned login counted as success")
+	}
+
+	db.ban = &userBan{IdUser: 2, Kind: userBanKindShadow}
+	cookie, _, err := starter.startSession(&user{Id: 2, Username: "john"}, clientInfo{})
+	if err != nil || cookie.Name != sessionCookieName || sessionStore.sessions != 1 {
+		t.Errorf("Shadow-banned user can't log in: %v", err)
+	}
+	if len(loginGuard.succeeded) != 1 || loginGuard.succeeded[0] != "john" {
+		t.Errorf("Failed logins not reset: %v", loginGuard.succeeded)
+	}
+}
+
+type setBanDbStub struct {
+	banDbStub
+	banned []int64
+}
+
+func (stub *setBanDbStub) setUserBan(ban userBan, record moderationActionRecord) error {
+	stub.banned = append(stub.banned, ban.IdUser)
+	return nil
+}
+
+func TestBanUserRequiresRolesOfTarget(t *testing.T) {
+	authorizer := newAuthorizer(nil, nil)
+	db := &setBanDbStub{}
+	service := &moderationService{userService: &requestUserStub{}, authorizer: authorizer, databaseServiceModeration: db, bansMap: &sync.Map{}}
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+	authorizer.assignUserRole(1, rbacRoleModerator, rbacScopeGlobal, nil)
+	authorizer.assignUserRole(2, rbacRoleAdmin, rbacScopeGlobal, nil)
+	authorizer.assignUserRole(3, rbacRoleModerator, rbacSiteScope(5), nil)
+
+	if _, err := service.banUser(cookie, 2, userBanKindBan, 0, ""); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("Global moderator bans an admin: %v", err)
+	}
+	if _, err := service.banUser(cookie, 1, userBanKindBan, 0, ""); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("Moderator bans self: %v", err)
+	}
+	if _, err := service.banUser(cookie, 4, userBanKindBan, 0, ""); err != nil {
+		t.Errorf("Global moderator can't ban a user without roles: %v", err)
+	}
+
+	if _, err := service.banUser(cookie, 3, userBanKindShadow, 0, ""); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("Moderator without roles:assign bans a site moderator: %v", err)
+	}
+	authorizer.assignUserRole(1, rbacRoleSuperadmin, rbacScopeGlobal, nil)
+	if _, err := service.banUser(cookie, 3, userBanKindShadow, 0, ""); err != nil {
+		t.Errorf("Superadmin can't ban a site moderator: %v", err)
+	}
+	if len(db.banned) != 2 {
+		t.Errorf("Expected 2 bans, got %v", db.banned)
+	}
+}
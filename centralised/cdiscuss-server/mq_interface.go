@@ -3,6 +3,14 @@ package main
 const (
 	mqSessionEnd         = "session end"
 	mqSessionsForUserEnd = "sessions for user end"
+	mqUserModified       = "user modified"
+	mqApiTokenRevoked    = "api token revoked"
+	mqUserRolesModified  = "user roles modified"
+	mqModerationAction   = "moderation action"
+	mqModerationPolicy   = "moderation policy modified"
+	mqContentPolicy      = "content policy modified"
+	mqSiteModified       = "site modified"
+	mqPageState          = "page discussion state modified"
 )
 
 type mqMessage struct {
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+const (
+	oidcStateRandomLen        int           = 32
+	oidcCodeVerifierRandomLen int           = 32 // 43 chars after encoding, minimum allowed by RFC 7636
+	oidcClockSkew             time.Duration = time.Minute
+)
+
+// subset of OpenID Provider Metadata that the relying party needs
+type oidcProviderMetadata struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type oidcJwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type oidcJwks struct {
+	Keys []oidcJwk `json:"keys"`
+}
+
+// aud claim can be a string or array of strings
+type oidcAudience []string
+
+func (audience *oidcAudience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*audience = oidcAudience{single}
+		return nil
+	}
+	var multiple []string
+	if err := json.Unmarshal(data, &multiple); err != nil {
+		return err
+	}
+	*audience = multiple
+	return nil
+}
+
+type oidcIdTokenClaims struct {
+	Issuer            string       `json:"iss"`
+	Subject           string       `json:"sub"`
+	Audience          oidcAudience `json:"aud"`
+	AuthorizedParty   string       `json:"azp"`
+	Expires           int64        `json:"exp"`
+	IssuedAt          int64        `json:"iat"`
+	Nonce             string       `json:"nonce"`
+	PreferredUsername string       `json:"preferred_username"`
+	Email             string       `json:"email"`
+	Name              string       `json:"name"`
+}
+
+type oidcJwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+func generateOidcRandomStr(length int) (string, error) {
+	b := make([]byte, length)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// PKCE S256 code challenge
+func oidcCodeChallenge(codeVerifier string) string {
+	sum := sha256.Sum256([]byte(codeVerifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+func parseOidcJwk(jwk oidcJwk) (crypto.PublicKey, error) {
+	switch jwk.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(jwk.N)
+		if err != nil {
+			return nil, fmt.Errorf("bad RSA modulus: %w", err)
+		}
+		e, err := base64.RawURLEncoding.DecodeString(jwk.E)
+		if err != nil || len(e) == 0 || len(e) > 4 {
+			return nil, errors.New("bad RSA exponent")
+		}
+		key := &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+		if key.N.BitLen() < 2048 {
+			return nil, errors.New("RSA key is too short")
+		}
+		return key, nil
+	case "EC":
+		if jwk.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %s", jwk.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(jwk.X)
+		if err != nil {
+			return nil, fmt.Errorf("bad EC x: %w", err)
+		}
+		y, err := base64.RawURLEncoding.DecodeString(jwk.Y)
+		if err != nil {
+			return nil, fmt.Errorf("bad EC y: %w", err)
+		}
+		key := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !key.Curve.IsOnCurve(key.X, key.Y) {
+			return nil, errors.New("EC point is not on curve")
+		}
+		return key, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %s", jwk.Kty)
+}
+
+func verifyOidcJwtSignature(alg string, key crypto.PublicKey, signedPart []byte, signature []byte) error {
+	digest := sha256.Sum256(signedPart)
+	switch alg {
+	case "RS256":
+		rsaKey, ok := key.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("RS256 needs RSA key")
+		}
+		return rsa.VerifyPKCS1v15(rsaKey, crypto.SHA256, digest[:], signature)
+	case "ES256":
+		ecKey, ok := key.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("ES256 needs EC key")
+		}
+		// JWS uses raw r||s instead of DER
+		if len(signature) != 64 {
+			return errors.New("bad ES256 signature length")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(ecKey, digest[:], r, s) {
+			return errors.New("ES256 signature doesn't match")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported alg %s", alg)
+}
+
+// returns header of the token, needed to pick the key before verification
+func parseOidcJwtHeader(idToken string) (*oidcJwtHeader, error) {
+	parts := strings.Split(idToken, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("ID token is not a JWS")
+	}
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token header encoding: %w", err)
+	}
+	var header oidcJwtHeader
+	err = json.Unmarshal(headerJSON, &header)
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token header: %w", err)
+	}
+	return &header, nil
+}
+
+// checks signature and claims as required by OpenID Connect Core 3.1.3.7
+func verifyOidcIdToken(idToken string, key crypto.PublicKey, issuer string, clientId string, nonce string, now time.Time) (*oidcIdTokenClaims, error) {
+	header, err := parseOidcJwtHeader(idToken)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(idToken, ".")
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token signature encoding: %w", err)
+	}
+	err = verifyOidcJwtSignature(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature)
+	if err != nil {
+		return nil, err
+	}
+
+	claimsJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token claims encoding: %w", err)
+	}
+	var claims oidcIdTokenClaims
+	err = json.Unmarshal(claimsJSON, &claims)
+	if err != nil {
+		return nil, fmt.Errorf("bad ID token claims: %w", err)
+	}
+
+	if claims.Issuer != issuer {
+		return nil, fmt.Errorf("wrong issuer %s", claims.Issuer)
+	}
+	if claims.Subject == "" {
+		return nil, errors.New("missing subject")
+	}
+	audienceOk := false
+	for _, audience := range claims.Audience {
+		if audience == clientId {
+			audienceOk = true
+		}
+	}
+	if !audienceOk {
+		return nil, errors.New("token was not issued for this client")
+	}
+	if len(claims.Audience) > 1 && claims.AuthorizedParty != clientId {
+		return nil, errors.New("wrong authorized party")
+	}
+	if !now.Before(time.Unix(claims.Expires, 0).Add(oidcClockSkew)) {
+		return nil, errors.New("token has expired")
+	}
+	if claims.IssuedAt != 0 && time.Unix(claims.IssuedAt, 0).After(now.Add(oidcClockSkew)) {
+		return nil, errors.New("token is issued in the future")
+	}
+	if claims.Nonce != nonce {
+		return nil, errors.New("wrong nonce")
+	}
+	return &claims, nil
+}
+
+// base for a new username, it has to pass validateUsername. Suffix is appended when it is taken.
+func oidcUsernameBase(claims *oidcIdTokenClaims) string {
+	const suffixRoom int = 6
+
+	candidates := []string{claims.PreferredUsername, strings.Split(claims.Email, "@")[0], claims.Name}
+	for _, candidate := range candidates {
+		var sb strings.Builder
+		for _, r := range candidate {
+			switch {
+			case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_':
+				sb.WriteRune(r)
+			case r == '.' || r == '-' || r == ' ':
+				sb.WriteRune('_')
+			}
+		}
+		username := strings.Trim(sb.String(), "_")
+		if len(username) > usernameMaxLen-suffixRoom {
+			username = username[:usernameMaxLen-suffixRoom]
+		}
+		if len(username) >= usernameMinLen {
+			return username
+		}
+	}
+	return oidcUsernameFallback
+}
+
+func oidcUsernameWithSuffix(base string) (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(100000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s_%05d", base, n.Int64()), nil
+}
@@ -0,0 +1,420 @@
+package main
+
+import (
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+type oidcService struct {
+	config     oidcConfig
+	httpClient *http.Client
+
+	metadataMutex    *sync.Mutex
+	metadata         *oidcProviderMetadata
+	dtMetadataLoaded time.Time
+	jwksKeys         map[string]crypto.PublicKey // kid -> key
+	dtJwksLoaded     time.Time
+
+	sessionStore        sessionStoreItf
+	sessionStarter      sessionStarterItf
+	databaseServiceOidc databaseServiceOidcItf
+	twoFactorVerifier   twoFactorVerifierItf
+	rateLimiter         rateLimiterItf
+	usernameFilter      usernameFilterItf
+	cookiePolicy        cookiePolicy
+
+	stopWorkerChan                   chan bool
+	deleteOutdatedAuthRequestsTicker *time.Ticker
+}
+
+func newOidcService(config oidcConfig, httpClient *http.Client, sessionStore sessionStoreItf, sessionStarter sessionStarterItf, databaseServiceOidc databaseServiceOidcItf,
+	twoFactorVerifier twoFactorVerifierItf, rateLimiter rateLimiterItf, usernameFilter usernameFilterItf, cookiePolicy cookiePolicy,
+	deleteOutdatedAuthRequestsPeriod time.Duration) (*oidcService, error) {
+	if config.issuer == "" || config.clientId == "" || config.redirectUri == "" {
+		return nil, errors.New("OIDC service needs issuer, client ID and redirect URI")
+	}
+	if databaseServiceOidc == nil {
+		return nil, errors.New("OIDC service needs database")
+	}
+	if sessionStarter == nil {
+		return nil, errors.New("OIDC service needs session starter")
+	}
+	if deleteOutdatedAuthRequestsPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedAuthRequestsPeriod value")
+	}
+	if len(config.scopes) == 0 {
+		config.scopes = []string{"openid", "profile", "email"}
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: oidcHttpTimeout}
+	}
+
+	service := &oidcService{config: config, httpClient: httpClient, metadataMutex: &sync.Mutex{}, sessionStore: sessionStore,
+		sessionStarter: sessionStarter, databaseServiceOidc: databaseServiceOidc, twoFactorVerifier: twoFactorVerifier, rateLimiter: rateLimiter, usernameFilter: usernameFilter,
+		cookiePolicy: cookiePolicy}
+	service.stopWorkerChan = make(chan bool)
+	service.deleteOutdatedAuthRequestsTicker = time.NewTicker(deleteOutdatedAuthRequestsPeriod)
+
+	go service.deleteOutdatedAuthRequestsLoopWorker()
+
+	return service, nil
+}
+
+func (service *oidcService) deleteOutdatedAuthRequestsLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.deleteOutdatedAuthRequestsTicker.C:
+			err := service.databaseServiceOidc.deleteOidcAuthRequestsThatExpired(time.Now())
+			if err != nil {
+				slog.Error("Deleting outdated OIDC auth requests from DB:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *oidcService) stop() {
+	service.deleteOutdatedAuthRequestsTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop oidcService instance")
+	}
+}
+
+func (service *oidcService) getJSON(request *http.Request, target any) error {
+	response, err := service.httpClient.Do(request)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, oidcResponseMaxLen))
+	if err != nil {
+		return err
+	}
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s responded with status %d: %s", request.URL, response.StatusCode, body)
+	}
+	return json.Unmarshal(body, target)
+}
+
+func (service *oidcService) getProviderMetadata() (*oidcProviderMetadata, error) {
+	service.metadataMutex.Lock()
+	defer service.metadataMutex.Unlock()
+
+	if service.metadata != nil && time.Since(service.dtMetadataLoaded) < oidcMetadataCacheAge {
+		return service.metadata, nil
+	}
+
+	request, err := http.NewRequest(http.MethodGet, strings.TrimSuffix(service.config.issuer, "/")+"/.well-known/openid-configuration", nil)
+	if err != nil {
+		return nil, err
+	}
+	var metadata oidcProviderMetadata
+	err = service.getJSON(request, &metadata)
+	if err != nil {
+		slog.Error("Failed to load OIDC provider metadata", slog.String("issuer", service.config.issuer), slog.Any("error", err))
+		return nil, errOidcProviderUnavailable
+	}
+	if metadata.Issuer != service.config.issuer || metadata.AuthorizationEndpoint == "" || metadata.TokenEndpoint == "" || metadata.JwksUri == "" {
+		slog.Error("OIDC provider metadata is not valid", slog.String("issuer", service.config.issuer), slog.Any("metadata", metadata))
+		return nil, errOidcProviderUnavailable
+	}
+
+	service.metadata = &metadata
+	service.dtMetadataLoaded = time.Now()
+	return service.metadata, nil
+}
+
+func (service *oidcService) getSigningKey(metadata *oidcProviderMetadata, kid string) (crypto.PublicKey, error) {
+	service.metadataMutex.Lock()
+	defer service.metadataMutex.Unlock()
+
+	key, ok := service.jwksKeys[kid]
+	if ok {
+		return key, nil
+	}
+	// provider may have rotated keys, but unknown kids must not make us hammer it
+	if service.jwksKeys != nil && time.Since(service.dtJwksLoaded) < oidcJwksMinRefreshAge {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+
+	request, err := http.NewRequest(http.MethodGet, metadata.JwksUri, nil)
+	if err != nil {
+		return nil, err
+	}
+	var jwks oidcJwks
+	err = service.getJSON(request, &jwks)
+	if err != nil {
+		slog.Error("Failed to load OIDC provider keys", slog.String("issuer", service.config.issuer), slog.Any("error", err))
+		return nil, errOidcProviderUnavailable
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		key, err := parseOidcJwk(jwk)
+		if err != nil {
+			slog.Warn("Skipping OIDC provider key", slog.String("kid", jwk.Kid), slog.Any("error", err))
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	service.jwksKeys = keys
+	service.dtJwksLoaded = time.Now()
+
+	key, ok = service.jwksKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %s", kid)
+	}
+	return key, nil
+}
+
+func (service *oidcService) beginOidcLogin(sessionCookie *http.Cookie) (string, *http.Cookie, error) {
+	metadata, err := service.getProviderMetadata()
+	if err != nil {
+		return "", nil, err
+	}
+
+	var idUser *int64
+	if sessionCookie != nil {
+		sessionToken, err := validateSessionCookie(sessionCookie)
+		if err != nil {
+			return "", nil, err
+		}
+		user, err := service.sessionStore.getUser(sessionToken)
+		if err != nil {
+			return "", nil, err
+		}
+		idUser = &user.Id
+	}
+
+	state, err := generateOidcRandomStr(oidcStateRandomLen)
+	if err != nil {
+		return "", nil, err
+	}
+	stateHash, err := calculateTokenHash(state)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce, err := generateOidcRandomStr(oidcStateRandomLen)
+	if err != nil {
+		return "", nil, err
+	}
+	codeVerifier, err := generateOidcRandomStr(oidcCodeVerifierRandomLen)
+	if err != nil {
+		return "", nil, err
+	}
+	request := oidcAuthRequest{stateHash: stateHash, nonce: nonce, codeVerifier: codeVerifier, idUser: idUser,
+		dtExpires: time.Now().Add(oidcAuthRequestAge)}
+	err = service.databaseServiceOidc.createOidcAuthRequest(request)
+	if err != nil {
+		return "", nil, err
+	}
+
+	authorizationUrl, err := url.Parse(metadata.AuthorizationEndpoint)
+	if err != nil {
+		slog.Error("OIDC authorization endpoint is not valid", slog.String("endpoint", metadata.AuthorizationEndpoint), slog.Any("error", err))
+		return "", nil, errOidcProviderUnavailable
+	}
+	query := authorizationUrl.Query()
+	query.Set("response_type", "code")
+	query.Set("client_id", service.config.clientId)
+	query.Set("redirect_uri", service.config.redirectUri)
+	query.Set("scope", strings.Join(service.config.scopes, " "))
+	query.Set("state", state)
+	query.Set("nonce", request.nonce)
+	query.Set("code_challenge", oidcCodeChallenge(request.codeVerifier))
+	query.Set("code_challenge_method", "S256")
+	authorizationUrl.RawQuery = query.Encode()
+
+	// provider redirects back with a top level GET, Lax is enough and works without third-party cookies
+	cookie := service.cookiePolicy.newCookie(oidcCookieName, state, request.dtExpires)
+	cookie.SameSite = http.SameSiteLaxMode
+
+	return authorizationUrl.String(), cookie, nil
+}
+
+type oidcTokenResponse struct {
+	IdToken   string `json:"id_token"`
+	TokenType string `json:"token_type"`
+}
+
+func (service *oidcService) exchangeCode(metadata *oidcProviderMetadata, code string, codeVerifier string) (string, error) {
+	form := url.Values{}
+	form.Set("grant_type", "authorization_code")
+	form.Set("code", code)
+	form.Set("redirect_uri", service.config.redirectUri)
+	form.Set("code_verifier", codeVerifier)
+	form.Set("client_id", service.config.clientId)
+
+	request, err := http.NewRequest(http.MethodPost, metadata.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	request.Header.Set("Accept", "application/json")
+	if service.config.clientSecret != "" {
+		// client_secret_basic, RFC 6749 2.3.1 wants the credentials form encoded first
+		request.SetBasicAuth(url.QueryEscape(service.config.clientId), url.QueryEscape(service.config.clientSecret))
+	}
+
+	var tokenResponse oidcTokenResponse
+	err = service.getJSON(request, &tokenResponse)
+	if err != nil {
+		return "", err
+	}
+	if tokenResponse.IdToken == "" {
+		return "", errors.New("token response without ID token")
+	}
+	return tokenResponse.IdToken, nil
+}
+
+func (service *oidcService) finishOidcLogin(client clientInfo, oidcCookie *http.Cookie, state string, code string) (*http.Cookie, *user, error) {
+	if oidcCookie == nil || oidcCookie.Name != oidcCookieName || oidcCookie.Value == "" || oidcCookie.Value != state || code == "" {
+		return nil, nil, errOidcNotValid
+	}
+
+	if service.rateLimiter != nil {
+		err := service.rateLimiter.allow(rateLimitOpLogin, rateLimitKeys{client: client})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	stateHash, err := calculateTokenHash(state)
+	if err != nil {
+		return nil, nil, errOidcNotValid
+	}
+	request, err := service.databaseServiceOidc.takeOidcAuthRequest(stateHash)
+	if err != nil {
+		return nil, nil, err
+	}
+	if request == nil || isExpired(time.Now(), request.dtExpires) {
+		return nil, nil, errOidcNotValid
+	}
+
+	metadata, err := service.getProviderMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	idToken, err := service.exchangeCode(metadata, code, request.codeVerifier)
+	if err != nil {
+		slog.Warn("OIDC code exchange failed", slog.String("issuer", service.config.issuer), slog.Any("error", err))
+		return nil, nil, errOidcNotValid
+	}
+	header, err := parseOidcJwtHeader(idToken)
+	if err != nil {
+		slog.Warn("OIDC ID token rejected", slog.Any("error", err))
+		return nil, nil, errOidcNotValid
+	}
+	key, err := service.getSigningKey(metadata, header.Kid)
+	if err != nil {
+		if errors.Is(err, errOidcProviderUnavailable) {
+			return nil, nil, err
+		}
+		slog.Warn("OIDC ID token rejected", slog.Any("error", err))
+		return nil, nil, errOidcNotValid
+	}
+	claims, err := verifyOidcIdToken(idToken, key, service.config.issuer, service.config.clientId, request.nonce, time.Now())
+	if err != nil {
+		slog.Warn("OIDC ID token rejected", slog.Any("error", err))
+		return nil, nil, errOidcNotValid
+	}
+
+	user, err := service.getOrCreateUser(claims, request.idUser)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if user.TwoFactorEnabled && service.twoFactorVerifier != nil {
+		ticket, expiresTime, err := service.twoFactorVerifier.createLoginTicket(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		return service.cookiePolicy.newCookie(twoFactorCookieName, ticket, expiresTime), nil, errTwoFactorRequired
+	}
+
+	return service.sessionStarter.startSession(user, client)
+}
+
+func (service *oidcService) getOrCreateUser(claims *oidcIdTokenClaims, idLinkingUser *int64) (*user, error) {
+	user, err := service.databaseServiceOidc.getUserByExternalIdentity(service.config.issuer, claims.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if idLinkingUser != nil {
+		if user != nil {
+			if user.Id != *idLinkingUser {
+				return nil, errOidcIdentityTaken
+			}
+			return user, nil
+		}
+		err = service.databaseServiceOidc.linkExternalIdentity(*idLinkingUser, service.config.issuer, claims.Subject)
+		if err != nil {
+			return nil, err
+		}
+		user, err = service.databaseServiceOidc.getUserByExternalIdentity(service.config.issuer, claims.Subject)
+		if err != nil {
+			return nil, err
+		}
+		if user == nil {
+			return nil, errUserDoesntExist
+		}
+		return user, nil
+	}
+
+	if user != nil {
+		return user, nil
+	}
+
+	base := oidcUsernameBase(claims)
+	if validateUsername(base, service.usernameFilter) != nil {
+		base = oidcUsernameFallback // name from the provider is not allowed by content policy
+	}
+	username := base
+	for attempt := 0; attempt < oidcUsernameMaxAttempts; attempt++ {
+		if attempt > 0 {
+			username, err = oidcUsernameWithSuffix(base)
+			if err != nil {
+				return nil, err
+			}
+		}
+		err = validateUsername(username)
+		if err != nil {
+			return nil, err
+		}
+		user, err = service.databaseServiceOidc.createUserWithExternalIdentity(username, generateRandomStr(oidcPasswordLen),
+			service.config.issuer, claims.Subject)
+		if errors.Is(err, errOidcIdentityTaken) {
+			// concurrent login of the same subject provisioned the user first
+			user, err = service.databaseServiceOidc.getUserByExternalIdentity(service.config.issuer, claims.Subject)
+			if err != nil {
+				return nil, err
+			}
+			if user == nil {
+				return nil, errUserDoesntExist // identity was unlinked again meanwhile
+			}
+			return user, nil
+		}
+		if !errors.Is(err, errUserAlreadyExists) {
+			return user, err
+		}
+	}
+	return nil, errUserAlreadyExists
+}
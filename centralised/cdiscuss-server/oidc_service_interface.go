@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	oidcCookieName          string        = "CDOIDC"
+	oidcAuthRequestAge      time.Duration = 10 * time.Minute
+	oidcMetadataCacheAge    time.Duration = time.Hour
+	oidcJwksMinRefreshAge   time.Duration = time.Minute // unknown kid triggers refresh at most this often
+	oidcHttpTimeout         time.Duration = 10 * time.Second
+	oidcResponseMaxLen      int64         = 1 << 20
+	oidcUsernameMaxAttempts int           = 5
+	oidcPasswordLen         int           = passwordMaxLen // password of provisioned users is random and never shown
+	oidcUsernameFallback    string        = "user"         // when claims give no usable username
+)
+
+// Issuer is any OpenID provider with discovery at issuer + /.well-known/openid-configuration,
+// so a local mock IdP works as well.
+type oidcConfig struct {
+	issuer       string
+	clientId     string
+	clientSecret string // empty for public clients, PKCE is always used
+	redirectUri  string
+	scopes       []string
+}
+
+type oidcServiceItf interface {
+	// returns URL of the provider to redirect to and a cookie binding the flow to the browser.
+	// With a valid session cookie the external account is linked to the logged in user.
+	beginOidcLogin(sessionCookie *http.Cookie) (string, *http.Cookie, error)
+	// called from redirect URI with state and code query params. Unknown subjects get a new user.
+	// If the user has 2FA enabled errTwoFactorRequired is returned together with login ticket cookie.
+	finishOidcLogin(client clientInfo, oidcCookie *http.Cookie, state string, code string) (*http.Cookie, *user, error)
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func signTestJwt(t *testing.T, alg string, kid string, key crypto.Signer, claims any) string {
+	headerJSON, _ := json.Marshal(oidcJwtHeader{Alg: alg, Kid: kid})
+	claimsJSON, _ := json.Marshal(claims)
+	signedPart := base64.RawURLEncoding.EncodeToString(headerJSON) + "." + base64.RawURLEncoding.EncodeToString(claimsJSON)
+	digest := sha256.Sum256([]byte(signedPart))
+
+	var signature []byte
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		signature, err = rsa.SignPKCS1v15(rand.Reader, k, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatalf("RSA signing error: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, k, digest[:])
+		if err != nil {
+			t.Fatalf("ECDSA signing error: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signedPart + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestOidcCodeChallenge(t *testing.T) {
+	// RFC 7636 appendix B
+	challenge := oidcCodeChallenge("dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk")
+	if challenge != "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM" {
+		t.Errorf("Wrong code challenge: %s", challenge)
+	}
+}
+
+func TestVerifyOidcIdToken(t *testing.T) {
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	now := time.Now()
+	claims := map[string]any{"iss": "https://idp.local", "sub": "42", "aud": "cdiscuss", "exp": now.Add(time.Hour).Unix(),
+		"iat": now.Unix(), "nonce": "n1"}
+
+	for _, test := range []struct {
+		alg    string
+		key    crypto.Signer
+		public crypto.PublicKey
+	}{{"RS256", rsaKey, &rsaKey.PublicKey}, {"ES256", ecKey, &ecKey.PublicKey}} {
+		idToken := signTestJwt(t, test.alg, "k1", test.key, claims)
+		verified, err := verifyOidcIdToken(idToken, test.public, "https://idp.local", "cdiscuss", "n1", now)
+		if err != nil || verified.Subject != "42" {
+			t.Errorf("%s: valid token rejected: %v", test.alg, err)
+		}
+		if _, err = verifyOidcIdToken(idToken, test.public, "https://idp.local", "cdiscuss", "other", now); err == nil {
+			t.Errorf("%s: wrong nonce accepted", test.alg)
+		}
+		if _, err = verifyOidcIdToken(idToken, test.public, "https://idp.local", "other-client", "n1", now); err == nil {
+			t.Errorf("%s: wrong audience accepted", test.alg)
+		}
+		if _, err = verifyOidcIdToken(idToken, test.public, "https://idp.local", "cdiscuss", "n1", now.Add(2*time.Hour)); err == nil {
+			t.Errorf("%s: expired token accepted", test.alg)
+		}
+	}
+
+	idToken := signTestJwt(t, "RS256", "k1", rsaKey, claims)
+	if _, err := verifyOidcIdToken(idToken, &ecKey.PublicKey, "https://idp.local", "cdiscuss", "n1", now); err == nil {
+		t.Errorf("Token verified with wrong key")
+	}
+}
+
+func TestOidcUsernameBase(t *testing.T) {
+	tests := []struct {
+		claims   oidcIdTokenClaims
+		expected string
+	}{
+		{oidcIdTokenClaims{PreferredUsername: "jane.doe"}, "jane_doe"},
+		{oidcIdTokenClaims{PreferredUsername: "jo", Email: "jonathan@example.com"}, "jonathan"},
+		{oidcIdTokenClaims{Name: "Žan Novak"}, "an_Novak"},
+		{oidcIdTokenClaims{}, "user"},
+	}
+	for _, test := range tests {
+		username := oidcUsernameBase(&test.claims)
+		if username != test.expected {
+			t.Errorf("Expected %s, got %s", test.expected, username)
+		}
+		withSuffix, err := oidcUsernameWithSuffix(username)
+		if err != nil {
+			t.Fatalf("Username suffix error: %v", err)
+		}
+		if err := validateUsername(withSuffix); err != nil {
+			t.Errorf("Username with suffix not valid: %v", err)
+		}
+	}
+}
+
+type oidcIdentityRaceDbStub struct {
+	databaseServiceOidcItf // only methods below are used
+}
+
+func (stub *oidcIdentityRaceDbStub) getUserByExternalIdentity(issuer string, subject string) (*user, error) {
+	return nil, nil
+}
+
+func (stub *oidcIdentityRaceDbStub) createUserWithExternalIdentity(username string, password string, issuer string, subject string) (*user, error) {
+	return nil, errOidcIdentityTaken
+}
+
+func TestOidcGetOrCreateUserIdentityRace(t *testing.T) {
+	service := &oidcService{config: oidcConfig{issuer: "https://id.example.com"}, databaseServiceOidc: &oidcIdentityRaceDbStub{}}
+
+	// identity was taken and unlinked again before it could be read
+	user, err := service.getOrCreateUser(&oidcIdTokenClaims{Subject: "sub", PreferredUsername: "adam"}, nil)
+	if !errors.Is(err, errUserDoesntExist) || user != nil {
+		t.Errorf("Expected errUserDoesntExist, got %v, %v", user, err)
+	}
+}
+
+func TestOidcServiceProviderDiscovery(t *testing.T) {
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	var issuer string
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(oidcProviderMetadata{Issuer: issuer, AuthorizationEndpoint: issuer + "/authorize",
+			TokenEndpoint: issuer + "/token", JwksUri: issuer + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		encode := func(n *big.Int) string { return base64.RawURLEncoding.EncodeToString(n.FillBytes(make([]byte, 32))) }
+		json.NewEncoder(w).Encode(oidcJwks{Keys: []oidcJwk{{Kty: "EC", Kid: "k1", Crv: "P-256", X: encode(ecKey.X), Y: encode(ecKey.Y)}}})
+	})
+	server := httptest.NewServer(mux)
+	defer server.Close()
+	issuer = server.URL
+
+	service := &oidcService{config: oidcConfig{issuer: issuer, clientId: "cdiscuss"}, httpClient: server.Client(), metadataMutex: &sync.Mutex{}}
+	metadata, err := service.getProviderMetadata()
+	if err != nil || metadata.TokenEndpoint != issuer+"/token" {
+		t.Fatalf("Discovery failed: %v %v", metadata, err)
+	}
+	key, err := service.getSigningKey(metadata, "k1")
+	if err != nil || !ecKey.PublicKey.Equal(key) {
+		t.Errorf("Wrong signing key: %v", err)
+	}
+	if _, err = service.getSigningKey(metadata, "unknown"); err == nil {
+		t.Errorf("Unknown key id accepted")
+	}
+}
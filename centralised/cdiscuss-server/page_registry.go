@@ -0,0 +1,116 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"time"
+)
+
+// implements pageRegistryItf
+type pageRegistry struct {
+	siteRegistry        siteRegistryItf
+	databaseServicePage databaseServicePageItf
+	rateLimiter         rateLimiterItf
+}
+
+func newPageRegistry(siteRegistry siteRegistryItf, databaseServicePage databaseServicePageItf, rateLimiter rateLimiterItf) (*pageRegistry, error) {
+	if siteRegistry == nil {
+		return nil, errors.New("page registry needs site registry")
+	}
+	if databaseServicePage == nil {
+		return nil, errors.New("page registry needs database")
+	}
+	return &pageRegistry{siteRegistry: siteRegistry, databaseServicePage: databaseServicePage, rateLimiter: rateLimiter}, nil
+}
+
+// site without allowed origins (default site) accepts any page, canonical URL can differ in origin only by rules of the site
+func (registry *pageRegistry) isPageUrlOfSite(site *site, rawUrl string, canonicalUrl string) (bool, error) {
+	if len(site.AllowedOrigins) == 0 {
+		return true, nil
+	}
+	for _, pageUrl := range []string{rawUrl, canonicalUrl} {
+		allowed, err := registry.siteRegistry.isOriginAllowedForSite(site.Id, normalizeOrigin(pageUrl))
+		if err != nil || allowed {
+			return allowed, err
+		}
+	}
+	return false, nil
+}
+
+func (registry *pageRegistry) canonicalizePageUrl(site *site, rawUrl string, canonicalHint string) (string, error) {
+	canonicalUrl, err := canonicalizeUrl(rawUrl, site.UrlRules)
+	if err != nil {
+		return "", err
+	}
+	allowed, err := registry.isPageUrlOfSite(site, rawUrl, canonicalUrl)
+	if err != nil {
+		return "", err
+	}
+	if !allowed {
+		return "", errPageUrlNotAllowed
+	}
+	if canonicalHint == "" {
+		return canonicalUrl, nil
+	}
+
+	// hint can't move the discussion to other site, without allowed origins it must stay on the same origin
+	hintedUrl, err := canonicalizeUrl(canonicalHint, site.UrlRules)
+	if err != nil {
+		slog.Debug("Ignoring canonical hint", slog.String("canonicalHint", canonicalHint), slog.Any("error", err))
+		return canonicalUrl, nil
+	}
+	if len(site.AllowedOrigins) == 0 {
+		allowed = normalizeOrigin(hintedUrl) == normalizeOrigin(canonicalUrl)
+	} else {
+		allowed, err = registry.isPageUrlOfSite(site, canonicalHint, hintedUrl)
+		if err != nil {
+			return "", err
+		}
+	}
+	if !allowed {
+		slog.Debug("Ignoring canonical hint of other site", slog.Int64("idSite", site.Id), slog.String("canonicalHint", canonicalHint))
+		return canonicalUrl, nil
+	}
+	return hintedUrl, nil
+}
+
+func (registry *pageRegistry) registerPage(client clientInfo, idSite int64, rawUrl string, canonicalHint string, title string) (*page, error) {
+	site, err := registry.siteRegistry.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+	canonicalUrl, err := registry.canonicalizePageUrl(site, rawUrl, canonicalHint)
+	if err != nil {
+		return nil, err
+	}
+	title, err = normalizePageTitle(title)
+	if err != nil {
+		return nil, err
+	}
+	urlHash := hashCanonicalUrl(canonicalUrl)
+
+	// embed registers the page on every view, database is written only for new pages and pages without title.
+	// Anybody can register, so a known title is never replaced.
+	existing, err := registry.databaseServicePage.getPage(idSite, urlHash)
+	if err != nil && !errors.Is(err, errPageDoesntExist) {
+		return nil, err
+	}
+	if existing != nil && (title == "" || existing.Title != "") {
+		return existing, nil
+	}
+
+	if registry.rateLimiter != nil {
+		err = registry.rateLimiter.allow(rateLimitOpRegisterPage, rateLimitKeys{client: client})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return registry.databaseServicePage.savePage(idSite, urlHash, canonicalUrl, title, time.Now())
+}
+
+func (registry *pageRegistry) getPage(idSite int64, urlHash string) (*page, error) {
+	if len(urlHash) != urlHashLen {
+		return nil, errUrlHashLen
+	}
+	return registry.databaseServicePage.getPage(idSite, urlHash)
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"net"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	pageUrlMaxLen         int = 2000
+	pageTitleMaxLen       int = 300 // longer titles are cut
+	siteUrlRulesParamsMax int = 50
+	siteUrlRulesParamMax  int = 100
+)
+
+// query parameters that only tell where the visitor came from, they never select the page
+var pageTrackingParams = map[string]bool{"fbclid": true, "gclid": true, "dclid": true, "gbraid": true, "wbraid": true, "msclkid": true,
+	"yclid": true, "twclid": true, "igshid": true, "mc_cid": true, "mc_eid": true, "_ga": true, "_gl": true, "_hsenc": true, "_hsmi": true,
+	"ref_src": true, "ref_url": true, "spm": true}
+var pageTrackingParamPrefixes = []string{"utm_", "pk_", "mtm_", "hsa_"}
+
+// per-site rules of URL canonicalization, part of site settings
+type siteUrlRules struct {
+	ForceHttps       bool     `json:"forceHttps"`       // http and https are the same page
+	StripWww         bool     `json:"stripWww"`         // www.example.com and example.com are the same page
+	IgnoreQuery      bool     `json:"ignoreQuery"`      // query never selects the page
+	KeepQueryParams  []string `json:"keepQueryParams"`  // if set only these parameters are kept
+	StripQueryParams []string `json:"stripQueryParams"` // removed on top of tracking parameters
+}
+
+type page struct {
+	IdSite       int64     `json:"idSite"`
+	UrlHash      string    `json:"urlHash"` // to be used for comments of the page
+	CanonicalUrl string    `json:"canonicalUrl"`
+	Title        string    `json:"title"`
+	DtCreated    time.Time `json:"dtCreated"`
+	DtModified   time.Time `json:"dtModified"`
+}
+
+// used by the embed before listing comments, no session is needed
+type pageRegistryItf interface {
+	// canonicalHint is rel=canonical of the page, it's ignored if it points outside the site. Title is set only if the page has none.
+	registerPage(client clientInfo, idSite int64, rawUrl string, canonicalHint string, title string) (*page, error)
+	// errPageDoesntExist if the page wasn't registered
+	getPage(idSite int64, urlHash string) (*page, error)
+}
+
+func validateSiteUrlRules(rules *siteUrlRules) error {
+	if len(rules.KeepQueryParams) > siteUrlRulesParamsMax || len(rules.StripQueryParams) > siteUrlRulesParamsMax {
+		return errSiteUrlRulesNotValid
+	}
+	for _, params := range [][]string{rules.KeepQueryParams, rules.StripQueryParams} {
+		for _, param := range params {
+			if param == "" || len(param) > siteUrlRulesParamMax || !utf8.ValidString(param) {
+				return errSiteUrlRulesNotValid
+			}
+		}
+	}
+	if rules.KeepQueryParams == nil {
+		rules.KeepQueryParams = make([]string, 0)
+	}
+	if rules.StripQueryParams == nil {
+		rules.StripQueryParams = make([]string, 0)
+	}
+	return nil
+}
+
+func isPageTrackingParam(name string) bool {
+	name = strings.ToLower(name)
+	if pageTrackingParams[name] {
+		return true
+	}
+	for _, prefix := range pageTrackingParamPrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// scheme and host are lower case without default port, dot segments and trailing slash are removed,
+// tracking parameters and fragment are dropped and remaining parameters are sorted
+func canonicalizeUrl(rawUrl string, rules siteUrlRules) (string, error) {
+	if len(rawUrl) > pageUrlMaxLen {
+		return "", errPageUrlNotValid
+	}
+	parsed, err := url.Parse(strings.TrimSpace(rawUrl))
+	if err != nil {
+		return "", errPageUrlNotValid
+	}
+	scheme := strings.ToLower(parsed.Scheme)
+	if scheme != "http" && scheme != "https" {
+		return "", errPageUrlNotValid
+	}
+	if rules.ForceHttps {
+		scheme = "https"
+	}
+
+	host := strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	if host == "" {
+		return "", errPageUrlNotValid
+	}
+	if rules.StripWww {
+		host = strings.TrimPrefix(host, "www.")
+	}
+	port := parsed.Port()
+	if (port == "80" && strings.ToLower(parsed.Scheme) == "http") || (port == "443" && scheme == "https") {
+		port = ""
+	}
+	if port != "" {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]" // IPv6
+	}
+
+	cleanPath := path.Clean("/" + parsed.Path)
+	query := ""
+	if !rules.IgnoreQuery {
+		values := parsed.Query()
+		for name := range values {
+			if isPageTrackingParam(name) || containsString(rules.StripQueryParams, name) ||
+				(len(rules.KeepQueryParams) > 0 && !containsString(rules.KeepQueryParams, name)) {
+				values.Del(name)
+			}
+		}
+		query = values.Encode() // sorted by name
+	}
+
+	canonical := url.URL{Scheme: scheme, Host: host, Path: cleanPath, RawQuery: query}
+	canonicalUrl := canonical.String()
+	if len(canonicalUrl) > pageUrlMaxLen {
+		return "", errPageUrlNotValid
+	}
+	return canonicalUrl, nil
+}
+
+func hashCanonicalUrl(canonicalUrl string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalUrl)))
+}
+
+// whitespace is collapsed and too long title is cut
+func normalizePageTitle(title string) (string, error) {
+	if !utf8.ValidString(title) {
+		return "", errPageTitleNotValid
+	}
+	title = strings.Join(strings.FieldsFunc(title, unicode.IsSpace), " ")
+	if utf8.RuneCountInString(title) > pageTitleMaxLen {
+		title = string([]rune(title)[:pageTitleMaxLen])
+	}
+	return title, nil
+}
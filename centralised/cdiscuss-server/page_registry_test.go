@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+type stubDatabaseServicePage struct {
+	pages map[string]page
+	saves int
+}
+
+func (db *stubDatabaseServicePage) getPage(idSite int64, urlHash string) (*page, error) {
+	page, ok := db.pages[urlHash]
+	if !ok || page.IdSite != idSite {
+		return nil, errPageDoesntExist
+	}
+	return &page, nil
+}
+
+func (db *stubDatabaseServicePage) savePage(idSite int64, urlHash string, canonicalUrl string, title string, now time.Time) (*page, error) {
+	db.saves++
+	saved, ok := db.pages[urlHash]
+	if !ok {
+		saved = page{IdSite: idSite, UrlHash: urlHash, CanonicalUrl: canonicalUrl, DtCreated: now}
+	}
+	if saved.Title == "" {
+		saved.Title = title
+	}
+	saved.DtModified = now
+	db.pages[urlHash] = saved
+	return &saved, nil
+}
+
+func TestCanonicalizeUrl(t *testing.T) {
+	tests := []struct {
+		rawUrl   string
+		rules    siteUrlRules
+		expected string
+	}{
+		{"https://www.example.com", siteUrlRules{}, "https://www.example.com/"},
+		{" HTTPS://Blog.Example.COM:443/a/./b/../c/?utm_source=x&b=2&a=1&fbclid=y#comments ", siteUrlRules{}, "https://blog.example.com/a/c?a=1&b=2"},
+		{"http://example.com:80/post/", siteUrlRules{ForceHttps: true, StripWww: true}, "https://example.com/post"},
+		{"http://www.example.com:8080/post", siteUrlRules{StripWww: true}, "http://example.com:8080/post"},
+		{"https://example.com/?p=12&page=2&ref=x", siteUrlRules{KeepQueryParams: []string{"p"}}, "https://example.com/?p=12"},
+		{"https://example.com/?p=12&ref=x", siteUrlRules{StripQueryParams: []string{"ref"}}, "https://example.com/?p=12"},
+		{"https://example.com/post?p=12", siteUrlRules{IgnoreQuery: true}, "https://example.com/post"},
+		{"https://[::1]:443/post", siteUrlRules{}, "https://[::1]/post"},
+	}
+	for _, test := range tests {
+		canonicalUrl, err := canonicalizeUrl(test.rawUrl, test.rules)
+		if err != nil {
+			t.Errorf("%s: canonicalization failed: %v", test.rawUrl, err)
+		} else if canonicalUrl != test.expected {
+			t.Errorf("%s: got %s want %s", test.rawUrl, canonicalUrl, test.expected)
+		}
+	}
+
+	for _, rawUrl := range []string{"", "example.com/post", "javascript:alert(1)", "ftp://example.com/", "https:///post"} {
+		if _, err := canonicalizeUrl(rawUrl, siteUrlRules{}); !errors.Is(err, errPageUrlNotValid) {
+			t.Errorf("%q: bad URL accepted: %v", rawUrl, err)
+		}
+	}
+}
+
+func TestPageRegistry(t *testing.T) {
+	siteRegistry := &stubSiteRegistry{origins: map[int64][]string{1: {}, 2: {"https://blog.example.com"}}}
+	db := &stubDatabaseServicePage{pages: make(map[string]page)}
+	registry, err := newPageRegistry(siteRegistry, db, nil)
+	if err != nil {
+		t.Fatalf("Page registry creation error: %v", err)
+	}
+
+	page, err := registry.registerPage(clientInfo{}, 2, "https://blog.example.com/post/?utm_medium=rss", "", "  First\n post ")
+	if err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	if page.CanonicalUrl != "https://blog.example.com/post" || page.UrlHash != hashCanonicalUrl(page.CanonicalUrl) || page.Title != "First post" {
+		t.Errorf("Wrong page: %+v", page)
+	}
+	again, err := registry.registerPage(clientInfo{}, 2, "https://blog.example.com/post#top", "https://blog.example.com/post", "")
+	if err != nil || again.UrlHash != page.UrlHash || again.Title != "First post" || db.saves != 1 {
+		t.Errorf("Same page registered again: %+v, saves %d, %v", again, db.saves, err)
+	}
+	again, err = registry.registerPage(clientInfo{}, 2, "https://blog.example.com/post", "", "Buy cheap watches")
+	if err != nil || again.Title != "First post" || db.saves != 1 {
+		t.Errorf("Known title replaced: %+v, saves %d, %v", again, db.saves, err)
+	}
+	if _, err := registry.registerPage(clientInfo{}, 2, "https://blog.example.com/other", "", ""); err != nil {
+		t.Fatalf("Register failed: %v", err)
+	}
+	untitled, err := registry.registerPage(clientInfo{}, 2, "https://blog.example.com/other", "", "Other post")
+	if err != nil || untitled.Title != "Other post" {
+		t.Errorf("Missing title not set: %+v, %v", untitled, err)
+	}
+
+	if _, err := registry.registerPage(clientInfo{}, 2, "https://evil.example.org/post", "", ""); !errors.Is(err, errPageUrlNotAllowed) {
+		t.Errorf("Page of other site registered: %v", err)
+	}
+	hinted, err := registry.registerPage(clientInfo{}, 2, "https://blog.example.com/post?id=3", "https://evil.example.org/post", "")
+	if err != nil || hinted.CanonicalUrl != "https://blog.example.com/post?id=3" {
+		t.Errorf("Canonical hint of other site used: %+v, %v", hinted, err)
+	}
+	hinted, err = registry.registerPage(clientInfo{}, 1, "https://a.example.com/amp/post", "https://a.example.com/post", "")
+	if err != nil || hinted.CanonicalUrl != "https://a.example.com/post" {
+		t.Errorf("Canonical hint of same origin not used: %+v, %v", hinted, err)
+	}
+	if _, err := registry.registerPage(clientInfo{}, 3, "https://blog.example.com/post", "", ""); !errors.Is(err, errSiteDoesntExist) {
+		t.Errorf("Page of missing site registered: %v", err)
+	}
+}
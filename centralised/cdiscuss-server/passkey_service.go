@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type passkeyService struct {
+	rpId           string
+	rpName         string
+	allowedOrigins []string
+
+	userService            userServiceItf
+	sessionStarter         sessionStarterItf
+	databaseServiceUser    databaseServiceUserItf
+	databaseServicePasskey databaseServicePasskeyItf
+	rateLimiter            rateLimiterItf
+
+	stopWorkerChan                 chan bool
+	deleteOutdatedChallengesTicker *time.Ticker
+}
+
+func newPasskeyService(rpId string, rpName string, allowedOrigins []string, userService userServiceItf, sessionStarter sessionStarterItf,
+	databaseServiceUser databaseServiceUserItf, databaseServicePasskey databaseServicePasskeyItf, rateLimiter rateLimiterItf,
+	deleteOutdatedChallengesPeriod time.Duration) (*passkeyService, error) {
+	if rpId == "" || len(allowedOrigins) == 0 {
+		return nil, errors.New("passkey service needs RP ID and allowed origins")
+	}
+	if databaseServicePasskey == nil {
+		return nil, errors.New("passkey service needs database")
+	}
+	if sessionStarter == nil {
+		return nil, errors.New("passkey service needs session starter")
+	}
+	if deleteOutdatedChallengesPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedChallengesPeriod value")
+	}
+
+	service := &passkeyService{rpId: rpId, rpName: rpName, allowedOrigins: allowedOrigins, userService: userService,
+		sessionStarter: sessionStarter, databaseServiceUser: databaseServiceUser, databaseServicePasskey: databaseServicePasskey, rateLimiter: rateLimiter}
+	service.stopWorkerChan = make(chan bool)
+	service.deleteOutdatedChallengesTicker = time.NewTicker(deleteOutdatedChallengesPeriod)
+
+	go service.deleteOutdatedChallengesLoopWorker()
+
+	return service, nil
+}
+
+func (service *passkeyService) deleteOutdatedChallengesLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.deleteOutdatedChallengesTicker.C:
+			err := service.databaseServicePasskey.deleteWebauthnChallengesThatExpired(time.Now())
+			if err != nil {
+				slog.Error("Deleting outdated WebAuthn challenges from DB:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *passkeyService) stop() {
+	service.deleteOutdatedChallengesTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop passkeyService instance")
+	}
+}
+
+func (service *passkeyService) newChallenge(kind string, idUser *int64) ([]byte, error) {
+	challenge := make([]byte, webauthnChallengeLen)
+	_, err := rand.Read(challenge)
+	if err != nil {
+		return nil, err
+	}
+	challengeHash, err := calculateTokenHash(string(challenge))
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.databaseServicePasskey.createWebauthnChallenge(challengeHash, kind, idUser, time.Now().Add(webauthnChallengeAge))
+	if err != nil {
+		return nil, err
+	}
+	return challenge, nil
+}
+
+// challenges are single use, returns user the challenge was issued for
+func (service *passkeyService) takeChallenge(challenge []byte, kind string) (*int64, error) {
+	challengeHash, err := calculateTokenHash(string(challenge))
+	if err != nil {
+		return nil, errPasskeyChallengeNotValid
+	}
+
+	found, idUser, expiresTime, err := service.databaseServicePasskey.takeWebauthnChallenge(challengeHash, kind)
+	if err != nil {
+		return nil, err
+	}
+	if !found || isExpired(time.Now(), expiresTime) {
+		return nil, errPasskeyChallengeNotValid
+	}
+	return idUser, nil
+}
+
+func (service *passkeyService) beginPasskeyRegistration(sessionCookie *http.Cookie) (*passkeyCreationOptions, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	challenge, err := service.newChallenge(webauthnChallengeKindReg, &user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := service.databaseServicePasskey.listPasskeyCredentials(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	excludeCredentialIds := make([]string, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		excludeCredentialIds = append(excludeCredentialIds, base64.RawURLEncoding.EncodeToString(passkey.credentialId))
+	}
+
+	options := &passkeyCreationOptions{Challenge: base64.RawURLEncoding.EncodeToString(challenge), RpId: service.rpId, RpName: service.rpName,
+		UserHandle: base64.RawURLEncoding.EncodeToString(webauthnUserHandle(user.Id)), Username: user.Username,
+		Algorithms: webauthnSupportedAlgorithms, ExcludeCredentialIds: excludeCredentialIds, TimeoutMs: webauthnChallengeAge.Milliseconds()}
+	return options, nil
+}
+
+func (service *passkeyService) finishPasskeyRegistration(sessionCookie *http.Cookie, name string, clientDataJSON []byte, attestationObject []byte) (*passkeyInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	if name == "" || len(name) > passkeyNameMaxLen {
+		return nil, errPasskeyNameLen
+	}
+
+	_, challenge, err := parseWebauthnClientData(clientDataJSON, webauthnTypeCreate, service.allowedOrigins)
+	if err != nil {
+		slog.Warn("Passkey registration rejected", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		return nil, errPasskeyNotValid
+	}
+	idUser, err := service.takeChallenge(challenge, webauthnChallengeKindReg)
+	if err != nil {
+		return nil, err
+	}
+	if idUser == nil || *idUser != user.Id {
+		return nil, errPasskeyChallengeNotValid
+	}
+
+	authDataBytes, err := parseWebauthnAttestationObject(attestationObject)
+	if err != nil {
+		slog.Warn("Passkey registration rejected", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		return nil, errPasskeyNotValid
+	}
+	authData, err := parseWebauthnAuthenticatorData(authDataBytes, service.rpId)
+	if err != nil || authData.credentialId == nil {
+		slog.Warn("Passkey registration rejected", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		return nil, errPasskeyNotValid
+	}
+	_, _, err = parseCosePublicKey(authData.publicKey)
+	if err != nil {
+		slog.Warn("Passkey registration rejected", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		return nil, errPasskeyNotValid
+	}
+
+	credential := passkeyCredential{idUser: user.Id, credentialId: authData.credentialId, publicKey: authData.publicKey,
+		signCount: authData.signCount, name: name, dtCreated: time.Now()}
+	id, err := service.databaseServicePasskey.createPasskeyCredential(credential)
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyInfo{Id: id, Name: name, DtCreated: credential.dtCreated}, nil
+}
+
+func (service *passkeyService) listPasskeys(sessionCookie *http.Cookie) ([]passkeyInfo, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	passkeys, err := service.databaseServicePasskey.listPasskeyCredentials(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	infos := make([]passkeyInfo, 0, len(passkeys))
+	for _, passkey := range passkeys {
+		infos = append(infos, passkeyInfo{Id: passkey.id, Name: passkey.name, DtCreated: passkey.dtCreated, DtLastUsed: passkey.dtLastUsed})
+	}
+	return infos, nil
+}
+
+func (service *passkeyService) deletePasskey(sessionCookie *http.Cookie, id int64) error {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+	return service.databaseServicePasskey.deletePasskeyCredential(id, user.Id)
+}
+
+func (service *passkeyService) beginPasskeyLogin() (*passkeyRequestOptions, error) {
+	challenge, err := service.newChallenge(webauthnChallengeKindLogin, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &passkeyRequestOptions{Challenge: base64.RawURLEncoding.EncodeToString(challenge), RpId: service.rpId,
+		TimeoutMs: webauthnChallengeAge.Milliseconds()}, nil
+}
+
+func (service *passkeyService) finishPasskeyLogin(client clientInfo, credentialId []byte, clientDataJSON []byte, authenticatorData []byte,
+	signature []byte, userHandle []byte) (*http.Cookie, *user, error) {
+	if service.rateLimiter != nil {
+		err := service.rateLimiter.allow(rateLimitOpLogin, rateLimitKeys{client: client})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	_, challenge, err := parseWebauthnClientData(clientDataJSON, webauthnTypeGet, service.allowedOrigins)
+	if err != nil {
+		slog.Warn("Passkey login rejected", slog.Any("error", err))
+		return nil, nil, errPasskeyNotValid
+	}
+	_, err = service.takeChallenge(challenge, webauthnChallengeKindLogin)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	credential, err := service.databaseServicePasskey.getPasskeyCredential(credentialId)
+	if err != nil {
+		return nil, nil, err
+	}
+	if credential == nil {
+		return nil, nil, errPasskeyNotValid
+	}
+	if userHandle != nil && !bytes.Equal(userHandle, webauthnUserHandle(credential.idUser)) {
+		return nil, nil, errPasskeyNotValid
+	}
+
+	authData, err := parseWebauthnAuthenticatorData(authenticatorData, service.rpId)
+	if err != nil {
+		slog.Warn("Passkey login rejected", slog.Int64("idUser", credential.idUser), slog.Any("error", err))
+		return nil, nil, errPasskeyNotValid
+	}
+	err = verifyWebauthnSignature(credential.publicKey, authenticatorData, clientDataJSON, signature)
+	if err != nil {
+		slog.Warn("Passkey login rejected", slog.Int64("idUser", credential.idUser), slog.Any("error", err))
+		return nil, nil, errPasskeyNotValid
+	}
+	// authenticators without counter always report 0, otherwise counter must grow or the key was cloned
+	if (authData.signCount != 0 || credential.signCount != 0) && authData.signCount <= credential.signCount {
+		slog.Warn("Passkey sign counter did not grow, possibly cloned authenticator", slog.Int64("idUser", credential.idUser))
+		return nil, nil, errPasskeyNotValid
+	}
+
+	err = service.databaseServicePasskey.updatePasskeyCredentialUse(credential.id, authData.signCount, time.Now())
+	if err != nil {
+		slog.Error("Failed to update passkey use", slog.Int64("id", credential.id), slog.Any("error", err))
+	}
+
+	user, err := service.databaseServiceUser.getUser(credential.idUser)
+	if err != nil {
+		return nil, nil, err
+	}
+	return service.sessionStarter.startSession(user, client)
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+const (
+	webauthnChallengeLen       int           = 32
+	webauthnChallengeAge       time.Duration = 5 * time.Minute
+	webauthnChallengeKindReg   string        = "registration"
+	webauthnChallengeKindLogin string        = "login"
+	passkeyNameMaxLen          int           = 100
+)
+
+// options for navigator.credentials.create(), binary values are base64url encoded
+type passkeyCreationOptions struct {
+	Challenge            string   `json:"challenge"`
+	RpId                 string   `json:"rpId"`
+	RpName               string   `json:"rpName"`
+	UserHandle           string   `json:"userHandle"`
+	Username             string   `json:"username"`
+	Algorithms           []int64  `json:"algorithms"`
+	ExcludeCredentialIds []string `json:"excludeCredentialIds"`
+	TimeoutMs            int64    `json:"timeoutMs"`
+}
+
+// options for navigator.credentials.get(), allowed credentials are not listed so discoverable passkeys are used
+type passkeyRequestOptions struct {
+	Challenge string `json:"challenge"`
+	RpId      string `json:"rpId"`
+	TimeoutMs int64  `json:"timeoutMs"`
+}
+
+type passkeyInfo struct {
+	Id         int64      `json:"id"`
+	Name       string     `json:"name"`
+	DtCreated  time.Time  `json:"dtCreated"`
+	DtLastUsed *time.Time `json:"dtLastUsed"`
+}
+
+type passkeyServiceItf interface {
+	beginPasskeyRegistration(sessionCookie *http.Cookie) (*passkeyCreationOptions, error)
+	finishPasskeyRegistration(sessionCookie *http.Cookie, name string, clientDataJSON []byte, attestationObject []byte) (*passkeyInfo, error)
+	listPasskeys(sessionCookie *http.Cookie) ([]passkeyInfo, error)
+	deletePasskey(sessionCookie *http.Cookie, id int64) error
+
+	beginPasskeyLogin() (*passkeyRequestOptions, error)
+	// creates a session just like password login
+	finishPasskeyLogin(client clientInfo, credentialId []byte, clientDataJSON []byte, authenticatorData []byte, signature []byte, userHandle []byte) (*http.Cookie, *user, error)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"time"
+)
+
+type passwordResetService struct {
+	resetUrl string // link in the mail, token is added as query param
+
+	databaseServicePasswordReset databaseServicePasswordResetItf
+	databaseServiceUser          databaseServiceUserItf
+	sessionStore                 sessionStoreItf
+	loginGuard                   loginGuardItf
+	rateLimiter                  rateLimiterItf
+	mailer                       mailerItf // nil if email is not configured
+
+	stopWorkerChan             chan bool
+	deleteOutdatedTokensTicker *time.Ticker
+}
+
+func newPasswordResetService(resetUrl string, databaseServicePasswordReset databaseServicePasswordResetItf, databaseServiceUser databaseServiceUserItf,
+	sessionStore sessionStoreItf, loginGuard loginGuardItf, rateLimiter rateLimiterItf, mailer mailerItf,
+	deleteOutdatedTokensPeriod time.Duration) (*passwordResetService, error) {
+	if databaseServicePasswordReset == nil || databaseServiceUser == nil {
+		return nil, errors.New("password reset service needs database")
+	}
+	if mailer != nil {
+		parsed, err := url.Parse(resetUrl)
+		if err != nil || parsed.Scheme == "" || parsed.Host == "" {
+			return nil, errors.New("bad resetUrl value")
+		}
+	}
+	if deleteOutdatedTokensPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedTokensPeriod value")
+	}
+
+	service := &passwordResetService{resetUrl: resetUrl, databaseServicePasswordReset: databaseServicePasswordReset,
+		databaseServiceUser: databaseServiceUser, sessionStore: sessionStore, loginGuard: loginGuard, rateLimiter: rateLimiter, mailer: mailer}
+	service.stopWorkerChan = make(chan bool)
+	service.deleteOutdatedTokensTicker = time.NewTicker(deleteOutdatedTokensPeriod)
+
+	go service.deleteOutdatedTokensLoopWorker()
+
+	return service, nil
+}
+
+func (service *passwordResetService) deleteOutdatedTokensLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.deleteOutdatedTokensTicker.C:
+			err := service.databaseServicePasswordReset.deletePasswordResetTokensThatExpired(time.Now())
+			if err != nil {
+				slog.Error("Deleting outdated password reset tokens from DB:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *passwordResetService) stop() {
+	service.deleteOutdatedTokensTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop passwordResetService instance")
+	}
+}
+
+func (service *passwordResetService) issuePasswordResetToken(idUser int64) (string, time.Time, error) {
+	token, err := generatePasswordResetToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	tokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	expiresTime := time.Now().Add(passwordResetTokenAge)
+
+	err = service.databaseServicePasswordReset.createPasswordResetToken(passwordResetToken{tokenHash: tokenHash, idUser: idUser, dtExpires: expiresTime})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return token, expiresTime, nil
+}
+
+func (service *passwordResetService) requestPasswordReset(client clientInfo, username string) error {
+	err := validateUsername(username)
+	if err != nil {
+		return err
+	}
+
+	if service.rateLimiter != nil {
+		err = service.rateLimiter.allow(rateLimitOpPasswordReset, rateLimitKeys{client: client})
+		if err != nil {
+			return err
+		}
+	}
+	if service.mailer == nil {
+		return nil
+	}
+
+	user, err := service.databaseServiceUser.getUserByUsername(username)
+	if err != nil {
+		if errors.Is(err, errUserDoesntExist) {
+			return nil
+		}
+		return err
+	}
+	email, err := service.databaseServiceUser.getUserEmail(user.Id)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return nil
+	}
+
+	// per user limit protects the mailbox, it is silent so it doesn't reveal the user exists
+	if service.rateLimiter != nil {
+		err = service.rateLimiter.allow(rateLimitOpPasswordReset, rateLimitKeys{idUser: &user.Id})
+		if err != nil {
+			slog.Warn("Password reset mail rate limited", slog.Int64("idUser", user.Id))
+			return nil
+		}
+	}
+
+	token, expiresTime, err := service.issuePasswordResetToken(user.Id)
+	if err != nil {
+		return err
+	}
+
+	link, _ := url.Parse(service.resetUrl)
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	body := fmt.Sprintf("Hi %s,\n\nsomebody asked to reset your cDiscuss password. If it was you, open the link below to set a new one:\n\n%s\n\n"+
+		"The link works once and expires at %s. If you didn't ask for it, you can ignore this mail.\n",
+		user.Username, link.String(), expiresTime.UTC().Format(time.RFC1123))
+	err = service.mailer.sendMail(email, "cDiscuss password reset", body)
+	if err != nil {
+		slog.Error("Failed to mail password reset link", slog.Int64("idUser", user.Id), slog.Any("error", err))
+		return err
+	}
+	return nil
+}
+
+func (service *passwordResetService) resetPassword(client clientInfo, token string, newPassword string) error {
+	err := validatePassword(newPassword)
+	if err != nil {
+		return err
+	}
+
+	if service.rateLimiter != nil {
+		err = service.rateLimiter.allow(rateLimitOpPasswordReset, rateLimitKeys{client: client})
+		if err != nil {
+			return err
+		}
+	}
+
+	tokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return errPasswordResetTokenNotValid
+	}
+	resetToken, err := service.databaseServicePasswordReset.takePasswordResetToken(tokenHash)
+	if err != nil {
+		return err
+	}
+	if resetToken == nil || isExpired(time.Now(), resetToken.dtExpires) {
+		return errPasswordResetTokenNotValid
+	}
+
+	err = service.databaseServiceUser.setUserPassword(resetToken.idUser, newPassword)
+	if err != nil {
+		return err
+	}
+
+	err = service.databaseServicePasswordReset.deletePasswordResetTokensForUser(resetToken.idUser)
+	if err != nil {
+		slog.Error("Failed to delete other password reset tokens", slog.Int64("idUser", resetToken.idUser), slog.Any("error", err))
+	}
+
+	if service.loginGuard != nil {
+		user, err := service.databaseServiceUser.getUser(resetToken.idUser)
+		if err == nil {
+			err = service.loginGuard.unlockUser(user.Username)
+		}
+		if err != nil {
+			slog.Error("Failed to unlock user after password reset", slog.Int64("idUser", resetToken.idUser), slog.Any("error", err))
+		}
+	}
+
+	return service.sessionStore.forgetSessionsForUser(resetToken.idUser)
+}
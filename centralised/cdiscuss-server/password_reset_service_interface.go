@@ -0,0 +1,51 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"net/mail"
+	"time"
+)
+
+const (
+	passwordResetTokenRandomLen int           = 32
+	passwordResetTokenAge       time.Duration = time.Hour
+	emailMaxLen                 int           = 254
+)
+
+type passwordResetServiceItf interface {
+	// mails reset link if the user has email and mailer is configured. Returns nil also for unknown
+	// users so usernames can't be probed.
+	requestPasswordReset(client clientInfo, username string) error
+	// token is single use, all sessions of the user are ended
+	resetPassword(client clientInfo, token string, newPassword string) error
+}
+
+// used by admins to hand the token to the user some other way
+type passwordResetIssuerItf interface {
+	issuePasswordResetToken(idUser int64) (string, time.Time, error)
+}
+
+func generatePasswordResetToken() (string, error) {
+	b := make([]byte, passwordResetTokenRandomLen)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// empty email is allowed, it removes the email
+func validateEmail(email string) error {
+	if email == "" {
+		return nil
+	}
+	if len(email) > emailMaxLen {
+		return errEmailNotValid
+	}
+	address, err := mail.ParseAddress(email)
+	if err != nil || address.Address != email {
+		return errEmailNotValid
+	}
+	return nil
+}
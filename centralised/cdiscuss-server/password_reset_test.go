@@ -0,0 +1,171 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateEmail(t *testing.T) {
+	for _, email := range []string{"", "jane@example.com", "jane.doe+cdiscuss@mail.example.org"} {
+		if err := validateEmail(email); err != nil {
+			t.Errorf("Valid email '%s' rejected: %v", email, err)
+		}
+	}
+	for _, email := range []string{"jane", "Jane <jane@example.com>", "jane@example.com\r\nBcc: x@example.com"} {
+		if err := validateEmail(email); !errors.Is(err, errEmailNotValid) {
+			t.Errorf("Email '%s' should be rejected, got %v", email, err)
+		}
+	}
+}
+
+func TestPasswordResetTokenIsUnique(t *testing.T) {
+	first, err := generatePasswordResetToken()
+	if err != nil {
+		t.Fatalf("Token generation error: %v", err)
+	}
+	second, _ := generatePasswordResetToken()
+	if first == second || len(first) < passwordResetTokenRandomLen {
+		t.Errorf("Weak reset tokens: %s %s", first, second)
+	}
+}
+
+type passwordResetDbStub struct {
+	tokens map[string]passwordResetToken
+}
+
+func (stub *passwordResetDbStub) createPasswordResetToken(token passwordResetToken) error {
+	stub.tokens[token.tokenHash] = token
+	return nil
+}
+
+func (stub *passwordResetDbStub) takePasswordResetToken(tokenHash string) (*passwordResetToken, error) {
+	token, ok := stub.tokens[tokenHash]
+	if !ok {
+		return nil, nil
+	}
+	delete(stub.tokens, tokenHash)
+	return &token, nil
+}
+
+func (stub *passwordResetDbStub) deletePasswordResetTokensForUser(idUser int64) error {
+	for tokenHash, token := range stub.tokens {
+		if token.idUser == idUser {
+			delete(stub.tokens, tokenHash)
+		}
+	}
+	return nil
+}
+
+func (stub *passwordResetDbStub) deletePasswordResetTokensThatExpired(now time.Time) error {
+	return nil
+}
+
+type passwordResetUserDbStub struct {
+	databaseServiceUserItf // only methods below are used
+	users                  map[string]*user
+	emails                 map[int64]string
+	passwords              map[int64]string
+}
+
+func (stub *passwordResetUserDbStub) getUserByUsername(username string) (*user, error) {
+	user, ok := stub.users[username]
+	if !ok {
+		return nil, errUserDoesntExist
+	}
+	return user, nil
+}
+
+func (stub *passwordResetUserDbStub) getUserEmail(idUser int64) (string, error) {
+	return stub.emails[idUser], nil
+}
+
+func (stub *passwordResetUserDbStub) setUserPassword(idUser int64, password string) error {
+	stub.passwords[idUser] = password
+	return nil
+}
+
+type forgetSessionsStub struct {
+	sessionStoreItf // only methods below are used
+	forgotten       []int64
+}
+
+func (stub *forgetSessionsStub) forgetSessionsForUser(idUser int64) error {
+	stub.forgotten = append(stub.forgotten, idUser)
+	return nil
+}
+
+type mailerStub struct {
+	to   []string
+	body string
+}
+
+func (stub *mailerStub) sendMail(to string, subject string, body string) error {
+	stub.to = append(stub.to, to)
+	stub.body = body
+	return nil
+}
+
+func newPasswordResetTestService() (*passwordResetService, *passwordResetDbStub, *passwordResetUserDbStub, *forgetSessionsStub, *mailerStub) {
+	resetDb := &passwordResetDbStub{tokens: make(map[string]passwordResetToken)}
+	userDb := &passwordResetUserDbStub{users: map[string]*user{"jane": {Id: 1, Username: "jane"}, "john": {Id: 2, Username: "john"}},
+		emails: map[int64]string{1: "jane@example.com"}, passwords: make(map[int64]string)}
+	sessionStore := &forgetSessionsStub{}
+	mailer := &mailerStub{}
+	service := &passwordResetService{resetUrl: "https://example.com/reset", databaseServicePasswordReset: resetDb, databaseServiceUser: userDb,
+		sessionStore: sessionStore, mailer: mailer}
+	return service, resetDb, userDb, sessionStore, mailer
+}
+
+func TestResetPassword(t *testing.T) {
+	service, resetDb, userDb, sessionStore, _ := newPasswordResetTestService()
+	token, _, err := service.issuePasswordResetToken(1)
+	if err != nil {
+		t.Fatalf("Issue failed: %v", err)
+	}
+	otherToken, _, _ := service.issuePasswordResetToken(1)
+
+	if err := service.resetPassword(clientInfo{}, token, "correct horse battery staple 1"); err != nil {
+		t.Fatalf("Reset failed: %v", err)
+	}
+	if userDb.passwords[1] != "correct horse battery staple 1" {
+		t.Errorf("Password not set")
+	}
+	if len(sessionStore.forgotten) != 1 || sessionStore.forgotten[0] != 1 {
+		t.Errorf("Sessions of the user not ended: %v", sessionStore.forgotten)
+	}
+	if err := service.resetPassword(clientInfo{}, token, "correct horse battery staple 2"); !errors.Is(err, errPasswordResetTokenNotValid) {
+		t.Errorf("Token used twice: %v", err)
+	}
+	if err := service.resetPassword(clientInfo{}, otherToken, "correct horse battery staple 2"); !errors.Is(err, errPasswordResetTokenNotValid) {
+		t.Errorf("Other tokens of the user should be deleted: %v", err)
+	}
+
+	expiredToken, _ := generatePasswordResetToken()
+	expiredHash, _ := calculateTokenHash(expiredToken)
+	resetDb.tokens[expiredHash] = passwordResetToken{tokenHash: expiredHash, idUser: 1, dtExpires: time.Now().Add(-time.Second)}
+	if err := service.resetPassword(clientInfo{}, expiredToken, "correct horse battery staple 3"); !errors.Is(err, errPasswordResetTokenNotValid) {
+		t.Errorf("Expired token accepted: %v", err)
+	}
+	if userDb.passwords[1] != "correct horse battery staple 1" || len(sessionStore.forgotten) != 1 {
+		t.Errorf("Failed reset changed the account")
+	}
+}
+
+func TestRequestPasswordResetDoesntRevealUsers(t *testing.T) {
+	service, resetDb, _, _, mailer := newPasswordResetTestService()
+
+	// unknown user and user without email look the same as a mailed one
+	for _, username := range []string{"nobody", "john", "jane"} {
+		if err := service.requestPasswordReset(clientInfo{}, username); err != nil {
+			t.Errorf("%s: request should succeed, got %v", username, err)
+		}
+	}
+	if len(mailer.to) != 1 || mailer.to[0] != "jane@example.com" || len(resetDb.tokens) != 1 {
+		t.Fatalf("Only jane should get a mail: %v, tokens %d", mailer.to, len(resetDb.tokens))
+	}
+	if !strings.Contains(mailer.body, "https://example.com/reset?token=") {
+		t.Errorf("Mail without reset link: %s", mailer.body)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	_ "image/gif"
+	_ "image/jpeg"
+	"image/png"
+	"net/url"
+	"strconv"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	displayNameMaxLen      int    = 50 // chars, not bytes
+	bioMaxLen              int    = 500
+	websiteMaxLen          int    = 200
+	avatarUploadMaxLen     int    = 2 << 20
+	avatarSourceMaxSide    int    = 4096 // decompression bomb guard, checked before decoding
+	avatarSize             int    = 128
+	avatarContentType      string = "image/png"
+	avatarUrlPrefix        string = "/avatars/"
+	identiconGridSize      int    = 5
+	profileRecentCommentsN uint64 = 20
+)
+
+// URL stays the same for identicons, uploaded avatars get version so caches pick up changes
+func avatarUrl(idUser int64, avatarVersion int64) string {
+	avatarPath := avatarUrlPrefix + strconv.FormatInt(idUser, 10) + ".png"
+	if avatarVersion > 0 {
+		avatarPath += "?v=" + strconv.FormatInt(avatarVersion, 10)
+	}
+	return avatarPath
+}
+
+func validateProfileText(text string, maxLen int, allowNewLines bool) bool {
+	if !utf8.ValidString(text) || utf8.RuneCountInString(text) > maxLen {
+		return false
+	}
+	for _, r := range text {
+		if r == '\n' && allowNewLines {
+			continue
+		}
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// display name is shown next to comments like username, so the same filters apply
+func validateProfile(displayName string, bio string, website string, usernameFilters ...usernameFilterItf) error {
+	if !validateProfileText(displayName, displayNameMaxLen, false) {
+		return errDisplayNameNotValid
+	}
+	for _, usernameFilter := range usernameFilters {
+		if usernameFilter == nil || displayName == "" {
+			continue
+		}
+		err := usernameFilter.checkUsername(displayName)
+		if errors.Is(err, errUsernameBlockedByPolicy) {
+			return errDisplayNameBlockedByPolicy
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if !validateProfileText(bio, bioMaxLen, true) {
+		return errBioNotValid
+	}
+	if website != "" {
+		parsed, err := url.Parse(website)
+		if err != nil || len(website) > websiteMaxLen || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return errWebsiteNotValid
+		}
+	}
+	return nil
+}
+
+// accepts PNG, JPEG and GIF, returns PNG cropped to square and scaled to avatarSize
+func processAvatarImage(data []byte) ([]byte, error) {
+	if len(data) == 0 || len(data) > avatarUploadMaxLen {
+		return nil, errAvatarNotValid
+	}
+	config, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarNotValid
+	}
+	if config.Width < 1 || config.Height < 1 || config.Width > avatarSourceMaxSide || config.Height > avatarSourceMaxSide {
+		return nil, errAvatarNotValid
+	}
+	source, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errAvatarNotValid
+	}
+
+	avatar := resizeImageToSquare(source, avatarSize)
+
+	var buf bytes.Buffer
+	err = png.Encode(&buf, avatar)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to encode avatar: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// center crop and area average downscale (nearest pixel when upscaling)
+func resizeImageToSquare(source image.Image, size int) *image.NRGBA {
+	bounds := source.Bounds()
+	side := bounds.Dx()
+	if bounds.Dy() < side {
+		side = bounds.Dy()
+	}
+	x0 := bounds.Min.X + (bounds.Dx()-side)/2
+	y0 := bounds.Min.Y + (bounds.Dy()-side)/2
+
+	result := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		sy0 := y0 + y*side/size
+		sy1 := y0 + (y+1)*side/size
+		if sy1 <= sy0 {
+			sy1 = sy0 + 1
+		}
+		for x := 0; x < size; x++ {
+			sx0 := x0 + x*side/size
+			sx1 := x0 + (x+1)*side/size
+			if sx1 <= sx0 {
+				sx1 = sx0 + 1
+			}
+
+			var r, g, b, a, n uint64
+			for sy := sy0; sy < sy1; sy++ {
+				for sx := sx0; sx < sx1; sx++ {
+					pr, pg, pb, pa := source.At(sx, sy).RGBA() // premultiplied
+					r += uint64(pr)
+					g += uint64(pg)
+					b += uint64(pb)
+					a += uint64(pa)
+					n++
+				}
+			}
+			if a == 0 {
+				continue
+			}
+			// un-premultiply
+			result.SetNRGBA(x, y, color.NRGBA{R: uint8(r * 0xff / a), G: uint8(g * 0xff / a), B: uint8(b * 0xff / a), A: uint8(a / n >> 8)})
+		}
+	}
+	return result
+}
+
+// GitHub like identicon, symmetric 5x5 grid in a color derived from the seed
+func generateIdenticon(seed string, size int) ([]byte, error) {
+	if size < identiconGridSize {
+		return nil, errors.New("bad size value")
+	}
+	sum := sha256.Sum256([]byte(seed))
+	foreground := color.NRGBA{R: sum[0]/2 + 64, G: sum[1]/2 + 64, B: sum[2]/2 + 64, A: 0xff}
+	background := color.NRGBA{R: 0xf0, G: 0xf0, B: 0xf0, A: 0xff}
+
+	cell := size / identiconGridSize
+	margin := (size - cell*identiconGridSize) / 2
+	img := image.NewNRGBA(image.Rect(0, 0, size, size))
+	for y := 0; y < size; y++ {
+		for x := 0; x < size; x++ {
+			img.SetNRGBA(x, y, background)
+		}
+	}
+
+	half := (identiconGridSize + 1) / 2
+	for row := 0; row < identiconGridSize; row++ {
+		for col := 0; col < half; col++ {
+			bit := sum[3+row*half+col]&1 == 1
+			if !bit {
+				continue
+			}
+			for _, c := range []int{col, identiconGridSize - 1 - col} {
+				for y := margin + row*cell; y < margin+(row+1)*cell; y++ {
+					for x := margin + c*cell; x < margin+(c+1)*cell; x++ {
+						img.SetNRGBA(x, y, foreground)
+					}
+				}
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	err := png.Encode(&buf, img)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+)
+
+type profileService struct {
+	userService            userServiceItf
+	databaseServiceProfile databaseServiceProfileItf
+	rateLimiter            rateLimiterItf
+	usernameFilter         usernameFilterItf
+}
+
+func newProfileService(userService userServiceItf, databaseServiceProfile databaseServiceProfileItf, rateLimiter rateLimiterItf,
+	usernameFilter usernameFilterItf) *profileService {
+	return &profileService{userService: userService, databaseServiceProfile: databaseServiceProfile, rateLimiter: rateLimiter,
+		usernameFilter: usernameFilter}
+}
+
+func (profileService *profileService) getPublicProfile(credential *http.Cookie, username string) (*publicProfile, error) {
+	err := validateUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	user, err := profileService.userService.resolveUsername(username)
+	if err != nil {
+		return nil, err
+	}
+
+	profile, err := profileService.databaseServiceProfile.getUserProfile(user.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	var idViewer int64
+	if credential != nil {
+		viewer, err := profileService.userService.getRequestUser(credential, apiTokenScopeReadComments)
+		if err != nil && !isCredentialNotValidError(err) {
+			return nil, err
+		}
+		// expired or invalid credential reads the profile as guest
+		if err == nil {
+			idViewer = viewer.Id
+		}
+	}
+	comments, err := profileService.databaseServiceProfile.listUserRecentComments(user.Id, idViewer, profileRecentCommentsN)
+	if err != nil {
+		return nil, err
+	}
+	return &publicProfile{userProfile: *profile, RecentComments: comments}, nil
+}
+
+func (profileService *profileService) modifyProfile(sessionCookie *http.Cookie, displayName string, bio string, website string) (*userProfile, error) {
+	err := validateProfile(displayName, bio, website, profileService.usernameFilter)
+	if err != nil {
+		return nil, err
+	}
+
+	user, err := profileService.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	err = profileService.databaseServiceProfile.updateUserProfile(user.Id, displayName, bio, website)
+	if err != nil {
+		return nil, err
+	}
+	return profileService.databaseServiceProfile.getUserProfile(user.Id)
+}
+
+func (profileService *profileService) uploadAvatar(sessionCookie *http.Cookie, image []byte) (*userProfile, error) {
+	user, err := profileService.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	if profileService.rateLimiter != nil {
+		err = profileService.rateLimiter.allow(rateLimitOpUploadAvatar, rateLimitKeys{idUser: &user.Id})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	avatar, err := processAvatarImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	err = profileService.databaseServiceProfile.setUserAvatar(user.Id, avatar)
+	if err != nil {
+		return nil, err
+	}
+	return profileService.databaseServiceProfile.getUserProfile(user.Id)
+}
+
+func (profileService *profileService) deleteAvatar(sessionCookie *http.Cookie) (*userProfile, error) {
+	user, err := profileService.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	err = profileService.databaseServiceProfile.deleteUserAvatar(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	return profileService.databaseServiceProfile.getUserProfile(user.Id)
+}
+
+func (profileService *profileService) getAvatar(idUser int64) ([]byte, string, error) {
+	avatar, err := profileService.databaseServiceProfile.getUserAvatar(idUser)
+	if err != nil {
+		return nil, "", err
+	}
+	if avatar != nil {
+		return avatar, avatarContentType, nil
+	}
+
+	// seeded by id, so it doesn't change with username
+	identicon, err := generateIdenticon(strconv.FormatInt(idUser, 10), avatarSize)
+	if err != nil {
+		return nil, "", err
+	}
+	return identicon, avatarContentType, nil
+}
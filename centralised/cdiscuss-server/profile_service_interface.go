@@ -0,0 +1,22 @@
+package main
+
+import (
+	"net/http"
+)
+
+type publicProfile struct {
+	userProfile
+	RecentComments []userRecentComment `json:"recentComments"`
+}
+
+type profileServiceItf interface {
+	// public, username can also be a previous username of the user. Credential is optional, it only
+	// identifies the viewer.
+	getPublicProfile(credential *http.Cookie, username string) (*publicProfile, error)
+	modifyProfile(sessionCookie *http.Cookie, displayName string, bio string, website string) (*userProfile, error)
+	// image is validated and resized, without upload identicon is used
+	uploadAvatar(sessionCookie *http.Cookie, image []byte) (*userProfile, error)
+	deleteAvatar(sessionCookie *http.Cookie) (*userProfile, error)
+	// returns PNG image and content type, served at avatarUrl
+	getAvatar(idUser int64) ([]byte, string, error)
+}
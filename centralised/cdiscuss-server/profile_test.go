@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestValidateProfile(t *testing.T) {
+	if err := validateProfile("Jane Dóe", "Line one\nline two", "https://jane.example.com"); err != nil {
+		t.Errorf("Valid profile rejected: %v", err)
+	}
+	if err := validateProfile(strings.Repeat("ž", displayNameMaxLen), "", ""); err != nil {
+		t.Errorf("Display name length should count chars: %v", err)
+	}
+	if err := validateProfile("Jane\nDoe", "", ""); !errors.Is(err, errDisplayNameNotValid) {
+		t.Errorf("New line in display name accepted: %v", err)
+	}
+	if err := validateProfile("", strings.Repeat("a", bioMaxLen+1), ""); !errors.Is(err, errBioNotValid) {
+		t.Errorf("Too long bio accepted: %v", err)
+	}
+	if err := validateProfile("", "", "javascript:alert(1)"); !errors.Is(err, errWebsiteNotValid) {
+		t.Errorf("Non http website accepted: %v", err)
+	}
+}
+
+func TestProcessAvatarImage(t *testing.T) {
+	source := image.NewRGBA(image.Rect(0, 0, 300, 200))
+	for y := 0; y < 200; y++ {
+		for x := 0; x < 300; x++ {
+			source.Set(x, y, color.RGBA{R: 200, G: 10, B: 10, A: 255})
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, source, nil); err != nil {
+		t.Fatalf("JPEG encoding error: %v", err)
+	}
+
+	avatar, err := processAvatarImage(buf.Bytes())
+	if err != nil {
+		t.Fatalf("Valid image rejected: %v", err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(avatar))
+	if err != nil {
+		t.Fatalf("Avatar is not PNG: %v", err)
+	}
+	if decoded.Bounds().Dx() != avatarSize || decoded.Bounds().Dy() != avatarSize {
+		t.Errorf("Wrong avatar size: %v", decoded.Bounds())
+	}
+	r, _, _, a := decoded.At(avatarSize/2, avatarSize/2).RGBA()
+	if r>>8 < 180 || a>>8 != 255 {
+		t.Errorf("Colors not preserved: r=%d a=%d", r>>8, a>>8)
+	}
+
+	if _, err = processAvatarImage([]byte("<svg></svg>")); !errors.Is(err, errAvatarNotValid) {
+		t.Errorf("Unsupported format accepted: %v", err)
+	}
+}
+
+func TestGenerateIdenticon(t *testing.T) {
+	first, err := generateIdenticon("7", avatarSize)
+	if err != nil {
+		t.Fatalf("Identicon error: %v", err)
+	}
+	second, _ := generateIdenticon("7", avatarSize)
+	other, _ := generateIdenticon("8", avatarSize)
+	if !bytes.Equal(first, second) || bytes.Equal(first, other) {
+		t.Errorf("Identicon should depend only on seed")
+	}
+	if avatarUrl(7, 0) != "/avatars/7.png" || avatarUrl(7, 3) != "/avatars/7.png?v=3" {
+		t.Errorf("Wrong avatar URL: %s %s", avatarUrl(7, 0), avatarUrl(7, 3))
+	}
+}
+
+type profileUserStub struct {
+	requestUserStub
+}
+
+func (stub *profileUserStub) resolveUsername(username string) (*user, error) {
+	return &user{Id: 1, Username: username}, nil
+}
+
+type recentCommentsDbStub struct {
+	databaseServiceProfileItf // only methods below are used
+	idViewer                  int64
+}
+
+func (stub *recentCommentsDbStub) getUserProfile(idUser int64) (*userProfile, error) {
+	return &userProfile{IdUser: idUser}, nil
+}
+
+func (stub *recentCommentsDbStub) listUserRecentComments(idUser int64, idViewer int64, count uint64) ([]userRecentComment, error) {
+	stub.idViewer = idViewer
+	return nil, nil
+}
+
+func TestGetPublicProfileViewer(t *testing.T) {
+	userStub := &profileUserStub{}
+	db := &recentCommentsDbStub{}
+	service := newProfileService(userStub, db, nil, nil)
+
+	_, err := service.getPublicProfile(&http.Cookie{Name: sessionCookieName, Value: "x"}, "adam")
+	if err != nil {
+		t.Fatalf("Reading profile failed: %v", err)
+	}
+	if db.idViewer != 1 {
+		t.Errorf("Own profile should be listed for the viewer, got idViewer=%d", db.idViewer)
+	}
+
+	userStub.err = errUserSessionIsNotValid
+	_, err = service.getPublicProfile(&http.Cookie{Name: sessionCookieName, Value: "x"}, "adam")
+	if err != nil || db.idViewer != 0 {
+		t.Errorf("Invalid session should read the profile as guest: %v, idViewer=%d", err, db.idViewer)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type rateLimiter struct {
+	policies  []rateLimitPolicy
+	forgetAge time.Duration
+
+	// used only when there is no database, otherwise buckets are shared between instances through it
+	bucketsMapMutex *sync.Mutex
+	bucketsMap      map[string]tokenBucket
+
+	stopWorkerChan              chan bool
+	deleteOutdatedBucketsTicker *time.Ticker
+
+	databaseServiceRateLimit databaseServiceRateLimitItf
+}
+
+func newRateLimiter(databaseServiceRateLimit databaseServiceRateLimitItf, policies []rateLimitPolicy, deleteOutdatedBucketsPeriod time.Duration) (*rateLimiter, error) {
+	var limiter rateLimiter
+
+	if deleteOutdatedBucketsPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedBucketsPeriod value")
+	}
+	for _, policy := range policies {
+		if policy.operation == "" || policy.scope == "" || policy.burst < 1 || policy.refillPeriod < 1 {
+			return nil, errors.New("bad rate limit policy")
+		}
+	}
+
+	limiter.policies = policies
+	limiter.forgetAge = rateLimitBucketsForgetAge(policies)
+	limiter.bucketsMapMutex = &sync.Mutex{}
+	limiter.bucketsMap = make(map[string]tokenBucket)
+	limiter.databaseServiceRateLimit = databaseServiceRateLimit
+
+	limiter.stopWorkerChan = make(chan bool)
+	limiter.deleteOutdatedBucketsTicker = time.NewTicker(deleteOutdatedBucketsPeriod)
+
+	go limiter.deleteOutdatedBucketsLoopWorker()
+
+	return &limiter, nil
+}
+
+func (limiter *rateLimiter) deleteOutdatedBucketsLoopWorker() {
+	for {
+		select {
+		case <-limiter.stopWorkerChan:
+			return
+		case <-limiter.deleteOutdatedBucketsTicker.C:
+			limiter.deleteOutdatedBuckets()
+		}
+	}
+}
+
+// buckets that were not touched for forgetAge are full, so there is no need to keep them
+func (limiter *rateLimiter) deleteOutdatedBuckets() {
+	before := time.Now().Add(-limiter.forgetAge)
+
+	if limiter.databaseServiceRateLimit != nil {
+		err := limiter.databaseServiceRateLimit.deleteRateLimitBucketsUpdatedBefore(before)
+		if err != nil {
+			slog.Error("Deleting outdated rate limit buckets from DB:", slog.Any("error", err))
+		}
+	}
+
+	limiter.bucketsMapMutex.Lock()
+	for key, bucket := range limiter.bucketsMap {
+		if bucket.dtUpdated.Before(before) {
+			delete(limiter.bucketsMap, key)
+		}
+	}
+	limiter.bucketsMapMutex.Unlock()
+}
+
+func (limiter *rateLimiter) stop() {
+	limiter.deleteOutdatedBucketsTicker.Stop()
+
+	select {
+	case limiter.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop rateLimiter instance")
+	}
+
+	limiter.bucketsMapMutex.Lock()
+	limiter.bucketsMap = make(map[string]tokenBucket)
+	limiter.bucketsMapMutex.Unlock()
+}
+
+func (limiter *rateLimiter) takeToken(bucketKey string, policy rateLimitPolicy, now time.Time) (bool, time.Duration, error) {
+	if limiter.databaseServiceRateLimit != nil {
+		return limiter.databaseServiceRateLimit.takeRateLimitToken(bucketKey, policy, now)
+	}
+
+	limiter.bucketsMapMutex.Lock()
+	defer limiter.bucketsMapMutex.Unlock()
+
+	bucket, ok := limiter.bucketsMap[bucketKey]
+	if !ok {
+		bucket = newFullTokenBucket(policy, now)
+	}
+	bucket, allowed, retryAfter := takeToken(bucket, policy, now)
+	limiter.bucketsMap[bucketKey] = bucket
+	return allowed, retryAfter, nil
+}
+
+func (limiter *rateLimiter) allow(operation string, keys rateLimitKeys) error {
+	var (
+		now        time.Time     = time.Now()
+		limited    bool          = false
+		retryAfter time.Duration = 0
+	)
+
+	for _, policy := range limiter.policies {
+		if policy.operation != operation {
+			continue
+		}
+		scopeKey := keys.keyForScope(policy.scope)
+		if scopeKey == "" {
+			continue
+		}
+
+		allowed, policyRetryAfter, err := limiter.takeToken(rateLimitBucketKey(policy, scopeKey), policy, now)
+		if err != nil {
+			slog.Error("Rate limiter failed to take a token", slog.String("operation", operation), slog.Any("error", err))
+			return errInternalServer
+		}
+		if !allowed {
+			limited = true
+			if policyRetryAfter > retryAfter {
+				retryAfter = policyRetryAfter
+			}
+		}
+	}
+
+	if limited {
+		return newRateLimitError(retryAfter)
+	}
+	return nil
+}
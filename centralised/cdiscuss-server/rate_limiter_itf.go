@@ -0,0 +1,128 @@
+package main
+
+import (
+	"math"
+	"strconv"
+	"time"
+)
+
+const (
+	rateLimitOpLogin          string = "login"
+	rateLimitOpCreateUser     string = "create user"
+	rateLimitOpCreateComment  string = "create comment"
+	rateLimitOpPasswordReset  string = "password reset"
+	rateLimitOpChangeUsername string = "change username"
+	rateLimitOpUploadAvatar   string = "upload avatar"
+	rateLimitOpReportComment  string = "report comment"
+	rateLimitOpRegisterPage   string = "register page"
+	rateLimitOpDataExport     string = "data export"
+
+	rateLimitScopeUser    string = "user"
+	rateLimitScopeIP      string = "ip"
+	rateLimitScopeSubnet  string = "subnet"
+	rateLimitScopeUrlHash string = "url"
+
+	rateLimitIPv4SubnetBits       int           = 24
+	rateLimitIPv6SubnetBits       int           = 64
+	rateLimitBucketsCleanUpPeriod time.Duration = time.Hour
+)
+
+// token bucket policy, bucket holds at most burst tokens and one token is regained every refillPeriod
+type rateLimitPolicy struct {
+	operation    string
+	scope        string
+	burst        float64
+	refillPeriod time.Duration
+}
+
+var defaultRateLimitPolicies = []rateLimitPolicy{
+	{operation: rateLimitOpLogin, scope: rateLimitScopeIP, burst: 10, refillPeriod: time.Minute},
+	{operation: rateLimitOpLogin, scope: rateLimitScopeSubnet, burst: 50, refillPeriod: 12 * time.Second},
+	{operation: rateLimitOpCreateUser, scope: rateLimitScopeIP, burst: 3, refillPeriod: 20 * time.Minute},
+	{operation: rateLimitOpCreateUser, scope: rateLimitScopeSubnet, burst: 10, refillPeriod: 6 * time.Minute},
+	{operation: rateLimitOpCreateComment, scope: rateLimitScopeUser, burst: 5, refillPeriod: 30 * time.Second},
+	{operation: rateLimitOpCreateComment, scope: rateLimitScopeIP, burst: 10, refillPeriod: 15 * time.Second},
+	{operation: rateLimitOpCreateComment, scope: rateLimitScopeUrlHash, burst: 30, refillPeriod: 2 * time.Second},
+	{operation: rateLimitOpPasswordReset, scope: rateLimitScopeUser, burst: 3, refillPeriod: 20 * time.Minute},
+	{operation: rateLimitOpPasswordReset, scope: rateLimitScopeIP, burst: 5, refillPeriod: 10 * time.Minute},
+	{operation: rateLimitOpChangeUsername, scope: rateLimitScopeUser, burst: 2, refillPeriod: 15 * 24 * time.Hour},
+	{operation: rateLimitOpUploadAvatar, scope: rateLimitScopeUser, burst: 5, refillPeriod: 12 * time.Minute},
+	{operation: rateLimitOpReportComment, scope: rateLimitScopeUser, burst: 10, refillPeriod: 6 * time.Minute},
+	{operation: rateLimitOpReportComment, scope: rateLimitScopeIP, burst: 20, refillPeriod: 3 * time.Minute},
+	{operation: rateLimitOpRegisterPage, scope: rateLimitScopeIP, burst: 30, refillPeriod: 2 * time.Second},
+	{operation: rateLimitOpDataExport, scope: rateLimitScopeUser, burst: 2, refillPeriod: 24 * time.Hour},
+}
+
+// values the buckets are keyed by, empty values are skipped
+type rateLimitKeys struct {
+	idUser  *int64
+	client  clientInfo
+	urlHash string
+}
+
+func (keys rateLimitKeys) keyForScope(scope string) string {
+	switch scope {
+	case rateLimitScopeUser:
+		if keys.idUser == nil {
+			return ""
+		}
+		return strconv.FormatInt(*keys.idUser, 10)
+	case rateLimitScopeIP:
+		return keys.client.ip
+	case rateLimitScopeSubnet:
+		return keys.client.subnet()
+	case rateLimitScopeUrlHash:
+		return keys.urlHash
+	}
+	return ""
+}
+
+func rateLimitBucketKey(policy rateLimitPolicy, scopeKey string) string {
+	return policy.operation + ":" + policy.scope + ":" + scopeKey
+}
+
+type rateLimiterItf interface {
+	// takes a token from every bucket of the operation, returns rateLimitError if any of them is empty
+	allow(operation string, keys rateLimitKeys) error
+}
+
+type tokenBucket struct {
+	tokens    float64
+	dtUpdated time.Time
+}
+
+func newFullTokenBucket(policy rateLimitPolicy, now time.Time) tokenBucket {
+	return tokenBucket{tokens: policy.burst, dtUpdated: now}
+}
+
+// refills the bucket for the time passed since its last update and tries to take one token from it.
+// Returns updated bucket, whether the token was taken and how long to wait for the next token if it wasn't.
+func takeToken(bucket tokenBucket, policy rateLimitPolicy, now time.Time) (tokenBucket, bool, time.Duration) {
+	elapsed := now.Sub(bucket.dtUpdated)
+	if elapsed > 0 && policy.refillPeriod > 0 {
+		bucket.tokens += float64(elapsed) / float64(policy.refillPeriod)
+	}
+	bucket.tokens = math.Min(bucket.tokens, policy.burst)
+	bucket.dtUpdated = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return bucket, true, 0
+	}
+
+	missing := 1 - bucket.tokens
+	retryAfter := time.Duration(math.Ceil(missing * float64(policy.refillPeriod)))
+	return bucket, false, retryAfter
+}
+
+// time in which an untouched bucket of any policy becomes full again
+func rateLimitBucketsForgetAge(policies []rateLimitPolicy) time.Duration {
+	var forgetAge time.Duration
+	for _, policy := range policies {
+		fillTime := time.Duration(policy.burst * float64(policy.refillPeriod))
+		if fillTime > forgetAge {
+			forgetAge = fillTime
+		}
+	}
+	return forgetAge
+}
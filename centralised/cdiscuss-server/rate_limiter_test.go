@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestTakeToken(t *testing.T) {
+	policy := rateLimitPolicy{operation: rateLimitOpCreateComment, scope: rateLimitScopeUser, burst: 2, refillPeriod: 10 * time.Second}
+	now := time.UnixMilli(1717855224906)
+
+	bucket := newFullTokenBucket(policy, now)
+	for i := 0; i < 2; i++ {
+		var allowed bool
+		bucket, allowed, _ = takeToken(bucket, policy, now)
+		if !allowed {
+			t.Fatalf("Token %d should be allowed", i)
+		}
+	}
+
+	bucket, allowed, retryAfter := takeToken(bucket, policy, now.Add(4*time.Second))
+	if allowed {
+		t.Fatalf("Empty bucket should not allow a token")
+	}
+	if retryAfter != 6*time.Second {
+		t.Errorf("Wrong retryAfter: %v", retryAfter)
+	}
+
+	bucket, allowed, _ = takeToken(bucket, policy, now.Add(10*time.Second))
+	if !allowed {
+		t.Fatalf("Refilled bucket should allow a token")
+	}
+
+	_, _, _ = takeToken(bucket, policy, now.Add(time.Hour))
+	bucket, _, _ = takeToken(bucket, policy, now.Add(time.Hour))
+	if bucket.tokens > policy.burst {
+		t.Errorf("Bucket overfilled: %f", bucket.tokens)
+	}
+}
+
+func TestClientInfoSubnet(t *testing.T) {
+	if subnet := (clientInfo{ip: "192.168.7.42"}).subnet(); subnet != "192.168.7.0" {
+		t.Errorf("Wrong IPv4 subnet: %s", subnet)
+	}
+	if subnet := (clientInfo{ip: "2001:db8:1:2:3:4:5:6"}).subnet(); subnet != "2001:db8:1:2::" {
+		t.Errorf("Wrong IPv6 subnet: %s", subnet)
+	}
+	if subnet := (clientInfo{ip: ""}).subnet(); subnet != "" {
+		t.Errorf("Wrong empty subnet: %s", subnet)
+	}
+}
+
+func TestRateLimiterAllow(t *testing.T) {
+	policies := []rateLimitPolicy{{operation: rateLimitOpLogin, scope: rateLimitScopeIP, burst: 1, refillPeriod: time.Hour}}
+	limiter, err := newRateLimiter(nil, policies, time.Hour)
+	if err != nil {
+		t.Fatalf("Rate limiter creation error: %v", err)
+	}
+	defer limiter.stop()
+
+	keys := rateLimitKeys{client: clientInfo{ip: "10.0.0.1"}}
+	if err := limiter.allow(rateLimitOpLogin, keys); err != nil {
+		t.Fatalf("First login should be allowed: %v", err)
+	}
+	err = limiter.allow(rateLimitOpLogin, keys)
+	errRetry, ok := err.(errWithRetryAfter)
+	if !ok {
+		t.Fatalf("Second login should be rate limited: %v", err)
+	}
+	if errRetry.getRetryAfter() <= 0 {
+		t.Errorf("Wrong retry after: %v", errRetry.getRetryAfter())
+	}
+	if err := limiter.allow(rateLimitOpCreateComment, keys); err != nil {
+		t.Errorf("Operation without policy should be allowed: %v", err)
+	}
+}
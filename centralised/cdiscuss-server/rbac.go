@@ -0,0 +1,174 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+)
+
+type rbacRolesCacheContainer struct {
+	roles       []roleAssignment
+	cachedUntil time.Time
+}
+
+type authorizer struct {
+	rolesMap *sync.Map // idUser -> rbacRolesCacheContainer
+
+	// used only when there is no database
+	memoryRolesMutex *sync.Mutex
+	memoryRoles      map[int64][]roleAssignment
+
+	databaseServiceRbac databaseServiceRbacItf
+	mqService           mqServiceItf
+}
+
+func newAuthorizer(databaseServiceRbac databaseServiceRbacItf, mqService mqServiceItf) *authorizer {
+	authorizer := &authorizer{rolesMap: &sync.Map{}, memoryRolesMutex: &sync.Mutex{}, memoryRoles: make(map[int64][]roleAssignment),
+		databaseServiceRbac: databaseServiceRbac, mqService: mqService}
+
+	if authorizer.mqService != nil {
+		authorizer.mqService.registerMessageCB(mqUserRolesModified, authorizer, false)
+	}
+	return authorizer
+}
+
+// implement MQ mqMessageCbItf
+func (authorizer *authorizer) onMessage(msg mqMessage) {
+	idUser, err := strconv.ParseInt(msg.Argument, 10, 64)
+	if err != nil {
+		slog.Error("Forgetting cached roles idUser parsing error:", slog.String("idUserStr", msg.Argument), slog.Any("error", err))
+		return
+	}
+	authorizer.rolesMap.Delete(idUser)
+}
+
+func (authorizer *authorizer) stop() {
+	if authorizer.mqService != nil {
+		err := authorizer.mqService.unregisterMessageCB(mqUserRolesModified, authorizer)
+		if err != nil {
+			slog.Error("authorizer unregistering MQ CB error:", slog.Any("error", err))
+		}
+	}
+}
+
+func (authorizer *authorizer) authorize(user *user, permission string, target rbacTarget) error {
+	if _, ok := rbacPermApiTokenScopes[permission]; !ok {
+		return errors.New("unknown permission " + permission)
+	}
+	if rbacRoleHasPermission(rbacRoleGuest, permission) {
+		return nil
+	}
+	if user == nil {
+		return errUserSessionIsNotValid
+	}
+	// API token can use only permissions its scopes allow, whatever roles the user has
+	if user.apiTokenScopes != nil && !hasApiTokenScope(user.apiTokenScopes, rbacPermApiTokenScopes[permission]) {
+		return errApiTokenScopeMissing
+	}
+	if rbacRoleHasPermission(rbacRoleUser, permission) {
+		return nil
+	}
+
+	roles, err := authorizer.getRoles(user.Id)
+	if err != nil {
+		return err
+	}
+	for _, assignment := range roles {
+		if rbacScopeCoversTarget(assignment.Scope, target) && rbacRoleHasPermission(assignment.Role, permission) {
+			return nil
+		}
+	}
+	return errPermissionDenied
+}
+
+func (authorizer *authorizer) getRoles(idUser int64) ([]roleAssignment, error) {
+	if authorizer.databaseServiceRbac == nil {
+		authorizer.memoryRolesMutex.Lock()
+		defer authorizer.memoryRolesMutex.Unlock()
+		return append([]roleAssignment(nil), authorizer.memoryRoles[idUser]...), nil
+	}
+
+	value, ok := authorizer.rolesMap.Load(idUser)
+	if ok {
+		cached, ok := value.(rbacRolesCacheContainer)
+		if ok && time.Now().Before(cached.cachedUntil) {
+			return cached.roles, nil
+		}
+	}
+
+	roles, err := authorizer.databaseServiceRbac.listUserRoles(idUser)
+	if err != nil {
+		return nil, err
+	}
+	authorizer.rolesMap.Store(idUser, rbacRolesCacheContainer{roles: roles, cachedUntil: time.Now().Add(rbacRolesCacheAge)})
+	return roles, nil
+}
+
+func (authorizer *authorizer) listUserRoles(idUser int64) ([]roleAssignment, error) {
+	return authorizer.getRoles(idUser)
+}
+
+func (authorizer *authorizer) assignUserRole(idUser int64, role string, scope string, idGrantedBy *int64) error {
+	err := validateRbacRoleAndScope(role, scope)
+	if err != nil {
+		return err
+	}
+
+	assignment := roleAssignment{IdUser: idUser, Role: role, Scope: scope, DtCreated: time.Now(), IdGrantedBy: idGrantedBy}
+	if authorizer.databaseServiceRbac == nil {
+		authorizer.memoryRolesMutex.Lock()
+		defer authorizer.memoryRolesMutex.Unlock()
+		for _, existing := range authorizer.memoryRoles[idUser] {
+			if existing.Role == role && existing.Scope == scope {
+				return nil
+			}
+		}
+		authorizer.memoryRoles[idUser] = append(authorizer.memoryRoles[idUser], assignment)
+		return nil
+	}
+
+	err = authorizer.databaseServiceRbac.assignUserRole(assignment)
+	if err != nil {
+		return err
+	}
+	authorizer.forgetCachedRoles(idUser)
+	return nil
+}
+
+func (authorizer *authorizer) revokeUserRole(idUser int64, role string, scope string) error {
+	if authorizer.databaseServiceRbac == nil {
+		authorizer.memoryRolesMutex.Lock()
+		defer authorizer.memoryRolesMutex.Unlock()
+		roles := authorizer.memoryRoles[idUser]
+		for i, existing := range roles {
+			if existing.Role == role && existing.Scope == scope {
+				authorizer.memoryRoles[idUser] = append(roles[:i], roles[i+1:]...)
+				return nil
+			}
+		}
+		return errRoleNotAssigned
+	}
+
+	revoked, err := authorizer.databaseServiceRbac.revokeUserRole(idUser, role, scope)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return errRoleNotAssigned
+	}
+	authorizer.forgetCachedRoles(idUser)
+	return nil
+}
+
+func (authorizer *authorizer) forgetCachedRoles(idUser int64) {
+	authorizer.rolesMap.Delete(idUser)
+
+	if authorizer.mqService != nil {
+		err := authorizer.mqService.sendMessage(mqUserRolesModified, strconv.FormatInt(idUser, 10))
+		if err != nil {
+			slog.Error("authorizer: informing roles change to other instances failed", slog.Any("error", err), slog.Int64("idUser", idUser))
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Same model as rbac.min.js used by the Firefox extension: role can do its own permissions and everything
+// its inherited roles can do.
+const (
+	rbacRoleSuperadmin string = "superadmin"
+	rbacRoleAdmin      string = "admin"
+	rbacRoleModerator  string = "moderator"
+	rbacRoleUser       string = "user"  // every logged in user has it implicitly
+	rbacRoleGuest      string = "guest" // everyone has it, also without session
+
+	rbacPermCommentsRead      string = "comments:read"
+	rbacPermCommentsWrite     string = "comments:write"
+	rbacPermCommentsDeleteOwn string = "comments:deleteOwn"
+	rbacPermCommentsModerate  string = "comments:moderate"
+	rbacPermUsersManage       string = "users:manage"
+	rbacPermRolesAssign       string = "roles:assign"
+	rbacPermSiteConfigure     string = "site:configure" // moderation policy and other settings of the scope
+	rbacPermAuditRead         string = "audit:read"
+
+	rbacScopeGlobal      string        = ""
+	rbacScopeSitePrefix  string        = "site:"
+	rbacScopePagePrefix  string        = "page:"
+	rbacRolesCacheAge    time.Duration = 10 * time.Minute
+	rbacMaxInheritsDepth int           = 10
+)
+
+type rbacRole struct {
+	Can      []string `json:"can"`
+	Inherits []string `json:"inherits"`
+}
+
+var rbacRoles = map[string]rbacRole{
+	rbacRoleSuperadmin: {Can: []string{rbacPermRolesAssign}, Inherits: []string{rbacRoleAdmin}},
+	rbacRoleAdmin:      {Can: []string{rbacPermUsersManage, rbacPermSiteConfigure, rbacPermAuditRead}, Inherits: []string{rbacRoleModerator}},
+	rbacRoleModerator:  {Can: []string{rbacPermCommentsModerate}, Inherits: []string{rbacRoleUser}},
+	rbacRoleUser:       {Can: []string{rbacPermCommentsWrite, rbacPermCommentsDeleteOwn}, Inherits: []string{rbacRoleGuest}},
+	rbacRoleGuest:      {Can: []string{rbacPermCommentsRead}},
+}
+
+// API token (see apiTokenScope* constants) must have this scope to use the permission. Administration
+// has no scope, it needs a real session, so a leaked token can't manage users, roles or sites.
+var rbacPermApiTokenScopes = map[string]string{
+	rbacPermCommentsRead:      apiTokenScopeReadComments,
+	rbacPermCommentsWrite:     apiTokenScopePostComments,
+	rbacPermCommentsDeleteOwn: apiTokenScopePostComments,
+	rbacPermCommentsModerate:  apiTokenScopeModerate,
+	rbacPermUsersManage:       apiTokenScopeNone,
+	rbacPermRolesAssign:       apiTokenScopeNone,
+	rbacPermSiteConfigure:     apiTokenScopeNone,
+	rbacPermAuditRead:         apiTokenScopeNone,
+}
+
+type roleAssignment struct {
+	IdUser      int64     `json:"idUser"`
+	Role        string    `json:"role"`
+	Scope       string    `json:"scope"` // rbacScopeGlobal, site:<idSite> or page:<urlHash>
+	DtCreated   time.Time `json:"dtCreated"`
+	IdGrantedBy *int64    `json:"idGrantedBy"`
+}
+
+// what the permission is used on, empty fields are not known or not relevant
+type rbacTarget struct {
+	site    string
+	urlHash string
+}
+
+type authorizerItf interface {
+	// errPermissionDenied if none of user's roles covering the target has the permission,
+	// user can be nil for guest permissions
+	authorize(user *user, permission string, target rbacTarget) error
+	listUserRoles(idUser int64) ([]roleAssignment, error)
+	assignUserRole(idUser int64, role string, scope string, idGrantedBy *int64) error
+	revokeUserRole(idUser int64, role string, scope string) error
+	// after roles were changed directly in database, on all instances
+	forgetCachedRoles(idUser int64)
+}
+
+// same algorithm as rbac.min.js, including inheritance loop detection
+func rbacRoleHasPermission(role string, permission string) bool {
+	return rbacRoleHasPermissionVisited(role, permission, make(map[string]bool))
+}
+
+func rbacRoleHasPermissionVisited(role string, permission string, visited map[string]bool) bool {
+	definition, ok := rbacRoles[role]
+	if !ok {
+		return false
+	}
+	if visited[role] || len(visited) > rbacMaxInheritsDepth {
+		slog.Warn("RBAC: inheritance loop detected", slog.String("role", role))
+		return false
+	}
+	visited[role] = true
+	defer delete(visited, role)
+
+	for _, can := range definition.Can {
+		if can == permission {
+			return true
+		}
+	}
+	for _, inherited := range definition.Inherits {
+		if rbacRoleHasPermissionVisited(inherited, permission, visited) {
+			return true
+		}
+	}
+	return false
+}
+
+func rbacSiteScope(idSite int64) string {
+	return rbacScopeSitePrefix + strconv.FormatInt(idSite, 10)
+}
+
+func rbacSiteTarget(idSite int64, urlHash string) rbacTarget {
+	return rbacTarget{site: strconv.FormatInt(idSite, 10), urlHash: urlHash}
+}
+
+func rbacPageScope(urlHash string) string {
+	return rbacScopePagePrefix + urlHash
+}
+
+var urlHashRegex = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+func validateRbacRoleAndScope(role string, scope string) error {
+	// guest and user are implicit
+	if role != rbacRoleSuperadmin && role != rbacRoleAdmin && role != rbacRoleModerator {
+		return errRoleNotValid
+	}
+	if scope == rbacScopeGlobal {
+		return nil
+	}
+	if idSite, found := strings.CutPrefix(scope, rbacScopeSitePrefix); found {
+		id, err := strconv.ParseInt(idSite, 10, 64)
+		if err != nil || id < 1 {
+			return errRoleScopeNotValid
+		}
+		return nil
+	}
+	if urlHash, found := strings.CutPrefix(scope, rbacScopePagePrefix); found && urlHashRegex.MatchString(urlHash) {
+		return nil
+	}
+	return errRoleScopeNotValid
+}
+
+// global assignment covers everything, site assignment covers all its pages
+func rbacScopeCoversTarget(scope string, target rbacTarget) bool {
+	if scope == rbacScopeGlobal {
+		return true
+	}
+	if target.site != "" && scope == rbacScopeSitePrefix+target.site {
+		return true
+	}
+	if target.urlHash != "" && scope == rbacPageScope(target.urlHash) {
+		return true
+	}
+	return false
+}
+
+// target of the role assignment itself, so that scoped superadmins can only assign inside their scope
+func rbacScopeToTarget(scope string) rbacTarget {
+	if idSite, found := strings.CutPrefix(scope, rbacScopeSitePrefix); found {
+		return rbacTarget{site: idSite}
+	}
+	if urlHash, found := strings.CutPrefix(scope, rbacScopePagePrefix); found {
+		return rbacTarget{urlHash: urlHash}
+	}
+	return rbacTarget{}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRbacRoleInheritance(t *testing.T) {
+	tests := []struct {
+		role       string
+		permission string
+		want       bool
+	}{
+		{rbacRoleGuest, rbacPermCommentsRead, true},
+		{rbacRoleGuest, rbacPermCommentsWrite, false},
+		{rbacRoleUser, rbacPermCommentsRead, true},
+		{rbacRoleUser, rbacPermCommentsModerate, false},
+		{rbacRoleModerator, rbacPermCommentsModerate, true},
+		{rbacRoleModerator, rbacPermUsersManage, false},
+		{rbacRoleAdmin, rbacPermUsersManage, true},
+		{rbacRoleAdmin, rbacPermRolesAssign, false},
+		{rbacRoleSuperadmin, rbacPermRolesAssign, true},
+		{rbacRoleSuperadmin, rbacPermCommentsRead, true},
+		{"owner", rbacPermCommentsRead, false},
+	}
+	for _, test := range tests {
+		if got := rbacRoleHasPermission(test.role, test.permission); got != test.want {
+			t.Errorf("%s %s: got %v want %v", test.role, test.permission, got, test.want)
+		}
+	}
+}
+
+func TestRbacInheritanceLoop(t *testing.T) {
+	rbacRoles["loopA"] = rbacRole{Inherits: []string{"loopB"}}
+	rbacRoles["loopB"] = rbacRole{Inherits: []string{"loopA"}}
+	defer delete(rbacRoles, "loopA")
+	defer delete(rbacRoles, "loopB")
+
+	if rbacRoleHasPermission("loopA", rbacPermCommentsRead) {
+		t.Errorf("Loop must not grant permission")
+	}
+}
+
+func TestRbacScopes(t *testing.T) {
+	urlHash := strings.Repeat("a", urlHashLen)
+	if err := validateRbacRoleAndScope(rbacRoleModerator, rbacPageScope(urlHash)); err != nil {
+		t.Errorf("Page scope should be valid: %v", err)
+	}
+	if err := validateRbacRoleAndScope(rbacRoleModerator, "site:abc"); !errors.Is(err, errRoleScopeNotValid) {
+		t.Errorf("Bad site scope accepted")
+	}
+	if err := validateRbacRoleAndScope(rbacRoleUser, rbacScopeGlobal); !errors.Is(err, errRoleNotValid) {
+		t.Errorf("Implicit role should not be assignable")
+	}
+
+	target := rbacTarget{site: "3", urlHash: urlHash}
+	if !rbacScopeCoversTarget(rbacScopeGlobal, target) || !rbacScopeCoversTarget(rbacSiteScope(3), target) ||
+		!rbacScopeCoversTarget(rbacPageScope(urlHash), target) {
+		t.Errorf("Scope should cover the target")
+	}
+	if rbacScopeCoversTarget(rbacSiteScope(4), target) || rbacScopeCoversTarget(rbacPageScope(strings.Repeat("b", urlHashLen)), target) {
+		t.Errorf("Scope of other site or page covers the target")
+	}
+}
+
+func TestAuthorizer(t *testing.T) {
+	authorizer := newAuthorizer(nil, nil)
+	urlHash := strings.Repeat("a", urlHashLen)
+	moderator := &user{Id: 1, Username: "moderator"}
+
+	if err := authorizer.authorize(nil, rbacPermCommentsRead, rbacTarget{}); err != nil {
+		t.Errorf("Guest should read: %v", err)
+	}
+	if err := authorizer.authorize(nil, rbacPermCommentsWrite, rbacTarget{}); !errors.Is(err, errUserSessionIsNotValid) {
+		t.Errorf("Guest should not write: %v", err)
+	}
+	if err := authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{urlHash: urlHash}); !errors.Is(err, errPermissionDenied) {
+		t.Errorf("User without role moderates: %v", err)
+	}
+
+	if err := authorizer.assignUserRole(moderator.Id, rbacRoleModerator, rbacPageScope(urlHash), nil); err != nil {
+		t.Fatalf("Assign failed: %v", err)
+	}
+	if err := authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{urlHash: urlHash}); err != nil {
+		t.Errorf("Page moderator can't moderate: %v", err)
+	}
+	if err := authorizer.authorize(moderator, rbacPermCommentsModerate, rbacTarget{urlHash: strings.Repeat("b", urlHashLen)}); err == nil {
+		t.Errorf("Page moderator moderates other page")
+	}
+
+	tokenUser := *moderator
+	tokenUser.apiTokenScopes = []string{apiTokenScopePostComments}
+	if err := authorizer.authorize(&tokenUser, rbacPermCommentsModerate, rbacTarget{urlHash: urlHash}); !errors.Is(err, errApiTokenScopeMissing) {
+		t.Errorf("API token without moderate scope moderates: %v", err)
+	}
+
+	admin := &user{Id: 3, Username: "admin", apiTokenScopes: []string{apiTokenScopeModerate}}
+	authorizer.assignUserRole(admin.Id, rbacRoleSuperadmin, rbacScopeGlobal, nil)
+	for _, permission := range []string{rbacPermUsersManage, rbacPermRolesAssign, rbacPermSiteConfigure, rbacPermAuditRead} {
+		if err := authorizer.authorize(admin, permission, rbacTarget{}); !errors.Is(err, errApiTokenScopeMissing) {
+			t.Errorf("API token used %s: %v", permission, err)
+		}
+	}
+
+	if err := authorizer.revokeUserRole(moderator.Id, rbacRoleModerator, rbacPageScope(urlHash)); err != nil {
+		t.Errorf("Revoke failed: %v", err)
+	}
+	if err := authorizer.revokeUserRole(moderator.Id, rbacRoleModerator, rbacPageScope(urlHash)); !errors.Is(err, errRoleNotAssigned) {
+		t.Errorf("Second revoke should fail: %v", err)
+	}
+}
+
+func TestAdminCantManageRoleHolders(t *testing.T) {
+	authorizer := newAuthorizer(nil, nil)
+	service := newAdmiUserService(&requestUserStub{}, nil, nil, nil, nil, nil, authorizer, nil, nil, false)
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+	authorizer.assignUserRole(1, rbacRoleAdmin, rbacScopeGlobal, nil)
+	authorizer.assignUserRole(2, rbacRoleSuperadmin, rbacScopeGlobal, nil)
+	authorizer.assignUserRole(3, rbacRoleModerator, rbacSiteScope(5), nil)
+
+	if _, err := service.getSessionAdminOfUser(cookie, 4); err != nil {
+		t.Errorf("Admin can't manage user without roles: %v", err)
+	}
+	for _, idUser := range []int64{2, 3} {
+		if _, err := service.getSessionAdminOfUser(cookie, idUser); !errors.Is(err, errUserNotAdmin) {
+			t.Errorf("Admin manages role holder %d: %v", idUser, err)
+		}
+	}
+	if _, _, err := service.createPasswordResetTokenAsAdmin(cookie, 2); !errors.Is(err, errUserNotAdmin) {
+		t.Errorf("Admin resets password of superadmin: %v", err)
+	}
+	if _, err := service.deleteUserAsAdmin(cookie, 2, accountDeletionModePurge, true); !errors.Is(err, errUserNotAdmin) {
+		t.Errorf("Admin deletes superadmin: %v", err)
+	}
+
+	authorizer.assignUserRole(1, rbacRoleSuperadmin, rbacScopeGlobal, nil)
+	for _, idUser := range []int64{2, 3} {
+		if _, err := service.getSessionAdminOfUser(cookie, idUser); err != nil {
+			t.Errorf("Superadmin can't manage role holder %d: %v", idUser, err)
+		}
+	}
+}
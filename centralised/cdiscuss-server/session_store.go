@@ -6,51 +6,94 @@ import (
 	"log/slog"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type sessionDataContainer struct {
+	id          int64
 	user        *user
 	expiresTime time.Time
+	dtCreated   time.Time
+	dtIssued    time.Time
+	dtLastSeen  time.Time
+	userAgent   string
+	ip          string
+	rotated     bool // replaced by a new token, expires soon and is not renewed
+}
+
+func newSessionDataContainer(session *sessionRecord) sessionDataContainer {
+	return sessionDataContainer{id: session.id, user: session.user, expiresTime: session.dtExpires, dtCreated: session.dtCreated,
+		dtIssued: session.dtIssued, dtLastSeen: session.dtLastSeen, userAgent: session.userAgent, ip: session.ip, rotated: session.rotated}
+}
+
+func (sessionData sessionDataContainer) toSessionInfo(current bool) sessionInfo {
+	return sessionInfo{Id: sessionData.id, DtCreated: sessionData.dtCreated, DtLastSeen: sessionData.dtLastSeen,
+		DtExpires: sessionData.expiresTime, UserAgent: sessionData.userAgent, IP: sessionData.ip, Current: current}
 }
 
 type sessionStore struct {
 	sessionTokensMap *sync.Map
+	lastSessionId    *atomic.Int64 // used only when there is no database
 
-	tokenExpiresAge            time.Duration
+	idleTimeout                time.Duration
+	absoluteLifetime           time.Duration
+	rotationAge                time.Duration
 	deleteOutdatedTokensPeriod time.Duration
 
+	// renewals are written to DB in batches instead of on every request
+	pendingRenewalsMutex *sync.Mutex
+	pendingRenewals      map[string]sessionRenewal
+
 	stopWorkerChan             chan bool
 	deleteOutdatedTokensTicker *time.Ticker
+	flushRenewalsTicker        *time.Ticker
 
 	databaseServiceSession databaseServiceSessionItf
 	mqService              mqServiceItf
 }
 
-func newSessionStore(databaseServiceSession databaseServiceSessionItf, mqService mqServiceItf, tokenExpiresAge time.Duration, deleteOutdatedTokensPeriod time.Duration) (*sessionStore, error) {
+func newSessionStore(databaseServiceSession databaseServiceSessionItf, mqService mqServiceItf, idleTimeout time.Duration, absoluteLifetime time.Duration,
+	rotationAge time.Duration, deleteOutdatedTokensPeriod time.Duration, flushRenewalsPeriod time.Duration) (*sessionStore, error) {
 	var session sessionStore
 
-	if tokenExpiresAge < 1 {
-		return nil, errors.New("bad tokenExpiresAge value")
+	if idleTimeout < 1 {
+		return nil, errors.New("bad idleTimeout value")
+	}
+	if absoluteLifetime < idleTimeout {
+		return nil, errors.New("bad absoluteLifetime value")
+	}
+	if rotationAge < 1 {
+		return nil, errors.New("bad rotationAge value")
 	}
 	if deleteOutdatedTokensPeriod < 1 {
 		return nil, errors.New("bad deleteOutdatedTokensPeriod value")
 	}
+	if flushRenewalsPeriod < 1 {
+		return nil, errors.New("bad flushRenewalsPeriod value")
+	}
 
 	session.sessionTokensMap = &sync.Map{}
+	session.lastSessionId = &atomic.Int64{}
 	session.databaseServiceSession = databaseServiceSession
 	session.mqService = mqService
-	session.tokenExpiresAge = tokenExpiresAge
+	session.idleTimeout = idleTimeout
+	session.absoluteLifetime = absoluteLifetime
+	session.rotationAge = rotationAge
 	session.deleteOutdatedTokensPeriod = deleteOutdatedTokensPeriod
+	session.pendingRenewalsMutex = &sync.Mutex{}
+	session.pendingRenewals = make(map[string]sessionRenewal)
 
 	session.stopWorkerChan = make(chan bool)
 	session.deleteOutdatedTokensTicker = time.NewTicker(deleteOutdatedTokensPeriod)
+	session.flushRenewalsTicker = time.NewTicker(flushRenewalsPeriod)
 
 	go session.deleteOudatedTokensLoopWorker()
 
 	if session.mqService != nil {
 		session.mqService.registerMessageCB(mqSessionEnd, &session, false)
 		session.mqService.registerMessageCB(mqSessionsForUserEnd, &session, false)
+		session.mqService.registerMessageCB(mqUserModified, &session, false)
 	}
 
 	return &session, nil
@@ -63,7 +106,7 @@ func (session *sessionStore) onMessage(msg mqMessage) {
 		tokenHash := msg.Argument
 		session.sessionTokensMap.Delete(tokenHash)
 		break
-	case mqSessionsForUserEnd:
+	case mqSessionsForUserEnd, mqUserModified:
 		idUserStr := msg.Argument
 		idUser, err := strconv.ParseInt(idUserStr, 10, 64)
 		if err != nil {
@@ -81,10 +124,41 @@ func (session *sessionStore) deleteOudatedTokensLoopWorker() {
 			return
 		case <-session.deleteOutdatedTokensTicker.C:
 			session.deleteOutdatedTokens()
+		case <-session.flushRenewalsTicker.C:
+			session.flushRenewals()
 		}
 	}
 }
 
+func (session *sessionStore) addPendingRenewal(tokenHash string, expiresTime time.Time, dtLastSeen time.Time) {
+	if session.databaseServiceSession == nil {
+		return
+	}
+	session.pendingRenewalsMutex.Lock()
+	session.pendingRenewals[tokenHash] = sessionRenewal{tokenHash: tokenHash, dtExpires: expiresTime, dtLastSeen: dtLastSeen}
+	session.pendingRenewalsMutex.Unlock()
+}
+
+func (session *sessionStore) flushRenewals() {
+	session.pendingRenewalsMutex.Lock()
+	renewalsMap := session.pendingRenewals
+	session.pendingRenewals = make(map[string]sessionRenewal)
+	session.pendingRenewalsMutex.Unlock()
+
+	if len(renewalsMap) == 0 || session.databaseServiceSession == nil {
+		return
+	}
+
+	renewals := make([]sessionRenewal, 0, len(renewalsMap))
+	for _, renewal := range renewalsMap {
+		renewals = append(renewals, renewal)
+	}
+	err := session.databaseServiceSession.renewSessions(renewals)
+	if err != nil {
+		slog.Error("Renewing seassions in DB:", slog.Any("error", err), slog.Int("count", len(renewals)))
+	}
+}
+
 func (session *sessionStore) deleteOutdatedTokens() {
 	now := time.Now()
 
@@ -110,6 +184,8 @@ func (session *sessionStore) deleteOutdatedTokens() {
 
 func (session *sessionStore) stop() {
 	session.deleteOutdatedTokensTicker.Stop()
+	session.flushRenewalsTicker.Stop()
+	session.flushRenewals()
 
 	select {
 	case session.stopWorkerChan <- true:
@@ -128,29 +204,37 @@ func (session *sessionStore) stop() {
 		if err := session.mqService.unregisterMessageCB(mqSessionsForUserEnd, session); err != nil {
 			slog.Error("sessionStore unregisterinf MQ CB error(mqSessionsForUserEnd):", slog.Any("error", err))
 		}
+		if err := session.mqService.unregisterMessageCB(mqUserModified, session); err != nil {
+			slog.Error("sessionStore unregisterinf MQ CB error(mqUserModified):", slog.Any("error", err))
+		}
 	}
 }
 
-func (session *sessionStore) storeSession(tokenHash string, user *user, expiresTime time.Time) error {
+func (session *sessionStore) storeSession(tokenHash string, sessionData *sessionDataContainer) error {
 	if tokenHash == "" {
 		return fmt.Errorf("tokenHash should not be empty string")
 	}
-	if user == nil {
+	if sessionData.user == nil {
 		return fmt.Errorf("user is nil")
 	}
 
-	sessionData := sessionDataContainer{user: user, expiresTime: expiresTime}
-
-	session.sessionTokensMap.Store(tokenHash, sessionData)
-
 	if session.databaseServiceSession != nil {
-		err := session.databaseServiceSession.createSession(tokenHash, user.Id, expiresTime)
-		return err
+		id, err := session.databaseServiceSession.createSession(sessionRecord{tokenHash: tokenHash, user: sessionData.user,
+			dtCreated: sessionData.dtCreated, dtIssued: sessionData.dtIssued, dtLastSeen: sessionData.dtLastSeen, dtExpires: sessionData.expiresTime,
+			userAgent: sessionData.userAgent, ip: sessionData.ip})
+		if err != nil {
+			return err
+		}
+		sessionData.id = id
+	} else {
+		sessionData.id = session.lastSessionId.Add(1)
 	}
+
+	session.sessionTokensMap.Store(tokenHash, *sessionData)
 	return nil
 }
 
-func (session *sessionStore) getUserOrForgetIfExpired(tokenHash string) (*user, error) {
+func (session *sessionStore) getSessionOrForgetIfExpired(tokenHash string) (*sessionDataContainer, error) {
 	var (
 		sessionData   sessionDataContainer
 		foundInMemory bool = false
@@ -170,33 +254,31 @@ func (session *sessionStore) getUserOrForgetIfExpired(tokenHash string) (*user,
 		foundInMemory = true
 	}
 
-	if !tokenFound && !foundInMemory && session.databaseServiceSession != nil {
-		expiresTimePtr, userPtr, err := session.databaseServiceSession.getSession(tokenHash)
+	now := time.Now()
+
+	// cached copy may be outdated if the session was renewed on other instance
+	if (!tokenFound || isExpired(now, sessionData.expiresTime)) && session.databaseServiceSession != nil {
+		sessionPtr, err := session.databaseServiceSession.getSession(tokenHash)
 		if err != nil {
 			return nil, err
 		}
-		sessionData = sessionDataContainer{user: userPtr, expiresTime: *expiresTimePtr}
-		tokenFound = true
-		foundInMemory = false
+		if sessionPtr != nil {
+			sessionData = newSessionDataContainer(sessionPtr)
+			tokenFound = true
+			foundInMemory = false
+		}
 	}
 
 	if !tokenFound {
 		return nil, errUserSessionIsNotValid
 	}
 
-	isTokenExpired := isExpired(time.Now(), sessionData.expiresTime)
-
-	if tokenFound && !foundInMemory && !isTokenExpired {
-		// cache non expired dbToken
-		session.sessionTokensMap.Store(tokenHash, sessionData)
-	}
+	isTokenExpired := isExpired(now, sessionData.expiresTime)
 
 	if tokenFound && isTokenExpired {
 		tokenFound = false
 
-		if foundInMemory {
-			session.sessionTokensMap.Delete(tokenHash)
-		}
+		session.sessionTokensMap.Delete(tokenHash)
 		if session.databaseServiceSession != nil {
 			err := session.databaseServiceSession.deleteSession(tokenHash)
 			if err != nil {
@@ -207,10 +289,28 @@ func (session *sessionStore) getUserOrForgetIfExpired(tokenHash string) (*user,
 		return nil, errUserSessionIsNotValid
 	}
 
-	return sessionData.user, nil
+	cachedSessionData := sessionData
+	sessionData.dtLastSeen = now
+	if !sessionData.rotated {
+		slidExpiresTime := slidingSessionExpires(sessionData.dtCreated, now, session.idleTimeout, session.absoluteLifetime)
+		if slidExpiresTime.After(sessionData.expiresTime) {
+			sessionData.expiresTime = slidExpiresTime
+		}
+		session.addPendingRenewal(tokenHash, sessionData.expiresTime, now)
+	}
+
+	if foundInMemory {
+		// don't bring back a session that was concurrently logged out
+		session.sessionTokensMap.CompareAndSwap(tokenHash, cachedSessionData, sessionData)
+	} else {
+		// cache non expired dbToken
+		session.sessionTokensMap.Store(tokenHash, sessionData)
+	}
+
+	return &sessionData, nil
 }
 
-func (session *sessionStore) newSession(user *user) (string, time.Time, error) {
+func (session *sessionStore) newSession(user *user, client clientInfo) (string, time.Time, error) {
 	if user == nil {
 		return "", time.Time{}, fmt.Errorf("user is nil")
 	}
@@ -222,9 +322,11 @@ func (session *sessionStore) newSession(user *user) (string, time.Time, error) {
 	}
 
 	now := time.Now()
-	expiresTime := now.Add(session.tokenExpiresAge)
+	expiresTime := slidingSessionExpires(now, now, session.idleTimeout, session.absoluteLifetime)
 
-	err = session.storeSession(tokenHash, user, expiresTime)
+	sessionData := sessionDataContainer{user: user, expiresTime: expiresTime, dtCreated: now, dtIssued: now, dtLastSeen: now,
+		userAgent: client.userAgent, ip: client.ip}
+	err = session.storeSession(tokenHash, &sessionData)
 	if err != nil {
 		return "", time.Time{}, err
 	}
@@ -241,12 +343,71 @@ func (session *sessionStore) getUser(token string) (*user, error) {
 		return nil, err
 	}
 
-	user, err := session.getUserOrForgetIfExpired(tokenHash)
+	sessionData, err := session.getSessionOrForgetIfExpired(tokenHash)
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return sessionData.user, nil
+}
+
+func (session *sessionStore) renewSession(token string) (string, time.Time, error) {
+	tokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	sessionData, err := session.getSessionOrForgetIfExpired(tokenHash)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	now := time.Now()
+	if sessionData.rotated || now.Sub(sessionData.dtIssued) < session.rotationAge {
+		return token, sessionData.expiresTime, nil
+	}
+
+	newToken := generateNewSessionToken()
+	newTokenHash, err := calculateTokenHash(newToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	newSessionData := *sessionData
+	newSessionData.dtIssued = now
+	newSessionData.dtLastSeen = now
+	err = session.storeSession(newTokenHash, &newSessionData)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	// old token is still accepted for a short while, then it expires on its own
+	graceExpiresTime := now.Add(seassionRotationGrace)
+	if graceExpiresTime.After(sessionData.expiresTime) {
+		graceExpiresTime = sessionData.expiresTime
+	}
+	if session.databaseServiceSession != nil {
+		err = session.databaseServiceSession.markSessionRotated(tokenHash, graceExpiresTime)
+		if err != nil {
+			slog.Error("Marking rotated seassion in DB:", slog.Any("error", err))
+		}
+	}
+	session.pendingRenewalsMutex.Lock()
+	delete(session.pendingRenewals, tokenHash)
+	session.pendingRenewalsMutex.Unlock()
+
+	graceSessionData := *sessionData
+	graceSessionData.expiresTime = graceExpiresTime
+	graceSessionData.rotated = true
+	session.sessionTokensMap.Store(tokenHash, graceSessionData)
+
+	if session.mqService != nil {
+		err = session.mqService.sendMessage(mqSessionEnd, tokenHash)
+		if err != nil {
+			slog.Error("session store: informing token rotation to other instancs failed", slog.Any("error", err))
+		}
+	}
+
+	return newToken, newSessionData.expiresTime, nil
 }
 
 func (session *sessionStore) logout(token string) error {
@@ -305,3 +466,123 @@ func (session *sessionStore) forgetSessionsForUser(idUser int64) error {
 	}
 	return nil
 }
+
+func (session *sessionStore) forgetCachedUser(idUser int64) error {
+	session.forgetInMemorySessionsForUser(idUser)
+
+	if session.mqService != nil {
+		idUserStr := strconv.FormatInt(idUser, 10)
+		err := session.mqService.sendMessage(mqUserModified, idUserStr)
+		if err != nil {
+			slog.Error("session store: informing user modification to other instancs failed", slog.Any("error", err), slog.Int64("idUser", idUser))
+		}
+	}
+	return nil
+}
+
+func (session *sessionStore) listSessions(idUser int64, token string) ([]sessionInfo, error) {
+	currentTokenHash, _ := calculateTokenHash(token)
+	sessions := make([]sessionInfo, 0)
+
+	if session.databaseServiceSession != nil {
+		sessionRecords, err := session.databaseServiceSession.listSessionsForUser(idUser)
+		if err != nil {
+			return nil, err
+		}
+		now := time.Now()
+		for i := range sessionRecords {
+			sessionData := newSessionDataContainer(&sessionRecords[i])
+			if isExpired(now, sessionData.expiresTime) {
+				continue
+			}
+			// last seen time in memory is newer than in DB
+			sessionDataAny, ok := session.sessionTokensMap.Load(sessionRecords[i].tokenHash)
+			if ok {
+				if cachedSessionData, ok := sessionDataAny.(sessionDataContainer); ok {
+					sessionData.dtLastSeen = cachedSessionData.dtLastSeen
+				}
+			}
+			sessions = append(sessions, sessionData.toSessionInfo(sessionRecords[i].tokenHash == currentTokenHash))
+		}
+		return sessions, nil
+	}
+
+	session.sessionTokensMap.Range(func(key, value any) bool {
+		sessionData, ok := value.(sessionDataContainer)
+		if !ok {
+			slog.Error("Listing sessions is not working, value is not sessionDataContainer")
+			return false
+		}
+		if sessionData.user.Id == idUser {
+			sessions = append(sessions, sessionData.toSessionInfo(key == currentTokenHash))
+		}
+		return true
+	})
+	return sessions, nil
+}
+
+func (session *sessionStore) revokeSession(idUser int64, id int64) error {
+	var tokenHash string
+
+	if session.databaseServiceSession != nil {
+		var err error
+		tokenHash, err = session.databaseServiceSession.deleteSessionById(id, idUser)
+		if err != nil {
+			return fmt.Errorf("Revoking session faild because of database: %w", err)
+		}
+	} else {
+		session.sessionTokensMap.Range(func(key, value any) bool {
+			sessionData, ok := value.(sessionDataContainer)
+			if ok && sessionData.id == id && sessionData.user.Id == idUser {
+				tokenHash = key.(string)
+				return false
+			}
+			return true
+		})
+	}
+	if tokenHash == "" {
+		return errSessionDoesntExist
+	}
+
+	session.sessionTokensMap.Delete(tokenHash)
+
+	if session.mqService != nil {
+		err := session.mqService.sendMessage(mqSessionEnd, tokenHash)
+		if err != nil {
+			slog.Error("session store: informing session revocation to other instancs failed", slog.Any("error", err))
+		}
+	}
+	return nil
+}
+
+func (session *sessionStore) forgetSessionsForUserExcept(idUser int64, token string) error {
+	keepTokenHash, err := calculateTokenHash(token)
+	if err != nil {
+		return err
+	}
+
+	if session.databaseServiceSession != nil {
+		err := session.databaseServiceSession.deleteSessionsForUserExcept(idUser, keepTokenHash)
+		if err != nil {
+			return fmt.Errorf("Deleting other user sessions faild because of database: %w", err)
+		}
+	}
+
+	session.sessionTokensMap.Range(func(key, value any) bool {
+		sessionData, ok := value.(sessionDataContainer)
+		if ok && sessionData.user.Id == idUser && key != keepTokenHash {
+			session.sessionTokensMap.Delete(key)
+		}
+		return true
+	})
+
+	// other instances drop all cached sessions of the user, the kept one is reloaded from DB
+	if session.mqService != nil {
+		idUserStr := strconv.FormatInt(idUser, 10)
+		err := session.mqService.sendMessage(mqSessionsForUserEnd, idUserStr)
+		if err != nil {
+			slog.Error("session store: informing user logout to other instancs failed", slog.Any("error", err), slog.Int64("idUser", idUser))
+		}
+	}
+	return nil
+}
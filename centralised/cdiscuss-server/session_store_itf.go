@@ -25,9 +25,39 @@ func calculateTokenHash(token string) (string, error) {
 	return fmt.Sprintf("%x", sha256.Sum256([]byte(token))), nil
 }
 
+const seassionRotationGrace time.Duration = time.Minute // rotated token stays valid for requests that are already on the way
+
+// sessions expire after idleTimeout without use, but never later than absoluteLifetime after login
+func slidingSessionExpires(dtCreated time.Time, now time.Time, idleTimeout time.Duration, absoluteLifetime time.Duration) time.Time {
+	idleExpires := now.Add(idleTimeout)
+	absoluteExpires := dtCreated.Add(absoluteLifetime)
+	if idleExpires.Before(absoluteExpires) {
+		return idleExpires
+	}
+	return absoluteExpires
+}
+
+type sessionInfo struct {
+	Id         int64     `json:"id"`
+	DtCreated  time.Time `json:"dtCreated"`
+	DtLastSeen time.Time `json:"dtLastSeen"`
+	DtExpires  time.Time `json:"dtExpires"`
+	UserAgent  string    `json:"userAgent"`
+	IP         string    `json:"ip"`
+	Current    bool      `json:"current"`
+}
+
 type sessionStoreItf interface {
-	newSession(user *user) (string, time.Time, error)
+	newSession(user *user, client clientInfo) (string, time.Time, error)
 	getUser(token string) (*user, error)
+	// returns token and its expiry time for re-issuing the cookie, token is rotated when it is older than rotation age
+	renewSession(token string) (string, time.Time, error)
 	logout(token string) error
 	forgetSessionsForUser(idUser int64) error
+	// token is used only to mark the current session
+	listSessions(idUser int64, token string) ([]sessionInfo, error)
+	revokeSession(idUser int64, id int64) error
+	forgetSessionsForUserExcept(idUser int64, token string) error
+	// drops cached user objects on all instances, sessions stay valid and user is reloaded from db
+	forgetCachedUser(idUser int64) error
 }
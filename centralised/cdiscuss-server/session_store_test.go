@@ -0,0 +1,101 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestSessionStoreRevokeSession(t *testing.T) {
+	store, err := newSessionStore(nil, nil, time.Hour, 2*time.Hour, time.Hour, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("Session store creation error: %v", err)
+	}
+	defer store.stop()
+
+	user := &user{Id: 7, Username: "adam"}
+	client := clientInfo{ip: "10.0.0.1", userAgent: "test agent"}
+	currentToken, _, err := store.newSession(user, client)
+	if err != nil {
+		t.Fatalf("New session error: %v", err)
+	}
+	otherToken, _, err := store.newSession(user, client)
+	if err != nil {
+		t.Fatalf("New session error: %v", err)
+	}
+
+	sessions, err := store.listSessions(user.Id, currentToken)
+	if err != nil || len(sessions) != 2 {
+		t.Fatalf("Wrong sessions listed: %v %v", sessions, err)
+	}
+	var otherId int64
+	for _, session := range sessions {
+		if session.UserAgent != client.userAgent || session.IP != client.ip {
+			t.Errorf("Wrong session client info: %v", session)
+		}
+		if !session.Current {
+			otherId = session.Id
+		}
+	}
+
+	err = store.revokeSession(user.Id+1, otherId)
+	if !errors.Is(err, errSessionDoesntExist) {
+		t.Errorf("Revoking other user session should fail: %v", err)
+	}
+	err = store.revokeSession(user.Id, otherId)
+	if err != nil {
+		t.Fatalf("Revoke session error: %v", err)
+	}
+	if _, err := store.getUser(otherToken); !errors.Is(err, errUserSessionIsNotValid) {
+		t.Errorf("Revoked session is still valid: %v", err)
+	}
+	if _, err := store.getUser(currentToken); err != nil {
+		t.Errorf("Current session should stay valid: %v", err)
+	}
+}
+
+func TestSlidingSessionExpires(t *testing.T) {
+	dtCreated := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	expires := slidingSessionExpires(dtCreated, dtCreated.Add(time.Hour), 2*time.Hour, 24*time.Hour)
+	if !expires.Equal(dtCreated.Add(3 * time.Hour)) {
+		t.Errorf("Wrong idle expiry: %v", expires)
+	}
+	expires = slidingSessionExpires(dtCreated, dtCreated.Add(23*time.Hour), 2*time.Hour, 24*time.Hour)
+	if !expires.Equal(dtCreated.Add(24 * time.Hour)) {
+		t.Errorf("Absolute lifetime not respected: %v", expires)
+	}
+}
+
+func TestSessionStoreRenewSessionRotatesToken(t *testing.T) {
+	store, err := newSessionStore(nil, nil, time.Hour, 2*time.Hour, time.Nanosecond, time.Hour, time.Minute)
+	if err != nil {
+		t.Fatalf("Session store creation error: %v", err)
+	}
+	defer store.stop()
+
+	user := &user{Id: 7, Username: "adam"}
+	oldToken, _, err := store.newSession(user, clientInfo{})
+	if err != nil {
+		t.Fatalf("New session error: %v", err)
+	}
+	time.Sleep(time.Millisecond)
+
+	newToken, _, err := store.renewSession(oldToken)
+	if err != nil {
+		t.Fatalf("Renew session error: %v", err)
+	}
+	if newToken == oldToken {
+		t.Fatalf("Token was not rotated")
+	}
+	if _, err = store.getUser(newToken); err != nil {
+		t.Errorf("New token not valid: %v", err)
+	}
+	if _, err = store.getUser(oldToken); err != nil {
+		t.Errorf("Old token should be valid during grace period: %v", err)
+	}
+	againToken, _, err := store.renewSession(oldToken)
+	if err != nil || againToken != oldToken {
+		t.Errorf("Rotated token should not be rotated again: %v", err)
+	}
+}
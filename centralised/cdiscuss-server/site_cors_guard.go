@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+)
+
+// Requests of the embed tell the site in siteIdHeaderName header or siteIdQueryParam. Browser requests
+// from origins the site doesn't allow are refused, allowed ones get CORS headers. Cross-origin requests
+// that don't tell the site are refused, so global and account endpoints never get CORS headers. Like
+// csrfGuard it's not wired yet, the HTTP layer has to wrap the embed endpoints with protect.
+type siteCorsGuard struct {
+	siteRegistry siteRegistryItf
+}
+
+func newSiteCorsGuard(siteRegistry siteRegistryItf) (*siteCorsGuard, error) {
+	if siteRegistry == nil {
+		return nil, errors.New("site CORS guard needs site registry")
+	}
+	return &siteCorsGuard{siteRegistry: siteRegistry}, nil
+}
+
+type requestSiteIdKey struct{}
+
+// site the guards checked the origin against, handlers of the embed endpoints must use this one
+// and refuse the request if it's not set
+func requestSiteId(r *http.Request) (int64, bool) {
+	idSite, ok := r.Context().Value(requestSiteIdKey{}).(int64)
+	return idSite, ok
+}
+
+func withRequestSiteId(r *http.Request, idSite int64) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), requestSiteIdKey{}, idSite))
+}
+
+// returns false if the request doesn't tell the site
+func parseRequestSiteId(r *http.Request) (int64, bool, error) {
+	idSiteStr := r.Header.Get(siteIdHeaderName)
+	if idSiteStr == "" {
+		idSiteStr = r.URL.Query().Get(siteIdQueryParam)
+	}
+	if idSiteStr == "" {
+		return 0, false, nil
+	}
+	idSite, err := strconv.ParseInt(idSiteStr, 10, 64)
+	if err != nil || idSite <= 0 {
+		return 0, true, errSiteDoesntExist
+	}
+	return idSite, true, nil
+}
+
+// returns allowed origin, empty for requests that are not cross-origin, and the site of the request
+func (guard *siteCorsGuard) checkRequest(r *http.Request) (string, int64, error) {
+	idSite, found, err := parseRequestSiteId(r)
+	if err != nil {
+		return "", 0, err
+	}
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		if !found {
+			idSite = defaultSiteId
+		}
+		return "", idSite, nil // not a cross-origin browser request, CSRF guard takes care of the rest
+	}
+	if !found {
+		return "", 0, errSiteOriginNotAllowed
+	}
+
+	allowed, err := guard.siteRegistry.isOriginAllowedForSite(idSite, origin)
+	if err != nil {
+		return "", 0, err
+	}
+	if !allowed {
+		return "", 0, errSiteOriginNotAllowed
+	}
+	return origin, idSite, nil
+}
+
+func (guard *siteCorsGuard) protect(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// caches must not give response for one origin to another
+		w.Header().Add("Vary", "Origin")
+
+		allowedOrigin, idSite, err := guard.checkRequest(r)
+		if err != nil {
+			if !errors.Is(err, errSiteOriginNotAllowed) && !errors.Is(err, errSiteDoesntExist) {
+				slog.Error("Checking site origin failed", slog.Any("error", err))
+			}
+			writeGuardError(w, err)
+			return
+		}
+		if allowedOrigin != "" {
+			w.Header().Set("Access-Control-Allow-Origin", allowedOrigin)
+			w.Header().Set("Access-Control-Allow-Credentials", "true")
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", siteCorsAllowedMethods)
+			w.Header().Set("Access-Control-Allow-Headers", siteCorsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", siteCorsMaxAgeSeconds)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, withRequestSiteId(r, idSite))
+	})
+}
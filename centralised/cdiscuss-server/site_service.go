@@ -0,0 +1,338 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+type siteCacheContainer struct {
+	site        *site
+	cachedUntil time.Time
+}
+
+// implements siteServiceItf and siteRegistryItf
+type siteService struct {
+	userService          userServiceItf
+	authorizer           authorizerItf
+	databaseServiceSite  databaseServiceSiteItf
+	siteModerationPolicy siteModerationPolicyItf
+	auditLogger          auditLoggerItf
+	mqService            mqServiceItf
+
+	sitesMap *sync.Map // idSite -> siteCacheContainer
+}
+
+func newSiteService(userService userServiceItf, authorizer authorizerItf, databaseServiceSite databaseServiceSiteItf,
+	siteModerationPolicy siteModerationPolicyItf, auditLogger auditLoggerItf, mqService mqServiceItf) (*siteService, error) {
+	if databaseServiceSite == nil {
+		return nil, errors.New("site service needs database")
+	}
+	if authorizer == nil {
+		return nil, errors.New("site service needs authorizer")
+	}
+
+	service := &siteService{userService: userService, authorizer: authorizer, databaseServiceSite: databaseServiceSite,
+		siteModerationPolicy: siteModerationPolicy, auditLogger: auditLogger, mqService: mqService, sitesMap: &sync.Map{}}
+	if service.mqService != nil {
+		service.mqService.registerMessageCB(mqSiteModified, service, false)
+	}
+	return service, nil
+}
+
+// implement MQ mqMessageCbItf
+func (service *siteService) onMessage(msg mqMessage) {
+	idSite, err := strconv.ParseInt(msg.Argument, 10, 64)
+	if err != nil {
+		slog.Error("Forgetting cached site idSite parsing error:", slog.String("idSiteStr", msg.Argument), slog.Any("error", err))
+		return
+	}
+	service.forgetCachedSite(idSite)
+}
+
+func (service *siteService) stop() {
+	if service.mqService != nil {
+		if err := service.mqService.unregisterMessageCB(mqSiteModified, service); err != nil {
+			slog.Error("siteService unregistering MQ CB error:", slog.Any("error", err))
+		}
+	}
+}
+
+func (service *siteService) forgetCachedSite(idSite int64) {
+	service.sitesMap.Delete(idSite)
+}
+
+func (service *siteService) siteModified(idSite int64) {
+	service.forgetCachedSite(idSite)
+	if service.mqService != nil {
+		err := service.mqService.sendMessage(mqSiteModified, strconv.FormatInt(idSite, 10))
+		if err != nil {
+			slog.Error("site: informing site change to other instances failed", slog.Any("error", err), slog.Int64("idSite", idSite))
+		}
+	}
+}
+
+func (service *siteService) getSite(idSite int64) (*site, error) {
+	now := time.Now()
+	value, ok := service.sitesMap.Load(idSite)
+	if ok {
+		cached, ok := value.(siteCacheContainer)
+		if ok && now.Before(cached.cachedUntil) {
+			return cached.site, nil
+		}
+	}
+
+	site, err := service.databaseServiceSite.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+	service.sitesMap.Store(idSite, siteCacheContainer{site: site, cachedUntil: now.Add(siteCacheAge)})
+	return site, nil
+}
+
+func (service *siteService) isOriginAllowedForSite(idSite int64, origin string) (bool, error) {
+	normalized := normalizeOrigin(origin)
+	if normalized == "" {
+		return false, nil
+	}
+	site, err := service.getSite(idSite)
+	if err != nil {
+		return false, err
+	}
+	for _, allowedOrigin := range site.AllowedOrigins {
+		if allowedOrigin == normalized {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (service *siteService) getSiteConfigurator(sessionCookie *http.Cookie, target rbacTarget) (*user, error) {
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+	err = service.authorizer.authorize(user, rbacPermSiteConfigure, target)
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+func (service *siteService) getSiteInfo(site *site) (*siteInfo, error) {
+	owners, err := service.databaseServiceSite.listSiteOwners(site.Id)
+	if err != nil {
+		return nil, err
+	}
+	info := &siteInfo{site: *site, Owners: owners}
+	if service.siteModerationPolicy != nil {
+		info.ModerationPolicy, err = service.siteModerationPolicy.getModerationPolicy(rbacSiteTarget(site.Id, ""))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return info, nil
+}
+
+func (service *siteService) createSite(sessionCookie *http.Cookie, settings siteSettings, idOwners []int64) (*siteInfo, error) {
+	err := validateSiteSettings(&settings)
+	if err != nil {
+		return nil, err
+	}
+	if len(idOwners) == 0 {
+		return nil, errSiteNeedsOwner
+	}
+	admin, err := service.getSiteConfigurator(sessionCookie, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
+
+	site, err := service.databaseServiceSite.createSite(settings, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	for _, idOwner := range idOwners {
+		err = service.authorizer.assignUserRole(idOwner, siteOwnerRole, rbacSiteScope(site.Id), &admin.Id)
+		if err != nil {
+			// site without owners would be left behind, its deletion also removes owners assigned so far
+			service.deleteSiteWithoutOwners(site.Id)
+			return nil, err
+		}
+	}
+
+	idSiteStr := strconv.FormatInt(site.Id, 10)
+	logAuditAction(service.auditLogger, admin, auditActionSiteCreate, auditTargetSite, idSiteStr, nil, site)
+	for _, idOwner := range idOwners {
+		logAuditAction(service.auditLogger, admin, auditActionSiteOwnerAdd, auditTargetSite, idSiteStr, nil, map[string]int64{"idUser": idOwner})
+	}
+	return service.getSiteInfo(site)
+}
+
+func (service *siteService) deleteSiteWithoutOwners(idSite int64) {
+	idUsers, err := service.databaseServiceSite.deleteSite(idSite)
+	if err != nil {
+		slog.Error("Failed to delete site after owner assignment failed", slog.Int64("idSite", idSite), slog.Any("error", err))
+		return
+	}
+	for _, idUser := range idUsers {
+		service.authorizer.forgetCachedRoles(idUser)
+	}
+}
+
+func (service *siteService) getSiteAsOwner(sessionCookie *http.Cookie, idSite int64) (*siteInfo, error) {
+	_, err := service.getSiteConfigurator(sessionCookie, rbacSiteTarget(idSite, ""))
+	if err != nil {
+		return nil, err
+	}
+	site, err := service.databaseServiceSite.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+	return service.getSiteInfo(site)
+}
+
+func (service *siteService) listSitesAsOwner(sessionCookie *http.Cookie) ([]site, error) {
+	user, err := service.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
+	if err != nil {
+		return nil, err
+	}
+	err = service.authorizer.authorize(user, rbacPermSiteConfigure, rbacTarget{})
+	if err == nil {
+		return service.databaseServiceSite.listSites(nil)
+	}
+	if !errors.Is(err, errPermissionDenied) {
+		return nil, err
+	}
+
+	roles, err := service.authorizer.listUserRoles(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	idSites := make([]int64, 0)
+	for _, role := range roles {
+		idSiteStr, found := strings.CutPrefix(role.Scope, rbacScopeSitePrefix)
+		if !found || !rbacRoleHasPermission(role.Role, rbacPermSiteConfigure) {
+			continue
+		}
+		idSite, err := strconv.ParseInt(idSiteStr, 10, 64)
+		if err == nil {
+			idSites = append(idSites, idSite)
+		}
+	}
+	return service.databaseServiceSite.listSites(idSites)
+}
+
+func (service *siteService) updateSite(sessionCookie *http.Cookie, idSite int64, settings siteSettings) (*siteInfo, error) {
+	err := validateSiteSettings(&settings)
+	if err != nil {
+		return nil, err
+	}
+	owner, err := service.getSiteConfigurator(sessionCookie, rbacSiteTarget(idSite, ""))
+	if err != nil {
+		return nil, err
+	}
+
+	previousSite, err := service.databaseServiceSite.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+	site, err := service.databaseServiceSite.updateSite(idSite, settings)
+	if err != nil {
+		return nil, err
+	}
+	service.siteModified(idSite)
+	logAuditAction(service.auditLogger, owner, auditActionSiteUpdate, auditTargetSite, strconv.FormatInt(idSite, 10), previousSite, site)
+	return service.getSiteInfo(site)
+}
+
+func (service *siteService) setSiteModerationPolicy(sessionCookie *http.Cookie, idSite int64, policy string) error {
+	if service.siteModerationPolicy == nil {
+		return errors.New("site moderation policy is not configured")
+	}
+	_, err := service.getSite(idSite)
+	if err != nil {
+		return err
+	}
+	// authorization and audit log are done by moderation service
+	return service.siteModerationPolicy.setModerationPolicy(sessionCookie, rbacSiteScope(idSite), policy)
+}
+
+func (service *siteService) deleteSite(sessionCookie *http.Cookie, idSite int64) error {
+	// comments from before sites existed would be deleted with it
+	if idSite == defaultSiteId {
+		return errSiteDefaultDelete
+	}
+	admin, err := service.getSiteConfigurator(sessionCookie, rbacTarget{})
+	if err != nil {
+		return err
+	}
+	previousSite, err := service.databaseServiceSite.getSite(idSite)
+	if err != nil {
+		return err
+	}
+
+	idUsers, err := service.databaseServiceSite.deleteSite(idSite)
+	if err != nil {
+		return err
+	}
+	for _, idUser := range idUsers {
+		service.authorizer.forgetCachedRoles(idUser)
+	}
+	service.siteModified(idSite)
+	logAuditAction(service.auditLogger, admin, auditActionSiteDelete, auditTargetSite, strconv.FormatInt(idSite, 10), previousSite, nil)
+	return nil
+}
+
+func (service *siteService) addSiteOwner(sessionCookie *http.Cookie, idSite int64, idUser int64) error {
+	owner, err := service.getSiteConfigurator(sessionCookie, rbacSiteTarget(idSite, ""))
+	if err != nil {
+		return err
+	}
+	_, err = service.getSite(idSite)
+	if err != nil {
+		return err
+	}
+
+	err = service.authorizer.assignUserRole(idUser, siteOwnerRole, rbacSiteScope(idSite), &owner.Id)
+	if err != nil {
+		return err
+	}
+	logAuditAction(service.auditLogger, owner, auditActionSiteOwnerAdd, auditTargetSite, strconv.FormatInt(idSite, 10), nil,
+		map[string]int64{"idUser": idUser})
+	return nil
+}
+
+func (service *siteService) removeSiteOwner(sessionCookie *http.Cookie, idSite int64, idUser int64) error {
+	owner, err := service.getSiteConfigurator(sessionCookie, rbacSiteTarget(idSite, ""))
+	if err != nil {
+		return err
+	}
+	owners, err := service.databaseServiceSite.listSiteOwners(idSite)
+	if err != nil {
+		return err
+	}
+	if len(owners) == 1 && owners[0].IdUser == idUser {
+		return errSiteNeedsOwner
+	}
+
+	err = service.authorizer.revokeUserRole(idUser, siteOwnerRole, rbacSiteScope(idSite))
+	if err != nil {
+		return err
+	}
+	logAuditAction(service.auditLogger, owner, auditActionSiteOwnerRemove, auditTargetSite, strconv.FormatInt(idSite, 10),
+		map[string]int64{"idUser": idUser}, nil)
+	return nil
+}
+
+func (service *siteService) getSitePublicConfig(idSite int64) (*sitePublicConfig, error) {
+	site, err := service.getSite(idSite)
+	if err != nil {
+		return nil, err
+	}
+	return &sitePublicConfig{Id: site.Id, Name: site.Name, PowRequired: site.PowRequired, PowHardnes: site.PowHardnes,
+		Styling: site.Styling}, nil
+}
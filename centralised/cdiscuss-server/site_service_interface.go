@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	defaultSiteId          int64         = 1 // comments from before sites existed
+	siteNameMaxLen         int           = 100
+	siteAllowedOriginsMax  int           = 20
+	siteOriginMaxLen       int           = 300
+	siteFontFamilyMaxLen   int           = 100
+	sitePowHardnesMax      uint          = 30
+	siteDefaultPowHardnes  uint          = 16
+	siteCacheAge           time.Duration = 10 * time.Minute
+	siteIdHeaderName       string        = "X-CDiscuss-Site"
+	siteIdQueryParam       string        = "site"
+	siteCorsMaxAgeSeconds  string        = "600"
+	siteThemeAuto          string        = ""
+	siteThemeLight         string        = "light"
+	siteThemeDark          string        = "dark"
+	siteOwnerRole          string        = rbacRoleAdmin // owners are admins in site scope
+	siteCorsAllowedMethods string        = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	siteCorsAllowedHeaders string        = "Content-Type, Authorization, " + csrfHeaderName + ", " + siteIdHeaderName
+)
+
+type siteStyling struct {
+	Theme       string `json:"theme"`       // siteTheme* constants
+	AccentColor string `json:"accentColor"` // #rrggbb or empty
+	FontFamily  string `json:"fontFamily"`
+}
+
+// what owners can change
+type siteSettings struct {
+	Name           string       `json:"name"`
+	AllowedOrigins []string     `json:"allowedOrigins"` // scheme://host[:port] of pages that embed the comments
+	PowRequired    bool         `json:"powRequired"`    // for creating comments
+	PowHardnes     uint         `json:"powHardnes"`
+	Styling        siteStyling  `json:"styling"`
+	UrlRules       siteUrlRules `json:"urlRules"` // how page URLs are canonicalized
+}
+
+type site struct {
+	Id        int64     `json:"id"`
+	DtCreated time.Time `json:"dtCreated"`
+	siteSettings
+}
+
+type siteOwner struct {
+	IdUser   int64  `json:"idUser"`
+	Username string `json:"username"`
+}
+
+// for owners and admins
+type siteInfo struct {
+	site
+	Owners           []siteOwner `json:"owners"`
+	ModerationPolicy string      `json:"moderationPolicy"` // effective policy, it can be inherited from global
+}
+
+// for the embed, without origins and owners
+type sitePublicConfig struct {
+	Id          int64       `json:"id"`
+	Name        string      `json:"name"`
+	PowRequired bool        `json:"powRequired"`
+	PowHardnes  uint        `json:"powHardnes"`
+	Styling     siteStyling `json:"styling"`
+}
+
+// used by comment service and HTTP layer, cached
+type siteRegistryItf interface {
+	// errSiteDoesntExist if there is no such site
+	getSite(idSite int64) (*site, error)
+	// origins of a site are trusted only for requests scoped to that site, never for global or account endpoints
+	isOriginAllowedForSite(idSite int64, origin string) (bool, error)
+}
+
+// moderation policy is kept by moderation service in site scope
+type siteModerationPolicyItf interface {
+	getModerationPolicy(target rbacTarget) (string, error)
+	setModerationPolicy(sessionCookie *http.Cookie, scope string, policy string) error
+}
+
+// create, delete and listing all sites need global site:configure, the rest site:configure in site scope (owners)
+type siteServiceItf interface {
+	createSite(sessionCookie *http.Cookie, settings siteSettings, idOwners []int64) (*siteInfo, error)
+	getSiteAsOwner(sessionCookie *http.Cookie, idSite int64) (*siteInfo, error)
+	// sites the user can configure
+	listSitesAsOwner(sessionCookie *http.Cookie) ([]site, error)
+	updateSite(sessionCookie *http.Cookie, idSite int64, settings siteSettings) (*siteInfo, error)
+	// empty policy inherits the global one
+	setSiteModerationPolicy(sessionCookie *http.Cookie, idSite int64, policy string) error
+	// deletes comments of the site too, default site can't be deleted
+	deleteSite(sessionCookie *http.Cookie, idSite int64) error
+	addSiteOwner(sessionCookie *http.Cookie, idSite int64, idUser int64) error
+	// the last owner can't be removed
+	removeSiteOwner(sessionCookie *http.Cookie, idSite int64, idUser int64) error
+	getSitePublicConfig(idSite int64) (*sitePublicConfig, error)
+}
+
+var siteAccentColorRegex = regexp.MustCompile(`^(#[0-9a-fA-F]{6})?$`)
+var siteFontFamilyRegex = regexp.MustCompile(`^[a-zA-Z0-9 ,'_-]*$`) // no characters that could close CSS declaration
+
+// normalizes origins in place
+func validateSiteSettings(settings *siteSettings) error {
+	if settings.Name == "" || !utf8.ValidString(settings.Name) || utf8.RuneCountInString(settings.Name) > siteNameMaxLen {
+		return errSiteNameNotValid
+	}
+	if len(settings.AllowedOrigins) > siteAllowedOriginsMax {
+		return errSiteOriginNotValid
+	}
+	origins := make([]string, 0, len(settings.AllowedOrigins))
+	seen := make(map[string]bool)
+	for _, origin := range settings.AllowedOrigins {
+		normalized := normalizeOrigin(origin)
+		if normalized == "" || len(normalized) > siteOriginMaxLen {
+			return errSiteOriginNotValid
+		}
+		if !seen[normalized] {
+			seen[normalized] = true
+			origins = append(origins, normalized)
+		}
+	}
+	settings.AllowedOrigins = origins
+
+	err := validateSiteUrlRules(&settings.UrlRules)
+	if err != nil {
+		return err
+	}
+	if settings.PowHardnes > sitePowHardnesMax {
+		return errSitePowHardnesNotValid
+	}
+	styling := settings.Styling
+	if styling.Theme != siteThemeAuto && styling.Theme != siteThemeLight && styling.Theme != siteThemeDark {
+		return errSiteStylingNotValid
+	}
+	if !siteAccentColorRegex.MatchString(styling.AccentColor) || len(styling.FontFamily) > siteFontFamilyMaxLen ||
+		!siteFontFamilyRegex.MatchString(styling.FontFamily) {
+		return errSiteStylingNotValid
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type stubSiteRegistry struct {
+	origins map[int64][]string
+}
+
+func (registry *stubSiteRegistry) getSite(idSite int64) (*site, error) {
+	origins, ok := registry.origins[idSite]
+	if !ok {
+		return nil, errSiteDoesntExist
+	}
+	return &site{Id: idSite, siteSettings: siteSettings{AllowedOrigins: origins}}, nil
+}
+
+func (registry *stubSiteRegistry) isOriginAllowedForSite(idSite int64, origin string) (bool, error) {
+	for _, allowed := range registry.origins[idSite] {
+		if allowed == normalizeOrigin(origin) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func TestValidateSiteSettings(t *testing.T) {
+	settings := siteSettings{Name: "Blog", AllowedOrigins: []string{"https://Blog.Example.com/", "https://blog.example.com"},
+		Styling: siteStyling{Theme: siteThemeDark, AccentColor: "#12abEF", FontFamily: "Georgia, serif"}}
+	if err := validateSiteSettings(&settings); err != nil {
+		t.Fatalf("Valid settings refused: %v", err)
+	}
+	if len(settings.AllowedOrigins) != 1 || settings.AllowedOrigins[0] != "https://blog.example.com" {
+		t.Errorf("Origins not normalized: %v", settings.AllowedOrigins)
+	}
+
+	tests := []struct {
+		name        string
+		settings    siteSettings
+		expectedErr error
+	}{
+		{"empty name", siteSettings{}, errSiteNameNotValid},
+		{"not http origin", siteSettings{Name: "a", AllowedOrigins: []string{"ftp://a.example.com"}}, errSiteOriginNotValid},
+		{"too hard pow", siteSettings{Name: "a", PowHardnes: sitePowHardnesMax + 1}, errSitePowHardnesNotValid},
+		{"unknown theme", siteSettings{Name: "a", Styling: siteStyling{Theme: "pink"}}, errSiteStylingNotValid},
+		{"css injection", siteSettings{Name: "a", Styling: siteStyling{FontFamily: "x;}body{display:none"}}, errSiteStylingNotValid},
+	}
+	for _, test := range tests {
+		if err := validateSiteSettings(&test.settings); !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: got %v want %v", test.name, err, test.expectedErr)
+		}
+	}
+}
+
+func TestSiteCorsGuard(t *testing.T) {
+	registry := &stubSiteRegistry{origins: map[int64][]string{1: {"https://a.example.com"}, 2: {"https://b.example.com"}}}
+	guard, err := newSiteCorsGuard(registry)
+	if err != nil {
+		t.Fatalf("Site CORS guard creation error: %v", err)
+	}
+	var handledSite int64
+	handler := guard.protect(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handledSite, _ = requestSiteId(r)
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		name           string
+		method         string
+		origin         string
+		site           string
+		expectedStatus int
+		expectedSite   int64
+	}{
+		{"same origin", http.MethodGet, "", "2", http.StatusOK, 2},
+		{"same origin without site", http.MethodGet, "", "", http.StatusOK, defaultSiteId},
+		{"allowed origin", http.MethodPost, "https://a.example.com", "1", http.StatusOK, 1},
+		{"origin of other site", http.MethodPost, "https://b.example.com", "1", http.StatusForbidden, 0},
+		{"site origin on global endpoint", http.MethodPost, "https://b.example.com", "", http.StatusForbidden, 0},
+		{"foreign origin", http.MethodGet, "https://evil.example.org", "", http.StatusForbidden, 0},
+		{"preflight", http.MethodOptions, "https://a.example.com", "1", http.StatusNoContent, 0},
+	}
+	for _, test := range tests {
+		handledSite = 0
+		r := httptest.NewRequest(test.method, "/comments", nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.site != "" {
+			r.Header.Set(siteIdHeaderName, test.site)
+		}
+		if test.method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != test.expectedStatus {
+			t.Errorf("%s: got status %d want %d", test.name, w.Code, test.expectedStatus)
+		}
+		if handledSite != test.expectedSite {
+			t.Errorf("%s: handler got site %d want %d", test.name, handledSite, test.expectedSite)
+		}
+		allowOrigin := w.Header().Get("Access-Control-Allow-Origin")
+		if test.expectedStatus != http.StatusForbidden && allowOrigin != test.origin {
+			t.Errorf("%s: wrong allowed origin %q", test.name, allowOrigin)
+		}
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/comments?"+siteIdQueryParam+"=abc", nil)
+	if _, _, err := parseRequestSiteId(r); !errors.Is(err, errSiteDoesntExist) {
+		t.Errorf("Bad site id accepted: %v", err)
+	}
+}
+
+func TestDeleteDefaultSite(t *testing.T) {
+	service := &siteService{}
+	if err := service.deleteSite(nil, defaultSiteId); !errors.Is(err, errSiteDefaultDelete) {
+		t.Errorf("Default site deleted: %v", err)
+	}
+}
+
+type siteOwnerAuthorizerStub struct {
+	*authorizer
+	failingIdUser int64
+}
+
+func (stub *siteOwnerAuthorizerStub) assignUserRole(idUser int64, role string, scope string, idGrantedBy *int64) error {
+	if idUser == stub.failingIdUser {
+		return errUserDoesntExist
+	}
+	return stub.authorizer.assignUserRole(idUser, role, scope, idGrantedBy)
+}
+
+type createSiteDbStub struct {
+	databaseServiceSiteItf // only methods below are used
+	deletedIdSite          int64
+}
+
+func (stub *createSiteDbStub) createSite(settings siteSettings, now time.Time) (*site, error) {
+	return &site{Id: 5, siteSettings: settings, DtCreated: now}, nil
+}
+
+func (stub *createSiteDbStub) deleteSite(idSite int64) ([]int64, error) {
+	stub.deletedIdSite = idSite
+	return []int64{2}, nil
+}
+
+func TestCreateSiteOwnerFailure(t *testing.T) {
+	authorizer := &siteOwnerAuthorizerStub{authorizer: newAuthorizer(nil, nil), failingIdUser: 3}
+	authorizer.assignUserRole(1, rbacRoleAdmin, rbacScopeGlobal, nil)
+	db := &createSiteDbStub{}
+	service := &siteService{userService: &requestUserStub{}, authorizer: authorizer, databaseServiceSite: db}
+	cookie := &http.Cookie{Name: sessionCookieName, Value: "x"}
+
+	_, err := service.createSite(cookie, siteSettings{Name: "Blog"}, []int64{2, 3})
+	if !errors.Is(err, errUserDoesntExist) {
+		t.Errorf("Owner assignment error not returned: %v", err)
+	}
+	if db.deletedIdSite != 5 {
+		t.Errorf("Site without owners was left behind")
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// implements spamClassifierItf and spamTrainerItf with heuristics and naive Bayes
+type localSpamClassifier struct {
+	databaseServiceSpam databaseServiceSpamItf
+}
+
+func newLocalSpamClassifier(databaseServiceSpam databaseServiceSpamItf) (*localSpamClassifier, error) {
+	if databaseServiceSpam == nil {
+		return nil, errors.New("local spam classifier needs database")
+	}
+	return &localSpamClassifier{databaseServiceSpam: databaseServiceSpam}, nil
+}
+
+// signals are independent probabilities, the result is the chance that at least one of them is right
+func combineSpamSignals(signals []float64) float64 {
+	notSpam := 1.0
+	for _, signal := range signals {
+		notSpam *= 1 - signal
+	}
+	return 1 - notSpam
+}
+
+func spamLinkSignal(commentBody string) float64 {
+	links := countSpamLinks(commentBody)
+	if links == 0 {
+		return 0
+	}
+	if links > spamLinksMax {
+		return 0.6
+	}
+	words := len(strings.Fields(commentBody))
+	if words <= links*5 { // mostly links
+		return 0.5
+	}
+	return 0.1 * float64(links)
+}
+
+// returns -1 if the classifier is not trained enough
+func spamBayesProbability(tokens []string, counts map[string]spamTokenCounts, totals spamTrainingTotals) float64 {
+	if totals.spamDocs == 0 || totals.hamDocs == 0 || totals.spamDocs+totals.hamDocs < spamBayesMinTrainingDocs {
+		return -1
+	}
+
+	logOdds := math.Log(float64(totals.spamDocs) / float64(totals.hamDocs))
+	for _, token := range tokens {
+		count, ok := counts[token]
+		if !ok || count.spam+count.ham == 0 {
+			continue // unknown tokens don't tell anything
+		}
+		// Laplace smoothing, so a token seen only in one class doesn't decide alone
+		pSpam := (float64(count.spam) + 1) / (float64(totals.spamDocs) + 2)
+		pHam := (float64(count.ham) + 1) / (float64(totals.hamDocs) + 2)
+		logOdds += math.Log(pSpam / pHam)
+	}
+	return 1 / (1 + math.Exp(-logOdds))
+}
+
+func (classifier *localSpamClassifier) classifyComment(request spamCheckRequest) (*spamVerdict, error) {
+	signals := make([]float64, 0, 4)
+	reasons := make([]string, 0)
+
+	if signal := spamLinkSignal(request.CommentBody); signal > 0 {
+		signals = append(signals, signal)
+		reasons = append(reasons, "links")
+	}
+
+	now := time.Now()
+	stats, err := classifier.databaseServiceSpam.getSpamAuthorStats(request.IdUser, request.CommentBody, now.Add(-spamRepeatedContentPeriod))
+	if err != nil {
+		return nil, err
+	}
+	if stats.sameBodyComments > 0 {
+		signals = append(signals, math.Min(0.3*float64(stats.sameBodyComments+1), 0.95))
+		reasons = append(reasons, "repeated content")
+	}
+	if stats.approvedComments == 0 && (stats.dtFirstComment == nil || now.Sub(*stats.dtFirstComment) < spamNewAuthorPeriod) {
+		signals = append(signals, 0.2)
+		reasons = append(reasons, "new author")
+	}
+
+	tokens := tokenizeForSpam(request.CommentBody)
+	if len(tokens) > 0 {
+		counts, totals, err := classifier.databaseServiceSpam.getSpamTokenCounts(tokens)
+		if err != nil {
+			return nil, err
+		}
+		probability := spamBayesProbability(tokens, counts, totals)
+		if probability > 0.5 {
+			signals = append(signals, probability)
+			reasons = append(reasons, "bayes")
+		}
+	}
+
+	score := combineSpamSignals(signals)
+	return &spamVerdict{Verdict: spamVerdictForScore(score), Score: score, Reasons: reasons}, nil
+}
+
+func (classifier *localSpamClassifier) trainSpam(commentBody string, spam bool) error {
+	tokens := tokenizeForSpam(commentBody)
+	if len(tokens) == 0 {
+		return nil
+	}
+	return classifier.databaseServiceSpam.trainSpamTokens(tokens, spam)
+}
+
+// implements spamClassifierItf by asking external service
+type webhookSpamClassifier struct {
+	webhookUrl string
+	httpClient *http.Client
+}
+
+func newWebhookSpamClassifier(webhookUrl string, httpClient *http.Client) (*webhookSpamClassifier, error) {
+	parsedUrl, err := url.Parse(webhookUrl)
+	if err != nil || (parsedUrl.Scheme != "https" && parsedUrl.Scheme != "http") || parsedUrl.Host == "" {
+		return nil, errors.New("bad webhookUrl value")
+	}
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: spamWebhookTimeout}
+	}
+	return &webhookSpamClassifier{webhookUrl: webhookUrl, httpClient: httpClient}, nil
+}
+
+func (classifier *webhookSpamClassifier) classifyComment(request spamCheckRequest) (*spamVerdict, error) {
+	requestJson, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+	httpRequest, err := http.NewRequest(http.MethodPost, classifier.webhookUrl, bytes.NewReader(requestJson))
+	if err != nil {
+		return nil, err
+	}
+	httpRequest.Header.Set("Content-Type", "application/json")
+	httpRequest.Header.Set("Accept", "application/json")
+
+	response, err := classifier.httpClient.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(response.Body, spamWebhookResponseMaxLen))
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s responded with status %d: %s", classifier.webhookUrl, response.StatusCode, body)
+	}
+
+	var verdict spamVerdict
+	err = json.Unmarshal(body, &verdict)
+	if err != nil {
+		return nil, err
+	}
+	if verdict.Score < 0 || verdict.Score > 1 || math.IsNaN(verdict.Score) {
+		return nil, fmt.Errorf("%s responded with bad score %v", classifier.webhookUrl, verdict.Score)
+	}
+	if verdict.Verdict == "" {
+		verdict.Verdict = spamVerdictForScore(verdict.Score)
+	}
+	if !validateSpamVerdict(verdict.Verdict) {
+		return nil, fmt.Errorf("%s responded with bad verdict %q", classifier.webhookUrl, verdict.Verdict)
+	}
+	return &verdict, nil
+}
+
+// implements spamClassifierItf, the most severe verdict and the highest score win.
+// Failing classifiers are skipped, spam check must not stop people from commenting.
+type spamClassifierChain struct {
+	classifiers []spamClassifierItf
+}
+
+func newSpamClassifierChain(classifiers ...spamClassifierItf) *spamClassifierChain {
+	return &spamClassifierChain{classifiers: classifiers}
+}
+
+func (chain *spamClassifierChain) classifyComment(request spamCheckRequest) (*spamVerdict, error) {
+	result := &spamVerdict{Verdict: spamVerdictAllow, Reasons: make([]string, 0)}
+	for _, classifier := range chain.classifiers {
+		verdict, err := classifier.classifyComment(request)
+		if err != nil {
+			slog.Error("Spam classifier failed", slog.Int64("idUser", request.IdUser), slog.Any("error", err))
+			continue
+		}
+		if spamVerdictSeverity(verdict.Verdict) > spamVerdictSeverity(result.Verdict) {
+			result.Verdict = verdict.Verdict
+		}
+		result.Score = math.Max(result.Score, verdict.Score)
+		result.Reasons = append(result.Reasons, verdict.Reasons...)
+	}
+	return result, nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	spamVerdictAllow  string = "allow"
+	spamVerdictHold   string = "hold" // comment waits in moderation queue
+	spamVerdictReject string = "reject"
+
+	spamScoreHold   float64 = 0.5
+	spamScoreReject float64 = 0.9
+
+	spamLinksMax              int           = 3
+	spamRepeatedContentPeriod time.Duration = 24 * time.Hour
+	spamNewAuthorPeriod       time.Duration = 24 * time.Hour
+	spamBayesMinTrainingDocs  int64         = 20 // classifier is not used before it has seen enough decisions
+	spamTokensMax             int           = 200
+	spamTokenMinLen           int           = 2
+	spamTokenMaxLen           int           = 40
+
+	spamWebhookTimeout        time.Duration = 5 * time.Second
+	spamWebhookResponseMaxLen int64         = 4096
+)
+
+// sent to webhook classifiers as JSON
+type spamCheckRequest struct {
+	IdUser      int64  `json:"idUser"`
+	Username    string `json:"username"`
+	UrlHash     string `json:"urlHash"`
+	IdParent    *int64 `json:"idParent"`
+	CommentBody string `json:"commentBody"`
+	Ip          string `json:"ip"`
+	UserAgent   string `json:"userAgent"`
+}
+
+// also the response expected from webhook classifiers, empty verdict is derived from the score
+type spamVerdict struct {
+	Verdict string   `json:"verdict"`
+	Score   float64  `json:"score"` // 0 is ham, 1 is spam
+	Reasons []string `json:"reasons"`
+}
+
+type spamClassifierItf interface {
+	classifyComment(request spamCheckRequest) (*spamVerdict, error)
+}
+
+// moderator decisions are fed back to the classifier
+type spamTrainerItf interface {
+	trainSpam(commentBody string, spam bool) error
+}
+
+type spamAuthorStats struct {
+	approvedComments int64
+	dtFirstComment   *time.Time // nil if the author has no comments yet
+	sameBodyComments int64      // comments with the same body since the given time
+}
+
+type spamTokenCounts struct {
+	spam int64
+	ham  int64
+}
+
+type spamTrainingTotals struct {
+	spamDocs int64
+	hamDocs  int64
+}
+
+func spamVerdictForScore(score float64) string {
+	switch {
+	case score >= spamScoreReject:
+		return spamVerdictReject
+	case score >= spamScoreHold:
+		return spamVerdictHold
+	}
+	return spamVerdictAllow
+}
+
+func spamVerdictSeverity(verdict string) int {
+	switch verdict {
+	case spamVerdictReject:
+		return 2
+	case spamVerdictHold:
+		return 1
+	}
+	return 0
+}
+
+func validateSpamVerdict(verdict string) bool {
+	return verdict == spamVerdictAllow || verdict == spamVerdictHold || verdict == spamVerdictReject
+}
+
+var spamLinkRegex = regexp.MustCompile(`(?i)(https?://|www\.)[^\s]+`)
+var spamTokenRegex = regexp.MustCompile(`[\p{L}\p{N}]+`)
+
+func countSpamLinks(commentBody string) int {
+	return len(spamLinkRegex.FindAllStringIndex(commentBody, -1))
+}
+
+// unique lowercase words, links are reduced to their host so that the domain is learned
+func tokenizeForSpam(commentBody string) []string {
+	seen := make(map[string]bool)
+	tokens := make([]string, 0)
+	add := func(token string) {
+		if len(tokens) >= spamTokensMax || seen[token] || len(token) < spamTokenMinLen || len(token) > spamTokenMaxLen {
+			return
+		}
+		seen[token] = true
+		tokens = append(tokens, token)
+	}
+
+	for _, link := range spamLinkRegex.FindAllString(commentBody, -1) {
+		host := strings.ToLower(link)
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "http://"), "https://")
+		host, _, _ = strings.Cut(host, "/")
+		add("host:" + host)
+	}
+	for _, word := range spamTokenRegex.FindAllString(strings.ToLower(spamLinkRegex.ReplaceAllString(commentBody, " ")), -1) {
+		add(word)
+	}
+	return tokens
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type spamDbStub struct {
+	stats  spamAuthorStats
+	counts map[string]spamTokenCounts
+	totals spamTrainingTotals
+}
+
+func (stub *spamDbStub) getSpamAuthorStats(idUser int64, commentBody string, since time.Time) (*spamAuthorStats, error) {
+	stats := stub.stats
+	return &stats, nil
+}
+
+func (stub *spamDbStub) getSpamTokenCounts(tokens []string) (map[string]spamTokenCounts, spamTrainingTotals, error) {
+	return stub.counts, stub.totals, nil
+}
+
+func (stub *spamDbStub) trainSpamTokens(tokens []string, spam bool) error {
+	for _, token := range tokens {
+		count := stub.counts[token]
+		if spam {
+			count.spam++
+		} else {
+			count.ham++
+		}
+		stub.counts[token] = count
+	}
+	if spam {
+		stub.totals.spamDocs++
+	} else {
+		stub.totals.hamDocs++
+	}
+	return nil
+}
+
+func TestTokenizeForSpam(t *testing.T) {
+	tokens := tokenizeForSpam("Cheap PILLS cheap pills at https://Pills.example.com/buy?x=1 now")
+	want := []string{"host:pills.example.com", "cheap", "pills", "at", "now"}
+	if strings.Join(tokens, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v want %v", tokens, want)
+	}
+}
+
+func TestLocalSpamClassifier(t *testing.T) {
+	if _, err := newLocalSpamClassifier(nil); err == nil {
+		t.Errorf("Classifier without database accepted")
+	}
+	dtFirstComment := time.Now().Add(-30 * 24 * time.Hour)
+	stub := &spamDbStub{stats: spamAuthorStats{approvedComments: 10, dtFirstComment: &dtFirstComment}, counts: make(map[string]spamTokenCounts)}
+	classifier, _ := newLocalSpamClassifier(stub)
+
+	verdict, err := classifier.classifyComment(spamCheckRequest{IdUser: 1, CommentBody: "I agree with the article, well written."})
+	if err != nil || verdict.Verdict != spamVerdictAllow {
+		t.Errorf("Plain comment of known author should be allowed: %+v %v", verdict, err)
+	}
+
+	stub.stats = spamAuthorStats{}
+	linkSpam := "http://a.example http://b.example http://c.example http://d.example"
+	verdict, _ = classifier.classifyComment(spamCheckRequest{IdUser: 2, CommentBody: linkSpam})
+	if verdict.Verdict != spamVerdictHold {
+		t.Errorf("Links of new author should be held: %+v", verdict)
+	}
+
+	stub.stats.sameBodyComments = 3
+	verdict, _ = classifier.classifyComment(spamCheckRequest{IdUser: 2, CommentBody: linkSpam})
+	if verdict.Verdict != spamVerdictReject {
+		t.Errorf("Repeated link spam should be rejected: %+v", verdict)
+	}
+}
+
+func TestSpamBayes(t *testing.T) {
+	stub := &spamDbStub{stats: spamAuthorStats{approvedComments: 1}, counts: make(map[string]spamTokenCounts)}
+	classifier, _ := newLocalSpamClassifier(stub)
+
+	spamBody := "buy cheap casino bonus now"
+	if got := spamBayesProbability(tokenizeForSpam(spamBody), stub.counts, stub.totals); got != -1 {
+		t.Errorf("Untrained classifier should not be used, got %v", got)
+	}
+	for i := 0; i < int(spamBayesMinTrainingDocs); i++ {
+		classifier.trainSpam("casino bonus for everyone, buy now", true)
+		classifier.trainSpam("thanks for the interesting article about gardening", false)
+	}
+
+	verdict, _ := classifier.classifyComment(spamCheckRequest{IdUser: 1, CommentBody: spamBody})
+	if verdict.Verdict == spamVerdictAllow {
+		t.Errorf("Trained spam should not be allowed: %+v", verdict)
+	}
+	verdict, _ = classifier.classifyComment(spamCheckRequest{IdUser: 1, CommentBody: "interesting article about gardening"})
+	if verdict.Verdict != spamVerdictAllow {
+		t.Errorf("Trained ham should be allowed: %+v", verdict)
+	}
+}
+
+type failingSpamClassifier struct{}
+
+func (classifier failingSpamClassifier) classifyComment(request spamCheckRequest) (*spamVerdict, error) {
+	return nil, errors.New("down")
+}
+
+func TestWebhookSpamClassifierChain(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request spamCheckRequest
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		score := 0.1
+		if strings.Contains(request.CommentBody, "casino") {
+			score = 0.7
+		}
+		json.NewEncoder(w).Encode(spamVerdict{Score: score, Reasons: []string{"webhook"}})
+	}))
+	defer server.Close()
+
+	if _, err := newWebhookSpamClassifier("ftp://example.com", nil); err == nil {
+		t.Errorf("Bad webhook URL accepted")
+	}
+	webhook, err := newWebhookSpamClassifier(server.URL, server.Client())
+	if err != nil {
+		t.Fatal(err)
+	}
+	chain := newSpamClassifierChain(failingSpamClassifier{}, webhook)
+
+	verdict, err := chain.classifyComment(spamCheckRequest{CommentBody: "casino"})
+	if err != nil || verdict.Verdict != spamVerdictHold || verdict.Score != 0.7 {
+		t.Errorf("Webhook verdict expected: %+v %v", verdict, err)
+	}
+	verdict, _ = chain.classifyComment(spamCheckRequest{CommentBody: "hello"})
+	if verdict.Verdict != spamVerdictAllow {
+		t.Errorf("Ham expected: %+v", verdict)
+	}
+}
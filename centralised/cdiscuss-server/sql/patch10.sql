@@ -0,0 +1,14 @@
+ALTER TABLE users ADD COLUMN email VARCHAR(254);
+
+CREATE TABLE password_reset_tokens (
+  token_hash CHAR(64) PRIMARY KEY NOT NULL, -- sha256
+  id_user BIGINT NOT NULL,
+  dt_expires TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_password_reset_token_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE INDEX idx_password_reset_tokens_id_user ON password_reset_tokens (id_user);
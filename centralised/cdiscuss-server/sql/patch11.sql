@@ -0,0 +1,15 @@
+CREATE TABLE username_history (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  username VARCHAR(50) NOT NULL, -- old username
+  dt_changed TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_reclaimable TIMESTAMP WITHOUT TIME ZONE NOT NULL, -- other users can't take the name before
+
+ CONSTRAINT fk_username_history_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE INDEX idx_username_history_username ON username_history (username);
+CREATE INDEX idx_username_history_id_user ON username_history (id_user);
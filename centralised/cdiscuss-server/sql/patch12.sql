@@ -0,0 +1,17 @@
+ALTER TABLE users ADD COLUMN display_name VARCHAR(50) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN bio VARCHAR(500) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN website VARCHAR(200) NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN avatar_version BIGINT NOT NULL DEFAULT 0; -- 0 means identicon
+
+CREATE TABLE user_avatars (
+  id_user BIGINT PRIMARY KEY NOT NULL,
+  image BYTEA NOT NULL, -- PNG
+  dt_updated TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_user_avatar_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE INDEX idx_comments_id_user ON comments (id_user, dt_created);
@@ -0,0 +1,21 @@
+CREATE TABLE data_exports (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  status VARCHAR(20) NOT NULL, -- pending, running, ready, failed
+  include_html BOOL NOT NULL DEFAULT FALSE,
+  dt_requested TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_started TIMESTAMP WITHOUT TIME ZONE,
+  dt_finished TIMESTAMP WITHOUT TIME ZONE,
+  dt_expires TIMESTAMP WITHOUT TIME ZONE,
+  archive BYTEA, -- zip
+
+ CONSTRAINT fk_data_export_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE INDEX idx_data_exports_id_user ON data_exports (id_user);
+CREATE INDEX idx_data_exports_status ON data_exports (status);
+-- one unfinished export per user
+CREATE UNIQUE INDEX uq_data_exports_unfinished ON data_exports (id_user) WHERE status IN ('pending', 'running');
@@ -0,0 +1,34 @@
+-- comments of anonymized accounts are moved to this user, it can't log in because pw_hash is not a sha256 hex string.
+-- Real account with the same name must be renamed first, it must not become the placeholder.
+ALTER TABLE users ADD COLUMN deleted_placeholder BOOL NOT NULL DEFAULT FALSE;
+CREATE UNIQUE INDEX uq_users_deleted_placeholder ON users (deleted_placeholder) WHERE deleted_placeholder;
+
+DO $$
+BEGIN
+  IF EXISTS (SELECT 1 FROM users WHERE username = 'deleted_user') THEN
+    RAISE EXCEPTION 'username deleted_user is taken, rename that user before applying the patch';
+  END IF;
+END;
+$$ LANGUAGE plpgsql;
+
+INSERT INTO users (username, salt, pw_hash, deleted_placeholder) VALUES ('deleted_user', '!!!!!!!!!!!!!!!!!!!!!', '!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!!', TRUE);
+
+CREATE TABLE account_deletions (
+  id_user BIGINT PRIMARY KEY NOT NULL,
+  mode VARCHAR(20) NOT NULL, -- anonymize, purge
+  dt_requested TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_execute TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  id_requested_by BIGINT, -- admin, NULL if the user requested it
+
+ CONSTRAINT fk_account_deletion_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE,
+
+ CONSTRAINT fk_account_deletion_requested_by
+   FOREIGN KEY(id_requested_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
+
+CREATE INDEX idx_account_deletions_dt_execute ON account_deletions (dt_execute);
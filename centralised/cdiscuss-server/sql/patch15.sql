@@ -0,0 +1,23 @@
+CREATE TABLE user_roles (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  role VARCHAR(20) NOT NULL, -- moderator, admin, superadmin
+  scope VARCHAR(80) NOT NULL DEFAULT '', -- '' global, site:<id> or page:<url hash>
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  id_granted_by BIGINT,
+
+ CONSTRAINT fk_user_role_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE,
+
+ CONSTRAINT fk_user_role_granted_by
+   FOREIGN KEY(id_granted_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
+
+CREATE UNIQUE INDEX uq_user_roles ON user_roles (id_user, role, scope);
+
+-- existing admins could do everything, including promoting other admins
+INSERT INTO user_roles (id_user, role, scope, dt_created) SELECT id, 'superadmin', '', NOW() FROM users WHERE admin_role;
@@ -0,0 +1,72 @@
+ALTER TABLE comments ADD COLUMN status VARCHAR(20) NOT NULL DEFAULT 'visible'; -- visible, hidden
+
+CREATE INDEX idx_comments_url_hash_status ON comments (url_hash, status);
+
+CREATE TABLE comment_reports (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_comment BIGINT NOT NULL,
+  id_reporter BIGINT NOT NULL,
+  reason VARCHAR(20) NOT NULL, -- spam, harassment, hate, offtopic, other
+  details TEXT NOT NULL DEFAULT '',
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_resolved TIMESTAMP WITHOUT TIME ZONE, -- NULL while the report is in moderation queue
+
+ CONSTRAINT fk_comment_report_comment
+   FOREIGN KEY(id_comment)
+   REFERENCES comments(id)
+   ON DELETE CASCADE,
+
+ CONSTRAINT fk_comment_report_reporter
+   FOREIGN KEY(id_reporter)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE UNIQUE INDEX uq_comment_reports_open ON comment_reports (id_comment, id_reporter) WHERE dt_resolved IS NULL;
+CREATE INDEX idx_comment_reports_open ON comment_reports (id_comment) WHERE dt_resolved IS NULL;
+
+-- kept after comment or moderator deletion, comment data is copied
+CREATE TABLE moderation_actions (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  action VARCHAR(20) NOT NULL, -- dismiss, hide, delete, ban
+  id_comment BIGINT,
+  url_hash CHAR(64) NOT NULL,
+  id_author BIGINT,
+  id_moderator BIGINT,
+  note TEXT NOT NULL DEFAULT '',
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_moderation_action_comment
+   FOREIGN KEY(id_comment)
+   REFERENCES comments(id)
+   ON DELETE SET NULL,
+
+ CONSTRAINT fk_moderation_action_author
+   FOREIGN KEY(id_author)
+   REFERENCES users(id)
+   ON DELETE SET NULL,
+
+ CONSTRAINT fk_moderation_action_moderator
+   FOREIGN KEY(id_moderator)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
+
+CREATE INDEX idx_moderation_actions_id_author ON moderation_actions (id_author);
+
+CREATE TABLE user_bans (
+  id_user BIGINT PRIMARY KEY NOT NULL,
+  id_banned_by BIGINT,
+  reason TEXT NOT NULL DEFAULT '',
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_user_ban_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE,
+
+ CONSTRAINT fk_user_ban_banned_by
+   FOREIGN KEY(id_banned_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
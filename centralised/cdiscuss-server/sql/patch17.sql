@@ -0,0 +1,15 @@
+-- comments.status can also be pending (waiting for approval) or rejected
+
+CREATE INDEX idx_comments_pending ON comments (id) WHERE status = 'pending';
+
+CREATE TABLE moderation_policies (
+  scope VARCHAR(80) PRIMARY KEY NOT NULL, -- '' global, site:<id> or page:<url hash>
+  policy VARCHAR(20) NOT NULL, -- open, first-post, all
+  dt_modified TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  id_modified_by BIGINT,
+
+ CONSTRAINT fk_moderation_policy_modified_by
+   FOREIGN KEY(id_modified_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
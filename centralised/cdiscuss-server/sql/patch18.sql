@@ -0,0 +1,7 @@
+ALTER TABLE user_bans ADD COLUMN kind VARCHAR(20) NOT NULL DEFAULT 'ban'; -- ban, suspension, shadow
+ALTER TABLE user_bans ADD COLUMN dt_expires TIMESTAMP WITHOUT TIME ZONE; -- only suspensions expire
+
+-- user actions (ban, suspend, shadowban, unban) are not tied to a comment
+ALTER TABLE moderation_actions ALTER COLUMN url_hash DROP NOT NULL;
+
+-- comments.status can also be shadow: comment of shadow-banned user, visible only to the author and moderators
@@ -0,0 +1,26 @@
+-- append-only, actor and target are not foreign keys so that entries outlive deleted users and comments
+CREATE TABLE audit_log (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  instance_id VARCHAR(64) NOT NULL,
+  id_actor BIGINT,
+  actor_username VARCHAR(50) NOT NULL DEFAULT '',
+  action VARCHAR(50) NOT NULL,
+  target_type VARCHAR(20) NOT NULL, -- user, comment, scope
+  target_id VARCHAR(80) NOT NULL,
+  before_state JSONB,
+  after_state JSONB
+);
+
+CREATE INDEX idx_audit_log_dt_created ON audit_log (dt_created);
+CREATE INDEX idx_audit_log_id_actor ON audit_log (id_actor);
+CREATE INDEX idx_audit_log_target ON audit_log (target_type, target_id);
+
+CREATE FUNCTION audit_log_append_only() RETURNS trigger AS $$
+BEGIN
+  RAISE EXCEPTION 'audit_log is append-only';
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER trg_audit_log_append_only BEFORE UPDATE OR DELETE OR TRUNCATE ON audit_log
+  FOR EACH STATEMENT EXECUTE FUNCTION audit_log_append_only();
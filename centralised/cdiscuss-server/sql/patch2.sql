@@ -0,0 +1,7 @@
+CREATE TABLE rate_limit_buckets (
+  bucket_key VARCHAR(200) PRIMARY KEY NOT NULL, -- operation:scope:key
+  tokens DOUBLE PRECISION NOT NULL,
+  dt_updated TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_rate_limit_buckets_dt_updated ON rate_limit_buckets (dt_updated);
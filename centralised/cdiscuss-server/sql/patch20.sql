@@ -0,0 +1,14 @@
+-- naive Bayes spam classifier, trained from moderator decisions
+CREATE TABLE spam_tokens (
+  token VARCHAR(40) PRIMARY KEY,
+  spam_count BIGINT NOT NULL DEFAULT 0,
+  ham_count BIGINT NOT NULL DEFAULT 0
+);
+
+CREATE TABLE spam_training_totals (
+  id SMALLINT PRIMARY KEY CHECK (id = 1), -- single row
+  spam_docs BIGINT NOT NULL DEFAULT 0,
+  ham_docs BIGINT NOT NULL DEFAULT 0
+);
+
+INSERT INTO spam_training_totals (id) VALUES (1);
@@ -0,0 +1,13 @@
+-- word filter and limits of comment bodies, usernames use only the global policy
+
+CREATE TABLE content_policies (
+  scope VARCHAR(80) PRIMARY KEY NOT NULL, -- '' global or site:<id>
+  policy JSONB NOT NULL, -- blocked terms, max links, max length
+  dt_modified TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  id_modified_by BIGINT,
+
+ CONSTRAINT fk_content_policy_modified_by
+   FOREIGN KEY(id_modified_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
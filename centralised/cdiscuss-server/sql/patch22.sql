@@ -0,0 +1,27 @@
+-- near-duplicate detection, normalized body hash and MinHash signature of word shingles
+
+CREATE TABLE comment_fingerprints (
+  id_comment BIGINT PRIMARY KEY NOT NULL,
+  id_user BIGINT NOT NULL,
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  body_hash CHAR(64) NOT NULL, -- sha256 of normalized body
+  signature BIGINT[] NOT NULL,
+  id_duplicate_of BIGINT, -- most similar earlier comment, shown in moderation queue
+  similarity REAL NOT NULL DEFAULT 0,
+
+ CONSTRAINT fk_comment_fingerprint_comment
+   FOREIGN KEY(id_comment)
+   REFERENCES comments(id)
+   ON DELETE CASCADE,
+ CONSTRAINT fk_comment_fingerprint_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE,
+ CONSTRAINT fk_comment_fingerprint_duplicate_of
+   FOREIGN KEY(id_duplicate_of)
+   REFERENCES comments(id)
+   ON DELETE SET NULL
+);
+
+CREATE INDEX idx_comment_fingerprints_dt_created ON comment_fingerprints (dt_created);
+CREATE INDEX idx_comment_fingerprints_id_user ON comment_fingerprints (id_user, dt_created);
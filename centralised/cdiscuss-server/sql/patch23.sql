@@ -0,0 +1,26 @@
+-- multi-tenant sites, comments that existed before belong to the default site with id 1
+
+CREATE TABLE sites (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  name VARCHAR(100) NOT NULL,
+  allowed_origins VARCHAR(300)[] NOT NULL DEFAULT '{}', -- normalized scheme://host[:port]
+  pow_required BOOL NOT NULL DEFAULT TRUE,
+  pow_hardnes INTEGER NOT NULL DEFAULT 16,
+  styling JSONB NOT NULL DEFAULT '{}',
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_sites_allowed_origins ON sites USING GIN (allowed_origins);
+
+INSERT INTO sites (name, dt_created) VALUES ('default', NOW());
+
+ALTER TABLE comments ADD COLUMN id_site BIGINT;
+UPDATE comments SET id_site = 1;
+ALTER TABLE comments ALTER COLUMN id_site SET NOT NULL;
+ALTER TABLE comments ADD CONSTRAINT fk_comment_site FOREIGN KEY(id_site) REFERENCES sites(id) ON DELETE CASCADE;
+
+DROP INDEX idx_comments_url_hash;
+DROP INDEX idx_comments_url_hash_status;
+CREATE INDEX idx_comments_site_url_hash_status ON comments (id_site, url_hash, status);
+
+-- owners are users with admin role in site:<id> scope, see user_roles
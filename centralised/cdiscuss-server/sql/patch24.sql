@@ -0,0 +1,18 @@
+-- pages registered by the embed, url_hash is sha256 of the canonical URL
+
+ALTER TABLE sites ADD COLUMN url_rules JSONB NOT NULL DEFAULT '{}';
+
+CREATE TABLE pages (
+  id_site BIGINT NOT NULL,
+  url_hash CHAR(64) NOT NULL, -- sha256
+  canonical_url VARCHAR(2000) NOT NULL,
+  title VARCHAR(300) NOT NULL DEFAULT '',
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_modified TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ PRIMARY KEY (id_site, url_hash),
+ CONSTRAINT fk_page_site
+   FOREIGN KEY(id_site)
+   REFERENCES sites(id)
+   ON DELETE CASCADE
+);
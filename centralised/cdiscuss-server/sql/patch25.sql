@@ -0,0 +1,20 @@
+-- discussion state of pages, pages without a row are open
+
+CREATE TABLE page_discussion_states (
+  id_site BIGINT NOT NULL,
+  url_hash CHAR(64) NOT NULL, -- sha256
+  state VARCHAR(20) NOT NULL, -- roots-locked, locked or archived
+  reason VARCHAR(1000) NOT NULL DEFAULT '', -- shown to readers
+  id_modified_by BIGINT,
+  dt_modified TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ PRIMARY KEY (id_site, url_hash),
+ CONSTRAINT fk_page_discussion_state_site
+   FOREIGN KEY(id_site)
+   REFERENCES sites(id)
+   ON DELETE CASCADE,
+ CONSTRAINT fk_page_discussion_state_modified_by
+   FOREIGN KEY(id_modified_by)
+   REFERENCES users(id)
+   ON DELETE SET NULL
+);
@@ -0,0 +1,4 @@
+-- status of shadow comment before the shadow-ban (visible or pending), restored when the shadow-ban ends
+ALTER TABLE comments ADD COLUMN status_before_shadow VARCHAR(20);
+
+UPDATE comments SET status_before_shadow = 'visible' WHERE status = 'shadow';
@@ -0,0 +1,7 @@
+CREATE TABLE login_failures (
+  failure_key VARCHAR(100) PRIMARY KEY NOT NULL, -- scope:username or scope:ip
+  failed_count INT NOT NULL,
+  dt_last_failure TIMESTAMP WITHOUT TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_login_failures_dt_last_failure ON login_failures (dt_last_failure);
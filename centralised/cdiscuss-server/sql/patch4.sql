@@ -0,0 +1,26 @@
+ALTER TABLE users ADD COLUMN totp_secret VARCHAR(64);
+ALTER TABLE users ADD COLUMN totp_enabled BOOL NOT NULL DEFAULT FALSE;
+ALTER TABLE users ADD COLUMN totp_last_counter BIGINT NOT NULL DEFAULT 0;
+
+CREATE TABLE user_recovery_codes (
+  id_user BIGINT NOT NULL,
+  code_hash CHAR(64) NOT NULL, -- sha256
+
+  PRIMARY KEY (id_user, code_hash),
+
+ CONSTRAINT fk_recovery_code_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE TABLE two_factor_tickets (
+  ticket_hash CHAR(64) PRIMARY KEY NOT NULL, -- sha256
+  id_user BIGINT NOT NULL,
+  dt_expires TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_two_factor_ticket_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
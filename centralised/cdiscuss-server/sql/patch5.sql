@@ -0,0 +1,29 @@
+CREATE TABLE webauthn_challenges (
+  challenge_hash CHAR(64) PRIMARY KEY NOT NULL, -- sha256
+  kind VARCHAR(20) NOT NULL, -- registration or login
+  id_user BIGINT, -- null for login, user is not known yet
+  dt_expires TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_webauthn_challenge_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE TABLE webauthn_credentials (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  credential_id BYTEA UNIQUE NOT NULL,
+  public_key BYTEA NOT NULL, -- COSE key
+  sign_count BIGINT NOT NULL DEFAULT 0,
+  name VARCHAR(100) NOT NULL,
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_last_used TIMESTAMP WITHOUT TIME ZONE,
+
+ CONSTRAINT fk_webauthn_credential_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE -- if account is deleted, than also drop all of user passkeys
+);
+
+CREATE INDEX idx_webauthn_credentials_id_user ON webauthn_credentials (id_user);
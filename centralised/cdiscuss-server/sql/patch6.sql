@@ -0,0 +1,7 @@
+ALTER TABLE user_seassions ADD COLUMN id BIGINT UNIQUE GENERATED ALWAYS AS IDENTITY;
+ALTER TABLE user_seassions ADD COLUMN dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC');
+ALTER TABLE user_seassions ADD COLUMN dt_last_seen TIMESTAMP WITHOUT TIME ZONE NOT NULL DEFAULT (NOW() AT TIME ZONE 'UTC');
+ALTER TABLE user_seassions ADD COLUMN user_agent VARCHAR(500) NOT NULL DEFAULT '';
+ALTER TABLE user_seassions ADD COLUMN ip VARCHAR(45) NOT NULL DEFAULT '';
+
+CREATE INDEX idx_user_seassions_id_user ON user_seassions (id_user);
@@ -0,0 +1,4 @@
+ALTER TABLE user_seassions ADD COLUMN dt_issued TIMESTAMP WITHOUT TIME ZONE;
+UPDATE user_seassions SET dt_issued = dt_created;
+ALTER TABLE user_seassions ALTER COLUMN dt_issued SET NOT NULL;
+ALTER TABLE user_seassions ADD COLUMN rotated BOOL NOT NULL DEFAULT FALSE;
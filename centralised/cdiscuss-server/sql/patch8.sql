@@ -0,0 +1,16 @@
+CREATE TABLE api_tokens (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  token_hash CHAR(64) UNIQUE NOT NULL, -- sha256
+  name VARCHAR(100) NOT NULL,
+  scopes TEXT[] NOT NULL,
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+  dt_last_used TIMESTAMP WITHOUT TIME ZONE,
+
+ CONSTRAINT fk_api_token_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE -- tokens die with the account
+);
+
+CREATE INDEX idx_api_tokens_id_user ON api_tokens (id_user);
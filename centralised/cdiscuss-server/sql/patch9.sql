@@ -0,0 +1,28 @@
+CREATE TABLE oidc_auth_requests (
+  state_hash CHAR(64) PRIMARY KEY NOT NULL, -- sha256
+  nonce VARCHAR(100) NOT NULL,
+  code_verifier VARCHAR(128) NOT NULL,
+  id_user BIGINT, -- set when linking external account to logged in user
+  dt_expires TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT fk_oidc_auth_request_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE TABLE user_external_identities (
+  id BIGINT PRIMARY KEY GENERATED ALWAYS AS IDENTITY,
+  id_user BIGINT NOT NULL,
+  issuer VARCHAR(500) NOT NULL,
+  subject VARCHAR(255) NOT NULL,
+  dt_created TIMESTAMP WITHOUT TIME ZONE NOT NULL,
+
+ CONSTRAINT uq_user_external_identity UNIQUE (issuer, subject),
+ CONSTRAINT fk_user_external_identity_user
+   FOREIGN KEY(id_user)
+   REFERENCES users(id)
+   ON DELETE CASCADE
+);
+
+CREATE INDEX idx_user_external_identities_id_user ON user_external_identities (id_user);
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer          string        = "cDiscuss"
+	totpSecretLen       int           = 20 // 160 bits as recommended by RFC 4226
+	totpDigits          int           = 6
+	totpPeriod          time.Duration = 30 * time.Second
+	totpAllowedSkew     int64         = 1 // periods before and after current one
+	recoveryCodesCount  int           = 10
+	recoveryCodeLen     int           = 10
+	recoveryCodeChars   string        = "abcdefghjkmnpqrstuvwxyz23456789" // no look alike chars
+	twoFactorTicketAge  time.Duration = 5 * time.Minute
+	twoFactorCookieName string        = "CDLOGIN2FA"
+)
+
+var totpBase32 = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func generateTotpSecret() (string, error) {
+	secret := make([]byte, totpSecretLen)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return totpBase32.EncodeToString(secret), nil
+}
+
+func decodeTotpSecret(secret string) ([]byte, error) {
+	return totpBase32.DecodeString(strings.ToUpper(strings.ReplaceAll(secret, " ", "")))
+}
+
+// otpauth URI understood by authenticator apps (usually shown as a QR code)
+func totpUri(username string, secret string) string {
+	label := url.PathEscape(totpIssuer + ":" + username)
+	values := url.Values{}
+	values.Set("secret", secret)
+	values.Set("issuer", totpIssuer)
+	values.Set("algorithm", "SHA1")
+	values.Set("digits", fmt.Sprint(totpDigits))
+	values.Set("period", fmt.Sprint(int64(totpPeriod.Seconds())))
+	return "otpauth://totp/" + label + "?" + values.Encode()
+}
+
+func totpCounter(now time.Time) int64 {
+	return now.Unix() / int64(totpPeriod.Seconds())
+}
+
+// HOTP value as defined in RFC 4226
+func hotpCode(secret []byte, counter int64, digits int) string {
+	var counterBytes [8]byte
+	binary.BigEndian.PutUint64(counterBytes[:], uint64(counter))
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(counterBytes[:])
+	sum := mac.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+
+	modulo := uint32(1)
+	for i := 0; i < digits; i++ {
+		modulo *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, value%modulo)
+}
+
+// Checks code against current period and allowed skew. Codes of periods up to lastUsedCounter
+// are rejected so that one code can't be replayed. Returns matched counter.
+func validateTotpCode(secret string, code string, now time.Time, lastUsedCounter int64) (int64, bool) {
+	secretBytes, err := decodeTotpSecret(secret)
+	if err != nil || len(code) != totpDigits {
+		return 0, false
+	}
+
+	currentCounter := totpCounter(now)
+	for counter := currentCounter - totpAllowedSkew; counter <= currentCounter+totpAllowedSkew; counter++ {
+		if counter <= lastUsedCounter {
+			continue
+		}
+		expected := hotpCode(secretBytes, counter, totpDigits)
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) == 1 {
+			return counter, true
+		}
+	}
+	return 0, false
+}
+
+// bytes above the largest multiple of the alphabet size are skipped, so every char is equally likely
+func generateRecoveryCode() (string, error) {
+	ll := len(recoveryCodeChars)
+	limit := 256 - 256%ll
+	code := make([]byte, 0, recoveryCodeLen)
+	b := make([]byte, recoveryCodeLen)
+	for len(code) < recoveryCodeLen {
+		_, err := rand.Read(b)
+		if err != nil {
+			return "", err
+		}
+		for i := 0; i < len(b) && len(code) < recoveryCodeLen; i++ {
+			if int(b[i]) < limit {
+				code = append(code, recoveryCodeChars[int(b[i])%ll])
+			}
+		}
+	}
+	return string(code[:recoveryCodeLen/2]) + "-" + string(code[recoveryCodeLen/2:]), nil
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimSpace(code), " ", ""))
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// test vectors from RFC 6238 appendix B (SHA1)
+func TestHotpCode(t *testing.T) {
+	secret := []byte("12345678901234567890")
+	vectors := map[int64]string{59: "94287082", 1111111109: "07081804", 1234567890: "89005924", 2000000000: "69279037"}
+
+	for unixTime, expected := range vectors {
+		code := hotpCode(secret, totpCounter(time.Unix(unixTime, 0)), 8)
+		if code != expected {
+			t.Errorf("Wrong code for time %d: %s", unixTime, code)
+		}
+	}
+}
+
+func TestValidateTotpCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	now := time.Unix(59, 0)
+
+	counter, ok := validateTotpCode(secret, "287082", now, 0)
+	if !ok {
+		t.Fatalf("Valid code was rejected")
+	}
+	if _, ok := validateTotpCode(secret, "287082", now, counter); ok {
+		t.Errorf("Replayed code was accepted")
+	}
+	if _, ok := validateTotpCode(secret, "287082", now.Add(time.Hour), 0); ok {
+		t.Errorf("Outdated code was accepted")
+	}
+	if _, ok := validateTotpCode(secret, "000000", now, 0); ok {
+		t.Errorf("Wrong code was accepted")
+	}
+}
+
+func TestTotpUri(t *testing.T) {
+	uri := totpUri("adam", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/cDiscuss:adam?") {
+		t.Errorf("Wrong URI prefix: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=cDiscuss") {
+		t.Errorf("URI is missing parameters: %s", uri)
+	}
+}
+
+func TestGenerateRecoveryCode(t *testing.T) {
+	code, err := generateRecoveryCode()
+	if err != nil {
+		t.Fatalf("Recovery code error: %v", err)
+	}
+	if len(code) != recoveryCodeLen+1 || code[recoveryCodeLen/2] != '-' {
+		t.Errorf("Wrong recovery code format: %s", code)
+	}
+	for _, c := range strings.ReplaceAll(code, "-", "") {
+		if !strings.ContainsRune(recoveryCodeChars, c) {
+			t.Errorf("Recovery code %s has char outside of alphabet", code)
+		}
+	}
+}
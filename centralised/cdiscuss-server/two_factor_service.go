@@ -0,0 +1,263 @@
+package main
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+type twoFactorService struct {
+	userService              userServiceItf
+	sessionStore             sessionStoreItf
+	databaseServiceTwoFactor databaseServiceTwoFactorItf
+
+	stopWorkerChan              chan bool
+	deleteOutdatedTicketsTicker *time.Ticker
+}
+
+func newTwoFactorService(userService userServiceItf, sessionStore sessionStoreItf, databaseServiceTwoFactor databaseServiceTwoFactorItf,
+	deleteOutdatedTicketsPeriod time.Duration) (*twoFactorService, error) {
+	if databaseServiceTwoFactor == nil {
+		return nil, errors.New("two factor service needs database")
+	}
+	if deleteOutdatedTicketsPeriod < 1 {
+		return nil, errors.New("bad deleteOutdatedTicketsPeriod value")
+	}
+
+	service := &twoFactorService{userService: userService, sessionStore: sessionStore, databaseServiceTwoFactor: databaseServiceTwoFactor}
+	service.stopWorkerChan = make(chan bool)
+	service.deleteOutdatedTicketsTicker = time.NewTicker(deleteOutdatedTicketsPeriod)
+
+	go service.deleteOutdatedTicketsLoopWorker()
+
+	return service, nil
+}
+
+func (service *twoFactorService) deleteOutdatedTicketsLoopWorker() {
+	for {
+		select {
+		case <-service.stopWorkerChan:
+			return
+		case <-service.deleteOutdatedTicketsTicker.C:
+			err := service.databaseServiceTwoFactor.deleteTwoFactorTicketsThatExpired(time.Now())
+			if err != nil {
+				slog.Error("Deleting outdated 2FA login tickets from DB:", slog.Any("error", err))
+			}
+		}
+	}
+}
+
+func (service *twoFactorService) stop() {
+	service.deleteOutdatedTicketsTicker.Stop()
+
+	select {
+	case service.stopWorkerChan <- true:
+	default:
+		slog.Error("can't stop twoFactorService instance")
+	}
+}
+
+func (service *twoFactorService) beginTotpEnrolment(sessionCookie *http.Cookie) (*totpEnrolment, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	if user.TwoFactorEnabled {
+		return nil, errTwoFactorAlreadyEnabled
+	}
+
+	secret, err := generateTotpSecret()
+	if err != nil {
+		return nil, err
+	}
+	err = service.databaseServiceTwoFactor.setUserTotpSecret(user.Id, secret)
+	if err != nil {
+		return nil, err
+	}
+	return &totpEnrolment{Secret: secret, Uri: totpUri(user.Username, secret)}, nil
+}
+
+func (service *twoFactorService) generateRecoveryCodes() ([]string, []string, error) {
+	codes := make([]string, 0, recoveryCodesCount)
+	codeHashes := make([]string, 0, recoveryCodesCount)
+	for i := 0; i < recoveryCodesCount; i++ {
+		code, err := generateRecoveryCode()
+		if err != nil {
+			return nil, nil, err
+		}
+		codeHash, err := calculateTokenHash(normalizeRecoveryCode(code))
+		if err != nil {
+			return nil, nil, err
+		}
+		codes = append(codes, code)
+		codeHashes = append(codeHashes, codeHash)
+	}
+	return codes, codeHashes, nil
+}
+
+func (service *twoFactorService) confirmTotpEnrolment(sessionCookie *http.Cookie, code string) ([]string, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+
+	totp, err := service.databaseServiceTwoFactor.getUserTotp(user.Id)
+	if err != nil {
+		return nil, err
+	}
+	if totp.enabled {
+		return nil, errTwoFactorAlreadyEnabled
+	}
+	if totp.secret == "" {
+		return nil, errTwoFactorNotEnrolled
+	}
+
+	counter, ok := validateTotpCode(totp.secret, code, time.Now(), totp.lastCounter)
+	if !ok {
+		return nil, errTwoFactorWrongCode
+	}
+
+	codes, codeHashes, err := service.generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = service.databaseServiceTwoFactor.enableUserTotp(user.Id, counter, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+
+	err = service.sessionStore.forgetCachedUser(user.Id)
+	if err != nil {
+		slog.Error("Failed to forget cached user after enabling 2FA", slog.Int64("idUser", user.Id), slog.Any("error", err))
+	}
+	return codes, nil
+}
+
+func (service *twoFactorService) disableTotp(sessionCookie *http.Cookie, code string) error {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+	if !user.TwoFactorEnabled {
+		return errTwoFactorNotEnabled
+	}
+
+	err = service.verifySecondFactor(user.Id, code)
+	if err != nil {
+		return err
+	}
+	err = service.databaseServiceTwoFactor.disableUserTotp(user.Id)
+	if err != nil {
+		return err
+	}
+
+	err = service.sessionStore.forgetCachedUser(user.Id)
+	if err != nil {
+		slog.Error("Failed to forget cached user after disabling 2FA", slog.Int64("idUser", user.Id), slog.Any("error", err))
+	}
+	return nil
+}
+
+func (service *twoFactorService) regenerateRecoveryCodes(sessionCookie *http.Cookie, code string) ([]string, error) {
+	user, err := service.userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	if !user.TwoFactorEnabled {
+		return nil, errTwoFactorNotEnabled
+	}
+
+	err = service.verifySecondFactor(user.Id, code)
+	if err != nil {
+		return nil, err
+	}
+
+	codes, codeHashes, err := service.generateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	err = service.databaseServiceTwoFactor.replaceRecoveryCodes(user.Id, codeHashes)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func (service *twoFactorService) createLoginTicket(user *user) (string, time.Time, error) {
+	ticket := generateNewSessionToken()
+	ticketHash, err := calculateTokenHash(ticket)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+
+	expiresTime := time.Now().Add(twoFactorTicketAge)
+	err = service.databaseServiceTwoFactor.createTwoFactorTicket(ticketHash, user.Id, expiresTime)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	return ticket, expiresTime, nil
+}
+
+func (service *twoFactorService) getLoginTicketUser(ticket string) (*user, error) {
+	ticketHash, err := calculateTokenHash(ticket)
+	if err != nil {
+		return nil, errTwoFactorTicketNotValid
+	}
+
+	expiresTime, user, err := service.databaseServiceTwoFactor.getTwoFactorTicket(ticketHash)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil || isExpired(time.Now(), *expiresTime) {
+		return nil, errTwoFactorTicketNotValid
+	}
+	return user, nil
+}
+
+func (service *twoFactorService) deleteLoginTicket(ticket string) error {
+	ticketHash, err := calculateTokenHash(ticket)
+	if err != nil {
+		return err
+	}
+	return service.databaseServiceTwoFactor.deleteTwoFactorTicket(ticketHash)
+}
+
+func (service *twoFactorService) verifySecondFactor(idUser int64, code string) error {
+	totp, err := service.databaseServiceTwoFactor.getUserTotp(idUser)
+	if err != nil {
+		return err
+	}
+	if !totp.enabled {
+		return errTwoFactorNotEnabled
+	}
+
+	if len(code) == totpDigits {
+		counter, ok := validateTotpCode(totp.secret, code, time.Now(), totp.lastCounter)
+		if !ok {
+			return errTwoFactorWrongCode
+		}
+		// only one of concurrent requests with the same code can move the counter
+		ok, err = service.databaseServiceTwoFactor.updateUserTotpLastCounter(idUser, counter)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return errTwoFactorWrongCode
+		}
+		return nil
+	}
+
+	codeHash, err := calculateTokenHash(normalizeRecoveryCode(code))
+	if err != nil {
+		return errTwoFactorWrongCode
+	}
+	used, err := service.databaseServiceTwoFactor.useRecoveryCode(idUser, codeHash)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return errTwoFactorWrongCode
+	}
+	return nil
+}
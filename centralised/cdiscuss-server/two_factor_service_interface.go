@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+type totpEnrolment struct {
+	Secret string `json:"secret"`
+	Uri    string `json:"uri"` // otpauth URI for QR code
+}
+
+type twoFactorServiceItf interface {
+	// generates new TOTP secret, 2FA stays disabled until the enrolment is confirmed with a code
+	beginTotpEnrolment(sessionCookie *http.Cookie) (*totpEnrolment, error)
+	// enables 2FA and returns one-time recovery codes, they can be shown to the user only this time
+	confirmTotpEnrolment(sessionCookie *http.Cookie, code string) ([]string, error)
+	// code can be TOTP or recovery code
+	disableTotp(sessionCookie *http.Cookie, code string) error
+	regenerateRecoveryCodes(sessionCookie *http.Cookie, code string) ([]string, error)
+}
+
+// used by userService for the second login step
+type twoFactorVerifierItf interface {
+	createLoginTicket(user *user) (string, time.Time, error)
+	getLoginTicketUser(ticket string) (*user, error)
+	deleteLoginTicket(ticket string) error
+	// accepts TOTP or recovery code, recovery codes can be used only once
+	verifySecondFactor(idUser int64, code string) error
+}
+
+func validateTwoFactorCookie(ticketCookie *http.Cookie) (string, error) {
+	if ticketCookie == nil || ticketCookie.Name != twoFactorCookieName || ticketCookie.Value == "" {
+		return "", errTwoFactorTicketNotValid
+	}
+	return ticketCookie.Value, nil
+}
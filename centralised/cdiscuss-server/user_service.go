@@ -1,7 +1,10 @@
 package main
 
 import (
+	"errors"
+	"log/slog"
 	"net/http"
+	"strconv"
 	"time"
 )
 
@@ -10,15 +13,27 @@ type userService struct {
 	databaseServiceUser            databaseServiceUserItf
 	proofOfWorkConformation        proofOfWorkConformationItf
 	doRequireProofOfWorkInRequests bool
+	rateLimiter                    rateLimiterItf
+	loginGuard                     loginGuardItf
+	twoFactorVerifier              twoFactorVerifierItf
+	apiTokenAuthenticator          apiTokenAuthenticatorItf
+	banChecker                     banCheckerItf
+	usernameFilter                 usernameFilterItf
+	cookiePolicy                   cookiePolicy
 }
 
 func newUserService(sessionStore sessionStoreItf, databaseServiceUser databaseServiceUserItf,
-	proofOfWorkConformation proofOfWorkConformationItf, doRequireProofOfWorkInRequests bool) *userService {
+	proofOfWorkConformation proofOfWorkConformationItf, doRequireProofOfWorkInRequests bool, rateLimiter rateLimiterItf,
+	loginGuard loginGuardItf, twoFactorVerifier twoFactorVerifierItf, apiTokenAuthenticator apiTokenAuthenticatorItf,
+	banChecker banCheckerItf, usernameFilter usernameFilterItf, cookiePolicy cookiePolicy) *userService {
 	return &userService{sessionStore: sessionStore, databaseServiceUser: databaseServiceUser,
-		proofOfWorkConformation: proofOfWorkConformation, doRequireProofOfWorkInRequests: doRequireProofOfWorkInRequests}
+		proofOfWorkConformation: proofOfWorkConformation, doRequireProofOfWorkInRequests: doRequireProofOfWorkInRequests,
+		rateLimiter: rateLimiter, loginGuard: loginGuard, twoFactorVerifier: twoFactorVerifier,
+		apiTokenAuthenticator: apiTokenAuthenticator, banChecker: banChecker, usernameFilter: usernameFilter,
+		cookiePolicy: cookiePolicy}
 }
 
-func (userService *userService) login(powString, username string, password string) (*http.Cookie, *user, error) {
+func (userService *userService) login(client clientInfo, powString, username string, password string) (*http.Cookie, *user, error) {
 	err := validateUsername(username)
 	if err != nil {
 		return nil, nil, err
@@ -28,8 +43,22 @@ func (userService *userService) login(powString, username string, password strin
 		return nil, nil, err
 	}
 
+	if userService.rateLimiter != nil {
+		err = userService.rateLimiter.allow(rateLimitOpLogin, rateLimitKeys{client: client})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if userService.loginGuard != nil {
+		err = userService.loginGuard.checkLoginAllowed(username, client)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	if userService.doRequireProofOfWorkInRequests && userService.proofOfWorkConformation != nil {
-		err = userService.proofOfWorkConformation.isTokenAceptableStore(powString, proofOfWorkLoginRequiredHardnes, username)
+		err = userService.proofOfWorkConformation.isTokenAceptableStore(powString, userService.getLoginProofOfWorkRequiredHardnes(username), username)
 		if err != nil {
 			return nil, nil, err
 		}
@@ -37,18 +66,96 @@ func (userService *userService) login(powString, username string, password strin
 
 	user, err := userService.databaseServiceUser.authenticateUser(username, password)
 	if err != nil {
+		if userService.loginGuard != nil && (errors.Is(err, errUserWrongPassword) || errors.Is(err, errUserDoesntExist)) {
+			err2 := userService.loginGuard.loginFailed(username, client)
+			if err2 != nil {
+				slog.Error("Failed to register failed login", slog.String("username", username), slog.Any("error", err2))
+			}
+		}
 		return nil, nil, err
 	}
-	sessionToken, expiresTime, err := userService.sessionStore.newSession(user)
+
+	if user.TwoFactorEnabled && userService.twoFactorVerifier != nil {
+		ticket, expiresTime, err := userService.twoFactorVerifier.createLoginTicket(user)
+		if err != nil {
+			return nil, nil, err
+		}
+		ticketCookie := userService.cookiePolicy.newCookie(twoFactorCookieName, ticket, expiresTime)
+		return ticketCookie, nil, errTwoFactorRequired
+	}
+
+	return userService.startSession(user, client)
+}
+
+// banned and suspended users can't log in, shadow-banned can
+func (userService *userService) startSession(user *user, client clientInfo) (*http.Cookie, *user, error) {
+	if userService.banChecker != nil {
+		ban, err := userService.banChecker.getUserBan(user.Id)
+		if err != nil {
+			return nil, nil, err
+		}
+		err = userBanError(ban)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	if userService.loginGuard != nil {
+		err := userService.loginGuard.loginSucceeded(user.Username)
+		if err != nil {
+			slog.Error("Failed to forget failed logins", slog.String("username", user.Username), slog.Any("error", err))
+		}
+	}
+	sessionToken, expiresTime, err := userService.sessionStore.newSession(user, client)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	cookie := &http.Cookie{Name: sessionCookieName, Value: sessionToken, Expires: expiresTime}
+	cookie := userService.cookiePolicy.newCookie(sessionCookieName, sessionToken, expiresTime)
 
 	return cookie, user, nil
 }
 
+func (userService *userService) loginSecondFactor(client clientInfo, ticketCookie *http.Cookie, code string) (*http.Cookie, *user, error) {
+	ticket, err := validateTwoFactorCookie(ticketCookie)
+	if err != nil {
+		return nil, nil, err
+	}
+	if userService.twoFactorVerifier == nil {
+		return nil, nil, errTwoFactorTicketNotValid
+	}
+
+	user, err := userService.twoFactorVerifier.getLoginTicketUser(ticket)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if userService.loginGuard != nil {
+		err = userService.loginGuard.checkLoginAllowed(user.Username, client)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	err = userService.twoFactorVerifier.verifySecondFactor(user.Id, code)
+	if err != nil {
+		if userService.loginGuard != nil && errors.Is(err, errTwoFactorWrongCode) {
+			err2 := userService.loginGuard.loginFailed(user.Username, client)
+			if err2 != nil {
+				slog.Error("Failed to register failed login", slog.String("username", user.Username), slog.Any("error", err2))
+			}
+		}
+		return nil, nil, err
+	}
+
+	err = userService.twoFactorVerifier.deleteLoginTicket(ticket)
+	if err != nil {
+		slog.Error("Failed to delete 2FA login ticket", slog.Int64("idUser", user.Id), slog.Any("error", err))
+	}
+
+	return userService.startSession(user, client)
+}
+
 func (userService *userService) getSessionUser(sessionCookie *http.Cookie) (*user, error) {
 	sessionToken, err := validateSessionCookie(sessionCookie)
 	if err != nil {
@@ -57,6 +164,31 @@ func (userService *userService) getSessionUser(sessionCookie *http.Cookie) (*use
 	return userService.sessionStore.getUser(sessionToken)
 }
 
+func (userService *userService) getRequestUser(credential *http.Cookie, anyOfScopes ...string) (*user, error) {
+	if !isApiTokenCredential(credential) {
+		return userService.getSessionUser(credential)
+	}
+	if userService.apiTokenAuthenticator == nil || credential.Value == "" {
+		return nil, errApiTokenNotValid
+	}
+	return userService.apiTokenAuthenticator.authenticateApiToken(credential.Value, anyOfScopes...)
+}
+
+func (userService *userService) renewSessionCookie(sessionCookie *http.Cookie) (*http.Cookie, error) {
+	sessionToken, err := validateSessionCookie(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	sessionToken, expiresTime, err := userService.sessionStore.renewSession(sessionToken)
+	if err != nil {
+		return nil, err
+	}
+
+	cookie := userService.cookiePolicy.newCookie(sessionCookieName, sessionToken, expiresTime)
+
+	return cookie, nil
+}
+
 func (userService *userService) logout(sessionCookie *http.Cookie) (*http.Cookie, error) {
 	sessionToken, err := validateSessionCookie(sessionCookie)
 	if err != nil {
@@ -67,14 +199,38 @@ func (userService *userService) logout(sessionCookie *http.Cookie) (*http.Cookie
 		return nil, err
 	}
 
-	sessionCookie.Expires = time.Time{}
-	sessionCookie.MaxAge = -1
+	return userService.cookiePolicy.newExpiredCookie(sessionCookieName), nil
+}
+
+func (userService *userService) listSessions(sessionCookie *http.Cookie) ([]sessionInfo, error) {
+	user, err := userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return nil, err
+	}
+	return userService.sessionStore.listSessions(user.Id, sessionCookie.Value)
+}
+
+func (userService *userService) revokeSession(sessionCookie *http.Cookie, idSession int64) error {
+	user, err := userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+	return userService.sessionStore.revokeSession(user.Id, idSession)
+}
 
-	return sessionCookie, nil
+func (userService *userService) logoutEverywhereElse(sessionCookie *http.Cookie) error {
+	user, err := userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+	return userService.sessionStore.forgetSessionsForUserExcept(user.Id, sessionCookie.Value)
 }
 
-func (userService *userService) getLoginProofOfWorkRequiredHardnes() uint {
-	return proofOfWorkLoginRequiredHardnes
+func (userService *userService) getLoginProofOfWorkRequiredHardnes(username string) uint {
+	if userService.loginGuard == nil {
+		return proofOfWorkLoginRequiredHardnes
+	}
+	return proofOfWorkLoginRequiredHardnes + userService.loginGuard.getPowHardnesIncrease(username)
 }
 
 func (userService *userService) getCreateUserProofOfWorkRequiredHardnes() uint {
@@ -82,8 +238,8 @@ func (userService *userService) getCreateUserProofOfWorkRequiredHardnes() uint {
 
 }
 
-func (userService *userService) createUser(powString, username string, password string) (*http.Cookie, *user, error) {
-	err := validateUsername(username)
+func (userService *userService) createUser(client clientInfo, powString, username string, password string) (*http.Cookie, *user, error) {
+	err := validateUsername(username, userService.usernameFilter)
 	if err != nil {
 		return nil, nil, err
 	}
@@ -92,6 +248,13 @@ func (userService *userService) createUser(powString, username string, password
 		return nil, nil, err
 	}
 
+	if userService.rateLimiter != nil {
+		err = userService.rateLimiter.allow(rateLimitOpCreateUser, rateLimitKeys{client: client})
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
 	if userService.doRequireProofOfWorkInRequests && userService.proofOfWorkConformation != nil {
 		err = userService.proofOfWorkConformation.isTokenAceptableStore(powString, proofOfWorkCreateUserRequiredHardnes, username)
 		if err != nil {
@@ -104,12 +267,12 @@ func (userService *userService) createUser(powString, username string, password
 	if err != nil {
 		return nil, nil, err
 	}
-	sessionToken, expiresTime, err := userService.sessionStore.newSession(user)
+	sessionToken, expiresTime, err := userService.sessionStore.newSession(user, client)
 	if err != nil {
 		return nil, nil, err
 	}
 
-	cookie := &http.Cookie{Name: sessionCookieName, Value: sessionToken, Expires: expiresTime}
+	cookie := userService.cookiePolicy.newCookie(sessionCookieName, sessionToken, expiresTime)
 
 	return cookie, user, nil
 }
@@ -128,41 +291,151 @@ func (userService *userService) modifyPassword(sessionCookie *http.Cookie, oldPa
 	return userService.databaseServiceUser.modifyUserPassword(user.Id, oldPassword, newPassword)
 }
 
-func (userService *userService) deleteAccount(sessionCookie *http.Cookie) (*http.Cookie, error) {
+func (userService *userService) changeUsername(sessionCookie *http.Cookie, newUsername string) (*user, error) {
+	err := validateUsername(newUsername, userService.usernameFilter)
+	if err != nil {
+		return nil, err
+	}
+
 	user, err := userService.getSessionUser(sessionCookie)
 	if err != nil {
 		return nil, err
 	}
 
-	err = userService.databaseServiceUser.deleteUser(user.Id)
+	// taken or reserved name must not use up the allowance, the change itself checks it again
+	now := time.Now()
+	err = userService.databaseServiceUser.checkUsernameAvailable(user.Id, newUsername, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if userService.rateLimiter != nil {
+		err = userService.rateLimiter.allow(rateLimitOpChangeUsername, rateLimitKeys{idUser: &user.Id})
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err = userService.databaseServiceUser.changeUsername(user.Id, newUsername, now, now.Add(usernameReclaimCooldown))
 	if err != nil {
 		return nil, err
 	}
 
-	return userService.logout(sessionCookie)
+	// cached sessions in all instances still hold the old name
+	err = userService.sessionStore.forgetCachedUser(user.Id)
+	if err != nil {
+		slog.Error("Failed to refresh cached user after username change", slog.Int64("idUser", user.Id), slog.Any("error", err))
+	}
+
+	return userService.databaseServiceUser.getUser(user.Id)
+}
+
+func (userService *userService) resolveUsername(username string) (*user, error) {
+	user, err := userService.databaseServiceUser.getUserByUsername(username)
+	if !errors.Is(err, errUserDoesntExist) {
+		return user, err
+	}
+
+	user, err = userService.databaseServiceUser.getUserByPreviousUsername(username)
+	if err != nil {
+		return nil, err
+	}
+	if user == nil {
+		return nil, errUserDoesntExist
+	}
+	return user, nil
+}
+
+func (userService *userService) modifyEmail(sessionCookie *http.Cookie, email string) error {
+	err := validateEmail(email)
+	if err != nil {
+		return err
+	}
+
+	user, err := userService.getSessionUser(sessionCookie)
+	if err != nil {
+		return err
+	}
+
+	return userService.databaseServiceUser.setUserEmail(user.Id, email)
 }
 
 type adminUserService struct {
 	userService         userServiceItf
 	sessionStore        sessionStoreItf
 	databaseServiceUser databaseServiceUserItf
+	loginGuard          loginGuardItf
+	passwordResetIssuer passwordResetIssuerItf
+	accountDeleter      accountDeleterItf
+	authorizer          authorizerItf
+	auditLogger         auditLoggerItf
+	usernameFilter      usernameFilterItf
+
+	requireAdminTwoFactor bool
 }
 
-func newAdmiUserService(userService userServiceItf, sessionStore sessionStoreItf, databaseServiceUser databaseServiceUserItf) *adminUserService {
-	return &adminUserService{userService: userService, sessionStore: sessionStore, databaseServiceUser: databaseServiceUser}
+func newAdmiUserService(userService userServiceItf, sessionStore sessionStoreItf, databaseServiceUser databaseServiceUserItf, loginGuard loginGuardItf,
+	passwordResetIssuer passwordResetIssuerItf, accountDeleter accountDeleterItf, authorizer authorizerItf, auditLogger auditLoggerItf, usernameFilter usernameFilterItf,
+	requireAdminTwoFactor bool) *adminUserService {
+	return &adminUserService{userService: userService, sessionStore: sessionStore, databaseServiceUser: databaseServiceUser, loginGuard: loginGuard,
+		passwordResetIssuer: passwordResetIssuer, accountDeleter: accountDeleter, authorizer: authorizer, auditLogger: auditLogger,
+		usernameFilter: usernameFilter, requireAdminTwoFactor: requireAdminTwoFactor}
 }
 
-func (adminUserService *adminUserService) createUserAsAdmin(sessionCookie *http.Cookie, username string, password string, adminRole bool) (*user, error) {
-	user, err := adminUserService.userService.getSessionUser(sessionCookie)
+// user management is global, roles:assign is checked against the scope of the assigned role
+func (adminUserService *adminUserService) getSessionAdmin(sessionCookie *http.Cookie, permission string, target rbacTarget) (*user, error) {
+	user, err := adminUserService.userService.getRequestUser(sessionCookie, apiTokenScopeModerate)
 	if err != nil {
 		return nil, err
 	}
 
-	if !user.AdminRole {
+	err = adminUserService.authorizer.authorize(user, permission, target)
+	if errors.Is(err, errPermissionDenied) {
 		return nil, errUserNotAdmin
 	}
+	if err != nil {
+		return nil, err
+	}
+	if adminUserService.requireAdminTwoFactor && !user.TwoFactorEnabled {
+		return nil, errAdminTwoFactorRequired
+	}
+	return user, nil
+}
+
+// users:manage is enough only for users without roles, otherwise an admin could take over a superadmin account,
+// so roles:assign is checked against the scope of every role of the target user
+func (adminUserService *adminUserService) getSessionAdminOfUser(sessionCookie *http.Cookie, idUser int64) (*user, error) {
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermUsersManage, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
+	roles, err := adminUserService.authorizer.listUserRoles(idUser)
+	if err != nil {
+		return nil, err
+	}
+	for _, role := range roles {
+		err = adminUserService.authorizer.authorize(admin, rbacPermRolesAssign, rbacScopeToTarget(role.Scope))
+		if errors.Is(err, errPermissionDenied) {
+			return nil, errUserNotAdmin
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return admin, nil
+}
+
+func (adminUserService *adminUserService) createUserAsAdmin(sessionCookie *http.Cookie, username string, password string, adminRole bool) (*user, error) {
+	permission := rbacPermUsersManage
+	if adminRole {
+		permission = rbacPermRolesAssign
+	}
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, permission, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
 
-	err = validateUsername(username)
+	err = validateUsername(username, adminUserService.usernameFilter)
 	if err != nil {
 		return nil, err
 	}
@@ -171,39 +444,178 @@ func (adminUserService *adminUserService) createUserAsAdmin(sessionCookie *http.
 		return nil, err
 	}
 
-	return adminUserService.databaseServiceUser.createUser(username, password, adminRole)
+	user, err := adminUserService.databaseServiceUser.createUser(username, password, false)
+	if err != nil {
+		return nil, err
+	}
+	idUserStr := strconv.FormatInt(user.Id, 10)
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserCreate, auditTargetUser, idUserStr, nil,
+		map[string]string{"username": username})
+	if !adminRole {
+		return user, nil
+	}
+	err = adminUserService.authorizer.assignUserRole(user.Id, rbacRoleAdmin, rbacScopeGlobal, &admin.Id)
+	if err != nil {
+		return nil, err
+	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserRoleAssign, auditTargetUser, idUserStr, nil,
+		map[string]string{"role": rbacRoleAdmin, "scope": rbacScopeGlobal})
+	user.AdminRole = true
+	return user, nil
 }
 
-func (adminUserService *adminUserService) deleteUserAsAdmin(sessionCookie *http.Cookie, idUser int64) error {
-	user, err := adminUserService.userService.getSessionUser(sessionCookie)
+func (adminUserService *adminUserService) deleteUserAsAdmin(sessionCookie *http.Cookie, idUser int64, mode string, immediately bool) (*accountDeletionInfo, error) {
+	admin, err := adminUserService.getSessionAdminOfUser(sessionCookie, idUser)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if adminUserService.accountDeleter == nil {
+		return nil, errors.New("account deleter is not configured")
 	}
 
-	if !user.AdminRole {
-		return errUserNotAdmin
+	gracePeriod := accountDeletionGracePeriod
+	if immediately {
+		gracePeriod = 0
 	}
-	err = adminUserService.databaseServiceUser.deleteUser(idUser)
+	info, err := adminUserService.accountDeleter.scheduleAccountDeletion(idUser, mode, &admin.Id, gracePeriod)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserDelete, auditTargetUser, strconv.FormatInt(idUser, 10), nil,
+		map[string]any{"mode": mode, "immediately": immediately})
+	if info != nil {
+		// sessions are ended so the user notices, logging in again and asking for cancellation still works
+		err = adminUserService.sessionStore.forgetSessionsForUser(idUser)
+		if err != nil {
+			return nil, err
+		}
 	}
+	return info, nil
+}
 
-	return adminUserService.sessionStore.forgetSessionsForUser(idUser)
+func (adminUserService *adminUserService) cancelUserDeletionAsAdmin(sessionCookie *http.Cookie, idUser int64) error {
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermUsersManage, rbacTarget{})
+	if err != nil {
+		return err
+	}
+	if adminUserService.accountDeleter == nil {
+		return errAccountDeletionNotScheduled
+	}
+	err = adminUserService.accountDeleter.cancelAccountDeletionOfUser(idUser)
+	if err != nil {
+		return err
+	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserDeletionCancel, auditTargetUser, strconv.FormatInt(idUser, 10), nil, nil)
+	return nil
 }
 
+// grants or revokes global admin role
 func (adminUserService *adminUserService) modifyUserAdminRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, adminRole bool) error {
-	user, err := adminUserService.userService.getSessionUser(sessionCookie)
+	if adminRole {
+		_, err := adminUserService.assignUserRoleAsAdmin(sessionCookie, idUser, rbacRoleAdmin, rbacScopeGlobal)
+		return err
+	}
+	return adminUserService.revokeUserRoleAsAdmin(sessionCookie, idUser, rbacRoleAdmin, rbacScopeGlobal)
+}
+
+func (adminUserService *adminUserService) listUserRolesAsAdmin(sessionCookie *http.Cookie, idUser int64) ([]roleAssignment, error) {
+	_, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermUsersManage, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
+	return adminUserService.authorizer.listUserRoles(idUser)
+}
+
+func (adminUserService *adminUserService) assignUserRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, role string, scope string) ([]roleAssignment, error) {
+	err := validateRbacRoleAndScope(role, scope)
+	if err != nil {
+		return nil, err
+	}
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermRolesAssign, rbacScopeToTarget(scope))
+	if err != nil {
+		return nil, err
+	}
+
+	err = adminUserService.authorizer.assignUserRole(idUser, role, scope, &admin.Id)
+	if err != nil {
+		return nil, err
+	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserRoleAssign, auditTargetUser, strconv.FormatInt(idUser, 10), nil,
+		map[string]string{"role": role, "scope": scope})
+	// cached sessions carry AdminRole
+	err = adminUserService.sessionStore.forgetCachedUser(idUser)
+	if err != nil {
+		return nil, err
+	}
+	return adminUserService.authorizer.listUserRoles(idUser)
+}
+
+func (adminUserService *adminUserService) revokeUserRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, role string, scope string) error {
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermRolesAssign, rbacScopeToTarget(scope))
 	if err != nil {
 		return err
 	}
+	if admin.Id == idUser && role == rbacRoleSuperadmin && scope == rbacScopeGlobal {
+		return errCantRevokeOwnSuperadmin // nobody could assign roles anymore
+	}
+
+	err = adminUserService.authorizer.revokeUserRole(idUser, role, scope)
+	if err != nil {
+		return err
+	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserRoleRevoke, auditTargetUser, strconv.FormatInt(idUser, 10),
+		map[string]string{"role": role, "scope": scope}, nil)
+	return adminUserService.sessionStore.forgetCachedUser(idUser)
+}
 
-	if !user.AdminRole {
-		return errUserNotAdmin
+func (adminUserService *adminUserService) unlockUserAsAdmin(sessionCookie *http.Cookie, idUser int64) error {
+	admin, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermUsersManage, rbacTarget{})
+	if err != nil {
+		return err
 	}
-	err = adminUserService.databaseServiceUser.modifyUserAdminRole(idUser, adminRole)
+	lockedUser, err := adminUserService.databaseServiceUser.getUser(idUser)
+	if err != nil {
+		return err
+	}
+	if adminUserService.loginGuard == nil {
+		return nil
+	}
+
+	err = adminUserService.loginGuard.unlockUser(lockedUser.Username)
 	if err != nil {
 		return err
 	}
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserUnlock, auditTargetUser, strconv.FormatInt(idUser, 10), nil, nil)
+	return nil
+}
+
+func (adminUserService *adminUserService) listUsernameHistoryAsAdmin(sessionCookie *http.Cookie, idUser int64) ([]usernameHistoryEntry, error) {
+	_, err := adminUserService.getSessionAdmin(sessionCookie, rbacPermUsersManage, rbacTarget{})
+	if err != nil {
+		return nil, err
+	}
+	return adminUserService.databaseServiceUser.listUsernameHistory(idUser)
+}
+
+func (adminUserService *adminUserService) createPasswordResetTokenAsAdmin(sessionCookie *http.Cookie, idUser int64) (string, time.Time, error) {
+	admin, err := adminUserService.getSessionAdminOfUser(sessionCookie, idUser)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	if adminUserService.passwordResetIssuer == nil {
+		return "", time.Time{}, errors.New("password reset is not configured")
+	}
+	_, err = adminUserService.databaseServiceUser.getUser(idUser)
+	if err != nil {
+		return "", time.Time{}, err
+	}
 
-	return adminUserService.sessionStore.forgetSessionsForUser(idUser)
+	token, dtExpires, err := adminUserService.passwordResetIssuer.issuePasswordResetToken(idUser)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// never the token itself
+	logAuditAction(adminUserService.auditLogger, admin, auditActionUserPasswordReset, auditTargetUser, strconv.FormatInt(idUser, 10), nil,
+		map[string]time.Time{"dtExpires": dtExpires})
+	return token, dtExpires, nil
 }
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"net/http"
 	"regexp"
 	"time"
@@ -14,38 +15,81 @@ const (
 	passwordMaxLen                       int           = 100
 	proofOfWorkLoginRequiredHardnes      uint          = 10
 	proofOfWorkCreateUserRequiredHardnes uint          = 19
-	seassionExpiresAge                   time.Duration = time.Hour * 24 * 30 * 6 // rughly six months
+	seassionExpiresAge                   time.Duration = time.Hour * 24 * 30 * 6 // rughly six months, absolute lifetime
+	seassionIdleTimeout                  time.Duration = time.Hour * 24 * 14
+	seassionRotationAge                  time.Duration = time.Hour * 24
+	seassionRenewFlushPeriod             time.Duration = time.Minute
 	seassionCleanUpPeriod                time.Duration = time.Hour
+	usernameReclaimCooldown              time.Duration = time.Hour * 24 * 90 // old username can't be taken by others before
 	sessionCookieName                    string        = "CDSESSION"
 )
 
 type userServiceItf interface {
-	login(powString string, username string, passwoed string) (*http.Cookie, *user, error)
+	// If the user has 2FA enabled errTwoFactorRequired is returned together with a short lived
+	// login ticket cookie, that has to be passed to loginSecondFactor with the code.
+	login(client clientInfo, powString string, username string, passwoed string) (*http.Cookie, *user, error)
+	// code can be TOTP or recovery code
+	loginSecondFactor(client clientInfo, ticketCookie *http.Cookie, code string) (*http.Cookie, *user, error)
 	getSessionUser(sessionCookie *http.Cookie) (*user, error)
+	// accepts session cookie or API token credential (see newApiTokenCredential), token must have
+	// at least one of the scopes
+	getRequestUser(credential *http.Cookie, anyOfScopes ...string) (*user, error)
+	// returns cookie with extended expiry time (and rotated token) that HTTP layer sets on the response
+	renewSessionCookie(sessionCookie *http.Cookie) (*http.Cookie, error)
 	logout(sessionCookie *http.Cookie) (*http.Cookie, error)
 
-	getLoginProofOfWorkRequiredHardnes() uint
+	listSessions(sessionCookie *http.Cookie) ([]sessionInfo, error)
+	revokeSession(sessionCookie *http.Cookie, idSession int64) error
+	logoutEverywhereElse(sessionCookie *http.Cookie) error
+
+	// hardnes grows while the username is under brute-force attack
+	getLoginProofOfWorkRequiredHardnes(username string) uint
 	getCreateUserProofOfWorkRequiredHardnes() uint
 
 	// creates new user in db and creates session
 	// validates username ^[A-Za-z0-9]{4,50}$ because ':' char is not allowed (POW token)
-	createUser(powString string, username string, password string) (*http.Cookie, *user, error)
+	createUser(client clientInfo, powString string, username string, password string) (*http.Cookie, *user, error)
 
 	modifyPassword(sessionCookie *http.Cookie, oldPassword string, newPassword string) error
+	// old username is kept in history and reserved for usernameReclaimCooldown, returns updated user
+	changeUsername(sessionCookie *http.Cookie, newUsername string) (*user, error)
+	// finds user by current or previous username, so old mentions still point to the right user
+	resolveUsername(username string) (*user, error)
+
+	// email is used for password reset, empty string removes it
+	modifyEmail(sessionCookie *http.Cookie, email string) error
+
+	// account deletion is in accountDeletionServiceItf
+}
 
-	// deletes user from db and destroys session
-	deleteAccount(sessionCookie *http.Cookie) (*http.Cookie, error)
+// used by passkeyService and oidcService, every login ends here so bans and failed logins are handled the same way
+type sessionStarterItf interface {
+	// errUserBanned or errUserSuspended if the user can't log in
+	startSession(user *user, client clientInfo) (*http.Cookie, *user, error)
 }
 
 type adminUserServiceItf interface {
 	createUserAsAdmin(sessionCookie *http.Cookie, username string, password string, adminRole bool) (*user, error)
-	deleteUserAsAdmin(sessionCookie *http.Cookie, idUser int64) error // also destroys existing sessions
+	// mode is accountDeletionModeAnonymize or accountDeletionModePurge, without immediately the deletion
+	// is scheduled after accountDeletionGracePeriod. Destroys existing sessions, returns nil info if deleted.
+	deleteUserAsAdmin(sessionCookie *http.Cookie, idUser int64, mode string, immediately bool) (*accountDeletionInfo, error)
+	cancelUserDeletionAsAdmin(sessionCookie *http.Cookie, idUser int64) error
+	// grants or revokes global admin role, same as assignUserRoleAsAdmin/revokeUserRoleAsAdmin
 	modifyUserAdminRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, adminRole bool) error
+	listUserRolesAsAdmin(sessionCookie *http.Cookie, idUser int64) ([]roleAssignment, error)
+	// needs roles:assign (superadmin) globally or in the scope, returns all roles of the user
+	assignUserRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, role string, scope string) ([]roleAssignment, error)
+	revokeUserRoleAsAdmin(sessionCookie *http.Cookie, idUser int64, role string, scope string) error
+	unlockUserAsAdmin(sessionCookie *http.Cookie, idUser int64) error // forgets failed logins of the user
+	listUsernameHistoryAsAdmin(sessionCookie *http.Cookie, idUser int64) ([]usernameHistoryEntry, error)
+	// single use token the admin hands to the user, it works with passwordResetServiceItf.resetPassword
+	createPasswordResetTokenAsAdmin(sessionCookie *http.Cookie, idUser int64) (string, time.Time, error)
 }
 
 var usernameRegex = regexp.MustCompile(`(?m)^[a-zA-Z0-9_]*$`) // because of Proof Of Work token format username must not contain ':' char.
 
-func validateUsername(username string) error {
+// username filters are given where new usernames are chosen, lookups check only the format
+func validateUsername(username string, usernameFilters ...usernameFilterItf) error {
 	if len(username) < usernameMinLen {
 		return errUsernameTooShort
 	}
@@ -58,6 +102,15 @@ func validateUsername(username string) error {
 		return errUsernameUnallowedChars
 	}
 
+	for _, usernameFilter := range usernameFilters {
+		if usernameFilter == nil {
+			continue
+		}
+		err := usernameFilter.checkUsername(username)
+		if err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -72,6 +125,11 @@ func validatePassword(password string) error {
 	return nil
 }
 
+// session or API token is missing, expired, revoked or lacks the scope
+func isCredentialNotValidError(err error) bool {
+	return errors.Is(err, errUserSessionIsNotValid) || errors.Is(err, errApiTokenNotValid) || errors.Is(err, errApiTokenScopeMissing)
+}
+
 func validateSessionCookie(sessionCookie *http.Cookie) (string, error) {
 	if sessionCookie == nil {
 		return "", errUserSessionIsNotValid
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type usernameDbStub struct {
+	databaseServiceUserItf // only methods below are used
+	users                  map[int64]*user
+	history                map[int64][]usernameHistoryEntry
+}
+
+func (stub *usernameDbStub) checkUsernameAvailable(id int64, username string, now time.Time) error {
+	for _, user := range stub.users {
+		if user.Username == username && user.Id == id {
+			return errUsernameUnchanged
+		}
+		if user.Username == username {
+			return errUserAlreadyExists
+		}
+	}
+	for idUser, entries := range stub.history {
+		for _, entry := range entries {
+			if idUser != id && entry.Username == username && entry.DtReclaimable.After(now) {
+				return errUsernameReserved
+			}
+		}
+	}
+	return nil
+}
+
+func (stub *usernameDbStub) changeUsername(id int64, newUsername string, now time.Time, dtReclaimable time.Time) error {
+	err := stub.checkUsernameAvailable(id, newUsername, now)
+	if err != nil {
+		return err
+	}
+	entry := usernameHistoryEntry{Username: stub.users[id].Username, DtChanged: now, DtReclaimable: dtReclaimable}
+	stub.history[id] = append([]usernameHistoryEntry{entry}, stub.history[id]...)
+	stub.users[id].Username = newUsername
+	return nil
+}
+
+func (stub *usernameDbStub) getUser(id int64) (*user, error) {
+	return stub.users[id], nil
+}
+
+func (stub *usernameDbStub) getUserByUsername(username string) (*user, error) {
+	for _, user := range stub.users {
+		if user.Username == username {
+			return user, nil
+		}
+	}
+	return nil, errUserDoesntExist
+}
+
+func (stub *usernameDbStub) getUserByPreviousUsername(username string) (*user, error) {
+	for idUser, entries := range stub.history {
+		for _, entry := range entries {
+			if entry.Username == username {
+				return stub.users[idUser], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+type usernameSessionStub struct {
+	sessionStoreItf // only methods below are used
+	db              *usernameDbStub
+}
+
+// session token is the user id
+func (stub *usernameSessionStub) getUser(token string) (*user, error) {
+	idUser, err := strconv.ParseInt(token, 10, 64)
+	if err != nil || stub.db.users[idUser] == nil {
+		return nil, errUserSessionIsNotValid
+	}
+	return stub.db.users[idUser], nil
+}
+
+func (stub *usernameSessionStub) forgetCachedUser(idUser int64) error {
+	return nil
+}
+
+type countingRateLimiterStub struct {
+	taken int
+}
+
+func (stub *countingRateLimiterStub) allow(operation string, keys rateLimitKeys) error {
+	stub.taken++
+	return nil
+}
+
+func newUsernameTestService() (*userService, *usernameDbStub, *countingRateLimiterStub) {
+	db := &usernameDbStub{users: map[int64]*user{1: {Id: 1, Username: "jane"}, 2: {Id: 2, Username: "john"}},
+		history: make(map[int64][]usernameHistoryEntry)}
+	rateLimiter := &countingRateLimiterStub{}
+	service := newUserService(&usernameSessionStub{db: db}, db, nil, false, rateLimiter, nil, nil, nil, nil, nil, cookiePolicy{})
+	return service, db, rateLimiter
+}
+
+func sessionOf(idUser int64) *http.Cookie {
+	return &http.Cookie{Name: sessionCookieName, Value: strconv.FormatInt(idUser, 10)}
+}
+
+func TestChangeUsernameReservesOldName(t *testing.T) {
+	service, db, rateLimiter := newUsernameTestService()
+
+	before := time.Now()
+	user, err := service.changeUsername(sessionOf(1), "jane_doe")
+	if err != nil || user.Username != "jane_doe" {
+		t.Fatalf("Change failed: %v %v", user, err)
+	}
+	entry := db.history[1][0]
+	if entry.Username != "jane" || entry.DtReclaimable.Before(before.Add(usernameReclaimCooldown)) {
+		t.Errorf("Old name not reserved for the cooldown: %+v", entry)
+	}
+
+	// taken and reserved names are refused without using up the allowance
+	for _, test := range []struct {
+		username    string
+		expectedErr error
+	}{{"jane_doe", errUsernameUnchanged}, {"jane", errUsernameReserved}, {"jane_doe", errUserAlreadyExists}} {
+		idUser := int64(2)
+		if test.expectedErr == errUsernameUnchanged {
+			idUser = 1
+		}
+		if _, err := service.changeUsername(sessionOf(idUser), test.username); !errors.Is(err, test.expectedErr) {
+			t.Errorf("%s: got %v want %v", test.username, err, test.expectedErr)
+		}
+	}
+	if rateLimiter.taken != 1 {
+		t.Errorf("Refused changes took rate limit tokens: %d", rateLimiter.taken)
+	}
+
+	// owner can take the old name back during the cooldown, others only after it
+	if _, err := service.changeUsername(sessionOf(1), "jane"); err != nil {
+		t.Errorf("Owner can't reclaim the old name: %v", err)
+	}
+	db.history[1][1].DtReclaimable = time.Now().Add(-time.Second)
+	if _, err := service.changeUsername(sessionOf(2), "jane_doe"); !errors.Is(err, errUsernameReserved) {
+		t.Errorf("Name reserved by the second change was taken: %v", err)
+	}
+	db.history[1][0].DtReclaimable = time.Now().Add(-time.Second)
+	if _, err := service.changeUsername(sessionOf(2), "jane_doe"); err != nil {
+		t.Errorf("Name should be free after the cooldown: %v", err)
+	}
+}
+
+func TestResolveUsername(t *testing.T) {
+	service, _, _ := newUsernameTestService()
+	if _, err := service.changeUsername(sessionOf(1), "jane_doe"); err != nil {
+		t.Fatalf("Change failed: %v", err)
+	}
+
+	for _, username := range []string{"jane_doe", "jane"} {
+		if user, err := service.resolveUsername(username); err != nil || user.Id != 1 {
+			t.Errorf("%s: got %v %v want user 1", username, user, err)
+		}
+	}
+	if _, err := service.resolveUsername("nobody"); !errors.Is(err, errUserDoesntExist) {
+		t.Errorf("Unknown name resolved: %v", err)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+const (
+	webauthnTypeCreate string = "webauthn.create"
+	webauthnTypeGet    string = "webauthn.get"
+
+	webauthnFlagUserPresent        byte = 0x01
+	webauthnFlagUserVerified       byte = 0x04
+	webauthnFlagAttestedCredential byte = 0x40
+
+	coseAlgES256 int64 = -7
+	coseAlgEdDSA int64 = -8
+	coseAlgRS256 int64 = -257
+
+	coseKeyTypeOKP int64 = 1
+	coseKeyTypeEC2 int64 = 2
+	coseKeyTypeRSA int64 = 3
+)
+
+var webauthnSupportedAlgorithms = []int64{coseAlgES256, coseAlgEdDSA, coseAlgRS256}
+
+type webauthnClientData struct {
+	Type      string `json:"type"`
+	Challenge string `json:"challenge"`
+	Origin    string `json:"origin"`
+}
+
+type webauthnAuthenticatorData struct {
+	rpIdHash     []byte
+	flags        byte
+	signCount    uint32
+	credentialId []byte
+	publicKey    []byte // COSE key
+}
+
+func parseWebauthnClientData(clientDataJSON []byte, expectedType string, allowedOrigins []string) (*webauthnClientData, []byte, error) {
+	var clientData webauthnClientData
+	err := json.Unmarshal(clientDataJSON, &clientData)
+	if err != nil {
+		return nil, nil, fmt.Errorf("WebAuthn client data JSON: %w", err)
+	}
+	if clientData.Type != expectedType {
+		return nil, nil, fmt.Errorf("WebAuthn client data has wrong type '%s'", clientData.Type)
+	}
+
+	originAllowed := false
+	for _, origin := range allowedOrigins {
+		if clientData.Origin == origin {
+			originAllowed = true
+			break
+		}
+	}
+	if !originAllowed {
+		return nil, nil, fmt.Errorf("WebAuthn origin '%s' is not allowed", clientData.Origin)
+	}
+
+	challenge, err := base64.RawURLEncoding.DecodeString(clientData.Challenge)
+	if err != nil {
+		return nil, nil, fmt.Errorf("WebAuthn client data challenge: %w", err)
+	}
+	return &clientData, challenge, nil
+}
+
+func parseWebauthnAuthenticatorData(authData []byte, rpId string) (*webauthnAuthenticatorData, error) {
+	const minLen = 32 + 1 + 4
+	if len(authData) < minLen {
+		return nil, errors.New("WebAuthn authenticator data is too short")
+	}
+
+	parsed := &webauthnAuthenticatorData{rpIdHash: authData[:32], flags: authData[32], signCount: binary.BigEndian.Uint32(authData[33:37])}
+
+	rpIdHash := sha256.Sum256([]byte(rpId))
+	if subtle.ConstantTimeCompare(parsed.rpIdHash, rpIdHash[:]) != 1 {
+		return nil, errors.New("WebAuthn authenticator data has wrong RP ID hash")
+	}
+	if parsed.flags&webauthnFlagUserPresent == 0 {
+		return nil, errors.New("WebAuthn user was not present")
+	}
+
+	if parsed.flags&webauthnFlagAttestedCredential != 0 {
+		rest := authData[minLen:]
+		const aaguidLen = 16
+		if len(rest) < aaguidLen+2 {
+			return nil, errors.New("WebAuthn attested credential data is too short")
+		}
+		rest = rest[aaguidLen:]
+		credentialIdLen := int(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+		if len(rest) < credentialIdLen {
+			return nil, errors.New("WebAuthn credential id is truncated")
+		}
+		parsed.credentialId = rest[:credentialIdLen]
+		rest = rest[credentialIdLen:]
+
+		// public key is CBOR encoded and may be followed by extensions
+		_, afterKey, err := decodeCbor(rest)
+		if err != nil {
+			return nil, fmt.Errorf("WebAuthn credential public key: %w", err)
+		}
+		parsed.publicKey = rest[:len(rest)-len(afterKey)]
+	}
+	return parsed, nil
+}
+
+// returns authenticator data from "none" (or any other, unverified) attestation
+func parseWebauthnAttestationObject(attestationObject []byte) ([]byte, error) {
+	decoded, _, err := decodeCbor(attestationObject)
+	if err != nil {
+		return nil, fmt.Errorf("WebAuthn attestation object: %w", err)
+	}
+	attestationMap, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, errors.New("WebAuthn attestation object is not a map")
+	}
+	authData, ok := attestationMap["authData"].([]byte)
+	if !ok {
+		return nil, errors.New("WebAuthn attestation object has no authData")
+	}
+	return authData, nil
+}
+
+func coseKeyInt(coseKey map[any]any, label int64) (int64, bool) {
+	value, ok := coseKey[label].(int64)
+	return value, ok
+}
+
+func coseKeyBytes(coseKey map[any]any, label int64) ([]byte, bool) {
+	value, ok := coseKey[label].([]byte)
+	return value, ok
+}
+
+// parses COSE key, returns public key and its algorithm
+func parseCosePublicKey(coseKeyData []byte) (crypto.PublicKey, int64, error) {
+	decoded, _, err := decodeCbor(coseKeyData)
+	if err != nil {
+		return nil, 0, err
+	}
+	coseKey, ok := decoded.(map[any]any)
+	if !ok {
+		return nil, 0, errors.New("COSE key is not a map")
+	}
+	keyType, ok1 := coseKeyInt(coseKey, 1)
+	alg, ok2 := coseKeyInt(coseKey, 3)
+	if !ok1 || !ok2 {
+		return nil, 0, errors.New("COSE key has no type or algorithm")
+	}
+
+	switch {
+	case keyType == coseKeyTypeEC2 && alg == coseAlgES256:
+		curve, _ := coseKeyInt(coseKey, -1)
+		x, okX := coseKeyBytes(coseKey, -2)
+		y, okY := coseKeyBytes(coseKey, -3)
+		if curve != 1 || !okX || !okY || len(x) != 32 || len(y) != 32 {
+			return nil, 0, errors.New("COSE EC2 key is not a valid P-256 key")
+		}
+		publicKey := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+		if !publicKey.Curve.IsOnCurve(publicKey.X, publicKey.Y) {
+			return nil, 0, errors.New("COSE EC2 point is not on curve")
+		}
+		return publicKey, alg, nil
+	case keyType == coseKeyTypeOKP && alg == coseAlgEdDSA:
+		curve, _ := coseKeyInt(coseKey, -1)
+		x, okX := coseKeyBytes(coseKey, -2)
+		if curve != 6 || !okX || len(x) != ed25519.PublicKeySize {
+			return nil, 0, errors.New("COSE OKP key is not a valid Ed25519 key")
+		}
+		return ed25519.PublicKey(x), alg, nil
+	case keyType == coseKeyTypeRSA && alg == coseAlgRS256:
+		n, okN := coseKeyBytes(coseKey, -1)
+		e, okE := coseKeyBytes(coseKey, -2)
+		if !okN || !okE || len(e) > 4 || len(n) < 256 {
+			return nil, 0, errors.New("COSE RSA key is not valid")
+		}
+		exponent := int(new(big.Int).SetBytes(e).Int64())
+		return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, alg, nil
+	}
+	return nil, 0, fmt.Errorf("COSE key type %d with algorithm %d is not supported", keyType, alg)
+}
+
+// verifies assertion signature over authenticator data and client data hash
+func verifyWebauthnSignature(coseKeyData []byte, authData []byte, clientDataJSON []byte, signature []byte) error {
+	publicKey, alg, err := parseCosePublicKey(coseKeyData)
+	if err != nil {
+		return err
+	}
+
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	signedData := bytes.Join([][]byte{authData, clientDataHash[:]}, nil)
+
+	switch alg {
+	case coseAlgES256:
+		digest := sha256.Sum256(signedData)
+		if !ecdsa.VerifyASN1(publicKey.(*ecdsa.PublicKey), digest[:], signature) {
+			return errors.New("WebAuthn ES256 signature is not valid")
+		}
+	case coseAlgEdDSA:
+		if !ed25519.Verify(publicKey.(ed25519.PublicKey), signedData, signature) {
+			return errors.New("WebAuthn EdDSA signature is not valid")
+		}
+	case coseAlgRS256:
+		digest := sha256.Sum256(signedData)
+		err = rsa.VerifyPKCS1v15(publicKey.(*rsa.PublicKey), crypto.SHA256, digest[:], signature)
+		if err != nil {
+			return fmt.Errorf("WebAuthn RS256 signature is not valid: %w", err)
+		}
+	}
+	return nil
+}
+
+func webauthnUserHandle(idUser int64) []byte {
+	handle := make([]byte, 8)
+	binary.BigEndian.PutUint64(handle, uint64(idUser))
+	return handle
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"testing"
+)
+
+const testRpId = "example.com"
+
+func testCoseES256Key(t *testing.T, privateKey *ecdsa.PrivateKey) []byte {
+	x := make([]byte, 32)
+	y := make([]byte, 32)
+	privateKey.PublicKey.X.FillBytes(x)
+	privateKey.PublicKey.Y.FillBytes(y)
+
+	// {1: 2, 3: -7, -1: 1, -2: x, -3: y}
+	coseKey := []byte{0xa5, 0x01, 0x02, 0x03, 0x26, 0x20, 0x01, 0x21, 0x58, 0x20}
+	coseKey = append(coseKey, x...)
+	coseKey = append(coseKey, 0x22, 0x58, 0x20)
+	return append(coseKey, y...)
+}
+
+func testAuthData(flags byte, signCount uint32, attestedCredential []byte) []byte {
+	rpIdHash := sha256.Sum256([]byte(testRpId))
+	authData := append([]byte{}, rpIdHash[:]...)
+	authData = append(authData, flags)
+	authData = binary.BigEndian.AppendUint32(authData, signCount)
+	return append(authData, attestedCredential...)
+}
+
+func TestDecodeCbor(t *testing.T) {
+	// {"fmt": "none", "attStmt": {}, "authData": h'0102'}
+	data := []byte{0xa3, 0x63, 'f', 'm', 't', 0x64, 'n', 'o', 'n', 'e', 0x67, 'a', 't', 't', 'S', 't', 'm', 't', 0xa0,
+		0x68, 'a', 'u', 't', 'h', 'D', 'a', 't', 'a', 0x42, 0x01, 0x02}
+
+	authData, err := parseWebauthnAttestationObject(data)
+	if err != nil {
+		t.Fatalf("Attestation object parsing error: %v", err)
+	}
+	if !bytes.Equal(authData, []byte{0x01, 0x02}) {
+		t.Errorf("Wrong authData: %x", authData)
+	}
+
+	value, rest, err := decodeCbor([]byte{0x39, 0x01, 0x00, 0xff})
+	if err != nil || value != int64(-257) || len(rest) != 1 {
+		t.Errorf("Wrong negative integer decoding: %v %x %v", value, rest, err)
+	}
+
+	_, _, err = decodeCbor([]byte{0x58, 0x20, 0x01})
+	if err == nil {
+		t.Errorf("Truncated byte string should fail")
+	}
+}
+
+func TestWebauthnRegistrationAndAssertion(t *testing.T) {
+	privateKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Key generation error: %v", err)
+	}
+	coseKey := testCoseES256Key(t, privateKey)
+
+	credentialId := []byte("credential-1")
+	attested := make([]byte, 16) // aaguid
+	attested = binary.BigEndian.AppendUint16(attested, uint16(len(credentialId)))
+	attested = append(attested, credentialId...)
+	attested = append(attested, coseKey...)
+
+	registration, err := parseWebauthnAuthenticatorData(testAuthData(webauthnFlagUserPresent|webauthnFlagAttestedCredential, 0, attested), testRpId)
+	if err != nil {
+		t.Fatalf("Registration authenticator data parsing error: %v", err)
+	}
+	if !bytes.Equal(registration.credentialId, credentialId) || !bytes.Equal(registration.publicKey, coseKey) {
+		t.Fatalf("Wrong attested credential data")
+	}
+
+	challenge := []byte("0123456789abcdef0123456789abcdef")
+	clientDataJSON := []byte(`{"type":"webauthn.get","challenge":"` + base64.RawURLEncoding.EncodeToString(challenge) + `","origin":"https://example.com"}`)
+	_, parsedChallenge, err := parseWebauthnClientData(clientDataJSON, webauthnTypeGet, []string{"https://example.com"})
+	if err != nil || !bytes.Equal(parsedChallenge, challenge) {
+		t.Fatalf("Client data parsing error: %v", err)
+	}
+	if _, _, err := parseWebauthnClientData(clientDataJSON, webauthnTypeGet, []string{"https://evil.example"}); err == nil {
+		t.Errorf("Wrong origin should be rejected")
+	}
+
+	authData := testAuthData(webauthnFlagUserPresent|webauthnFlagUserVerified, 1, nil)
+	clientDataHash := sha256.Sum256(clientDataJSON)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, privateKey, digest[:])
+	if err != nil {
+		t.Fatalf("Signing error: %v", err)
+	}
+
+	err = verifyWebauthnSignature(registration.publicKey, authData, clientDataJSON, signature)
+	if err != nil {
+		t.Errorf("Valid signature was rejected: %v", err)
+	}
+	err = verifyWebauthnSignature(registration.publicKey, testAuthData(webauthnFlagUserPresent, 2, nil), clientDataJSON, signature)
+	if err == nil {
+		t.Errorf("Signature over different data was accepted")
+	}
+
+	if _, err := parseWebauthnAuthenticatorData(authData, "other.example"); err == nil {
+		t.Errorf("Wrong RP ID should be rejected")
+	}
+}